@@ -10,11 +10,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -50,20 +53,67 @@ type Client struct {
 	UserID        id.UserID    // The user ID of the client. Used for forming HTTP paths which use the client's user ID.
 	DeviceID      id.DeviceID  // The device ID of the client.
 	AccessToken   string       // The access_token for the client.
+	RefreshToken  string       // The refresh_token for the client. If set, the access token is refreshed automatically after soft logouts.
+	IsGuest       bool         // Whether the client is logged in as a guest user. Set automatically by Whoami.
 	UserAgent     string       // The value for the User-Agent header
 	Client        *http.Client // The underlying HTTP client which will be used to make HTTP requests.
 	Syncer        Syncer       // The thing which can process /sync responses
 	Store         Storer       // The thing which can store rooms/tokens/ids
+	StateStore    StateStore   // Optional store for room members, power levels and encryption state. Updated automatically during sync.
 	Logger        Logger
 	SyncPresence  event.Presence
 
 	StreamSyncMinAge time.Duration
 
-	// Number of times that mautrix will retry any HTTP request
-	// if the request fails entirely or returns a HTTP gateway error (502-504)
+	// Extra headers to add to all requests, e.g. for tracing or authenticating with a reverse proxy.
+	// Headers set in FullRequest.Headers take precedence over these and UserAgent,
+	// but the Authorization header is always set from AccessToken if there is one.
+	DefaultHeaders http.Header
+
+	// Number of times that mautrix will retry HTTP requests with idempotent methods (i.e. everything except POST)
+	// if the request fails entirely or returns a HTTP gateway error (502-504). Ignored if RetryPolicy is set.
 	DefaultHTTPRetries int
 	// Set to true to disable automatically sleeping on 429 errors.
 	IgnoreRateLimit bool
+	// RetryPolicy overrides DefaultHTTPRetries with a more configurable retry policy.
+	RetryPolicy *RetryPolicy
+	// OnTokenRefresh is called after the access token has been refreshed, so that the new tokens can be persisted.
+	//
+	// The refresh updates AccessToken and RefreshToken while other requests may be running, so those fields
+	// shouldn't be read directly from other goroutines after the client starts making requests.
+	OnTokenRefresh func(resp *RespRefresh)
+	refreshLock    sync.Mutex
+	tokenLock      sync.RWMutex
+
+	// RequestHook is called after every HTTP request attempt made with MakeFullRequest, including failed and
+	// retried attempts. It can be used to collect metrics like request latency and error rates.
+	RequestHook func(metrics *RequestMetrics)
+
+	// If true, SendMessageEvent and SendStateEvent check the power levels cached in StateStore before sending
+	// and return an InsufficientPowerLevelError without making a request if the user isn't allowed to send the event.
+	CheckPowerLevelsBeforeSending bool
+	// Optional queue for pacing SendMessageEvent and SendStateEvent calls in each room and retrying them
+	// after rate limit errors. If nil, events are sent immediately.
+	SendQueue *SendQueue
+
+	// The spec versions and unstable features supported by the server. Set automatically by Versions.
+	// Use GetCachedVersions to read it while other requests may be running.
+	SpecVersions *RespVersions
+	versionsLock sync.Mutex
+	// The error from the last failed Versions call, which GetCachedVersions returns instead of making a new
+	// request until FailedVersionsRetryDelay has passed.
+	versionsErr     error
+	versionsErrTime time.Time
+	// The media repository config of the server. Set automatically by GetMediaConfig.
+	MediaConfig *RespMediaConfig
+	// Whether media should be downloaded using the authenticated media endpoints (MSC3916).
+	// If nil, they're used if the server advertises support for them in SpecVersions (see Versions).
+	UseAuthenticatedMedia *bool
+
+	// ProfileCache is an optional cache for GetProfile. It's automatically invalidated based on member events in sync.
+	ProfileCache *ProfileCache
+
+	accountDataLock sync.Mutex
 
 	txnID int32
 
@@ -73,6 +123,88 @@ type Client struct {
 	AppServiceUserID id.UserID
 
 	syncingID uint32 // Identifies the current Sync. Only one Sync can be active at any given time.
+
+	syncCancel     context.CancelFunc // Cancels the context of the current Sync.
+	syncCancelLock sync.Mutex
+
+	// The default context for requests that don't have one set explicitly. See WithContext.
+	ctx context.Context
+	// The client this one was copied from with WithContext. The tokens, caches and transaction ID counter
+	// are always read from and written to the parent, so that they stay in sync between the copies.
+	parent *Client
+}
+
+// WithContext returns a shallow copy of the client that uses the given context for all requests which don't have
+// a context set explicitly. This can be used to cancel or set a deadline for a group of requests:
+//
+//	ctxCli := cli.WithContext(ctx)
+//	resp, err := ctxCli.SendText(roomID, "Hello")
+//
+// The copy shares the HTTP client, stores, callbacks, tokens, cached versions and media config and the
+// transaction ID counter with the original, so e.g. a token refresh done by the copy is also used by the
+// original. The exported fields of the copy are only a snapshot of the original's values at the time of
+// copying: changing them on the copy has no effect on the token and cache state. It's meant for making
+// requests, not for running Sync.
+func (cli *Client) WithContext(ctx context.Context) *Client {
+	parent := cli.root()
+	accessToken, refreshToken := cli.getTokens()
+	parent.versionsLock.Lock()
+	specVersions := parent.SpecVersions
+	parent.versionsLock.Unlock()
+	return &Client{
+		HomeserverURL:    cli.HomeserverURL,
+		UserID:           cli.UserID,
+		DeviceID:         cli.DeviceID,
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		IsGuest:          cli.IsGuest,
+		UserAgent:        cli.UserAgent,
+		Client:           cli.Client,
+		Syncer:           cli.Syncer,
+		Store:            cli.Store,
+		StateStore:       cli.StateStore,
+		Logger:           cli.Logger,
+		SyncPresence:     cli.SyncPresence,
+		StreamSyncMinAge: cli.StreamSyncMinAge,
+
+		DefaultHeaders:     cli.DefaultHeaders,
+		DefaultHTTPRetries: cli.DefaultHTTPRetries,
+		IgnoreRateLimit:    cli.IgnoreRateLimit,
+		RetryPolicy:        cli.RetryPolicy,
+		OnTokenRefresh:     cli.OnTokenRefresh,
+		RequestHook:        cli.RequestHook,
+
+		CheckPowerLevelsBeforeSending: cli.CheckPowerLevelsBeforeSending,
+		SendQueue:                     cli.SendQueue,
+
+		SpecVersions: specVersions,
+		MediaConfig:  parent.MediaConfig,
+		ProfileCache: cli.ProfileCache,
+
+		UseAuthenticatedMedia: cli.UseAuthenticatedMedia,
+
+		AppServiceUserID: cli.AppServiceUserID,
+
+		ctx:    ctx,
+		parent: parent,
+	}
+}
+
+// root returns the client whose token and cache state this client uses, i.e. the original client if this one
+// was created with WithContext.
+func (cli *Client) root() *Client {
+	if cli.parent != nil {
+		return cli.parent
+	}
+	return cli
+}
+
+// context returns the context set with WithContext, or context.Background() if there isn't one.
+func (cli *Client) context() context.Context {
+	if cli.ctx != nil {
+		return cli.ctx
+	}
+	return context.Background()
 }
 
 type ClientWellKnown struct {
@@ -131,17 +263,103 @@ func DiscoverClientAPI(serverName string) (*ClientWellKnown, error) {
 	return &wellKnown, nil
 }
 
+// DiscoveryAction is the action that a client should take after a failure in server discovery.
+// See https://spec.matrix.org/v1.4/client-server-api/#well-known-uri
+type DiscoveryAction string
+
+const (
+	// DiscoveryIgnore means the server doesn't have a .well-known file, so the client should continue
+	// with whatever homeserver URL it already has (e.g. one entered by the user).
+	DiscoveryIgnore DiscoveryAction = "IGNORE"
+	// DiscoveryFailPrompt means the .well-known file is invalid, so the client should ask the user for the homeserver URL.
+	DiscoveryFailPrompt DiscoveryAction = "FAIL_PROMPT"
+	// DiscoveryFailError means the discovered server is broken, so the client should show an error and stop.
+	DiscoveryFailError DiscoveryAction = "FAIL_ERROR"
+)
+
+// DiscoveryError is returned by DiscoverAndValidateClientAPI when the server discovery process fails.
+type DiscoveryError struct {
+	Action  DiscoveryAction
+	Message string
+	Err     error
+}
+
+func (err DiscoveryError) Error() string {
+	if err.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", err.Action, err.Message, err.Err)
+	}
+	return fmt.Sprintf("%s: %s", err.Action, err.Message)
+}
+
+func (err DiscoveryError) Unwrap() error {
+	return err.Err
+}
+
+// DiscoverAndValidateClientAPI resolves the client API URL from a Matrix server name like DiscoverClientAPI,
+// but also validates the result following the spec: the homeserver URL must respond to /versions
+// and the identity server URL (if present) must respond to /_matrix/identity/v2.
+// https://spec.matrix.org/v1.4/client-server-api/#well-known-uri
+//
+// All errors are of type DiscoveryError, which contains the action that the client should take.
+func DiscoverAndValidateClientAPI(serverName string) (*ClientWellKnown, error) {
+	wellKnown, err := DiscoverClientAPI(serverName)
+	if err != nil {
+		return nil, DiscoveryError{Action: DiscoveryFailPrompt, Message: "failed to fetch .well-known file", Err: err}
+	} else if wellKnown == nil {
+		return nil, DiscoveryError{Action: DiscoveryIgnore, Message: ".well-known file not found"}
+	} else if len(wellKnown.Homeserver.BaseURL) == 0 {
+		return nil, DiscoveryError{Action: DiscoveryFailPrompt, Message: ".well-known file doesn't contain a homeserver URL"}
+	}
+	cli, err := NewClient(wellKnown.Homeserver.BaseURL, "", "")
+	if err != nil {
+		return nil, DiscoveryError{Action: DiscoveryFailError, Message: "invalid homeserver URL", Err: err}
+	}
+	_, err = cli.Versions()
+	if err != nil {
+		return nil, DiscoveryError{Action: DiscoveryFailError, Message: "homeserver URL doesn't point at a Matrix server", Err: err}
+	}
+	if len(wellKnown.IdentityServer.BaseURL) > 0 {
+		err = validateIdentityServer(cli.Client, wellKnown.IdentityServer.BaseURL)
+		if err != nil {
+			return nil, DiscoveryError{Action: DiscoveryFailError, Message: "identity server URL doesn't point at an identity server", Err: err}
+		}
+	}
+	return wellKnown, nil
+}
+
+func validateIdentityServer(client *http.Client, baseURL string) error {
+	parsedURL, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	parsedURL.Path = strings.TrimSuffix(parsedURL.Path, "/") + "/_matrix/identity/v2"
+	resp, err := client.Get(parsedURL.String())
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
 // SetCredentials sets the user ID and access token on this client instance.
 //
 // Deprecated: use the StoreCredentials field in ReqLogin instead.
 func (cli *Client) SetCredentials(userID id.UserID, accessToken string) {
+	cli.tokenLock.Lock()
 	cli.AccessToken = accessToken
+	cli.tokenLock.Unlock()
 	cli.UserID = userID
 }
 
 // ClearCredentials removes the user ID and access token on this client instance.
 func (cli *Client) ClearCredentials() {
+	cli.tokenLock.Lock()
 	cli.AccessToken = ""
+	cli.RefreshToken = ""
+	cli.tokenLock.Unlock()
 	cli.UserID = ""
 	cli.DeviceID = ""
 }
@@ -160,20 +378,29 @@ func (cli *Client) Sync() error {
 	return cli.SyncWithContext(context.Background())
 }
 
+// SyncWithContext starts syncing like Sync, but stops when the given context is cancelled.
+//
+// The in-flight /sync request is cancelled immediately when either the context is cancelled or StopSync is called.
+// If the context is cancelled, ctx.Err() is returned. If the sync is stopped with StopSync (or by starting another
+// sync), nil is returned. The next batch token is stored before processing each response, so calling this again
+// will continue from where the previous sync stopped.
 func (cli *Client) SyncWithContext(ctx context.Context) error {
 	// Mark the client as syncing.
 	// We will keep syncing until the syncing state changes. Either because
 	// Sync is called or StopSync is called.
 	syncingID := cli.incrementSyncingID()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cli.setSyncCancel(cancel)
 	nextBatch := cli.Store.LoadNextBatch(cli.UserID)
 	filterID := cli.Store.LoadFilterID(cli.UserID)
 	if filterID == "" {
 		filterJSON := cli.Syncer.GetFilterJSON(cli.UserID)
-		resFilter, err := cli.CreateFilter(filterJSON)
+		var err error
+		filterID, err = cli.GetOrCreateFilter(filterJSON)
 		if err != nil {
 			return err
 		}
-		filterID = resFilter.FilterID
 		cli.Store.SaveFilterID(cli.UserID, filterID)
 	}
 	lastSuccessfulSync := time.Now().Add(-cli.StreamSyncMinAge - 1*time.Hour)
@@ -193,7 +420,9 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 			StreamResponse: streamResp,
 		})
 		if err != nil {
-			if ctx.Err() != nil {
+			if cli.getSyncingID() != syncingID {
+				return nil
+			} else if ctx.Err() != nil {
 				return ctx.Err()
 			}
 			duration, err2 := cli.Syncer.OnFailedSync(resSync, err)
@@ -202,6 +431,9 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 			}
 			select {
 			case <-ctx.Done():
+				if cli.getSyncingID() != syncingID {
+					return nil
+				}
 				return ctx.Err()
 			case <-time.After(duration):
 				continue
@@ -220,6 +452,12 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 		// to not process some events, but it means that we won't get constantly stuck processing
 		// a malformed/buggy event which keeps making us panic.
 		cli.Store.SaveNextBatch(cli.UserID, resSync.NextBatch)
+		if cli.StateStore != nil {
+			UpdateStateStoreFromSync(cli.StateStore, resSync)
+		}
+		if cli.ProfileCache != nil {
+			cli.ProfileCache.UpdateFromSync(resSync)
+		}
 		if err = cli.Syncer.ProcessResponse(resSync, nextBatch); err != nil {
 			return err
 		}
@@ -236,10 +474,23 @@ func (cli *Client) getSyncingID() uint32 {
 	return atomic.LoadUint32(&cli.syncingID)
 }
 
+// setSyncCancel stores the cancel function of the current sync and cancels the previous sync, if any.
+func (cli *Client) setSyncCancel(cancel context.CancelFunc) {
+	cli.syncCancelLock.Lock()
+	prevCancel := cli.syncCancel
+	cli.syncCancel = cancel
+	cli.syncCancelLock.Unlock()
+	if prevCancel != nil {
+		prevCancel()
+	}
+}
+
 // StopSync stops the ongoing sync started by Sync.
 func (cli *Client) StopSync() {
 	// Advance the syncing state so that any running Syncs will terminate.
 	cli.incrementSyncingID()
+	// Cancel the in-flight /sync request so that the sync stops immediately.
+	cli.setSyncCancel(nil)
 }
 
 const logBodyContextKey = "fi.mau.mautrix.log_body"
@@ -278,10 +529,58 @@ func (cli *Client) LogRequestDone(req *http.Request, resp *http.Response, handle
 	)
 }
 
+// RequestMetrics contains information about a single HTTP request attempt. See Client.RequestHook.
+type RequestMetrics struct {
+	Method string
+	// The path of the request URL, without the query string.
+	Path string
+	// The HTTP status code of the response, or 0 if no response was received.
+	StatusCode int
+	// The Matrix error code (e.g. M_LIMIT_EXCEEDED) of the response, if any.
+	ErrCode  string
+	Duration time.Duration
+	// The attempt number, starting from 1.
+	Attempt int
+	// Whether the request will be retried after this attempt.
+	WillRetry bool
+	// The error of this attempt. This is nil for successful requests and for retried attempts with a response.
+	Error error
+}
+
+func (cli *Client) callRequestHook(req *http.Request, res *http.Response, err error, duration time.Duration, attempt int, willRetry bool) {
+	if cli.RequestHook == nil {
+		return
+	}
+	metrics := &RequestMetrics{
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Duration:  duration,
+		Attempt:   attempt,
+		WillRetry: willRetry,
+		Error:     err,
+	}
+	if res != nil {
+		metrics.StatusCode = res.StatusCode
+	}
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) && httpErr.RespError != nil {
+		metrics.ErrCode = httpErr.RespError.ErrCode
+	} else if willRetry && metrics.StatusCode == http.StatusTooManyRequests {
+		// The body of retried responses isn't parsed, but servers always use M_LIMIT_EXCEEDED for rate limits.
+		metrics.ErrCode = MLimitExceeded.ErrCode
+	}
+	cli.RequestHook(metrics)
+}
+
 func (cli *Client) MakeRequest(method string, httpURL string, reqBody interface{}, resBody interface{}) ([]byte, error) {
 	return cli.MakeFullRequest(FullRequest{Method: method, URL: httpURL, RequestJSON: reqBody, ResponseJSON: resBody})
 }
 
+// MakeRequestContext makes a JSON HTTP request like MakeRequest, but with the given context.
+func (cli *Client) MakeRequestContext(ctx context.Context, method string, httpURL string, reqBody interface{}, resBody interface{}) ([]byte, error) {
+	return cli.MakeFullRequest(FullRequest{Method: method, URL: httpURL, RequestJSON: reqBody, ResponseJSON: resBody, Context: ctx})
+}
+
 type ClientResponseHandler = func(req *http.Request, res *http.Response, responseJSON interface{}) ([]byte, error)
 
 type FullRequest struct {
@@ -297,6 +596,47 @@ type FullRequest struct {
 	MaxAttempts      int
 	SensitiveContent bool
 	Handler          ClientResponseHandler
+	// UploadProgress is called whenever a chunk of the request body has been sent.
+	// The total is -1 if the length of the body isn't known.
+	// If the request is retried, the count starts from zero again.
+	UploadProgress func(bytesSent, total int64)
+}
+
+// progressReader wraps a request body and reports how many bytes have been read from it.
+type progressReader struct {
+	io.ReadCloser
+	sent     int64
+	total    int64
+	callback func(bytesSent, total int64)
+}
+
+func (pr *progressReader) Read(p []byte) (n int, err error) {
+	n, err = pr.ReadCloser.Read(p)
+	if n > 0 {
+		pr.sent += int64(n)
+		pr.callback(pr.sent, pr.total)
+	}
+	return
+}
+
+func wrapUploadProgress(req *http.Request, callback func(bytesSent, total int64)) {
+	if callback == nil || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	total := req.ContentLength
+	if total <= 0 {
+		total = -1
+	}
+	req.Body = &progressReader{ReadCloser: req.Body, total: total, callback: callback}
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return &progressReader{ReadCloser: body, total: total, callback: callback}, nil
+		}
+	}
 }
 
 var requestID int32
@@ -344,7 +684,7 @@ func (params *FullRequest) compileRequest() (*http.Request, error) {
 		}
 	}
 	if params.Headers != nil {
-		req.Header = params.Headers
+		req.Header = params.Headers.Clone()
 	}
 	if params.RequestJSON != nil {
 		req.Header.Set("Content-Type", "application/json")
@@ -352,6 +692,7 @@ func (params *FullRequest) compileRequest() (*http.Request, error) {
 	if params.RequestLength > 0 && params.RequestBody != nil {
 		req.ContentLength = params.RequestLength
 	}
+	wrapUploadProgress(req, params.UploadProgress)
 	return req, nil
 }
 
@@ -362,8 +703,56 @@ func (params *FullRequest) compileRequest() (*http.Request, error) {
 // with the HTTP body bytes if it got that far. This error is an HTTPError which includes the returned
 // HTTP status code and possibly a RespError as the WrappedError, if the HTTP body could be decoded as a RespError.
 func (cli *Client) MakeFullRequest(params FullRequest) ([]byte, error) {
+	usedToken, _ := cli.getTokens()
+	data, err := cli.makeFullRequest(params)
+	// Request bodies given as readers can't be sent again, so only retry requests with other kinds of bodies.
+	if params.RequestBody == nil && cli.isSoftLogout(err) {
+		if refreshErr := cli.refreshAfterSoftLogout(usedToken); refreshErr != nil {
+			cli.logWarning("Failed to refresh access token after soft logout: %v", refreshErr)
+		} else {
+			data, err = cli.makeFullRequest(params)
+		}
+	}
+	return data, err
+}
+
+// getTokens returns the current access and refresh tokens, which may be changed concurrently by RefreshAccessToken.
+func (cli *Client) getTokens() (accessToken, refreshToken string) {
+	root := cli.root()
+	root.tokenLock.RLock()
+	defer root.tokenLock.RUnlock()
+	return root.AccessToken, root.RefreshToken
+}
+
+func (cli *Client) isSoftLogout(err error) bool {
+	var httpErr HTTPError
+	_, refreshToken := cli.getTokens()
+	return len(refreshToken) > 0 && errors.As(err, &httpErr) && httpErr.RespError != nil &&
+		httpErr.RespError.ErrCode == MUnknownToken.ErrCode && httpErr.RespError.SoftLogout()
+}
+
+func (cli *Client) refreshAfterSoftLogout(usedToken string) error {
+	root := cli.root()
+	root.refreshLock.Lock()
+	defer root.refreshLock.Unlock()
+	if accessToken, _ := cli.getTokens(); accessToken != usedToken {
+		// Another request already refreshed the token
+		return nil
+	}
+	_, err := cli.RefreshAccessToken()
+	return err
+}
+
+func (cli *Client) makeFullRequest(params FullRequest) ([]byte, error) {
+	if params.Context == nil {
+		params.Context = cli.ctx
+	}
+	policy := cli.getRetryPolicy()
 	if params.MaxAttempts == 0 {
-		params.MaxAttempts = 1 + cli.DefaultHTTPRetries
+		params.MaxAttempts = policy.MaxAttempts
+	}
+	if params.MaxAttempts < 1 {
+		params.MaxAttempts = 1
 	}
 	req, err := params.compileRequest()
 	if err != nil {
@@ -372,11 +761,36 @@ func (cli *Client) MakeFullRequest(params FullRequest) ([]byte, error) {
 	if params.Handler == nil {
 		params.Handler = cli.handleNormalResponse
 	}
-	req.Header.Set("User-Agent", cli.UserAgent)
-	if len(cli.AccessToken) > 0 {
-		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	cli.setRequestHeaders(req)
+	return cli.executeCompiledRequest(req, &requestAttempt{
+		policy:  policy,
+		number:  1,
+		retries: params.MaxAttempts - 1,
+		backoff: policy.BaseDelay,
+	}, params.ResponseJSON, params.Handler)
+}
+
+// setRequestHeaders adds DefaultHeaders, the User-Agent and the Authorization header to the given request.
+func (cli *Client) setRequestHeaders(req *http.Request) {
+	for key, values := range cli.DefaultHeaders {
+		key = http.CanonicalHeaderKey(key)
+		if _, overridden := req.Header[key]; !overridden {
+			req.Header[key] = values
+		}
+	}
+	if len(req.Header.Get("User-Agent")) == 0 {
+		req.Header.Set("User-Agent", cli.UserAgent)
 	}
-	return cli.executeCompiledRequest(req, params.MaxAttempts-1, 4*time.Second, params.ResponseJSON, params.Handler)
+	if accessToken, _ := cli.getTokens(); len(accessToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+}
+
+type requestAttempt struct {
+	policy  *RetryPolicy
+	number  int
+	retries int
+	backoff time.Duration
 }
 
 func (cli *Client) logWarning(format string, args ...interface{}) {
@@ -388,7 +802,7 @@ func (cli *Client) logWarning(format string, args ...interface{}) {
 	}
 }
 
-func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff time.Duration, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
+func (cli *Client) doRetry(req *http.Request, cause error, attempt *requestAttempt, backoff time.Duration, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
 	reqID, _ := req.Context().Value(logRequestIDContextKey).(int)
 	if req.Body != nil {
 		if req.GetBody == nil {
@@ -404,7 +818,12 @@ func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff
 	}
 	cli.logWarning("Request #%d failed: %v, retrying in %d seconds", reqID, cause, int(backoff.Seconds()))
 	time.Sleep(backoff)
-	return cli.executeCompiledRequest(req, retries-1, backoff*2, responseJSON, handler)
+	return cli.executeCompiledRequest(req, &requestAttempt{
+		policy:  attempt.policy,
+		number:  attempt.number + 1,
+		retries: attempt.retries - 1,
+		backoff: attempt.backoff * 2,
+	}, responseJSON, handler)
 }
 
 func (cli *Client) readRequestBody(req *http.Request, res *http.Response) ([]byte, error) {
@@ -474,14 +893,19 @@ func (cli *Client) handleResponseError(req *http.Request, res *http.Response) ([
 	}
 
 	respErr := &RespError{}
+	var hint string
 	if _ = json.Unmarshal(contents, respErr); respErr.ErrCode == "" {
 		respErr = nil
+	} else if cli.IsGuest && res.StatusCode == http.StatusForbidden {
+		// Guests can only use a small subset of the API, so make it obvious why the request may have failed
+		hint = "the client is logged in as a guest user, which can't use most endpoints"
 	}
 
 	return contents, HTTPError{
 		Request:   req,
 		Response:  res,
 		RespError: respErr,
+		Hint:      hint,
 	}
 }
 
@@ -513,7 +937,7 @@ func (cli *Client) shouldRetry(res *http.Response) bool {
 		(res.StatusCode == http.StatusTooManyRequests && !cli.IgnoreRateLimit)
 }
 
-func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backoff time.Duration, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
+func (cli *Client) executeCompiledRequest(req *http.Request, attempt *requestAttempt, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
 	cli.LogRequest(req)
 	startTime := time.Now()
 	res, err := cli.Client.Do(req)
@@ -522,23 +946,32 @@ func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backof
 		defer res.Body.Close()
 	}
 	if err != nil {
-		if retries > 0 {
-			return cli.doRetry(req, err, retries, backoff, responseJSON, handler)
+		if attempt.retries > 0 && attempt.policy.canRetry(req, nil, err, cli.IgnoreRateLimit) {
+			cli.callRequestHook(req, res, err, duration, attempt.number, true)
+			return cli.doRetry(req, err, attempt, attempt.policy.addJitter(attempt.backoff), responseJSON, handler)
 		}
+		cli.callRequestHook(req, res, err, duration, attempt.number, false)
 		return nil, HTTPError{
 			Request:  req,
 			Response: res,
+			Attempts: attempt.number,
 
 			Message:      "request error",
 			WrappedError: err,
 		}
 	}
 
-	if retries > 0 && cli.shouldRetry(res) {
+	if attempt.retries > 0 && attempt.policy.canRetry(req, res, nil, cli.IgnoreRateLimit) {
+		backoff := attempt.policy.addJitter(attempt.backoff)
 		if res.StatusCode == http.StatusTooManyRequests {
-			backoff = cli.parseBackoffFromResponse(res, time.Now(), backoff)
+			if retryAfter, ok := parseRetryAfterMSFromResponse(res); ok {
+				backoff = retryAfter
+			} else {
+				backoff = cli.parseBackoffFromResponse(res, time.Now(), backoff)
+			}
 		}
-		return cli.doRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retries, backoff, responseJSON, handler)
+		cli.callRequestHook(req, res, nil, duration, attempt.number, true)
+		return cli.doRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), attempt, backoff, responseJSON, handler)
 	}
 
 	var body []byte
@@ -549,16 +982,63 @@ func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backof
 		body, err = handler(req, res, responseJSON)
 		cli.LogRequestDone(req, res, err, len(body), duration)
 	}
+	if httpErr, ok := err.(HTTPError); ok {
+		httpErr.Attempts = attempt.number
+		err = httpErr
+	}
+	cli.callRequestHook(req, res, err, duration, attempt.number, false)
 	return body, err
 }
 
 // Whoami gets the user ID of the current user. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3accountwhoami
+//
+// If the UserID or DeviceID fields of the client are empty, they're filled using the response.
+// This is useful after logging in with only an access token, as the crypto module needs to know the device ID.
 func (cli *Client) Whoami() (resp *RespWhoami, err error) {
 	urlPath := cli.BuildClientURL("v3", "account", "whoami")
 	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	if err == nil && resp != nil {
+		if cli.UserID == "" {
+			cli.UserID = resp.UserID
+		}
+		if cli.DeviceID == "" && resp.UserID == cli.UserID {
+			cli.DeviceID = resp.DeviceID
+		}
+		if resp.UserID == cli.UserID {
+			cli.IsGuest = resp.IsGuest
+		}
+	}
 	return
 }
 
+// GetOrCreateFilter returns the ID of a previously uploaded filter with the same content,
+// or uploads the filter with CreateFilter if it hasn't been uploaded before.
+//
+// Filter IDs are only reused if the client's Store implements FilterHashStorer.
+func (cli *Client) GetOrCreateFilter(filter *Filter) (string, error) {
+	hashStore, ok := cli.Store.(FilterHashStorer)
+	if !ok {
+		resp, err := cli.CreateFilter(filter)
+		if err != nil {
+			return "", err
+		}
+		return resp.FilterID, nil
+	}
+	hash, err := filter.Hash()
+	if err != nil {
+		return "", fmt.Errorf("failed to hash filter: %w", err)
+	}
+	if filterID := hashStore.LoadFilterIDForHash(cli.UserID, hash); filterID != "" {
+		return filterID, nil
+	}
+	resp, err := cli.CreateFilter(filter)
+	if err != nil {
+		return "", err
+	}
+	hashStore.SaveFilterIDForHash(cli.UserID, hash, resp.FilterID)
+	return resp.FilterID, nil
+}
+
 // CreateFilter makes an HTTP request according to https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3useruseridfilter
 func (cli *Client) CreateFilter(filter *Filter) (resp *RespCreateFilter, err error) {
 	urlPath := cli.BuildClientURL("v3", "user", cli.UserID, "filter")
@@ -579,9 +1059,12 @@ func (cli *Client) SyncRequest(timeout int, since, filterID string, fullState bo
 }
 
 type ReqSync struct {
-	Timeout     int
-	Since       string
-	FilterID    string
+	Timeout  int
+	Since    string
+	FilterID string
+	// An inline filter to use instead of a pre-uploaded filter ID. This is ignored if FilterID is set.
+	// A nil or empty filter won't add the filter parameter at all.
+	Filter      *Filter
 	FullState   bool
 	SetPresence event.Presence
 
@@ -598,6 +1081,11 @@ func (req *ReqSync) BuildQuery() map[string]string {
 	}
 	if req.FilterID != "" {
 		query["filter"] = req.FilterID
+	} else if req.Filter != nil && !reflect.DeepEqual(*req.Filter, Filter{}) {
+		filterJSON, err := json.Marshal(req.Filter)
+		if err == nil {
+			query["filter"] = string(filterJSON)
+		}
 	}
 	if req.SetPresence != "" {
 		query["set_presence"] = string(req.SetPresence)
@@ -637,22 +1125,20 @@ func (cli *Client) FullSyncRequest(req ReqSync) (resp *RespSync, err error) {
 }
 
 func (cli *Client) register(url string, req *ReqRegister) (resp *RespRegister, uiaResp *RespUserInteractive, err error) {
-	var bodyBytes []byte
-	bodyBytes, err = cli.MakeFullRequest(FullRequest{
+	err = cli.DoUIA(&UIARequest{
 		Method:           http.MethodPost,
 		URL:              url,
-		RequestJSON:      req,
+		Body:             req,
 		SensitiveContent: len(req.Password) > 0,
-	})
-	if err != nil {
-		httpErr, ok := err.(HTTPError)
-		// if response has a 401 status, but doesn't have the errcode field, it's probably a UIA response.
-		if ok && httpErr.IsStatus(http.StatusUnauthorized) && httpErr.RespError == nil {
-			err = json.Unmarshal(bodyBytes, &uiaResp)
-		}
-	} else {
-		// body should be RespRegister
-		err = json.Unmarshal(bodyBytes, &resp)
+		// Registration UIA stages are completed by the caller, so just return the first UIA response.
+		Callback: func(uia *RespUserInteractive) interface{} {
+			uiaResp = uia
+			return nil
+		},
+	}, &resp)
+	if uiaResp != nil && uiaResp.ErrCode == "" {
+		// If the response doesn't have the errcode field, the error is just the UIA challenge.
+		err = nil
 	}
 	return
 }
@@ -668,6 +1154,10 @@ func (cli *Client) Register(req *ReqRegister) (*RespRegister, *RespUserInteracti
 // RegisterGuest makes an HTTP request according to https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3register
 // with kind=guest.
 //
+// Guest registration doesn't need any auth or username. To use the returned credentials, set them on the client
+// with SetCredentials and set IsGuest to true (or call Whoami, which sets it automatically).
+// See https://spec.matrix.org/v1.4/client-server-api/#guest-access for the endpoints that guests can use.
+//
 // For kind=user, see Register.
 func (cli *Client) RegisterGuest(req *ReqRegister) (*RespRegister, *RespUserInteractive, error) {
 	query := map[string]string{
@@ -716,6 +1206,22 @@ func (cli *Client) GetLoginFlows() (resp *RespLoginFlows, err error) {
 	return
 }
 
+// BuildSSORedirectURL builds the URL that the user should be sent to for logging in with SSO.
+// After logging in, the homeserver will redirect the user back to redirectURL with a loginToken query parameter,
+// which can be passed to Login with the m.login.token type.
+//
+// If idpID is empty, the homeserver will choose the identity provider or let the user pick one.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3loginssoredirect
+func (cli *Client) BuildSSORedirectURL(idpID, redirectURL string) string {
+	urlPath := ClientURLPath{"v3", "login", "sso", "redirect"}
+	if idpID != "" {
+		urlPath = append(urlPath, idpID)
+	}
+	return cli.BuildURLWithQuery(urlPath, map[string]string{
+		"redirectUrl": redirectURL,
+	})
+}
+
 // Login a user to the homeserver according to https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3login
 func (cli *Client) Login(req *ReqLogin) (resp *RespLogin, err error) {
 	_, err = cli.MakeFullRequest(FullRequest{
@@ -727,7 +1233,10 @@ func (cli *Client) Login(req *ReqLogin) (resp *RespLogin, err error) {
 	})
 	if req.StoreCredentials && err == nil {
 		cli.DeviceID = resp.DeviceID
+		cli.tokenLock.Lock()
 		cli.AccessToken = resp.AccessToken
+		cli.RefreshToken = resp.RefreshToken
+		cli.tokenLock.Unlock()
 		cli.UserID = resp.UserID
 		cli.Logger.Debugfln("Stored credentials for %s/%s after login", cli.UserID, cli.DeviceID)
 	}
@@ -743,6 +1252,36 @@ func (cli *Client) Login(req *ReqLogin) (resp *RespLogin, err error) {
 	return
 }
 
+// RefreshAccessToken uses the client's refresh token to get a new access token.
+// See https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3refresh
+//
+// The new tokens are stored in the client and passed to the OnTokenRefresh callback.
+// This is called automatically when a request fails due to a soft logout and a refresh token is available.
+func (cli *Client) RefreshAccessToken() (resp *RespRefresh, err error) {
+	_, refreshToken := cli.getTokens()
+	_, err = cli.makeFullRequest(FullRequest{
+		Method:           http.MethodPost,
+		URL:              cli.BuildClientURL("v3", "refresh"),
+		RequestJSON:      &ReqRefresh{RefreshToken: refreshToken},
+		ResponseJSON:     &resp,
+		SensitiveContent: true,
+	})
+	if err != nil {
+		return
+	}
+	root := cli.root()
+	root.tokenLock.Lock()
+	root.AccessToken = resp.AccessToken
+	if len(resp.RefreshToken) > 0 {
+		root.RefreshToken = resp.RefreshToken
+	}
+	root.tokenLock.Unlock()
+	if cli.OnTokenRefresh != nil {
+		cli.OnTokenRefresh(resp)
+	}
+	return
+}
+
 // Logout the current user. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3logout
 // This does not clear the credentials from the client instance. See ClearCredentials() instead.
 func (cli *Client) Logout() (resp *RespLogout, err error) {
@@ -760,12 +1299,58 @@ func (cli *Client) LogoutAll() (resp *RespLogout, err error) {
 }
 
 // Versions returns the list of supported Matrix versions on this homeserver. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientversions
+//
+// The response is stored in Client.SpecVersions, so that GetCachedVersions doesn't need to make a request again.
 func (cli *Client) Versions() (resp *RespVersions, err error) {
+	root := cli.root()
+	root.versionsLock.Lock()
+	defer root.versionsLock.Unlock()
+	return cli.fetchVersions()
+}
+
+// fetchVersions makes the request for Versions and caches the result. The caller must hold versionsLock.
+func (cli *Client) fetchVersions() (resp *RespVersions, err error) {
 	urlPath := cli.BuildClientURL("versions")
 	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	root := cli.root()
+	if err == nil {
+		root.SpecVersions = resp
+		root.versionsErr = nil
+	} else {
+		root.versionsErr = err
+		root.versionsErrTime = time.Now()
+	}
 	return
 }
 
+// FailedVersionsRetryDelay is how long GetCachedVersions returns the error from a failed Versions call
+// instead of making a new request.
+var FailedVersionsRetryDelay = 5 * time.Minute
+
+// GetCachedVersions returns the versions supported by the server, only fetching them with Versions if they haven't
+// been fetched before. Call Versions directly to force a refresh.
+//
+// If fetching the versions failed less than FailedVersionsRetryDelay ago, the same error is returned again
+// without making a request.
+func (cli *Client) GetCachedVersions() (*RespVersions, error) {
+	versions, _, err := cli.getCachedVersions()
+	return versions, err
+}
+
+// getCachedVersions is GetCachedVersions, but also returns whether a request was made.
+func (cli *Client) getCachedVersions() (versions *RespVersions, fetched bool, err error) {
+	root := cli.root()
+	root.versionsLock.Lock()
+	defer root.versionsLock.Unlock()
+	if root.SpecVersions != nil {
+		return root.SpecVersions, false, nil
+	} else if root.versionsErr != nil && time.Since(root.versionsErrTime) < FailedVersionsRetryDelay {
+		return nil, false, root.versionsErr
+	}
+	versions, err = cli.fetchVersions()
+	return versions, true, err
+}
+
 // Capabilities returns capabilities on this homeserver. See https://spec.matrix.org/v1.3/client-server-api/#capabilities-negotiation
 func (cli *Client) Capabilities() (resp *RespCapabilities, err error) {
 	urlPath := cli.BuildClientURL("v3", "capabilities")
@@ -777,6 +1362,9 @@ func (cli *Client) Capabilities() (resp *RespCapabilities, err error) {
 //
 // If serverName is specified, this will be added as a query param to instruct the homeserver to join via that server. If content is specified, it will
 // be JSON encoded and used as the request body.
+//
+// Guest users can only join rooms where the m.room.guest_access state event allows it (guest_access: can_join).
+// Otherwise the server responds with M_FORBIDDEN or MGuestAccessForbidden.
 func (cli *Client) JoinRoom(roomIDorAlias, serverName string, content interface{}) (resp *RespJoinRoom, err error) {
 	var urlPath string
 	if serverName != "" {
@@ -792,10 +1380,50 @@ func (cli *Client) JoinRoom(roomIDorAlias, serverName string, content interface{
 
 // JoinRoomByID joins the client to a room ID. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidjoin
 //
-// Unlike JoinRoom, this method can only be used to join rooms that the server already knows about.
-// It's mostly intended for bridges and other things where it's already certain that the server is in the room.
-func (cli *Client) JoinRoomByID(roomID id.RoomID) (resp *RespJoinRoom, err error) {
-	_, err = cli.MakeRequest("POST", cli.BuildClientURL("v3", "rooms", roomID, "join"), nil, &resp)
+// If no via servers are given, this method can only be used to join rooms that the server already knows about.
+// That is mostly useful for bridges and other things where it's already certain that the server is in the room.
+// When joining rooms over federation, specify servers in ReqJoinRoom.Via, which will make this use
+// https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3joinroomidoralias with server_name query params.
+func (cli *Client) JoinRoomByID(roomID id.RoomID, optionalReq ...*ReqJoinRoom) (resp *RespJoinRoom, err error) {
+	req := &ReqJoinRoom{}
+	if len(optionalReq) == 1 {
+		req = optionalReq[0]
+	} else if len(optionalReq) > 1 {
+		panic("invalid number of arguments to JoinRoomByID")
+	}
+	var urlPath string
+	if len(req.Via) > 0 {
+		urlPath = cli.BuildURLWithFullQuery(ClientURLPath{"v3", "join", roomID}, func(q url.Values) {
+			q["server_name"] = req.Via
+		})
+	} else {
+		urlPath = cli.BuildClientURL("v3", "rooms", roomID, "join")
+	}
+	_, err = cli.MakeRequest("POST", urlPath, req, &resp)
+	if err == nil && resp != nil && resp.RoomID == "" {
+		resp.RoomID = roomID
+	}
+	return
+}
+
+// KnockRoom requests to join a room ID or alias. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3knockroomidoralias
+//
+// Knocking is only allowed if the room's join rule is knock. Otherwise, the server will respond with
+// a M_FORBIDDEN error, which can be checked with errors.Is(err, mautrix.MForbidden). The reason sent by
+// the server is available in the error message.
+func (cli *Client) KnockRoom(roomIDorAlias string, optionalReq ...*ReqKnockRoom) (resp *RespKnockRoom, err error) {
+	req := &ReqKnockRoom{}
+	if len(optionalReq) == 1 {
+		req = optionalReq[0]
+	} else if len(optionalReq) > 1 {
+		panic("invalid number of arguments to KnockRoom")
+	}
+	urlPath := cli.BuildURLWithFullQuery(ClientURLPath{"v3", "knock", roomIDorAlias}, func(q url.Values) {
+		if len(req.Via) > 0 {
+			q["server_name"] = req.Via
+		}
+	})
+	_, err = cli.MakeRequest("POST", urlPath, req, &resp)
 	return
 }
 
@@ -818,6 +1446,9 @@ func (cli *Client) SetDisplayName(displayName string) (err error) {
 		DisplayName string `json:"displayname"`
 	}{displayName}
 	_, err = cli.MakeRequest("PUT", urlPath, &s, nil)
+	if err == nil && cli.ProfileCache != nil {
+		cli.ProfileCache.Invalidate(cli.UserID)
+	}
 	return
 }
 
@@ -851,14 +1482,20 @@ func (cli *Client) SetAvatarURL(url id.ContentURI) (err error) {
 	if err != nil {
 		return err
 	}
+	if cli.ProfileCache != nil {
+		cli.ProfileCache.Invalidate(cli.UserID)
+	}
 
 	return nil
 }
 
 // GetAccountData gets the user's account data of this type. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3useruseridaccount_datatype
+//
+// If the account data hasn't been set, the returned error will match MNotFound with errors.Is and output is not modified.
 func (cli *Client) GetAccountData(name string, output interface{}) (err error) {
 	urlPath := cli.BuildClientURL("v3", "user", cli.UserID, "account_data", name)
 	_, err = cli.MakeRequest("GET", urlPath, nil, output)
+	err = normalizeNotFoundError(err, "Account data not found")
 	return
 }
 
@@ -873,10 +1510,129 @@ func (cli *Client) SetAccountData(name string, data interface{}) (err error) {
 	return nil
 }
 
-// GetRoomAccountData gets the user's account data of this type in a specific room. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3useruseridaccount_datatype
+// MaxAccountDataUpdateAttempts is the number of times AddDirectChat, IgnoreUser and UnignoreUser will try
+// to store a change if it's overwritten by a concurrent update.
+var MaxAccountDataUpdateAttempts = 3
+
+// updateAccountData stores a change in the given account data type using a read-modify-write loop.
+//
+// Matrix doesn't have a compare-and-swap for account data, so the apply function is called again after writing
+// to verify that the change wasn't overwritten by another client. It must read the current data and return nil
+// if the change is already present, or the modified data to store otherwise. Concurrent updates within the same
+// Client are serialized.
+func (cli *Client) updateAccountData(eventType string, apply func() (interface{}, error)) error {
+	root := cli.root()
+	root.accountDataLock.Lock()
+	defer root.accountDataLock.Unlock()
+	for attempt := 0; ; attempt++ {
+		data, err := apply()
+		if err != nil {
+			return fmt.Errorf("failed to get %s: %w", eventType, err)
+		} else if data == nil {
+			return nil
+		} else if attempt >= MaxAccountDataUpdateAttempts {
+			return fmt.Errorf("%s was overwritten by concurrent updates %d times", eventType, MaxAccountDataUpdateAttempts)
+		}
+		err = cli.SetAccountData(eventType, data)
+		if err != nil {
+			return fmt.Errorf("failed to set %s: %w", eventType, err)
+		}
+	}
+}
+
+// GetDirectChats gets the m.direct account data, which maps user IDs to the direct chat rooms with them.
+// If the account data doesn't exist yet, an empty map is returned.
+func (cli *Client) GetDirectChats() (event.DirectChatsEventContent, error) {
+	var directChats event.DirectChatsEventContent
+	err := cli.GetAccountData(event.AccountDataDirectChats.Type, &directChats)
+	if errors.Is(err, MNotFound) {
+		err = nil
+	} else if err != nil {
+		return nil, err
+	}
+	if directChats == nil {
+		directChats = make(event.DirectChatsEventContent)
+	}
+	return directChats, nil
+}
+
+// AddDirectChat adds the given room to the m.direct account data as a direct chat with the given user.
+//
+// The account data is read, modified and written back. The data is read again after writing, and the update is
+// retried if another client overwrote it in between (up to MaxAccountDataUpdateAttempts times).
+func (cli *Client) AddDirectChat(userID id.UserID, roomID id.RoomID) error {
+	return cli.updateAccountData(event.AccountDataDirectChats.Type, func() (interface{}, error) {
+		directChats, err := cli.GetDirectChats()
+		if err != nil {
+			return nil, err
+		} else if isDirectChat(directChats, userID, roomID) {
+			return nil, nil
+		}
+		directChats[userID] = append(directChats[userID], roomID)
+		return directChats, nil
+	})
+}
+
+func isDirectChat(directChats event.DirectChatsEventContent, userID id.UserID, roomID id.RoomID) bool {
+	for _, existingRoomID := range directChats[userID] {
+		if existingRoomID == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetIgnoredUsers gets the m.ignored_user_list account data.
+// If the account data doesn't exist yet, an empty list is returned.
+func (cli *Client) GetIgnoredUsers() (*event.IgnoredUserListEventContent, error) {
+	var content event.IgnoredUserListEventContent
+	err := cli.GetAccountData(event.AccountDataIgnoredUserList.Type, &content)
+	if err != nil && !errors.Is(err, MNotFound) {
+		return nil, err
+	}
+	if content.IgnoredUsers == nil {
+		content.IgnoredUsers = make(map[id.UserID]event.IgnoredUser)
+	}
+	return &content, nil
+}
+
+// IgnoreUser adds the given user to the m.ignored_user_list account data.
+//
+// Like AddDirectChat, the list is read again after writing and the update is retried if another client overwrote it.
+func (cli *Client) IgnoreUser(userID id.UserID) error {
+	return cli.updateIgnoredUsers(userID, true)
+}
+
+// UnignoreUser removes the given user from the m.ignored_user_list account data.
+func (cli *Client) UnignoreUser(userID id.UserID) error {
+	return cli.updateIgnoredUsers(userID, false)
+}
+
+func (cli *Client) updateIgnoredUsers(userID id.UserID, ignore bool) error {
+	return cli.updateAccountData(event.AccountDataIgnoredUserList.Type, func() (interface{}, error) {
+		content, err := cli.GetIgnoredUsers()
+		if err != nil {
+			return nil, err
+		} else if _, isIgnored := content.IgnoredUsers[userID]; isIgnored == ignore {
+			return nil, nil
+		}
+		if ignore {
+			content.IgnoredUsers[userID] = event.IgnoredUser{}
+		} else {
+			delete(content.IgnoredUsers, userID)
+		}
+		return content, nil
+	})
+}
+
+// GetRoomAccountData gets the user's account data of this type in a specific room. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3useruseridroomsroomidaccount_datatype
+//
+// Like GetAccountData, the returned error will match MNotFound with errors.Is if the account data hasn't been set,
+// which allows distinguishing unset data from data that was set to an empty object.
 func (cli *Client) GetRoomAccountData(roomID id.RoomID, name string, output interface{}) (err error) {
 	urlPath := cli.BuildClientURL("v3", "user", cli.UserID, "rooms", roomID, "account_data", name)
 	_, err = cli.MakeRequest("GET", urlPath, nil, output)
+	err = normalizeNotFoundError(err, "Account data not found")
 	return
 }
 
@@ -892,9 +1648,17 @@ func (cli *Client) SetRoomAccountData(roomID id.RoomID, name string, data interf
 }
 
 type ReqSendEvent struct {
-	Timestamp     int64
+	Timestamp int64
+	// The transaction ID to use. If empty, a new one is generated with Client.TxnID.
+	//
+	// The server deduplicates requests with the same transaction ID from the same device: sending an event again
+	// with the same transaction ID returns the ID of the original event instead of sending a new one.
+	// Storing the transaction ID before sending therefore makes it safe to retry after a restart.
 	TransactionID string
 
+	// Check the cached power levels before sending even if Client.CheckPowerLevelsBeforeSending is false.
+	CheckPowerLevel bool
+
 	MeowEventID id.EventID
 }
 
@@ -905,6 +1669,9 @@ func (cli *Client) SendMessageEvent(roomID id.RoomID, eventType event.Type, cont
 	if len(extra) > 0 {
 		req = extra[0]
 	}
+	if err = cli.checkSendPowerLevel(roomID, eventType, req.CheckPowerLevel); err != nil {
+		return
+	}
 
 	var txnID string
 	if len(req.TransactionID) > 0 {
@@ -924,25 +1691,59 @@ func (cli *Client) SendMessageEvent(roomID id.RoomID, eventType event.Type, cont
 	urlData := ClientURLPath{"v3", "rooms", roomID, "send", eventType.String(), txnID}
 
 	urlPath := cli.BuildURLWithQuery(urlData, queryParams)
-	_, err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+	err = cli.queueSend(roomID, func() error {
+		_, err := cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+		return err
+	})
+	err = wrapSendForbiddenError(err, roomID, eventType)
 	return
 }
 
+// queueSend calls fn through the SendQueue if the client has one, or directly otherwise.
+func (cli *Client) queueSend(roomID id.RoomID, fn func() error) error {
+	if cli.SendQueue == nil {
+		return fn()
+	}
+	return cli.SendQueue.Run(cli.context(), roomID, fn)
+}
+
+// stateEventURLPath returns the URL path for a state event. The state key is left out if it's empty,
+// as allowed by the spec, instead of producing a path with a trailing slash.
+func stateEventURLPath(roomID id.RoomID, eventType event.Type, stateKey string) ClientURLPath {
+	if stateKey == "" {
+		return ClientURLPath{"v3", "rooms", roomID, "state", eventType.String()}
+	}
+	return ClientURLPath{"v3", "rooms", roomID, "state", eventType.String(), stateKey}
+}
+
 // SendStateEvent sends a state event into a room. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidstateeventtypestatekey
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
-func (cli *Client) SendStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}) (resp *RespSendEvent, err error) {
-	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "state", eventType.String(), stateKey)
-	_, err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+//
+// Only the CheckPowerLevel field of the optional extra parameter is used.
+func (cli *Client) SendStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}, extra ...ReqSendEvent) (resp *RespSendEvent, err error) {
+	if err = cli.checkSendPowerLevel(roomID, eventType, len(extra) > 0 && extra[0].CheckPowerLevel); err != nil {
+		return
+	}
+	urlPath := cli.BuildURL(stateEventURLPath(roomID, eventType, stateKey))
+	err = cli.queueSend(roomID, func() error {
+		_, err := cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+		return err
+	})
+	err = wrapSendForbiddenError(err, roomID, eventType)
 	return
 }
 
 // SendMassagedStateEvent sends a state event into a room with a custom timestamp. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidstateeventtypestatekey
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
 func (cli *Client) SendMassagedStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}, ts int64) (resp *RespSendEvent, err error) {
-	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "rooms", roomID, "state", eventType.String(), stateKey}, map[string]string{
+	urlPath := cli.BuildURLWithQuery(stateEventURLPath(roomID, eventType, stateKey), map[string]string{
 		"ts": strconv.FormatInt(ts, 10),
 	})
-	_, err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+	err = cli.queueSend(roomID, func() error {
+		_, err := cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+		return err
+	})
+	err = wrapSendForbiddenError(err, roomID, eventType)
 	return
 }
 
@@ -988,17 +1789,144 @@ func (cli *Client) SendNotice(roomID id.RoomID, text string) (*RespSendEvent, er
 	})
 }
 
-func (cli *Client) SendReaction(roomID id.RoomID, eventID id.EventID, reaction string) (*RespSendEvent, error) {
-	return cli.SendMessageEvent(roomID, event.EventReaction, &event.ReactionEventContent{
-		RelatesTo: event.RelatesTo{
-			EventID: eventID,
-			Type:    event.RelAnnotation,
-			Key:     reaction,
-		},
-	})
+// SendEdit sends an edit of the given event, replacing its content with newContent.
+// See https://spec.matrix.org/v1.4/client-server-api/#event-replacements
+//
+// The given content is not modified: the edit is built from a copy with event.MessageEventContent.SetEdit.
+func (cli *Client) SendEdit(roomID id.RoomID, targetEventID id.EventID, newContent *event.MessageEventContent) (*RespSendEvent, error) {
+	content := *newContent
+	content.SetEdit(targetEventID)
+	return cli.SendMessageEvent(roomID, event.EventMessage, &content)
+}
+
+// SendLocation sends a m.location message with the given geo URI (e.g. geo:51.5008,0.1247).
+// See event.NewLocationMessage for details. If the asset type is empty, event.AssetSelf is used.
+func (cli *Client) SendLocation(roomID id.RoomID, geoURI, description string, assetType event.LocationAssetType) (*RespSendEvent, error) {
+	content, err := event.NewLocationMessage(geoURI, description, assetType, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	return cli.SendMessageEvent(roomID, event.EventMessage, content)
+}
+
+// StartPoll sends a MSC3381 poll with the given question and answers. See event.NewPollStart for details.
+func (cli *Client) StartPoll(roomID id.RoomID, question string, answers []string, kind event.PollKind, maxSelections int) (*RespSendEvent, error) {
+	return cli.SendMessageEvent(roomID, event.EventUnstablePollStart, event.NewPollStart(question, answers, kind, maxSelections))
+}
+
+// RespondToPoll votes for the given answer IDs in a poll. Sending a new response replaces the previous one,
+// and sending a response without answers removes the vote.
+func (cli *Client) RespondToPoll(roomID id.RoomID, pollID id.EventID, answerIDs ...string) (*RespSendEvent, error) {
+	if answerIDs == nil {
+		answerIDs = []string{}
+	}
+	return cli.SendMessageEvent(roomID, event.EventUnstablePollResponse, &event.PollResponseEventContent{
+		RelatesTo: event.RelatesTo{Type: event.RelReference, EventID: pollID},
+		Response:  event.PollResponse{Answers: answerIDs},
+	})
+}
+
+// EndPoll ends a poll, so that no more responses are counted. Only the poll creator can end polls.
+func (cli *Client) EndPoll(roomID id.RoomID, pollID id.EventID) (*RespSendEvent, error) {
+	return cli.SendMessageEvent(roomID, event.EventUnstablePollEnd, &event.PollEndEventContent{
+		RelatesTo: event.RelatesTo{Type: event.RelReference, EventID: pollID},
+		Text:      "Ended poll",
+	})
+}
+
+// GetPollResults fetches a poll and all responses to it, and tallies the results with event.TallyPoll.
+//
+// The events are fetched with GetEvent and GetRelations, so this doesn't work in encrypted rooms,
+// where the events need to be decrypted before tallying.
+func (cli *Client) GetPollResults(roomID id.RoomID, pollID id.EventID) (*event.PollResults, error) {
+	start, err := cli.GetEvent(roomID, pollID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get poll start event: %w", err)
+	}
+	var related []*event.Event
+	req := &ReqGetRelations{RelationType: event.RelReference, Limit: 100}
+	for {
+		resp, err := cli.GetRelations(roomID, pollID, req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get poll responses: %w", err)
+		}
+		related = append(related, resp.Chunk...)
+		if resp.NextBatch == "" || resp.NextBatch == req.From {
+			break
+		}
+		req.From = resp.NextBatch
+	}
+	return event.TallyPoll(start, related), nil
+}
+
+// SendReaction sends a m.reaction event with the given key to the given event.
+// See https://spec.matrix.org/v1.4/client-server-api/#event-annotations-and-reactions
+//
+// The returned event ID can be passed to RedactEvent to remove the reaction later (or use RedactReaction to find it).
+// If the same reaction was already sent, some servers reject it with an error matching MDuplicateAnnotation.
+func (cli *Client) SendReaction(roomID id.RoomID, eventID id.EventID, reaction string) (*RespSendEvent, error) {
+	return cli.SendMessageEvent(roomID, event.EventReaction, &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{
+			EventID: eventID,
+			Type:    event.RelAnnotation,
+			Key:     reaction,
+		},
+	})
+}
+
+// RedactReaction finds the user's own reactions with the given key to the given event
+// using the relations API and redacts them. The IDs of the redacted reaction events are returned.
+// If the user hasn't reacted with the key, nothing is redacted and no error is returned.
+//
+// Encrypted reactions are found using the unencrypted m.relates_to field, which clients normally leave
+// in the clear. Reactions whose key is only inside the encrypted payload can't be matched and are skipped.
+func (cli *Client) RedactReaction(roomID id.RoomID, eventID id.EventID, reaction string) (redacted []id.EventID, err error) {
+	req := &ReqGetRelations{RelationType: event.RelAnnotation}
+	for {
+		var resp *RespGetRelations
+		resp, err = cli.GetRelations(roomID, eventID, req)
+		if err != nil {
+			return
+		}
+		for _, evt := range resp.Chunk {
+			if evt.Sender != cli.UserID || len(reaction) == 0 || reactionKey(evt) != reaction {
+				continue
+			}
+			_, err = cli.RedactEvent(roomID, evt.ID)
+			if err != nil {
+				return
+			}
+			redacted = append(redacted, evt.ID)
+		}
+		if resp.NextBatch == "" {
+			return
+		}
+		req.From = resp.NextBatch
+	}
+}
+
+// reactionKey returns the annotation key of a plaintext reaction or the cleartext m.relates_to of an encrypted event.
+func reactionKey(evt *event.Event) string {
+	switch evt.Type {
+	case event.EventReaction:
+		_ = evt.Content.ParseRaw(event.EventReaction)
+		if content, ok := evt.Content.Parsed.(*event.ReactionEventContent); ok {
+			return content.RelatesTo.Key
+		}
+	case event.EventEncrypted:
+		_ = evt.Content.ParseRaw(event.EventEncrypted)
+		if content, ok := evt.Content.Parsed.(*event.EncryptedEventContent); ok && content.RelatesTo != nil &&
+			content.RelatesTo.Type == event.RelAnnotation {
+			return content.RelatesTo.Key
+		}
+	}
+	return ""
 }
 
 // RedactEvent redacts the given event. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidredacteventidtxnid
+//
+// The returned event ID is the ID of the redaction event. Locally cached copies of the redacted event
+// can be updated with event.Event.Redact.
 func (cli *Client) RedactEvent(roomID id.RoomID, eventID id.EventID, extra ...ReqRedact) (resp *RespSendEvent, err error) {
 	req := ReqRedact{}
 	if len(extra) > 0 {
@@ -1030,9 +1958,107 @@ func (cli *Client) RedactEvent(roomID id.RoomID, eventID id.EventID, extra ...Re
 func (cli *Client) CreateRoom(req *ReqCreateRoom) (resp *RespCreateRoom, err error) {
 	urlPath := cli.BuildClientURL("v3", "createRoom")
 	_, err = cli.MakeRequest("POST", urlPath, req, &resp)
+	if err == nil && req.IsDirect && req.AddToDirectChats {
+		for _, userID := range req.Invite {
+			if dmErr := cli.AddDirectChat(userID, resp.RoomID); dmErr != nil {
+				cli.logWarning("Failed to add %s to m.direct for %s: %v", resp.RoomID, userID, dmErr)
+			}
+		}
+	}
 	return
 }
 
+// UpgradeRoom upgrades the given room to a new room version. The old room will get a m.room.tombstone event pointing
+// at the replacement room. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidupgrade
+func (cli *Client) UpgradeRoom(roomID id.RoomID, newVersion string) (resp *RespUpgradeRoom, err error) {
+	u := cli.BuildClientURL("v3", "rooms", roomID, "upgrade")
+	_, err = cli.MakeRequest("POST", u, &ReqUpgradeRoom{NewVersion: newVersion}, &resp)
+	return
+}
+
+var ErrTombstoneLoop = errors.New("tombstone chain contains a loop")
+
+// MaxTombstoneChainLength is the maximum number of tombstones FollowTombstones will follow.
+const MaxTombstoneChainLength = 64
+
+// FollowTombstones follows m.room.tombstone events starting from the given room and returns the ID of the newest room.
+//
+// If the given room doesn't have a tombstone, the same room ID is returned. If the client can't read the state of
+// a replacement room (e.g. because it hasn't joined it), that room is considered the newest one. An error is returned
+// if the chain loops back to a room that was already visited or is longer than MaxTombstoneChainLength.
+func (cli *Client) FollowTombstones(roomID id.RoomID) (id.RoomID, error) {
+	visited := map[id.RoomID]struct{}{roomID: {}}
+	for len(visited) <= MaxTombstoneChainLength {
+		var tombstone event.TombstoneEventContent
+		err := cli.StateEvent(roomID, event.StateTombstone, "", &tombstone)
+		if errors.Is(err, MNotFound) || errors.Is(err, MForbidden) {
+			return roomID, nil
+		} else if err != nil {
+			return roomID, fmt.Errorf("failed to get tombstone of %s: %w", roomID, err)
+		} else if tombstone.ReplacementRoom == "" {
+			return roomID, nil
+		}
+		if _, alreadyVisited := visited[tombstone.ReplacementRoom]; alreadyVisited {
+			return roomID, fmt.Errorf("%w: %s points at %s", ErrTombstoneLoop, roomID, tombstone.ReplacementRoom)
+		}
+		roomID = tombstone.ReplacementRoom
+		visited[roomID] = struct{}{}
+	}
+	return roomID, fmt.Errorf("%w: more than %d tombstones", ErrTombstoneLoop, MaxTombstoneChainLength)
+}
+
+// GetRoomPredecessor returns the room that the given room replaced, based on the predecessor field of the
+// m.room.create event. If the room isn't an upgrade of another room, nil is returned.
+//
+// If the StateStore implements RoomUpgradeStateStore, the cached create event is used if there is one,
+// and a fetched create event is stored there.
+func (cli *Client) GetRoomPredecessor(roomID id.RoomID) (*event.Predecessor, error) {
+	upgradeStore, _ := cli.StateStore.(RoomUpgradeStateStore)
+	var create *event.CreateEventContent
+	if upgradeStore != nil {
+		create = upgradeStore.GetCreateEvent(roomID)
+	}
+	if create == nil {
+		create = &event.CreateEventContent{}
+		err := cli.StateEvent(roomID, event.StateCreate, "", create)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get create event of %s: %w", roomID, err)
+		}
+		if upgradeStore != nil {
+			upgradeStore.SetCreateEvent(roomID, create)
+		}
+	}
+	if create.Predecessor == nil || create.Predecessor.RoomID == "" {
+		return nil, nil
+	}
+	return create.Predecessor, nil
+}
+
+// GetRoomSuccessor returns the room that replaced the given room, based on the m.room.tombstone event.
+// If the room hasn't been upgraded, an empty room ID is returned. To follow a chain of upgrades, use FollowTombstones.
+//
+// If the StateStore implements RoomUpgradeStateStore, the cached tombstone is used if there is one,
+// and a fetched tombstone is stored there.
+func (cli *Client) GetRoomSuccessor(roomID id.RoomID) (id.RoomID, error) {
+	upgradeStore, _ := cli.StateStore.(RoomUpgradeStateStore)
+	if upgradeStore != nil {
+		if tombstone := upgradeStore.GetTombstone(roomID); tombstone != nil {
+			return tombstone.ReplacementRoom, nil
+		}
+	}
+	var tombstone event.TombstoneEventContent
+	err := cli.StateEvent(roomID, event.StateTombstone, "", &tombstone)
+	if errors.Is(err, MNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get tombstone of %s: %w", roomID, err)
+	}
+	if upgradeStore != nil {
+		upgradeStore.SetTombstone(roomID, &tombstone)
+	}
+	return tombstone.ReplacementRoom, nil
+}
+
 // LeaveRoom leaves the given room. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidleave
 func (cli *Client) LeaveRoom(roomID id.RoomID, optionalReq ...*ReqLeave) (resp *RespLeaveRoom, err error) {
 	req := &ReqLeave{}
@@ -1109,18 +2135,143 @@ func (cli *Client) GetOwnPresence() (resp *RespPresence, err error) {
 	return cli.GetPresence(cli.UserID)
 }
 
+// SetPresence sets the user's presence without changing the status message.
+// See https://spec.matrix.org/v1.4/client-server-api/#put_matrixclientv3presenceuseridstatus
+//
+// Presence updates of other users are received through sync as EventSourcePresence events (event.EphemeralEventPresence).
 func (cli *Client) SetPresence(status event.Presence) (err error) {
-	req := ReqPresence{Presence: status}
+	return cli.SetPresenceWithStatus(&ReqPresence{Presence: status})
+}
+
+// SetPresenceWithStatus sets the user's presence and optionally the status message.
+// See https://spec.matrix.org/v1.4/client-server-api/#put_matrixclientv3presenceuseridstatus
+func (cli *Client) SetPresenceWithStatus(req *ReqPresence) (err error) {
 	u := cli.BuildClientURL("v3", "presence", cli.UserID, "status")
 	_, err = cli.MakeRequest("PUT", u, req, nil)
 	return
 }
 
+// ErrEncryptionAlgorithmChange is returned by EnableEncryption if the room is already encrypted with a different algorithm.
+var ErrEncryptionAlgorithmChange = errors.New("room is already encrypted with a different algorithm")
+
+// EnableEncryption sends a m.room.encryption state event to the given room.
+// See https://spec.matrix.org/v1.2/client-server-api/#mroomencryption
+//
+// If opts is nil or doesn't specify an algorithm, m.megolm.v1.aes-sha2 is used. Encryption can't be disabled or
+// changed to another algorithm once enabled, so ErrEncryptionAlgorithmChange is returned if the room is already
+// encrypted with a different algorithm.
+//
+// After the event is sent, it's also saved in the client's StateStore (if set), so that OlmMachine.EncryptMegolmEvent
+// can encrypt events for the room right away instead of waiting for the event to come down sync.
+func (cli *Client) EnableEncryption(roomID id.RoomID, opts *event.EncryptionEventContent) (resp *RespSendEvent, err error) {
+	content := event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}
+	if opts != nil {
+		content = *opts
+		if len(content.Algorithm) == 0 {
+			content.Algorithm = id.AlgorithmMegolmV1
+		}
+	}
+	var existing event.EncryptionEventContent
+	err = cli.StateEvent(roomID, event.StateEncryption, "", &existing)
+	if err != nil && !errors.Is(err, MNotFound) {
+		return nil, fmt.Errorf("failed to get existing encryption state: %w", err)
+	} else if len(existing.Algorithm) > 0 && existing.Algorithm != content.Algorithm {
+		return nil, fmt.Errorf("%w (%s)", ErrEncryptionAlgorithmChange, existing.Algorithm)
+	}
+	resp, err = cli.SendStateEvent(roomID, event.StateEncryption, "", &content)
+	if err == nil && cli.StateStore != nil {
+		cli.StateStore.SetEncryptionEvent(roomID, &content)
+	}
+	return
+}
+
+// IsEncrypted checks whether the m.room.encryption state event of the given room is cached.
+//
+// If the client has a StateStore, it's used. Otherwise, this only works if room state is being stored in the Store,
+// e.g. by passing InMemoryStore.UpdateState to DefaultSyncer.OnEvent.
+func (cli *Client) IsEncrypted(roomID id.RoomID) bool {
+	if cli.StateStore != nil {
+		return cli.StateStore.IsEncrypted(roomID)
+	}
+	room := cli.Store.LoadRoom(roomID)
+	return room != nil && room.GetStateEvent(event.StateEncryption, "") != nil
+}
+
+// GetPinnedEvents gets the IDs of the pinned events in the given room.
+// If the room doesn't have a m.room.pinned_events state event, an empty list is returned.
+func (cli *Client) GetPinnedEvents(roomID id.RoomID) ([]id.EventID, error) {
+	var content event.PinnedEventsEventContent
+	err := cli.StateEvent(roomID, event.StatePinnedEvents, "", &content)
+	if err != nil && !errors.Is(err, MNotFound) {
+		return nil, err
+	}
+	return content.Pinned, nil
+}
+
+// PinEvent adds the given event to the pinned events of the room, keeping the existing pins.
+// Duplicate pins are removed when the state event is written. If the event is already pinned
+// and there are no duplicates, the state event isn't changed.
+func (cli *Client) PinEvent(roomID id.RoomID, eventID id.EventID) error {
+	pinned, err := cli.GetPinnedEvents(roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get pinned events: %w", err)
+	}
+	newPinned, found := dedupPinnedEvents(pinned, eventID, false)
+	if !found {
+		newPinned = append(newPinned, eventID)
+	} else if len(newPinned) == len(pinned) {
+		return nil
+	}
+	_, err = cli.SendStateEvent(roomID, event.StatePinnedEvents, "", &event.PinnedEventsEventContent{
+		Pinned: newPinned,
+	})
+	return err
+}
+
+// UnpinEvent removes the given event from the pinned events of the room.
+// Duplicate pins are removed when the state event is written. If the event isn't pinned
+// and there are no duplicates, the state event isn't changed.
+func (cli *Client) UnpinEvent(roomID id.RoomID, eventID id.EventID) error {
+	pinned, err := cli.GetPinnedEvents(roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get pinned events: %w", err)
+	}
+	newPinned, _ := dedupPinnedEvents(pinned, eventID, true)
+	if len(newPinned) == len(pinned) {
+		return nil
+	}
+	_, err = cli.SendStateEvent(roomID, event.StatePinnedEvents, "", &event.PinnedEventsEventContent{
+		Pinned: newPinned,
+	})
+	return err
+}
+
+// dedupPinnedEvents removes duplicates from the list of pinned events while keeping the order,
+// optionally removes the given event, and reports whether the given event was in the list.
+func dedupPinnedEvents(pinned []id.EventID, eventID id.EventID, remove bool) (newPinned []id.EventID, found bool) {
+	newPinned = make([]id.EventID, 0, len(pinned)+1)
+	seen := make(map[id.EventID]struct{}, len(pinned))
+	for _, existing := range pinned {
+		if _, isDuplicate := seen[existing]; isDuplicate {
+			continue
+		}
+		seen[existing] = struct{}{}
+		if existing == eventID {
+			found = true
+			if remove {
+				continue
+			}
+		}
+		newPinned = append(newPinned, existing)
+	}
+	return
+}
+
 // StateEvent gets a single state event in a room. It will attempt to JSON unmarshal into the given "outContent" struct with
 // the HTTP response body, or return an error.
 // See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3roomsroomidstateeventtypestatekey
 func (cli *Client) StateEvent(roomID id.RoomID, eventType event.Type, stateKey string, outContent interface{}) (err error) {
-	u := cli.BuildClientURL("v3", "rooms", roomID, "state", eventType.String(), stateKey)
+	u := cli.BuildURL(stateEventURLPath(roomID, eventType, stateKey))
 	_, err = cli.MakeRequest("GET", u, nil, outContent)
 	return
 }
@@ -1192,21 +2343,214 @@ func (cli *Client) GetDownloadURL(mxcURL id.ContentURI) string {
 }
 
 func (cli *Client) Download(mxcURL id.ContentURI) (io.ReadCloser, error) {
-	return cli.DownloadContext(context.Background(), mxcURL)
+	return cli.DownloadContext(cli.context(), mxcURL)
 }
 
+// DownloadContext downloads the given content URI and returns the response body.
+//
+// If the media was created with an asynchronous upload and the content isn't available yet,
+// the returned error will match MNotYetUploaded with errors.Is.
 func (cli *Client) DownloadContext(ctx context.Context, mxcURL id.ContentURI) (io.ReadCloser, error) {
-	if req, err := http.NewRequestWithContext(ctx, http.MethodGet, cli.GetDownloadURL(mxcURL), nil); err != nil {
+	resp, err := cli.DownloadMedia(ctx, mxcURL)
+	if err != nil {
 		return nil, err
-	} else if resp, err := cli.Client.Do(req); err != nil {
+	}
+	return resp.Body, nil
+}
+
+// shouldUseAuthenticatedMedia checks whether the authenticated media endpoints should be used,
+// either based on the UseAuthenticatedMedia override or the versions supported by the server.
+// The versions are fetched with GetCachedVersions if they haven't been fetched yet.
+func (cli *Client) shouldUseAuthenticatedMedia() bool {
+	if cli.UseAuthenticatedMedia != nil {
+		return *cli.UseAuthenticatedMedia
+	}
+	// If fetching the versions fails, assume the server doesn't support authenticated media.
+	// The legacy endpoint falls back to the authenticated one anyway if the server doesn't recognize it.
+	versions, fetched, err := cli.getCachedVersions()
+	if err != nil {
+		if fetched {
+			cli.logWarning("Failed to fetch server versions to check for authenticated media support: %v", err)
+		}
+		return false
+	}
+	return versions.SupportsAuthenticatedMedia()
+}
+
+// isUnrecognizedMediaEndpoint checks whether the error means that the server doesn't have the requested
+// media endpoint, i.e. a 401 or 404 response with the M_UNRECOGNIZED error code.
+func isUnrecognizedMediaEndpoint(err error) bool {
+	var httpErr HTTPError
+	return errors.As(err, &httpErr) && errors.Is(err, MUnrecognized) &&
+		(httpErr.IsStatus(http.StatusUnauthorized) || httpErr.IsStatus(http.StatusNotFound))
+}
+
+// maxMediaRedirects is the maximum number of redirects doMediaRequest follows manually.
+const maxMediaRedirects = 5
+
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+// doMediaRequest sends a GET request for media with the usual request headers (including authentication)
+// and converts non-2xx responses into errors.
+//
+// Some deployments redirect media downloads to a CDN. Those are normally followed by the HTTP client, but if the
+// client is configured to not follow redirects, they're followed here. The access token and other headers set by
+// the client are not sent to the redirect target, only the headers given to this function are.
+func (cli *Client) doMediaRequest(ctx context.Context, reqURL string, headers http.Header, notFoundMessage string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
 		return nil, err
-	} else {
-		return resp.Body, nil
 	}
+	for key, values := range headers {
+		req.Header[key] = values
+	}
+	cli.setRequestHeaders(req)
+	resp, err := cli.Client.Do(req)
+	for redirects := 0; err == nil && isRedirect(resp.StatusCode) && resp.Header.Get("Location") != ""; redirects++ {
+		_ = resp.Body.Close()
+		var location *url.URL
+		if redirects >= maxMediaRedirects {
+			return nil, fmt.Errorf("stopped after %d redirects", maxMediaRedirects)
+		} else if location, err = req.URL.Parse(resp.Header.Get("Location")); err != nil {
+			return nil, fmt.Errorf("failed to parse redirect location: %w", err)
+		} else if req, err = http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil); err != nil {
+			return nil, err
+		}
+		for key, values := range headers {
+			req.Header[key] = values
+		}
+		req.Header.Set("User-Agent", cli.UserAgent)
+		resp, err = cli.Client.Do(req)
+	}
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		_, err = cli.handleResponseError(req, resp)
+		return nil, normalizeNotYetUploadedError(normalizeNotFoundError(err, notFoundMessage))
+	}
+	return resp, nil
+}
+
+// doAuthenticatedMediaRequest requests media from the authenticated or legacy endpoint depending on
+// shouldUseAuthenticatedMedia. Unless the endpoint was chosen explicitly, the other endpoint is used as
+// a fallback if the server responds with M_UNRECOGNIZED, e.g. when the advertised versions are wrong
+// or when the server has disabled the legacy endpoints.
+func (cli *Client) doAuthenticatedMediaRequest(ctx context.Context, authPath, legacyPath PrefixableURLPath, forceAuth bool, query map[string]string, headers http.Header, notFoundMessage string) (*http.Response, error) {
+	explicit := forceAuth || cli.UseAuthenticatedMedia != nil
+	if forceAuth || cli.shouldUseAuthenticatedMedia() {
+		resp, err := cli.doMediaRequest(ctx, cli.BuildURLWithQuery(authPath, query), headers, notFoundMessage)
+		if explicit || !isUnrecognizedMediaEndpoint(err) {
+			return resp, err
+		}
+		cli.logWarning("Server advertised authenticated media support, but didn't recognize the endpoint, falling back to legacy media endpoints")
+		return cli.doMediaRequest(ctx, cli.BuildURLWithQuery(legacyPath, query), headers, notFoundMessage)
+	}
+	resp, err := cli.doMediaRequest(ctx, cli.BuildURLWithQuery(legacyPath, query), headers, notFoundMessage)
+	if explicit || !isUnrecognizedMediaEndpoint(err) {
+		return resp, err
+	}
+	cli.logWarning("Server didn't recognize legacy media endpoint, falling back to authenticated media endpoints")
+	return cli.doMediaRequest(ctx, cli.BuildURLWithQuery(authPath, query), headers, notFoundMessage)
+}
+
+// DownloadMedia downloads the given content URI and returns a stream of the content along with its metadata.
+// The body is not buffered, so large files can be streamed elsewhere without holding them in memory.
+//
+// The optional request can be used to download a byte range of the file and to control whether the server
+// should fetch remote media. The authenticated media endpoints (MSC3916) are used if the server advertises
+// support for them in its versions (fetched with GetCachedVersions if necessary), unless overridden with
+// Client.UseAuthenticatedMedia or ReqDownloadMedia.Authenticated. The access token is sent to both the
+// authenticated and the legacy endpoints, but not to CDNs that the server redirects to.
+//
+// If the media was created with an asynchronous upload and the content isn't available yet,
+// the returned error will match MNotYetUploaded with errors.Is.
+func (cli *Client) DownloadMedia(ctx context.Context, mxcURL id.ContentURI, optionalReq ...*ReqDownloadMedia) (*RespDownloadMedia, error) {
+	if err := mxcURL.Validate(); err != nil {
+		return nil, err
+	}
+	var req ReqDownloadMedia
+	if len(optionalReq) > 0 && optionalReq[0] != nil {
+		req = *optionalReq[0]
+	}
+	query := map[string]string{"allow_redirect": "true"}
+	if req.AllowRemote != nil {
+		query["allow_remote"] = strconv.FormatBool(*req.AllowRemote)
+	}
+	var headers http.Header
+	if req.Offset > 0 || req.Length > 0 {
+		rangeHeader := fmt.Sprintf("bytes=%d-", req.Offset)
+		if req.Length > 0 {
+			rangeHeader += strconv.FormatInt(req.Offset+req.Length-1, 10)
+		}
+		headers = http.Header{"Range": {rangeHeader}}
+	}
+	resp, err := cli.doAuthenticatedMediaRequest(
+		ctx,
+		ClientURLPath{"v1", "media", "download", mxcURL.Homeserver, mxcURL.FileID},
+		MediaURLPath{"v3", "download", mxcURL.Homeserver, mxcURL.FileID},
+		req.Authenticated, query, headers, "Media not found",
+	)
+	if err != nil {
+		return nil, err
+	}
+	output := &RespDownloadMedia{
+		Body:          resp.Body,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: resp.ContentLength,
+		Partial:       resp.StatusCode == http.StatusPartialContent,
+		TotalSize:     -1,
+	}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		output.FileName = params["filename"]
+	}
+	if output.Partial {
+		contentRange := resp.Header.Get("Content-Range")
+		if slash := strings.LastIndexByte(contentRange, '/'); slash != -1 {
+			if total, err := strconv.ParseInt(contentRange[slash+1:], 10, 64); err == nil {
+				output.TotalSize = total
+			}
+		}
+	} else if resp.ContentLength >= 0 {
+		output.TotalSize = resp.ContentLength
+	}
+	return output, nil
+}
+
+// normalizeNotFoundError makes HTTP 404 errors without a Matrix error code (e.g. from reverse proxies) match MNotFound.
+func normalizeNotFoundError(err error, message string) error {
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) && httpErr.IsStatus(http.StatusNotFound) && httpErr.RespError == nil {
+		httpErr.RespError = &RespError{ErrCode: MNotFound.ErrCode, Err: message}
+		return httpErr
+	}
+	return err
+}
+
+// normalizeNotYetUploadedError makes errors about media that hasn't been uploaded yet match MNotYetUploaded,
+// including the unstable MSC2246 error code and gateway timeouts without an error code.
+func normalizeNotYetUploadedError(err error) error {
+	httpErr, ok := err.(HTTPError)
+	if !ok {
+		return err
+	}
+	if httpErr.RespError != nil && httpErr.RespError.ErrCode == unstableNotYetUploadedErrCode {
+		httpErr.RespError.ErrCode = MNotYetUploaded.ErrCode
+	} else if httpErr.RespError == nil && httpErr.IsStatus(http.StatusGatewayTimeout) {
+		httpErr.RespError = &RespError{ErrCode: MNotYetUploaded.ErrCode, Err: "Media not yet uploaded"}
+	}
+	return httpErr
 }
 
 func (cli *Client) DownloadBytes(mxcURL id.ContentURI) ([]byte, error) {
-	return cli.DownloadBytesContext(context.Background(), mxcURL)
+	return cli.DownloadBytesContext(cli.context(), mxcURL)
 }
 
 func (cli *Client) DownloadBytesContext(ctx context.Context, mxcURL id.ContentURI) ([]byte, error) {
@@ -1218,6 +2562,64 @@ func (cli *Client) DownloadBytesContext(ctx context.Context, mxcURL id.ContentUR
 	return io.ReadAll(resp)
 }
 
+// GetThumbnailURL returns the URL for a server-generated thumbnail of the given content URI.
+// See https://spec.matrix.org/v1.4/client-server-api/#get_matrixmediav3thumbnailservernamemediaid
+func (cli *Client) GetThumbnailURL(mxcURL id.ContentURI, width, height int, method ThumbnailMethod, optionalReq ...*ReqThumbnail) string {
+	return cli.BuildURLWithQuery(MediaURLPath{"v3", "thumbnail", mxcURL.Homeserver, mxcURL.FileID}, thumbnailQuery(width, height, method, optionalReq...))
+}
+
+func thumbnailQuery(width, height int, method ThumbnailMethod, optionalReq ...*ReqThumbnail) map[string]string {
+	query := map[string]string{
+		"width":  strconv.Itoa(width),
+		"height": strconv.Itoa(height),
+	}
+	if method != "" {
+		query["method"] = string(method)
+	}
+	if len(optionalReq) > 0 && optionalReq[0] != nil {
+		req := optionalReq[0]
+		if req.AllowRemote != nil {
+			query["allow_remote"] = strconv.FormatBool(*req.AllowRemote)
+		}
+		if req.Animated {
+			query["animated"] = "true"
+		}
+	}
+	return query
+}
+
+// DownloadThumbnail downloads a server-generated thumbnail of the given content URI.
+// It returns the thumbnail data and its content type.
+func (cli *Client) DownloadThumbnail(mxcURL id.ContentURI, width, height int, method ThumbnailMethod, optionalReq ...*ReqThumbnail) ([]byte, string, error) {
+	return cli.DownloadThumbnailContext(cli.context(), mxcURL, width, height, method, optionalReq...)
+}
+
+// DownloadThumbnailContext downloads a server-generated thumbnail like DownloadThumbnail.
+//
+// If the server can't produce a thumbnail (e.g. because the media isn't an image), the returned error will match
+// MNotFound with errors.Is, even if the server didn't include an error code. In that case, the caller can fall back
+// to downloading the full media.
+func (cli *Client) DownloadThumbnailContext(ctx context.Context, mxcURL id.ContentURI, width, height int, method ThumbnailMethod, optionalReq ...*ReqThumbnail) ([]byte, string, error) {
+	if err := mxcURL.Validate(); err != nil {
+		return nil, "", err
+	}
+	resp, err := cli.doAuthenticatedMediaRequest(
+		ctx,
+		ClientURLPath{"v1", "media", "thumbnail", mxcURL.Homeserver, mxcURL.FileID},
+		MediaURLPath{"v3", "thumbnail", mxcURL.Homeserver, mxcURL.FileID},
+		false, thumbnailQuery(width, height, method, optionalReq...), nil, "Thumbnail not found",
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
 // UnstableCreateMXC creates a blank Matrix content URI to allow uploading the content asynchronously later.
 // See https://github.com/matrix-org/matrix-spec-proposals/pull/2246
 func (cli *Client) UnstableCreateMXC() (*RespCreateMXC, error) {
@@ -1272,6 +2674,10 @@ func (cli *Client) Upload(content io.Reader, contentType string, contentLength i
 	})
 }
 
+// ErrMediaTooLarge is returned by UploadMedia if ReqUploadMedia.CheckSize is set and the content is larger than
+// the upload size limit advertised by the server.
+var ErrMediaTooLarge = errors.New("media is larger than the server's upload size limit")
+
 type ReqUploadMedia struct {
 	ContentBytes  []byte
 	Content       io.Reader
@@ -1286,6 +2692,16 @@ type ReqUploadMedia struct {
 	// UploadURL specifies the URL to upload the content to (MSC3870)
 	// see https://github.com/matrix-org/matrix-spec-proposals/pull/3870 for more info
 	UploadURL string
+
+	// Context can be used to abort the upload mid-stream.
+	Context context.Context
+	// Progress is called periodically with the number of bytes sent so far. The total is -1 if ContentLength isn't set.
+	Progress func(bytesSent, total int64)
+
+	// If true, the size of the content is checked against the upload size limit from GetCachedMediaConfig
+	// before uploading. The check is skipped if the size or the limit isn't known, including when fetching
+	// the media config fails.
+	CheckSize bool
 }
 
 func (cli *Client) uploadMediaToURL(data ReqUploadMedia) (*RespMediaUpload, error) {
@@ -1299,13 +2715,21 @@ func (cli *Client) uploadMediaToURL(data ReqUploadMedia) (*RespMediaUpload, erro
 			data.Content = bytes.NewReader(data.ContentBytes)
 		}
 		cli.Logger.Debugfln("Uploading media to external URL %s", data.UploadURL)
-		req, err := http.NewRequest(http.MethodPut, data.UploadURL, data.Content)
+		ctx := data.Context
+		if ctx == nil {
+			ctx = cli.context()
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, data.UploadURL, data.Content)
 		if err != nil {
 			return nil, err
 		}
 		// Tell the next retry to create a new reader from ContentBytes
 		data.Content = nil
 		req.Header.Set("Content-Type", data.ContentType)
+		if data.ContentBytes == nil && data.ContentLength > 0 {
+			req.ContentLength = data.ContentLength
+		}
+		wrapUploadProgress(req, data.Progress)
 
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
@@ -1330,7 +2754,8 @@ func (cli *Client) uploadMediaToURL(data ReqUploadMedia) (*RespMediaUpload, erro
 	_, err := cli.MakeFullRequest(FullRequest{
 		Method:       http.MethodPost,
 		URL:          notifyURL,
-		ResponseJSON: m,
+		ResponseJSON: &m,
+		Context:      data.Context,
 	})
 	if err != nil {
 		return nil, err
@@ -1342,6 +2767,11 @@ func (cli *Client) uploadMediaToURL(data ReqUploadMedia) (*RespMediaUpload, erro
 // UploadMedia uploads the given data to the content repository and returns an MXC URI.
 // See https://spec.matrix.org/v1.2/client-server-api/#post_matrixmediav3upload
 func (cli *Client) UploadMedia(data ReqUploadMedia) (*RespMediaUpload, error) {
+	if data.CheckSize {
+		if err := cli.checkUploadSize(data); err != nil {
+			return nil, err
+		}
+	}
 	if data.UploadURL != "" {
 		return cli.uploadMediaToURL(data)
 	}
@@ -1371,10 +2801,54 @@ func (cli *Client) UploadMedia(data ReqUploadMedia) (*RespMediaUpload, error) {
 		RequestBody:   data.Content,
 		RequestLength: data.ContentLength,
 		ResponseJSON:  &m,
+		Context:       data.Context,
+
+		UploadProgress: data.Progress,
 	})
 	return &m, err
 }
 
+func (cli *Client) checkUploadSize(data ReqUploadMedia) error {
+	size := data.ContentLength
+	if data.ContentBytes != nil {
+		size = int64(len(data.ContentBytes))
+	}
+	if size <= 0 {
+		return nil
+	}
+	config, err := cli.GetCachedMediaConfig()
+	if err != nil {
+		// The limit is unknown, so let the server decide whether the upload is too large.
+		cli.logWarning("Failed to get media config to check upload size: %v", err)
+		return nil
+	} else if config.UploadSize > 0 && size > config.UploadSize {
+		return fmt.Errorf("%w (%d > %d bytes)", ErrMediaTooLarge, size, config.UploadSize)
+	}
+	return nil
+}
+
+// GetMediaConfig fetches the configuration of the media repository, such as the maximum upload size.
+// See https://spec.matrix.org/v1.4/client-server-api/#get_matrixmediav3config
+//
+// The response is stored in Client.MediaConfig, so that GetCachedMediaConfig doesn't need to make a request again.
+func (cli *Client) GetMediaConfig() (resp *RespMediaConfig, err error) {
+	u := cli.BuildURL(MediaURLPath{"v3", "config"})
+	_, err = cli.MakeRequest(http.MethodGet, u, nil, &resp)
+	if err == nil {
+		cli.root().MediaConfig = resp
+	}
+	return
+}
+
+// GetCachedMediaConfig returns the media repository config, only fetching it with GetMediaConfig if it hasn't
+// been fetched before. Call GetMediaConfig directly to force a refresh.
+func (cli *Client) GetCachedMediaConfig() (*RespMediaConfig, error) {
+	if config := cli.root().MediaConfig; config != nil {
+		return config, nil
+	}
+	return cli.GetMediaConfig()
+}
+
 // GetURLPreview asks the homeserver to fetch a preview for a given URL.
 //
 // See https://spec.matrix.org/v1.2/client-server-api/#get_matrixmediav3preview_url
@@ -1391,6 +2865,9 @@ func (cli *Client) GetURLPreview(url string) (*RespPreviewURL, error) {
 //
 // In general, usage of this API is discouraged in favour of /sync, as calling this API can race with incoming membership changes.
 // This API is primarily designed for application services which may want to efficiently look up joined members in a room.
+//
+// The whole member list is returned in a single response, which can be several megabytes in rooms with tens of
+// thousands of members.
 func (cli *Client) JoinedMembers(roomID id.RoomID) (resp *RespJoinedMembers, err error) {
 	u := cli.BuildClientURL("v3", "rooms", roomID, "joined_members")
 	_, err = cli.MakeRequest("GET", u, nil, &resp)
@@ -1421,6 +2898,7 @@ func (cli *Client) Members(roomID id.RoomID, req ...ReqMembers) (resp *RespMembe
 //
 // In general, usage of this API is discouraged in favour of /sync, as calling this API can race with incoming membership changes.
 // This API is primarily designed for application services which may want to efficiently look up joined rooms.
+// Unlike sync, it's cheap to call, so it can be used for getting the list of rooms on startup.
 func (cli *Client) JoinedRooms() (resp *RespJoinedRooms, err error) {
 	u := cli.BuildClientURL("v3", "joined_rooms")
 	_, err = cli.MakeRequest("GET", u, nil, &resp)
@@ -1429,6 +2907,9 @@ func (cli *Client) JoinedRooms() (resp *RespJoinedRooms, err error) {
 
 // Messages returns a list of message and state events for a room. It uses
 // pagination query parameters to paginate history in the room.
+//
+// If the filter has LazyLoadMembers set, the State field of the response will contain the member events of
+// the senders of the returned events. They can be stored in a state store with RespMessages.UpdateStateStore.
 // See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3roomsroomidmessages
 func (cli *Client) Messages(roomID id.RoomID, from, to string, dir rune, filter *FilterPart, limit int) (resp *RespMessages, err error) {
 	query := map[string]string{
@@ -1456,7 +2937,10 @@ func (cli *Client) Messages(roomID id.RoomID, from, to string, dir rune, filter
 
 // Context returns a number of events that happened just before and after the
 // specified event. It use pagination query parameters to paginate history in
-// the room.
+// the room. The content of the target event is parsed automatically.
+//
+// Set LazyLoadMembers in the filter to only get the member events of the senders in the returned events,
+// which can then be stored with RespContext.UpdateStateStore.
 // See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3roomsroomidcontexteventid
 func (cli *Client) Context(roomID id.RoomID, eventID id.EventID, filter *FilterPart, limit int) (resp *RespContext, err error) {
 	query := map[string]string{}
@@ -1473,17 +2957,173 @@ func (cli *Client) Context(roomID id.RoomID, eventID id.EventID, filter *FilterP
 
 	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "rooms", roomID, "context", eventID}, query)
 	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	if err == nil && resp != nil && resp.Event != nil {
+		err = parseFetchedEvent(resp.Event)
+	}
 	return
 }
 
+// Search searches for events on the server. The content of the result events, the context events around them
+// and the room state events is parsed automatically.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3search
+func (cli *Client) Search(req *ReqSearch) (resp *RespSearch, err error) {
+	query := map[string]string{}
+	if req.NextBatch != "" {
+		query["next_batch"] = req.NextBatch
+	}
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "search"}, query)
+	_, err = cli.MakeRequest("POST", urlPath, req, &resp)
+	if err == nil && resp != nil {
+		roomEvents := &resp.SearchCategories.RoomEvents
+		for _, result := range roomEvents.Results {
+			parseFetchedEvents(result.Result)
+			if result.Context != nil {
+				parseFetchedEvents(result.Context.EventsBefore...)
+				parseFetchedEvents(result.Context.EventsAfter...)
+			}
+		}
+		for _, state := range roomEvents.State {
+			parseFetchedEvents(state...)
+		}
+	}
+	return
+}
+
+// parseFetchedEvents parses the content of the given events, ignoring nil events and parsing errors.
+func parseFetchedEvents(evts ...*event.Event) {
+	for _, evt := range evts {
+		if evt != nil {
+			_ = parseFetchedEvent(evt)
+		}
+	}
+}
+
+// GetRelations returns the events that relate to the given event, optionally filtered by relation type and event type.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+func (cli *Client) GetRelations(roomID id.RoomID, eventID id.EventID, req *ReqGetRelations) (resp *RespGetRelations, err error) {
+	if req == nil {
+		req = &ReqGetRelations{}
+	}
+	urlPath := append(ClientURLPath{"v1", "rooms", roomID, "relations", eventID}, req.PathSuffix()...)
+	_, err = cli.MakeRequest("GET", cli.BuildURLWithQuery(urlPath, req.Query()), nil, &resp)
+	return
+}
+
+// GetEvent fetches a single event from a room. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3roomsroomideventeventid
+//
+// The event content is parsed automatically if the event type is known. If the event doesn't exist or the user isn't
+// allowed to see it, the returned error will match MNotFound with errors.Is, even if the server didn't include an error code.
 func (cli *Client) GetEvent(roomID id.RoomID, eventID id.EventID) (resp *event.Event, err error) {
 	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "event", eventID)
 	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	err = normalizeNotFoundError(err, "Event not found")
+	if err == nil && resp != nil {
+		err = parseFetchedEvent(resp)
+	}
 	return
 }
 
+// Hierarchy gets a single page of the space hierarchy of the given room.
+// See https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv1roomsroomidhierarchy
+//
+// The server walks the tree in depth-first order, limited by max_depth, and skips rooms that it has already
+// returned on the page, so cycles in the space graph don't cause infinite responses.
+// To get the whole hierarchy, use GetSpaceChildren.
+func (cli *Client) Hierarchy(roomID id.RoomID, req *ReqHierarchy) (resp *RespHierarchy, err error) {
+	if req == nil {
+		req = &ReqHierarchy{}
+	}
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v1", "rooms", roomID, "hierarchy"}, req.Query())
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	if err == nil && resp != nil {
+		for _, room := range resp.Rooms {
+			for _, evt := range room.ChildrenState {
+				if evt.StateKey == nil {
+					// Stripped state events always have a state key, but it may be omitted if it's empty
+					evt.StateKey = new(string)
+				}
+				evt.RoomID = room.RoomID
+				_ = parseFetchedEvent(evt)
+			}
+		}
+	}
+	return
+}
+
+// ErrHierarchyPaginationLoop is returned by GetSpaceChildren if the server returns the same pagination token twice.
+var ErrHierarchyPaginationLoop = errors.New("space hierarchy pagination loops")
+
+// GetSpaceChildren gets the whole space hierarchy of the given room by following the pagination tokens of Hierarchy.
+//
+// The result is a flattened list in the order returned by the server, starting with the requested room itself.
+// Rooms that appear in the hierarchy multiple times (e.g. because of cycles) are only included once.
+// The From field of the request is used as the initial pagination token.
+func (cli *Client) GetSpaceChildren(roomID id.RoomID, req *ReqHierarchy) ([]*HierarchyRoom, error) {
+	pageReq := ReqHierarchy{}
+	if req != nil {
+		pageReq = *req
+	}
+	var rooms []*HierarchyRoom
+	seenRooms := make(map[id.RoomID]struct{})
+	seenTokens := make(map[string]struct{})
+	for {
+		resp, err := cli.Hierarchy(roomID, &pageReq)
+		if err != nil {
+			return rooms, err
+		}
+		for _, room := range resp.Rooms {
+			if _, seen := seenRooms[room.RoomID]; !seen {
+				seenRooms[room.RoomID] = struct{}{}
+				rooms = append(rooms, room)
+			}
+		}
+		if resp.NextBatch == "" {
+			return rooms, nil
+		} else if _, seen := seenTokens[resp.NextBatch]; seen {
+			return rooms, fmt.Errorf("%w: got token %s twice", ErrHierarchyPaginationLoop, resp.NextBatch)
+		}
+		seenTokens[resp.NextBatch] = struct{}{}
+		pageReq.From = resp.NextBatch
+	}
+}
+
+// parseFetchedEvent sets the event type class and parses the content of an event fetched from a room.
+// Unknown event types are not considered errors.
+func parseFetchedEvent(evt *event.Event) error {
+	if evt.StateKey != nil {
+		evt.Type.Class = event.StateEventType
+	} else {
+		evt.Type.Class = event.MessageEventType
+	}
+	err := evt.Content.ParseRaw(evt.Type)
+	if errors.Is(err, event.ErrUnsupportedContentType) || errors.Is(err, event.ErrContentAlreadyParsed) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to parse content of %s: %w", evt.ID, err)
+	}
+	return nil
+}
+
+// MarkRead sends a public read receipt for the given event.
 func (cli *Client) MarkRead(roomID id.RoomID, eventID id.EventID) (err error) {
-	return cli.MarkReadWithContent(roomID, eventID, struct{}{})
+	return cli.SendReceipt(roomID, eventID, event.ReceiptTypeRead)
+}
+
+// SendReceipt sends a receipt of the given type, e.g. event.ReceiptTypeReadPrivate to mark an event as read
+// without showing it to other users.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3roomsroomidreceiptreceipttypeeventid
+//
+// The optional request can be used to send a threaded receipt.
+func (cli *Client) SendReceipt(roomID id.RoomID, eventID id.EventID, receiptType event.ReceiptType, optionalReq ...*ReqSendReceipt) (err error) {
+	req := &ReqSendReceipt{}
+	if len(optionalReq) == 1 {
+		req = optionalReq[0]
+	} else if len(optionalReq) > 1 {
+		panic("invalid number of arguments to SendReceipt")
+	}
+	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "receipt", receiptType, eventID)
+	_, err = cli.MakeRequest("POST", urlPath, req, nil)
+	return
 }
 
 // MarkReadWithContent sends a read receipt including custom data.
@@ -1494,12 +3134,20 @@ func (cli *Client) MarkReadWithContent(roomID id.RoomID, eventID id.EventID, con
 	return
 }
 
+// SetReadMarkers sets the fully read marker and optionally the public and private read receipts at once.
+// The content should usually be a *ReqSetReadMarkers.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3roomsroomidread_markers
 func (cli *Client) SetReadMarkers(roomID id.RoomID, content interface{}) (err error) {
 	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "read_markers")
 	_, err = cli.MakeRequest("POST", urlPath, &content, nil)
 	return
 }
 
+// AddTag adds a tag to a room, e.g. event.RoomTagFavourite. The order is optional: use math.NaN() to add the tag without an order.
+// See https://spec.matrix.org/v1.4/client-server-api/#put_matrixclientv3useruseridroomsroomidtagstag
+//
+// Tag changes are also received through sync as room account data (event.AccountDataRoomTags),
+// so DefaultSyncer.OnEventType can be used to keep a UI up to date.
 func (cli *Client) AddTag(roomID id.RoomID, tag string, order float64) error {
 	var tagData event.Tag
 	if order == order {
@@ -1508,12 +3156,15 @@ func (cli *Client) AddTag(roomID id.RoomID, tag string, order float64) error {
 	return cli.AddTagWithCustomData(roomID, tag, tagData)
 }
 
+// AddTagWithCustomData adds a tag to a room with arbitrary tag content instead of just the order.
 func (cli *Client) AddTagWithCustomData(roomID id.RoomID, tag string, data interface{}) (err error) {
 	urlPath := cli.BuildClientURL("v3", "user", cli.UserID, "rooms", roomID, "tags", tag)
 	_, err = cli.MakeRequest("PUT", urlPath, data, nil)
 	return
 }
 
+// GetTags gets the tags of a room.
+// See https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3useruseridroomsroomidtags
 func (cli *Client) GetTags(roomID id.RoomID) (tags event.TagEventContent, err error) {
 	err = cli.GetTagsWithCustomData(roomID, &tags)
 	return
@@ -1525,6 +3176,8 @@ func (cli *Client) GetTagsWithCustomData(roomID id.RoomID, resp interface{}) (er
 	return
 }
 
+// RemoveTag removes a tag from a room.
+// See https://spec.matrix.org/v1.4/client-server-api/#delete_matrixclientv3useruseridroomsroomidtagstag
 func (cli *Client) RemoveTag(roomID id.RoomID, tag string) (err error) {
 	urlPath := cli.BuildClientURL("v3", "user", cli.UserID, "rooms", roomID, "tags", tag)
 	_, err = cli.MakeRequest("DELETE", urlPath, nil, nil)
@@ -1546,30 +3199,208 @@ func (cli *Client) TurnServer() (resp *RespTurnServer, err error) {
 	return
 }
 
+// CreateAlias creates a new room alias pointing at the given room ID.
+// See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3directoryroomroomalias
 func (cli *Client) CreateAlias(alias id.RoomAlias, roomID id.RoomID) (resp *RespAliasCreate, err error) {
 	urlPath := cli.BuildClientURL("v3", "directory", "room", alias)
 	_, err = cli.MakeRequest("PUT", urlPath, &ReqAliasCreate{RoomID: roomID}, &resp)
 	return
 }
 
+// ResolveAlias resolves a room alias into a room ID and a list of servers that can be used to join the room.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3directoryroomroomalias
 func (cli *Client) ResolveAlias(alias id.RoomAlias) (resp *RespAliasResolve, err error) {
 	urlPath := cli.BuildClientURL("v3", "directory", "room", alias)
 	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
 	return
 }
 
+// DeleteAlias removes a room alias.
+// See https://spec.matrix.org/v1.2/client-server-api/#delete_matrixclientv3directoryroomroomalias
 func (cli *Client) DeleteAlias(alias id.RoomAlias) (resp *RespAliasDelete, err error) {
 	urlPath := cli.BuildClientURL("v3", "directory", "room", alias)
 	_, err = cli.MakeRequest("DELETE", urlPath, nil, &resp)
 	return
 }
 
+// GetCanonicalAlias gets the m.room.canonical_alias state event of a room.
+// If the room doesn't have a canonical alias, empty content is returned.
+func (cli *Client) GetCanonicalAlias(roomID id.RoomID) (*event.CanonicalAliasEventContent, error) {
+	var content event.CanonicalAliasEventContent
+	err := cli.StateEvent(roomID, event.StateCanonicalAlias, "", &content)
+	if errors.Is(err, MNotFound) {
+		return &content, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// ErrAliasPointsToOtherRoom is returned by SetCanonicalAlias if validation is enabled and an alias doesn't point at the room.
+var ErrAliasPointsToOtherRoom = errors.New("alias doesn't point at the room")
+
+// SetCanonicalAlias sends a m.room.canonical_alias state event. An empty alias removes the main canonical alias.
+//
+// Servers reject canonical aliases that don't point at the room. If validate is true, all the aliases are resolved
+// before sending the event, and ErrAliasPointsToOtherRoom is returned if any of them point at a different room.
+func (cli *Client) SetCanonicalAlias(roomID id.RoomID, alias id.RoomAlias, altAliases []id.RoomAlias, validate bool) (*RespSendEvent, error) {
+	if validate {
+		aliases := altAliases
+		if alias != "" {
+			aliases = append([]id.RoomAlias{alias}, altAliases...)
+		}
+		for _, aliasToCheck := range aliases {
+			resolved, err := cli.ResolveAlias(aliasToCheck)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve %s: %w", aliasToCheck, err)
+			} else if resolved.RoomID != roomID {
+				return nil, fmt.Errorf("%w: %s points at %s", ErrAliasPointsToOtherRoom, aliasToCheck, resolved.RoomID)
+			}
+		}
+	}
+	return cli.SendStateEvent(roomID, event.StateCanonicalAlias, "", &event.CanonicalAliasEventContent{
+		Alias:      alias,
+		AltAliases: altAliases,
+	})
+}
+
+// GetServerACL gets the m.room.server_acl state event of a room. If the room doesn't have an ACL, nil is returned.
+func (cli *Client) GetServerACL(roomID id.RoomID) (*event.ServerACLEventContent, error) {
+	var content event.ServerACLEventContent
+	err := cli.StateEvent(roomID, event.StateServerACL, "", &content)
+	if errors.Is(err, MNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// ErrServerACLBansOwnServer is returned by SetServerACL if the ACL would ban the client's own server.
+var ErrServerACLBansOwnServer = errors.New("server ACL would ban the client's own server")
+
+// SetServerACL sends a m.room.server_acl state event.
+//
+// An ACL that bans the client's own server can't be undone by the client, as the server will no longer accept
+// events in the room. Therefore, unless force is true, ErrServerACLBansOwnServer is returned instead of sending
+// such an ACL.
+func (cli *Client) SetServerACL(roomID id.RoomID, acl *event.ServerACLEventContent, force bool) (*RespSendEvent, error) {
+	if ownServer := cli.UserID.Homeserver(); !force && ownServer != "" && !acl.IsAllowed(ownServer) {
+		return nil, fmt.Errorf("%w (%s)", ErrServerACLBansOwnServer, ownServer)
+	}
+	return cli.SendStateEvent(roomID, event.StateServerACL, "", acl)
+}
+
+// PowerLevelChanges is a batch of changes to the m.room.power_levels event of a room. See Client.UpdatePowerLevels.
+type PowerLevelChanges struct {
+	// The new power levels of users. Users whose level is set to users_default are removed from the users map.
+	Users map[id.UserID]int
+	// The new power levels required to send specific event types.
+	Events map[event.Type]int
+}
+
+// UpdatePowerLevels applies the given changes to the m.room.power_levels event of a room in a single state event.
+//
+// The current power levels are always fetched from the server right before sending, rather than using the state
+// store, to minimize the risk of overwriting concurrent changes. The content is modified as raw JSON, so all other
+// keys (including ones unknown to event.PowerLevelsEventContent) are preserved. If the client has a StateStore,
+// the new power levels are stored there after sending.
+func (cli *Client) UpdatePowerLevels(roomID id.RoomID, changes *PowerLevelChanges) (*RespSendEvent, error) {
+	var content map[string]interface{}
+	err := cli.StateEvent(roomID, event.StatePowerLevels, "", &content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current power levels: %w", err)
+	} else if content == nil {
+		content = make(map[string]interface{})
+	}
+	if len(changes.Users) > 0 {
+		usersDefault, _ := content["users_default"].(float64)
+		users, _ := content["users"].(map[string]interface{})
+		if users == nil {
+			users = make(map[string]interface{})
+		}
+		for userID, level := range changes.Users {
+			if float64(level) == usersDefault {
+				delete(users, string(userID))
+			} else {
+				users[string(userID)] = level
+			}
+		}
+		content["users"] = users
+	}
+	if len(changes.Events) > 0 {
+		events, _ := content["events"].(map[string]interface{})
+		if events == nil {
+			events = make(map[string]interface{})
+		}
+		for eventType, level := range changes.Events {
+			events[eventType.Type] = level
+		}
+		content["events"] = events
+	}
+	resp, err := cli.SendStateEvent(roomID, event.StatePowerLevels, "", content)
+	if err == nil && cli.StateStore != nil {
+		var levels event.PowerLevelsEventContent
+		if raw, marshalErr := json.Marshal(content); marshalErr == nil && json.Unmarshal(raw, &levels) == nil {
+			cli.StateStore.SetPowerLevels(roomID, &levels)
+		}
+	}
+	return resp, err
+}
+
+// SetUserPowerLevel changes the power level of a single user. See UpdatePowerLevels for details.
+func (cli *Client) SetUserPowerLevel(roomID id.RoomID, userID id.UserID, level int) (*RespSendEvent, error) {
+	return cli.UpdatePowerLevels(roomID, &PowerLevelChanges{Users: map[id.UserID]int{userID: level}})
+}
+
+// SetEventPowerLevel changes the power level required to send a specific event type. See UpdatePowerLevels for details.
+func (cli *Client) SetEventPowerLevel(roomID id.RoomID, eventType event.Type, level int) (*RespSendEvent, error) {
+	return cli.UpdatePowerLevels(roomID, &PowerLevelChanges{Events: map[event.Type]int{eventType: level}})
+}
+
+// GetAliases gets the local aliases of a room.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3roomsroomidaliases
 func (cli *Client) GetAliases(roomID id.RoomID) (resp *RespAliasList, err error) {
 	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "aliases")
 	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
 	return
 }
 
+// PublicRooms lists rooms in the public room directory of the local server or the server specified in the request.
+//
+// If the request has a filter or third party network options, this uses
+// https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3publicrooms,
+// otherwise it uses https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3publicrooms
+func (cli *Client) PublicRooms(req *ReqPublicRooms) (resp *RespPublicRooms, err error) {
+	if req == nil {
+		req = &ReqPublicRooms{}
+	}
+	post := req.needsPost()
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "publicRooms"}, req.Query(post))
+	if post {
+		_, err = cli.MakeRequest("POST", urlPath, req, &resp)
+	} else {
+		_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	}
+	return
+}
+
+// GetRoomDirectoryVisibility gets whether a room is published in the public room directory.
+// See https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3directorylistroomroomid
+func (cli *Client) GetRoomDirectoryVisibility(roomID id.RoomID) (resp *RespRoomDirectoryVisibility, err error) {
+	urlPath := cli.BuildClientURL("v3", "directory", "list", "room", roomID)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// SetRoomDirectoryVisibility publishes a room in the public room directory or removes it from there.
+// See https://spec.matrix.org/v1.4/client-server-api/#put_matrixclientv3directorylistroomroomid
+func (cli *Client) SetRoomDirectoryVisibility(roomID id.RoomID, visibility RoomDirectoryVisibility) (err error) {
+	urlPath := cli.BuildClientURL("v3", "directory", "list", "room", roomID)
+	_, err = cli.MakeRequest("PUT", urlPath, &ReqRoomDirectoryVisibility{Visibility: visibility}, nil)
+	return
+}
+
 func (cli *Client) UploadKeys(req *ReqUploadKeys) (resp *RespUploadKeys, err error) {
 	urlPath := cli.BuildClientURL("v3", "keys", "upload")
 	_, err = cli.MakeRequest("POST", urlPath, req, &resp)
@@ -1597,6 +3428,52 @@ func (cli *Client) GetKeyChanges(from, to string) (resp *RespKeyChanges, err err
 	return
 }
 
+// GetKeyBackupLatestVersion gets information about the latest server-side key backup version.
+// See https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3room_keysversion
+func (cli *Client) GetKeyBackupLatestVersion() (resp *RespRoomKeysVersion, err error) {
+	urlPath := cli.BuildClientURL("v3", "room_keys", "version")
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// GetKeyBackupVersion gets information about the given server-side key backup version.
+// See https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3room_keysversionversion
+func (cli *Client) GetKeyBackupVersion(version string) (resp *RespRoomKeysVersion, err error) {
+	urlPath := cli.BuildClientURL("v3", "room_keys", "version", version)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// CreateKeyBackupVersion creates a new server-side key backup version.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3room_keysversion
+func (cli *Client) CreateKeyBackupVersion(req *ReqRoomKeysVersionCreate) (resp *RespRoomKeysVersionCreate, err error) {
+	urlPath := cli.BuildClientURL("v3", "room_keys", "version")
+	_, err = cli.MakeRequest("POST", urlPath, req, &resp)
+	return
+}
+
+// GetKeyBackup gets all the sessions stored in the given key backup version.
+// See https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3room_keyskeys
+func (cli *Client) GetKeyBackup(version string) (resp *RespRoomKeys, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "room_keys", "keys"}, map[string]string{
+		"version": version,
+	})
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// PutKeysInBackup stores sessions in the given key backup version.
+// See https://spec.matrix.org/v1.4/client-server-api/#put_matrixclientv3room_keyskeys
+func (cli *Client) PutKeysInBackup(version string, req *ReqKeyBackup) (resp *RespRoomKeysUpdate, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "room_keys", "keys"}, map[string]string{
+		"version": version,
+	})
+	_, err = cli.MakeRequest("PUT", urlPath, req, &resp)
+	return
+}
+
+// SendToDevice sends to-device events to the given devices. Use id.AllDevices as the device ID to send to all devices of a user.
+// See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3sendtodeviceeventtypetxnid
 func (cli *Client) SendToDevice(eventType event.Type, req *ReqSendToDevice) (resp *RespSendToDevice, err error) {
 	urlPath := cli.BuildClientURL("v3", "sendToDevice", eventType.String(), cli.TxnID())
 	_, err = cli.MakeRequest("PUT", urlPath, req, &resp)
@@ -1633,33 +3510,104 @@ func (cli *Client) DeleteDevices(req *ReqDeleteDevices) error {
 	return err
 }
 
-type UIACallback = func(*RespUserInteractive) interface{}
-
 // UploadCrossSigningKeys uploads the given cross-signing keys to the server.
 // Because the endpoint requires user-interactive authentication a callback must be provided that,
 // given the UI auth parameters, produces the required result (or nil to end the flow).
 func (cli *Client) UploadCrossSigningKeys(keys *UploadCrossSigningKeysReq, uiaCallback UIACallback) error {
-	content, err := cli.MakeFullRequest(FullRequest{
+	return cli.DoUIA(&UIARequest{
+		Method:   http.MethodPost,
+		URL:      cli.BuildClientURL("v3", "keys", "device_signing", "upload"),
+		Body:     keys,
+		Callback: uiaCallback,
+	}, nil)
+}
+
+// ChangePassword changes the password of the current user.
+// The endpoint requires user-interactive authentication, see UIACallback.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3accountpassword
+func (cli *Client) ChangePassword(req *ReqChangePassword, uiaCallback UIACallback) error {
+	return cli.DoUIA(&UIARequest{
 		Method:           http.MethodPost,
-		URL:              cli.BuildClientURL("v3", "keys", "device_signing", "upload"),
-		RequestJSON:      keys,
-		SensitiveContent: keys.Auth != nil,
-	})
-	if respErr, ok := err.(HTTPError); ok && respErr.IsStatus(http.StatusUnauthorized) {
-		// try again with UI auth
-		var uiAuthResp RespUserInteractive
-		if err := json.Unmarshal(content, &uiAuthResp); err != nil {
-			return fmt.Errorf("failed to decode UIA response: %w", err)
-		}
-		auth := uiaCallback(&uiAuthResp)
-		if auth != nil {
-			keys.Auth = auth
-			return cli.UploadCrossSigningKeys(keys, uiaCallback)
-		}
-	}
+		URL:              cli.BuildClientURL("v3", "account", "password"),
+		Body:             req,
+		SensitiveContent: true,
+		Callback:         uiaCallback,
+	}, nil)
+}
+
+// DeactivateAccount deactivates the current user's account. This is irreversible.
+// The endpoint requires user-interactive authentication, see UIACallback.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3accountdeactivate
+func (cli *Client) DeactivateAccount(req *ReqDeactivateAccount, uiaCallback UIACallback) (resp *RespDeactivateAccount, err error) {
+	err = cli.DoUIA(&UIARequest{
+		Method:   http.MethodPost,
+		URL:      cli.BuildClientURL("v3", "account", "deactivate"),
+		Body:     req,
+		Callback: uiaCallback,
+	}, &resp)
+	return
+}
+
+// GetThreePIDs returns the third-party identifiers (e.g. email addresses) associated with the current user's account.
+// See https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3account3pid
+func (cli *Client) GetThreePIDs() (resp *RespThreePIDs, err error) {
+	_, err = cli.MakeRequest("GET", cli.BuildClientURL("v3", "account", "3pid"), nil, &resp)
+	return
+}
+
+// RequestEmailToken asks the homeserver to send a validation token to the given email address
+// for adding it to the current user's account. The returned session ID (sid) is used together with the
+// client secret in AddThreePID after the user has clicked the link in the email.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3pidemailrequesttoken
+func (cli *Client) RequestEmailToken(req *ReqRequestEmailToken) (resp *RespRequestToken, err error) {
+	_, err = cli.MakeRequest("POST", cli.BuildClientURL("v3", "account", "3pid", "email", "requestToken"), req, &resp)
+	return
+}
+
+// RequestMSISDNToken asks the homeserver to send a validation token to the given phone number by SMS.
+// If the response contains a submit URL, the token received by the user must be submitted there.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3pidmsisdnrequesttoken
+func (cli *Client) RequestMSISDNToken(req *ReqRequestMSISDNToken) (resp *RespRequestToken, err error) {
+	_, err = cli.MakeRequest("POST", cli.BuildClientURL("v3", "account", "3pid", "msisdn", "requestToken"), req, &resp)
+	return
+}
+
+// AddThreePID adds a validated third-party identifier to the current user's account on the homeserver.
+// The endpoint requires user-interactive authentication, see UIACallback.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3pidadd
+func (cli *Client) AddThreePID(req *ReqAddThreePID, uiaCallback UIACallback) error {
+	return cli.DoUIA(&UIARequest{
+		Method:   http.MethodPost,
+		URL:      cli.BuildClientURL("v3", "account", "3pid", "add"),
+		Body:     req,
+		Callback: uiaCallback,
+	}, nil)
+}
+
+// BindThreePID binds a third-party identifier that was validated by an identity server to the current user's
+// Matrix ID on that identity server, so that other users can find the user by the identifier.
+// Unlike AddThreePID, the validation token must've been requested directly from the identity server.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3pidbind
+func (cli *Client) BindThreePID(req *ReqBindThreePID) error {
+	_, err := cli.MakeRequest("POST", cli.BuildClientURL("v3", "account", "3pid", "bind"), req, nil)
 	return err
 }
 
+// DeleteThreePID removes a third-party identifier from the current user's account.
+// The homeserver will also attempt to unbind it from the identity server.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3piddelete
+func (cli *Client) DeleteThreePID(req *ReqThreePID) (resp *RespThreePIDUnbind, err error) {
+	_, err = cli.MakeRequest("POST", cli.BuildClientURL("v3", "account", "3pid", "delete"), req, &resp)
+	return
+}
+
+// UnbindThreePID unbinds a third-party identifier from an identity server without removing it from the homeserver.
+// See https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3pidunbind
+func (cli *Client) UnbindThreePID(req *ReqThreePID) (resp *RespThreePIDUnbind, err error) {
+	_, err = cli.MakeRequest("POST", cli.BuildClientURL("v3", "account", "3pid", "unbind"), req, &resp)
+	return
+}
+
 func (cli *Client) UploadSignatures(req *ReqUploadSignatures) (resp *RespUploadSignatures, err error) {
 	urlPath := cli.BuildClientURL("v3", "keys", "signatures", "upload")
 	_, err = cli.MakeRequest("POST", urlPath, req, &resp)
@@ -1708,8 +3656,38 @@ func (cli *Client) PutPushRule(scope string, kind pushrules.PushRuleType, ruleID
 	return err
 }
 
+// SetPushRuleEnabled enables or disables a push rule.
+// See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3pushrulesscopekindruleidenabled
+func (cli *Client) SetPushRuleEnabled(scope string, kind pushrules.PushRuleType, ruleID string, enabled bool) error {
+	urlPath := cli.BuildClientURL("v3", "pushrules", scope, kind, ruleID, "enabled")
+	_, err := cli.MakeRequest("PUT", urlPath, &ReqPutPushRuleEnabled{Enabled: enabled}, nil)
+	return err
+}
+
+// EnablePushRule enables the given push rule.
+func (cli *Client) EnablePushRule(scope string, kind pushrules.PushRuleType, ruleID string) error {
+	return cli.SetPushRuleEnabled(scope, kind, ruleID, true)
+}
+
+// DisablePushRule disables the given push rule.
+func (cli *Client) DisablePushRule(scope string, kind pushrules.PushRuleType, ruleID string) error {
+	return cli.SetPushRuleEnabled(scope, kind, ruleID, false)
+}
+
+// SetPushRuleActions replaces the actions of a push rule.
+// See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3pushrulesscopekindruleidactions
+func (cli *Client) SetPushRuleActions(scope string, kind pushrules.PushRuleType, ruleID string, actions pushrules.PushActionArray) error {
+	urlPath := cli.BuildClientURL("v3", "pushrules", scope, kind, ruleID, "actions")
+	_, err := cli.MakeRequest("PUT", urlPath, &ReqPutPushRuleActions{Actions: actions}, nil)
+	return err
+}
+
 // BatchSend sends a batch of historical events into a room. This is only available for appservices.
 //
+// To import history in chronological order, send the newest batch first with an empty BatchID, then keep
+// sending older batches with BatchID set to the NextBatchID of the previous response. All batches must use
+// the same PrevEventID. The events are sent as the users in the events, so they must be registered appservice users.
+//
 // See https://github.com/matrix-org/matrix-doc/pull/2716 for more info.
 func (cli *Client) BatchSend(roomID id.RoomID, req *ReqBatchSend) (resp *RespBatchSend, err error) {
 	path := ClientURLPath{"unstable", "org.matrix.msc2716", "rooms", roomID, "batch_send"}
@@ -1726,9 +3704,34 @@ func (cli *Client) BatchSend(roomID id.RoomID, req *ReqBatchSend) (resp *RespBat
 	return
 }
 
+var (
+	ErrBatchSendMissingPrevEvent = errors.New("batch send requires a prev event ID")
+	ErrBatchSendNoEvents         = errors.New("batch send requires at least one event")
+)
+
+// BatchSendHistory sends a batch of historical events into a room, anchored after prevEventID.
+//
+// batchID should be empty for the first (newest) batch and the NextBatchID of the previous response for
+// each following batch. The PrevEventID and BatchID fields of req are ignored and req is not modified.
+// See BatchSend for more info.
+func (cli *Client) BatchSendHistory(roomID id.RoomID, prevEventID id.EventID, batchID string, req *ReqBatchSend) (*RespBatchSend, error) {
+	if len(prevEventID) == 0 {
+		return nil, ErrBatchSendMissingPrevEvent
+	} else if req == nil || len(req.Events) == 0 {
+		return nil, ErrBatchSendNoEvents
+	}
+	reqCopy := *req
+	reqCopy.PrevEventID = prevEventID
+	reqCopy.BatchID = id.BatchID(batchID)
+	return cli.BatchSend(roomID, &reqCopy)
+}
+
 // TxnID returns the next transaction ID.
+//
+// The IDs contain the current time in nanoseconds and a per-client counter, so they're monotonic within a client
+// and won't collide with IDs generated by previous runs of the same program.
 func (cli *Client) TxnID() string {
-	txnID := atomic.AddInt32(&cli.txnID, 1)
+	txnID := atomic.AddInt32(&cli.root().txnID, 1)
 	return fmt.Sprintf("mautrix-go_%d_%d", time.Now().UnixNano(), txnID)
 }
 
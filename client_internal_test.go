@@ -1,8 +1,11 @@
 package mautrix
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 )
@@ -73,3 +76,99 @@ func TestBackoffFromResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryAfterMSFromResponse(t *testing.T) {
+	for name, tt := range map[string]struct {
+		body     string
+		expected time.Duration
+		ok       bool
+	}{
+		"LimitExceeded": {
+			body:     `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 2000}`,
+			expected: 2 * time.Second,
+			ok:       true,
+		},
+		"NoRetryAfter": {
+			body: `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests"}`,
+		},
+		"OtherError": {
+			body: `{"errcode": "M_UNKNOWN", "error": "Something", "retry_after_ms": 2000}`,
+		},
+		"NotJSON": {
+			body: `Too many requests`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			res := &http.Response{Body: io.NopCloser(strings.NewReader(tt.body))}
+			actual, ok := parseRetryAfterMSFromResponse(res)
+			if ok != tt.ok || actual != tt.expected {
+				t.Fatalf("Retry after output mismatch, expected %s/%t, got %s/%t", tt.expected, tt.ok, actual, ok)
+			}
+			remainingBody, _ := io.ReadAll(res.Body)
+			if string(remainingBody) != tt.body {
+				t.Fatalf("Response body wasn't restored, got %q", remainingBody)
+			}
+		})
+	}
+}
+
+func TestNormalizeNotYetUploadedError(t *testing.T) {
+	for name, tt := range map[string]struct {
+		status   int
+		respErr  *RespError
+		expected bool
+	}{
+		"StableCode":   {status: http.StatusGatewayTimeout, respErr: &RespError{ErrCode: "M_NOT_YET_UPLOADED"}, expected: true},
+		"UnstableCode": {status: http.StatusGatewayTimeout, respErr: &RespError{ErrCode: unstableNotYetUploadedErrCode}, expected: true},
+		"BareTimeout":  {status: http.StatusGatewayTimeout, expected: true},
+		"NotFound":     {status: http.StatusNotFound, respErr: &RespError{ErrCode: "M_NOT_FOUND"}, expected: false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := normalizeNotYetUploadedError(HTTPError{
+				Request:   &http.Request{Method: http.MethodGet},
+				Response:  &http.Response{StatusCode: tt.status},
+				RespError: tt.respErr,
+			})
+			if errors.Is(err, MNotYetUploaded) != tt.expected {
+				t.Fatalf("Expected errors.Is(err, MNotYetUploaded) to be %t for %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestRateLimitBackoff(t *testing.T) {
+	limitedErr := fmt.Errorf("wrapped: %w", HTTPError{RespError: &RespError{
+		ErrCode:   MLimitExceeded.ErrCode,
+		ExtraData: map[string]interface{}{"retry_after_ms": float64(1500)},
+	}})
+	if backoff, ok := rateLimitBackoff(limitedErr); !ok || backoff != 1500*time.Millisecond {
+		t.Fatalf("Expected backoff of 1.5s for rate limited error, got %s (ok: %t)", backoff, ok)
+	}
+	if _, ok := rateLimitBackoff(HTTPError{RespError: &MForbidden}); ok {
+		t.Fatalf("Expected non-rate limit error to not have a backoff")
+	}
+}
+
+func TestProfileCache_DeletesExpired(t *testing.T) {
+	cache := &ProfileCache{TTL: -time.Second}
+	cache.Set("@alice:example.com", &RespUserProfile{DisplayName: "Alice"})
+	if cache.Get("@alice:example.com") != nil {
+		t.Error("Expected expired profile to not be returned")
+	}
+	if len(cache.profiles) != 0 {
+		t.Errorf("Expected expired profile to be deleted, but cache has %d entries", len(cache.profiles))
+	}
+}
+
+func TestRetryPolicy_AddJitter(t *testing.T) {
+	policy := &RetryPolicy{}
+	if delay := policy.addJitter(10 * time.Millisecond); delay != 10*time.Millisecond {
+		t.Fatalf("Expected no jitter without Jitter set, got %s", delay)
+	}
+	policy.Jitter = 5 * time.Millisecond
+	for i := 0; i < 1000; i++ {
+		if delay := policy.addJitter(10 * time.Millisecond); delay < 10*time.Millisecond || delay >= 15*time.Millisecond {
+			t.Fatalf("Delay %s is outside the jitter bounds", delay)
+		}
+	}
+}
@@ -0,0 +1,1575 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/mautrixtest"
+)
+
+func TestClient_DefaultHeaders(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/test", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, struct{}{})
+	})
+
+	cli := hs.NewClient()
+	cli.DefaultHeaders = http.Header{
+		"X-Trace-Id":    {"default"},
+		"X-Proxy-Auth":  {"secret"},
+		"Authorization": {"Bearer wrong"},
+	}
+	_, err := cli.MakeFullRequest(mautrix.FullRequest{
+		Method:  http.MethodGet,
+		URL:     cli.BuildClientURL("v3", "test"),
+		Headers: http.Header{"X-Trace-Id": {"override"}, "User-Agent": {"custom"}},
+	})
+	require.NoError(t, err)
+	requests := hs.Requests()
+	require.Len(t, requests, 1)
+	received := requests[0].Header
+	assert.Equal(t, "override", received.Get("X-Trace-Id"))
+	assert.Equal(t, "secret", received.Get("X-Proxy-Auth"))
+	assert.Equal(t, "custom", received.Get("User-Agent"))
+	assert.Equal(t, "Bearer "+hs.AccessToken, received.Get("Authorization"))
+}
+
+func TestClient_SendMessageEvent_TransactionID(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+
+	cli := hs.NewClient()
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}
+	txnID := cli.TxnID()
+	first, err := cli.SendMessageEvent("!room:example.com", event.EventMessage, content, mautrix.ReqSendEvent{TransactionID: txnID})
+	require.NoError(t, err)
+	second, err := cli.SendMessageEvent("!room:example.com", event.EventMessage, content, mautrix.ReqSendEvent{TransactionID: txnID})
+	require.NoError(t, err)
+	assert.Equal(t, first.EventID, second.EventID)
+
+	third, err := cli.SendMessageEvent("!room:example.com", event.EventMessage, content)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.EventID, third.EventID)
+	assert.Len(t, hs.SentEvents(), 2)
+}
+
+func TestClient_ChangePassword_UIA(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/account/password", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body["auth"] == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"flows": [{"stages": ["m.login.password"]}], "session": "xyz"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	})
+
+	cli := hs.NewClient()
+	err := cli.ChangePassword(&mautrix.ReqChangePassword{NewPassword: "hunter3"}, func(uia *mautrix.RespUserInteractive) interface{} {
+		assert.True(t, uia.HasSingleStageFlow(mautrix.AuthTypePassword))
+		return &mautrix.BaseAuthData{Type: mautrix.AuthTypePassword, Session: uia.Session}
+	})
+	require.NoError(t, err)
+	requests := hs.Requests()
+	require.Len(t, requests, 2)
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(requests[1].Body, &body))
+	assert.Equal(t, "xyz", body["auth"].(map[string]interface{})["session"])
+
+	err = cli.ChangePassword(&mautrix.ReqChangePassword{NewPassword: "hunter4"}, func(uia *mautrix.RespUserInteractive) interface{} {
+		return nil
+	})
+	assert.Error(t, err)
+}
+
+func TestClient_DoUIA_StageHandlers(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/account/deactivate", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Auth map[string]interface{} `json:"auth"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		completed := `[]`
+		if body.Auth != nil {
+			assert.Equal(t, "xyz", body.Auth["session"])
+			if body.Auth["type"] == "m.login.password" {
+				_, _ = w.Write([]byte(`{"id_server_unbind_result": "success"}`))
+				return
+			}
+			completed = `["m.login.dummy"]`
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = fmt.Fprintf(w, `{"flows": [{"stages": ["m.login.recaptcha"]}, {"stages": ["m.login.dummy", "m.login.password"]}], "session": "xyz", "completed": %s}`, completed)
+	})
+
+	cli := hs.NewClient()
+	var stages []mautrix.AuthType
+	resp, err := cli.DeactivateAccount(&mautrix.ReqDeactivateAccount{}, mautrix.UIAStageHandlers{
+		mautrix.AuthTypeDummy: func(uia *mautrix.RespUserInteractive) interface{} {
+			stages = append(stages, mautrix.AuthTypeDummy)
+			return &mautrix.BaseAuthData{Type: mautrix.AuthTypeDummy}
+		},
+		mautrix.AuthTypePassword: func(uia *mautrix.RespUserInteractive) interface{} {
+			stages = append(stages, mautrix.AuthTypePassword)
+			return &mautrix.ReqUIAuthLogin{BaseAuthData: mautrix.BaseAuthData{Type: mautrix.AuthTypePassword}, User: "user", Password: "hunter2"}
+		},
+	}.Callback)
+	require.NoError(t, err)
+	assert.Equal(t, "success", resp.IDServerUnbindResult)
+	assert.Equal(t, []mautrix.AuthType{mautrix.AuthTypeDummy, mautrix.AuthTypePassword}, stages)
+}
+
+func TestClient_GuestAccess(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@guest:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/account/whoami", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespWhoami{UserID: "@guest:example.com", IsGuest: true})
+	})
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/join/!room:example.com", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteError(w, http.StatusForbidden, mautrix.MGuestAccessForbidden, "Guest access not allowed")
+	})
+
+	cli := hs.NewClient()
+	_, err := cli.Whoami()
+	require.NoError(t, err)
+	assert.True(t, cli.IsGuest)
+
+	_, err = cli.JoinRoom("!room:example.com", "", nil)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, mautrix.MGuestAccessForbidden))
+	assert.Contains(t, err.Error(), "guest user")
+	var httpErr mautrix.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, "Guest access not allowed", httpErr.RespError.Err)
+	assert.NotEmpty(t, httpErr.Hint)
+}
+
+func TestClient_PublicRooms(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle("", "/_matrix/client/v3/publicRooms", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"chunk":[{"room_id":"!room:example.com","name":"Room","num_joined_members":5,"join_rule":"public"}],"next_batch":"next"}`))
+	})
+
+	cli := hs.NewClient()
+	resp, err := cli.PublicRooms(&mautrix.ReqPublicRooms{Limit: 10, Since: "prev"})
+	require.NoError(t, err)
+	require.Len(t, resp.Chunk, 1)
+	assert.Equal(t, 5, resp.Chunk[0].NumJoinedMembers)
+	assert.Equal(t, event.JoinRulePublic, resp.Chunk[0].JoinRule)
+	assert.Equal(t, "next", resp.NextBatch)
+
+	_, err = cli.PublicRooms(&mautrix.ReqPublicRooms{
+		Server: "remote.example.com",
+		Filter: &mautrix.PublicRoomsFilter{GenericSearchTerm: "test"},
+	})
+	require.NoError(t, err)
+	requests := hs.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, http.MethodGet, requests[0].Method)
+	assert.Equal(t, "limit=10&since=prev", requests[0].Query.Encode())
+	assert.Equal(t, http.MethodPost, requests[1].Method)
+	assert.Equal(t, "server=remote.example.com", requests[1].Query.Encode())
+}
+
+func TestClient_GetSpaceChildren(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodGet, "/_matrix/client/v1/rooms/!space:example.com/hierarchy", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("from") == "" {
+			_, _ = w.Write([]byte(`{"rooms":[
+				{"room_id":"!space:example.com","room_type":"m.space","num_joined_members":2,"children_state":[
+					{"type":"m.space.child","state_key":"!child:example.com","sender":"@user:example.com","origin_server_ts":1,"content":{"via":["example.com"],"suggested":true}}
+				]},
+				{"room_id":"!child:example.com","num_joined_members":1,"children_state":[]}
+			],"next_batch":"page2"}`))
+		} else {
+			_, _ = w.Write([]byte(`{"rooms":[{"room_id":"!child:example.com","num_joined_members":1,"children_state":[]}]}`))
+		}
+	})
+
+	cli := hs.NewClient()
+	maxDepth := 2
+	rooms, err := cli.GetSpaceChildren("!space:example.com", &mautrix.ReqHierarchy{MaxDepth: &maxDepth, SuggestedOnly: true})
+	require.NoError(t, err)
+	require.Len(t, rooms, 2)
+	assert.Equal(t, event.RoomTypeSpace, rooms[0].RoomType)
+	require.Len(t, rooms[0].ChildrenState, 1)
+	child := rooms[0].ChildrenState[0].Content.AsSpaceChild()
+	assert.True(t, child.Suggested)
+	assert.Equal(t, []string{"example.com"}, child.Via)
+	requests := hs.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "max_depth=2&suggested_only=true", requests[0].Query.Encode())
+	assert.Equal(t, "from=page2&max_depth=2&suggested_only=true", requests[1].Query.Encode())
+}
+
+func TestClient_SetCanonicalAlias_Validate(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/directory/room/#good:example.com", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespAliasResolve{RoomID: "!room:example.com", Servers: []string{"example.com"}})
+	})
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/directory/room/#other:example.com", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespAliasResolve{RoomID: "!other:example.com", Servers: []string{"example.com"}})
+	})
+
+	cli := hs.NewClient()
+	_, err := cli.SetCanonicalAlias("!room:example.com", "#good:example.com", []id.RoomAlias{"#other:example.com"}, true)
+	assert.ErrorIs(t, err, mautrix.ErrAliasPointsToOtherRoom)
+	assert.Empty(t, hs.SentEvents())
+
+	_, err = cli.SetCanonicalAlias("!room:example.com", "#good:example.com", nil, true)
+	require.NoError(t, err)
+	sent := hs.SentEvents()
+	require.Len(t, sent, 1)
+	assert.Equal(t, event.StateCanonicalAlias.Type, sent[0].Type.Type)
+	assert.Equal(t, id.RoomAlias("#good:example.com"), sent[0].Content.AsCanonicalAlias().Alias)
+}
+
+func TestClient_SetServerACL_OwnServer(t *testing.T) {
+	cli, err := mautrix.NewClient("https://example.com", "@user:example.com", "token")
+	require.NoError(t, err)
+	_, err = cli.SetServerACL("!room:example.com", &event.ServerACLEventContent{Allow: []string{"*"}, Deny: []string{"example.com"}}, false)
+	assert.ErrorIs(t, err, mautrix.ErrServerACLBansOwnServer)
+	_, err = cli.SetServerACL("!room:example.com", &event.ServerACLEventContent{Allow: []string{"other.example"}}, false)
+	assert.ErrorIs(t, err, mautrix.ErrServerACLBansOwnServer)
+}
+
+func TestClient_UpdatePowerLevels(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@admin:example.com")
+	defer hs.Close()
+	hs.SetState("!room:example.com", event.StatePowerLevels, "", map[string]interface{}{
+		"users":              map[string]int{"@admin:example.com": 100, "@mod:example.com": 50},
+		"events":             map[string]int{"m.room.name": 50},
+		"com.example.custom": true,
+	})
+
+	cli := hs.NewClient()
+	cli.StateStore = mautrix.NewMemoryStateStore()
+	_, err := cli.UpdatePowerLevels("!room:example.com", &mautrix.PowerLevelChanges{
+		Users:  map[id.UserID]int{"@mod:example.com": 0, "@new:example.com": 75},
+		Events: map[event.Type]int{event.StateTopic: 75},
+	})
+	require.NoError(t, err)
+	sent := hs.SentEvents()
+	require.Len(t, sent, 1)
+	assert.Equal(t, map[string]interface{}{
+		"users":              map[string]interface{}{"@admin:example.com": float64(100), "@new:example.com": float64(75)},
+		"events":             map[string]interface{}{"m.room.name": float64(50), "m.room.topic": float64(75)},
+		"com.example.custom": true,
+	}, sent[0].Content.Raw)
+	assert.Equal(t, 75, mautrix.GetPowerLevel(cli.StateStore, "!room:example.com", "@new:example.com"))
+}
+
+func TestClient_DownloadThumbnail(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodGet, "/_matrix/media/v3/thumbnail/example.com/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("png data"))
+	})
+	hs.Handle(http.MethodGet, "/_matrix/media/v3/thumbnail/example.com/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	cli := hs.NewClient()
+	allowRemote := false
+	data, contentType, err := cli.DownloadThumbnail(id.ContentURI{Homeserver: "example.com", FileID: "image"}, 64, 32, mautrix.ThumbnailMethodScale, &mautrix.ReqThumbnail{AllowRemote: &allowRemote, Animated: true})
+	require.NoError(t, err)
+	assert.Equal(t, "png data", string(data))
+	assert.Equal(t, "image/png", contentType)
+	requests := hs.RequestsTo(http.MethodGet, "/_matrix/media/v3/thumbnail/example.com/image")
+	require.Len(t, requests, 1)
+	assert.Equal(t, "allow_remote=false&animated=true&height=32&method=scale&width=64", requests[0].Query.Encode())
+
+	_, _, err = cli.DownloadThumbnail(id.ContentURI{Homeserver: "example.com", FileID: "missing"}, 64, 32, mautrix.ThumbnailMethodCrop)
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+}
+
+func TestClient_UploadMedia_CheckSize(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	failConfig := false
+	hs.Handle(http.MethodGet, "/_matrix/media/v3/config", func(w http.ResponseWriter, r *http.Request) {
+		if failConfig {
+			mautrixtest.WriteError(w, http.StatusNotFound, mautrix.MUnrecognized, "Unrecognized request")
+			return
+		}
+		_, _ = w.Write([]byte(`{"m.upload.size": 10}`))
+	})
+	hs.Handle(http.MethodPost, "/_matrix/media/v3/upload", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"content_uri": "mxc://example.com/file"}`))
+	})
+	uploads := func() int {
+		return len(hs.RequestsTo(http.MethodPost, "/_matrix/media/v3/upload"))
+	}
+
+	cli := hs.NewClient()
+	_, err := cli.UploadMedia(mautrix.ReqUploadMedia{ContentBytes: []byte("way too much data"), CheckSize: true})
+	assert.ErrorIs(t, err, mautrix.ErrMediaTooLarge)
+	resp, err := cli.UploadMedia(mautrix.ReqUploadMedia{ContentBytes: []byte("small"), CheckSize: true})
+	require.NoError(t, err)
+	assert.Equal(t, "mxc://example.com/file", resp.ContentURI.String())
+	assert.Len(t, hs.RequestsTo(http.MethodGet, "/_matrix/media/v3/config"), 1)
+	assert.Equal(t, 1, uploads())
+
+	cli.MediaConfig = &mautrix.RespMediaConfig{}
+	_, err = cli.UploadMedia(mautrix.ReqUploadMedia{ContentBytes: []byte("way too much data"), CheckSize: true})
+	assert.NoError(t, err)
+
+	failConfig = true
+	cli.MediaConfig = nil
+	_, err = cli.UploadMedia(mautrix.ReqUploadMedia{ContentBytes: []byte("way too much data"), CheckSize: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, uploads())
+}
+
+func TestClient_UploadMedia_UploadURL(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPut, "/external-upload", func(w http.ResponseWriter, r *http.Request) {})
+	hs.Handle(http.MethodPost, "/_matrix/media/unstable/fi.mau.msc2246/upload/example.com/abc/complete", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"content_uri": "mxc://example.com/abc"}`))
+	})
+
+	cli := hs.NewClient()
+	var progress []int64
+	resp, err := cli.UploadMedia(mautrix.ReqUploadMedia{
+		ContentBytes: []byte("hello world"),
+		ContentType:  "text/plain",
+		UnstableMXC:  id.ContentURI{Homeserver: "example.com", FileID: "abc"},
+		UploadURL:    hs.Server.URL + "/external-upload",
+		Progress: func(bytesSent, total int64) {
+			progress = append(progress, bytesSent)
+		},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp, "the response of the complete request should be decoded")
+	assert.Equal(t, "mxc://example.com/abc", resp.ContentURI.String())
+	requests := hs.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "/external-upload", requests[0].Path)
+	assert.Equal(t, "hello world", string(requests[0].Body))
+	require.NotEmpty(t, progress)
+	assert.EqualValues(t, len("hello world"), progress[len(progress)-1])
+}
+
+func TestClient_UploadMedia_Progress(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPost, "/_matrix/media/v3/upload", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"content_uri": "mxc://example.com/file"}`))
+	})
+
+	cli := hs.NewClient()
+	data := strings.Repeat("a", 100000)
+	var lastSent, lastTotal int64
+	_, err := cli.UploadMedia(mautrix.ReqUploadMedia{
+		Content:       strings.NewReader(data),
+		ContentLength: int64(len(data)),
+		Progress: func(bytesSent, total int64) {
+			assert.GreaterOrEqual(t, bytesSent, lastSent, "progress should never go backwards")
+			lastSent, lastTotal = bytesSent, total
+		},
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), lastSent)
+	assert.EqualValues(t, len(data), lastTotal)
+}
+
+func TestClient_SendStateEvent(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPut, "/_matrix/client/v3/rooms/!room:example.com/state/m.room.power_levels", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteError(w, http.StatusForbidden, mautrix.MForbidden, "user_level (0) < send_level (100)")
+	})
+	hs.Handle(http.MethodPut, "/_matrix/client/v3/rooms/!room:example.com/state/m.room.name", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteError(w, http.StatusForbidden, mautrix.MForbidden, "User @user:example.com not in room !room:example.com")
+	})
+
+	cli := hs.NewClient()
+	resp, err := cli.SendStateEvent("!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "hi"})
+	require.NoError(t, err)
+	sent := hs.SentEvents()
+	require.Len(t, sent, 1)
+	assert.Equal(t, sent[0].ID, resp.EventID)
+	_, err = cli.SendStateEvent("!room:example.com", event.StateMember, "@weird/user?:example.com", &event.MemberEventContent{Membership: event.MembershipJoin})
+	require.NoError(t, err)
+	requests := hs.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "/_matrix/client/v3/rooms/%21room:example.com/state/m.room.topic", requests[0].RawPath)
+	assert.Equal(t, "/_matrix/client/v3/rooms/%21room:example.com/state/m.room.member/@weird%2Fuser%3F:example.com", requests[1].RawPath)
+	sent = hs.SentEvents()
+	require.Len(t, sent, 2)
+	assert.Equal(t, "@weird/user?:example.com", *sent[1].StateKey)
+
+	_, err = cli.SendStateEvent("!room:example.com", event.StatePowerLevels, "", &event.PowerLevelsEventContent{})
+	assert.ErrorIs(t, err, mautrix.ErrInsufficientPowerLevel)
+	assert.ErrorIs(t, err, mautrix.ErrSendForbidden)
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	var forbiddenErr mautrix.SendForbiddenError
+	require.ErrorAs(t, err, &forbiddenErr)
+	assert.Equal(t, event.StatePowerLevels, forbiddenErr.EventType)
+
+	_, err = cli.SendStateEvent("!room:example.com", event.StateRoomName, "", &event.RoomNameEventContent{Name: "hi"})
+	assert.ErrorIs(t, err, mautrix.ErrSendForbidden)
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	assert.NotErrorIs(t, err, mautrix.ErrInsufficientPowerLevel)
+}
+
+func TestClient_RoomAccountData(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	stored := map[string][]byte{}
+	hs.HandlePrefix("", "/_matrix/client/v3/user/@user:example.com/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			stored[r.URL.Path], _ = io.ReadAll(r.Body)
+			_, _ = w.Write([]byte(`{}`))
+		} else if data, ok := stored[r.URL.Path]; ok {
+			_, _ = w.Write(data)
+		} else {
+			// Some reverse proxies return a plain 404 without a Matrix error code
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	cli := hs.NewClient()
+	var content map[string]string
+	err := cli.GetRoomAccountData("!room:example.com", "com.example.bridge", &content)
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+	assert.Nil(t, content)
+
+	require.NoError(t, cli.SetRoomAccountData("!room:example.com", "com.example.bridge", map[string]string{}))
+	assert.Len(t, hs.RequestsTo(http.MethodPut, "/_matrix/client/v3/user/@user:example.com/rooms/!room:example.com/account_data/com.example.bridge"), 1)
+	require.NoError(t, cli.GetRoomAccountData("!room:example.com", "com.example.bridge", &content))
+	assert.Equal(t, map[string]string{}, content)
+}
+
+func TestClient_AccountData_EscapesType(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPut, "/_matrix/client/v3/user/@user:example.com/account_data/com.example/custom type", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	})
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/user/@user:example.com/account_data/com.example/custom type", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteError(w, http.StatusNotFound, mautrix.MNotFound, "Account data not found")
+	})
+
+	cli := hs.NewClient()
+	require.NoError(t, cli.SetAccountData("com.example/custom type", map[string]int{"value": 1}))
+	var out struct {
+		Value int `json:"value"`
+	}
+	assert.ErrorIs(t, cli.GetAccountData("com.example/custom type", &out), mautrix.MNotFound)
+	requests := hs.Requests()
+	require.Len(t, requests, 2)
+	for _, req := range requests {
+		assert.Equal(t, "/_matrix/client/v3/user/@user:example.com/account_data/com.example%2Fcustom%20type", req.RawPath)
+	}
+}
+
+func TestClient_RequestHook(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	var requests int
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/account/whoami", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 1}`))
+			return
+		} else if requests == 3 {
+			mautrixtest.WriteError(w, http.StatusNotFound, mautrix.MNotFound, "Not found")
+			return
+		}
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespWhoami{UserID: hs.UserID})
+	})
+
+	cli := hs.NewClient()
+	cli.RetryPolicy = &mautrix.RetryPolicy{MaxAttempts: 2}
+	var metrics []*mautrix.RequestMetrics
+	cli.RequestHook = func(m *mautrix.RequestMetrics) {
+		metrics = append(metrics, m)
+	}
+	_, err := cli.Whoami()
+	require.NoError(t, err)
+	_, err = cli.Whoami()
+	require.ErrorIs(t, err, mautrix.MNotFound)
+
+	require.Len(t, metrics, 3)
+	assert.Equal(t, "/_matrix/client/v3/account/whoami", metrics[0].Path)
+	assert.Equal(t, http.StatusTooManyRequests, metrics[0].StatusCode)
+	assert.Equal(t, mautrix.MLimitExceeded.ErrCode, metrics[0].ErrCode)
+	assert.True(t, metrics[0].WillRetry)
+	assert.Equal(t, 2, metrics[1].Attempt)
+	assert.Equal(t, http.StatusOK, metrics[1].StatusCode)
+	assert.NoError(t, metrics[1].Error)
+	assert.Equal(t, mautrix.MNotFound.ErrCode, metrics[2].ErrCode)
+	assert.False(t, metrics[2].WillRetry)
+	assert.Error(t, metrics[2].Error)
+}
+
+func TestClient_WithContext(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+
+	cli := hs.NewClient()
+	cli.DefaultHeaders = http.Header{"X-Test": {"1"}}
+	cli.RequestHook = func(*mautrix.RequestMetrics) {}
+	ctx, cancel := context.WithCancel(context.Background())
+	ctxCli := cli.WithContext(ctx)
+
+	// All exported fields must be copied
+	orig, copied := reflect.ValueOf(cli).Elem(), reflect.ValueOf(ctxCli).Elem()
+	for i := 0; i < orig.NumField(); i++ {
+		if !orig.Type().Field(i).IsExported() {
+			continue
+		} else if orig.Field(i).Kind() == reflect.Func {
+			assert.Equal(t, orig.Field(i).Pointer(), copied.Field(i).Pointer(), orig.Type().Field(i).Name)
+		} else {
+			assert.Equal(t, orig.Field(i).Interface(), copied.Field(i).Interface(), orig.Type().Field(i).Name)
+		}
+	}
+
+	_, err := ctxCli.Whoami()
+	require.NoError(t, err)
+	cancel()
+	_, err = ctxCli.Whoami()
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = cli.Whoami()
+	assert.NoError(t, err)
+}
+
+func TestClient_DownloadMedia(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	handleDownload := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Disposition", `inline; filename="hello world.txt"`)
+		if r.Header.Get("Range") == "bytes=6-10" {
+			w.Header().Set("Content-Range", "bytes 6-10/11")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte("world"))
+			return
+		}
+		_, _ = w.Write([]byte("hello world"))
+	}
+	hs.Handle(http.MethodGet, "/_matrix/media/v3/download/example.com/file", handleDownload)
+	hs.Handle(http.MethodGet, "/_matrix/client/v1/media/download/example.com/file", handleDownload)
+	lastRequest := func() mautrixtest.Request {
+		requests := hs.Requests()
+		require.NotEmpty(t, requests)
+		return requests[len(requests)-1]
+	}
+
+	cli := hs.NewClient()
+	mxc := id.ContentURI{Homeserver: "example.com", FileID: "file"}
+	allowRemote := false
+	resp, err := cli.DownloadMedia(context.Background(), mxc, &mautrix.ReqDownloadMedia{Offset: 6, Length: 5, AllowRemote: &allowRemote})
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, "world", string(data))
+	assert.True(t, resp.Partial)
+	assert.Equal(t, int64(11), resp.TotalSize)
+	assert.Equal(t, "hello world.txt", resp.FileName)
+	assert.Equal(t, "text/plain", resp.ContentType)
+	req := lastRequest()
+	assert.Equal(t, "/_matrix/media/v3/download/example.com/file", req.Path)
+	assert.Equal(t, "false", req.Query.Get("allow_remote"))
+	assert.Equal(t, "Bearer "+hs.AccessToken, req.Header.Get("Authorization"))
+
+	cli.SpecVersions = &mautrix.RespVersions{UnstableFeatures: map[string]bool{"org.matrix.msc3916.stable": true}}
+	resp, err = cli.DownloadMedia(context.Background(), mxc)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.False(t, resp.Partial)
+	assert.Equal(t, int64(11), resp.TotalSize)
+	assert.Equal(t, "/_matrix/client/v1/media/download/example.com/file", lastRequest().Path)
+}
+
+func TestClient_AuthenticatedMedia(t *testing.T) {
+	cdn := mautrixtest.NewHomeserver("")
+	defer cdn.Close()
+	cdn.Handle(http.MethodGet, "/file", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("cdn data"))
+	})
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	recognizeAuthenticated := true
+	recognizeLegacy := true
+	hs.Handle(http.MethodGet, "/_matrix/client/versions", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"versions": ["v1.11"]}`))
+	})
+	hs.HandlePrefix(http.MethodGet, "/_matrix/client/v1/media/", func(w http.ResponseWriter, r *http.Request) {
+		if !recognizeAuthenticated {
+			mautrixtest.WriteError(w, http.StatusNotFound, mautrix.MUnrecognized, "Unrecognized request")
+			return
+		}
+		http.Redirect(w, r, cdn.Server.URL+"/file", http.StatusTemporaryRedirect)
+	})
+	hs.HandlePrefix(http.MethodGet, "/_matrix/media/", func(w http.ResponseWriter, r *http.Request) {
+		if !recognizeLegacy {
+			mautrixtest.WriteError(w, http.StatusNotFound, mautrix.MUnrecognized, "Unrecognized request")
+			return
+		}
+		http.Redirect(w, r, cdn.Server.URL+"/file", http.StatusTemporaryRedirect)
+	})
+	paths := func() []string {
+		var paths []string
+		for _, req := range hs.Requests() {
+			paths = append(paths, req.Path)
+		}
+		hs.ResetRequests()
+		return paths
+	}
+
+	cli := hs.NewClient()
+	// Don't follow redirects automatically to make sure they're handled manually without leaking the token
+	cli.Client = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	mxc := id.ContentURI{Homeserver: "example.com", FileID: "file"}
+	resp, err := cli.DownloadMedia(context.Background(), mxc, &mautrix.ReqDownloadMedia{Offset: 2})
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, []string{"/_matrix/client/versions", "/_matrix/client/v1/media/download/example.com/file"}, paths())
+	cdnRequests := cdn.Requests()
+	require.Len(t, cdnRequests, 1)
+	assert.Empty(t, cdnRequests[0].Header.Get("Authorization"))
+	assert.Equal(t, "bytes=2-", cdnRequests[0].Header.Get("Range"))
+
+	recognizeAuthenticated = false
+	data, _, err := cli.DownloadThumbnail(mxc, 32, 32, mautrix.ThumbnailMethodScale)
+	require.NoError(t, err)
+	assert.Equal(t, "cdn data", string(data))
+	assert.Equal(t, []string{"/_matrix/client/v1/media/thumbnail/example.com/file", "/_matrix/media/v3/thumbnail/example.com/file"}, paths())
+
+	recognizeAuthenticated = true
+	recognizeLegacy = false
+	cli.SpecVersions = &mautrix.RespVersions{Versions: []mautrix.SpecVersion{mautrix.SpecV11}}
+	_, err = cli.DownloadBytes(mxc)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/_matrix/media/v3/download/example.com/file", "/_matrix/client/v1/media/download/example.com/file"}, paths())
+
+	recognizeAuthenticated = false
+	recognizeLegacy = true
+	useAuthenticated := true
+	cli.UseAuthenticatedMedia = &useAuthenticated
+	_, err = cli.DownloadBytes(mxc)
+	assert.ErrorIs(t, err, mautrix.MUnrecognized)
+	assert.Equal(t, []string{"/_matrix/client/v1/media/download/example.com/file"}, paths())
+}
+
+func TestClient_AuthenticatedMedia_VersionsFailure(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodGet, "/_matrix/client/versions", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteError(w, http.StatusNotFound, mautrix.MUnrecognized, "Unrecognized request")
+	})
+	hs.Handle(http.MethodGet, "/_matrix/media/v3/download/example.com/file", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("data"))
+	})
+
+	cli := hs.NewClient()
+	mxc := id.ContentURI{Homeserver: "example.com", FileID: "file"}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := cli.DownloadBytes(mxc)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "data", string(data))
+			}
+		}()
+	}
+	wg.Wait()
+	// The failed probe is remembered instead of being repeated for every download
+	assert.Len(t, hs.RequestsTo(http.MethodGet, "/_matrix/client/versions"), 1)
+	_, err := cli.GetCachedVersions()
+	assert.ErrorIs(t, err, mautrix.MUnrecognized)
+	assert.Len(t, hs.RequestsTo(http.MethodGet, "/_matrix/client/versions"), 1)
+
+	defer func(delay time.Duration) {
+		mautrix.FailedVersionsRetryDelay = delay
+	}(mautrix.FailedVersionsRetryDelay)
+	mautrix.FailedVersionsRetryDelay = 0
+	_, err = cli.DownloadBytes(mxc)
+	require.NoError(t, err)
+	assert.Len(t, hs.RequestsTo(http.MethodGet, "/_matrix/client/versions"), 2)
+}
+
+func TestClient_RefreshAccessToken(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/refresh", func(w http.ResponseWriter, r *http.Request) {
+		var req mautrix.ReqRefresh
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "refresh1", req.RefreshToken)
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespRefresh{AccessToken: "token2", RefreshToken: "refresh2"})
+	})
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/joined_rooms", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Token expired", "soft_logout": true}`))
+			return
+		}
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespJoinedRooms{JoinedRooms: []id.RoomID{"!room:example.com"}})
+	})
+
+	cli := hs.NewClient()
+	cli.RefreshToken = "refresh1"
+	var refreshed *mautrix.RespRefresh
+	cli.OnTokenRefresh = func(resp *mautrix.RespRefresh) {
+		refreshed = resp
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := cli.JoinedRooms()
+			if assert.NoError(t, err) {
+				assert.Equal(t, []id.RoomID{"!room:example.com"}, resp.JoinedRooms)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, hs.RequestsTo(http.MethodPost, "/_matrix/client/v3/refresh"), 1)
+	require.NotNil(t, refreshed)
+	assert.Equal(t, "token2", refreshed.AccessToken)
+	assert.Equal(t, "token2", cli.AccessToken)
+	assert.Equal(t, "refresh2", cli.RefreshToken)
+}
+
+func TestClient_WithContext_SharesTokens(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/refresh", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespRefresh{AccessToken: "token2", RefreshToken: "refresh2"})
+	})
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/joined_rooms", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Token expired", "soft_logout": true}`))
+			return
+		}
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespJoinedRooms{})
+	})
+
+	cli := hs.NewClient()
+	cli.RefreshToken = "refresh1"
+	ctxCli := cli.WithContext(context.Background()).WithContext(context.Background())
+	_, err := ctxCli.JoinedRooms()
+	require.NoError(t, err)
+	_, err = cli.JoinedRooms()
+	require.NoError(t, err)
+	assert.Len(t, hs.RequestsTo(http.MethodPost, "/_matrix/client/v3/refresh"), 1)
+	assert.Len(t, hs.RequestsTo(http.MethodGet, "/_matrix/client/v3/joined_rooms"), 3)
+	assert.Equal(t, "token2", cli.AccessToken)
+	assert.Equal(t, "refresh2", cli.RefreshToken)
+
+	// The copies use the same transaction ID counter as the original
+	txnCounter := func(txnID string) string {
+		return txnID[strings.LastIndexByte(txnID, '_')+1:]
+	}
+	assert.Equal(t, "1", txnCounter(cli.TxnID()))
+	assert.Equal(t, "2", txnCounter(ctxCli.TxnID()))
+	assert.Equal(t, "3", txnCounter(cli.TxnID()))
+}
+
+// handleAccountData makes the mock homeserver store global account data. The overwrite function is called
+// for every PUT and can return a different body to store, which simulates another client overwriting the data.
+func handleAccountData(t *testing.T, hs *mautrixtest.Homeserver, initial map[string]string, overwrite func(eventType string, body []byte) []byte) map[string]string {
+	var lock sync.Mutex
+	stored := initial
+	prefix := "/_matrix/client/v3/user/" + hs.UserID.String() + "/account_data/"
+	hs.HandlePrefix("", prefix, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		eventType := strings.TrimPrefix(r.URL.Path, prefix)
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := stored[eventType]
+			if !ok {
+				mautrixtest.WriteError(w, http.StatusNotFound, mautrix.MNotFound, "Account data not found")
+				return
+			}
+			_, _ = w.Write([]byte(data))
+		case http.MethodPut:
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			if overwrite != nil {
+				body = overwrite(eventType, body)
+			}
+			stored[eventType] = string(body)
+			_, _ = w.Write([]byte(`{}`))
+		}
+	})
+	return stored
+}
+
+func countPuts(hs *mautrixtest.Homeserver) int {
+	var puts int
+	for _, req := range hs.Requests() {
+		if req.Method == http.MethodPut {
+			puts++
+		}
+	}
+	return puts
+}
+
+func TestClient_AddDirectChat(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	stored := handleAccountData(t, hs, map[string]string{
+		"m.direct": `{"@alice:example.com": ["!alice:example.com"]}`,
+	}, nil)
+	cli := hs.NewClient()
+
+	require.NoError(t, cli.AddDirectChat("@bob:example.com", "!bob:example.com"))
+	assert.JSONEq(t, `{"@alice:example.com": ["!alice:example.com"], "@bob:example.com": ["!bob:example.com"]}`, stored["m.direct"])
+	require.NoError(t, cli.AddDirectChat("@bob:example.com", "!bob:example.com"))
+	assert.Equal(t, 1, countPuts(hs), "adding an existing direct chat shouldn't write the account data")
+}
+
+func TestClient_AddDirectChat_ConcurrentOverwrite(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	overwrites := 1
+	stored := handleAccountData(t, hs, map[string]string{}, func(_ string, body []byte) []byte {
+		if overwrites > 0 {
+			overwrites--
+			return []byte(`{"@alice:example.com": ["!alice:example.com"]}`)
+		}
+		return body
+	})
+	cli := hs.NewClient()
+
+	require.NoError(t, cli.AddDirectChat("@bob:example.com", "!bob:example.com"))
+	assert.Equal(t, 2, countPuts(hs))
+	assert.JSONEq(t, `{"@alice:example.com": ["!alice:example.com"], "@bob:example.com": ["!bob:example.com"]}`, stored["m.direct"])
+
+	overwrites = mautrix.MaxAccountDataUpdateAttempts
+	err := cli.AddDirectChat("@carol:example.com", "!carol:example.com")
+	assert.ErrorContains(t, err, "overwritten by concurrent updates")
+	assert.Equal(t, 2+mautrix.MaxAccountDataUpdateAttempts, countPuts(hs))
+}
+
+func TestClient_IgnoreUser(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	overwrites := 1
+	stored := handleAccountData(t, hs, map[string]string{}, func(_ string, body []byte) []byte {
+		if overwrites > 0 {
+			overwrites--
+			return []byte(`{"ignored_users": {}}`)
+		}
+		return body
+	})
+	cli := hs.NewClient()
+
+	require.NoError(t, cli.IgnoreUser("@spam:example.com"))
+	assert.Equal(t, 2, countPuts(hs))
+	assert.JSONEq(t, `{"ignored_users": {"@spam:example.com": {}}}`, stored["m.ignored_user_list"])
+	require.NoError(t, cli.IgnoreUser("@spam:example.com"))
+	assert.Equal(t, 2, countPuts(hs), "ignoring an already ignored user shouldn't write the account data")
+
+	require.NoError(t, cli.UnignoreUser("@spam:example.com"))
+	assert.JSONEq(t, `{"ignored_users": {}}`, stored["m.ignored_user_list"])
+	ignored, err := cli.GetIgnoredUsers()
+	require.NoError(t, err)
+	assert.Empty(t, ignored.IgnoredUsers)
+
+	overwrites = mautrix.MaxAccountDataUpdateAttempts
+	err = cli.IgnoreUser("@spam:example.com")
+	assert.ErrorContains(t, err, "overwritten by concurrent updates")
+}
+
+func TestClient_RedactReaction(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodGet, "/_matrix/client/v1/rooms/!room:example.com/relations/$target/m.annotation", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"chunk": [
+			{"event_id": "$plain", "sender": "@user:example.com", "type": "m.reaction",
+				"content": {"m.relates_to": {"rel_type": "m.annotation", "event_id": "$target", "key": "👍"}}},
+			{"event_id": "$encrypted", "sender": "@user:example.com", "type": "m.room.encrypted",
+				"content": {"algorithm": "m.megolm.v1.aes-sha2", "ciphertext": "...", "session_id": "abc",
+					"m.relates_to": {"rel_type": "m.annotation", "event_id": "$target", "key": "👍"}}},
+			{"event_id": "$other_key", "sender": "@user:example.com", "type": "m.reaction",
+				"content": {"m.relates_to": {"rel_type": "m.annotation", "event_id": "$target", "key": "👎"}}},
+			{"event_id": "$other_user", "sender": "@other:example.com", "type": "m.reaction",
+				"content": {"m.relates_to": {"rel_type": "m.annotation", "event_id": "$target", "key": "👍"}}}
+		]}`))
+	})
+	hs.HandlePrefix(http.MethodPut, "/_matrix/client/v3/rooms/!room:example.com/redact/", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespSendEvent{EventID: "$redaction"})
+	})
+
+	cli := hs.NewClient()
+	redacted, err := cli.RedactReaction("!room:example.com", "$target", "👍")
+	require.NoError(t, err)
+	assert.Equal(t, []id.EventID{"$plain", "$encrypted"}, redacted)
+	var redactedPaths []string
+	for _, req := range hs.Requests() {
+		if req.Method == http.MethodPut {
+			redactedPaths = append(redactedPaths, req.Path[:strings.LastIndexByte(req.Path, '/')])
+		}
+	}
+	assert.Equal(t, []string{
+		"/_matrix/client/v3/rooms/!room:example.com/redact/$plain",
+		"/_matrix/client/v3/rooms/!room:example.com/redact/$encrypted",
+	}, redactedPaths)
+}
+
+func TestClient_Register(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@alice:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/register", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if body["auth"] == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"session": "abc", "flows": [{"stages": ["m.login.dummy"]}], "params": {}}`))
+			return
+		}
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespRegister{UserID: hs.UserID, AccessToken: hs.AccessToken, DeviceID: hs.DeviceID})
+	})
+
+	cli, err := mautrix.NewClient(hs.Server.URL, "", "")
+	require.NoError(t, err)
+	resp, uia, err := cli.Register(&mautrix.ReqRegister{Username: "alice", Password: "wonderland"})
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+	require.NotNil(t, uia)
+	assert.Equal(t, "abc", uia.Session)
+
+	resp, err = cli.RegisterDummy(&mautrix.ReqRegister{Username: "alice", Password: "wonderland"})
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@alice:example.com"), resp.UserID)
+	assert.Equal(t, hs.AccessToken, resp.AccessToken)
+	requests := hs.Requests()
+	require.Len(t, requests, 3)
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(requests[2].Body, &body))
+	assert.Equal(t, map[string]interface{}{"type": "m.login.dummy", "session": "abc"}, body["auth"])
+	assert.Equal(t, "alice", body["username"])
+}
+
+func TestClient_PinEvent(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.SetState("!room:example.com", event.StatePinnedEvents, "", &event.PinnedEventsEventContent{Pinned: []id.EventID{"$a", "$b", "$a"}})
+	pinned := func() []id.EventID {
+		sent := hs.SentEvents()
+		require.NotEmpty(t, sent)
+		return sent[len(sent)-1].Content.AsPinnedEvents().Pinned
+	}
+
+	cli := hs.NewClient()
+	require.NoError(t, cli.PinEvent("!room:example.com", "$a"))
+	assert.Equal(t, []id.EventID{"$a", "$b"}, pinned(), "existing duplicates should be removed")
+	require.NoError(t, cli.PinEvent("!room:example.com", "$a"))
+	assert.Len(t, hs.SentEvents(), 1, "pinning an already pinned event shouldn't change the state")
+
+	require.NoError(t, cli.PinEvent("!room:example.com", "$c"))
+	assert.Equal(t, []id.EventID{"$a", "$b", "$c"}, pinned())
+
+	require.NoError(t, cli.UnpinEvent("!room:example.com", "$b"))
+	assert.Equal(t, []id.EventID{"$a", "$c"}, pinned())
+	require.NoError(t, cli.UnpinEvent("!room:example.com", "$b"))
+	assert.Len(t, hs.SentEvents(), 3, "unpinning an event that isn't pinned shouldn't change the state")
+
+	hs.SetState("!room:example.com", event.StatePinnedEvents, "", &event.PinnedEventsEventContent{Pinned: []id.EventID{"$a", "$c", "$a"}})
+	require.NoError(t, cli.UnpinEvent("!room:example.com", "$a"))
+	assert.Equal(t, []id.EventID{"$c"}, pinned())
+}
+
+func TestClient_EnableEncryption(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+
+	cli := hs.NewClient()
+	cli.StateStore = mautrix.NewMemoryStateStore()
+	assert.False(t, cli.IsEncrypted("!room:example.com"))
+
+	resp, err := cli.EnableEncryption("!room:example.com", &event.EncryptionEventContent{RotationPeriodMessages: 50})
+	require.NoError(t, err)
+	sent := hs.SentEvents()
+	require.Len(t, sent, 1)
+	assert.Equal(t, sent[0].ID, resp.EventID)
+	assert.JSONEq(t, `{"algorithm": "m.megolm.v1.aes-sha2", "rotation_period_msgs": 50}`, string(sent[0].Content.VeryRaw))
+	assert.True(t, cli.IsEncrypted("!room:example.com"), "sent encryption event should be saved in the state store")
+	assert.Equal(t, 50, cli.StateStore.GetEncryptionEvent("!room:example.com").RotationPeriodMessages)
+
+	_, err = cli.EnableEncryption("!room:example.com", nil)
+	assert.NoError(t, err, "re-enabling with the same algorithm should be allowed")
+
+	_, err = cli.EnableEncryption("!room:example.com", &event.EncryptionEventContent{Algorithm: "com.example.other"})
+	assert.ErrorIs(t, err, mautrix.ErrEncryptionAlgorithmChange)
+	sent = hs.SentEvents()
+	require.Len(t, sent, 2)
+	assert.JSONEq(t, `{"algorithm": "m.megolm.v1.aes-sha2"}`, string(sent[1].Content.VeryRaw))
+}
+
+func TestClient_JoinedMembers(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/rooms/!room:example.com/joined_members", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"joined": {"@alice:example.com": {"display_name": "Alice", "avatar_url": "mxc://example.com/alice"}, "@bob:example.com": {}}}`))
+	})
+
+	cli := hs.NewClient()
+	cli.StateStore = mautrix.NewMemoryStateStore()
+	resp, err := cli.JoinedMembers("!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, map[id.UserID]mautrix.JoinedMember{
+		"@alice:example.com": {DisplayName: "Alice", AvatarURL: "mxc://example.com/alice"},
+		"@bob:example.com":   {},
+	}, resp.Joined)
+	assert.False(t, cli.StateStore.IsInRoom("!room:example.com", "@alice:example.com"), "JoinedMembers shouldn't modify the state store")
+}
+
+func TestClient_RetryPolicy(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	status := http.StatusBadGateway
+	hs.Handle("", "/_matrix/client/v3/test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Try again", "retry_after_ms": 1}`))
+	})
+
+	cli := hs.NewClient()
+	cli.RetryPolicy = &mautrix.RetryPolicy{MaxAttempts: 3}
+	doRequest := func(method string) int {
+		hs.ResetRequests()
+		_, err := cli.MakeFullRequest(mautrix.FullRequest{Method: method, URL: hs.Server.URL + "/_matrix/client/v3/test"})
+		var httpErr mautrix.HTTPError
+		require.ErrorAs(t, err, &httpErr)
+		requests := len(hs.Requests())
+		assert.Equal(t, requests, httpErr.Attempts, "Attempts should match the number of requests made")
+		return requests
+	}
+
+	assert.Equal(t, 3, doRequest(http.MethodGet))
+	assert.Equal(t, 3, doRequest(http.MethodPut))
+	assert.Equal(t, 1, doRequest(http.MethodPost), "POST requests shouldn't be retried by default")
+	cli.RetryPolicy.RetryNonIdempotent = true
+	assert.Equal(t, 3, doRequest(http.MethodPost))
+
+	status = http.StatusTooManyRequests
+	assert.Equal(t, 3, doRequest(http.MethodGet))
+	cli.IgnoreRateLimit = true
+	assert.Equal(t, 1, doRequest(http.MethodGet), "rate limited requests shouldn't be retried with IgnoreRateLimit")
+}
+
+func TestClient_RetryPolicy_Default(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle("", "/_matrix/client/v3/test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Try again", "retry_after_ms": 1}`))
+	})
+
+	cli := hs.NewClient()
+	cli.DefaultHTTPRetries = 2
+	doRequest := func(method string) int {
+		hs.ResetRequests()
+		_, err := cli.MakeFullRequest(mautrix.FullRequest{Method: method, URL: hs.Server.URL + "/_matrix/client/v3/test"})
+		assert.ErrorIs(t, err, mautrix.MLimitExceeded)
+		return len(hs.Requests())
+	}
+
+	assert.Equal(t, 3, doRequest(http.MethodGet))
+	assert.Equal(t, 1, doRequest(http.MethodPost), "POST requests shouldn't be retried without an explicit policy")
+}
+
+func TestClient_GetRelations(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.HandlePrefix(http.MethodGet, "/_matrix/client/v1/rooms/!room:example.com/relations/$target", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"chunk": [{"event_id": "$reaction", "type": "m.reaction", "sender": "@alice:example.com", "content": {"m.relates_to": {"rel_type": "m.annotation", "event_id": "$target", "key": "👍"}}}], "next_batch": "next"}`))
+	})
+
+	cli := hs.NewClient()
+	resp, err := cli.GetRelations("!room:example.com", "$target", nil)
+	require.NoError(t, err)
+	require.Len(t, resp.Chunk, 1)
+	assert.Equal(t, id.EventID("$reaction"), resp.Chunk[0].ID)
+	assert.Equal(t, "next", resp.NextBatch)
+
+	_, err = cli.GetRelations("!room:example.com", "$target", &mautrix.ReqGetRelations{RelationType: event.RelAnnotation})
+	require.NoError(t, err)
+	_, err = cli.GetRelations("!room:example.com", "$target", &mautrix.ReqGetRelations{
+		RelationType: event.RelAnnotation,
+		EventType:    event.EventReaction,
+		Dir:          'b',
+		From:         "next",
+		Limit:        10,
+	})
+	require.NoError(t, err)
+	var paths, queries []string
+	for _, req := range hs.Requests() {
+		paths = append(paths, req.Path)
+		queries = append(queries, req.Query.Encode())
+	}
+	assert.Equal(t, []string{
+		"/_matrix/client/v1/rooms/!room:example.com/relations/$target",
+		"/_matrix/client/v1/rooms/!room:example.com/relations/$target/m.annotation",
+		"/_matrix/client/v1/rooms/!room:example.com/relations/$target/m.annotation/m.reaction",
+	}, paths)
+	assert.Equal(t, []string{"", "", "dir=b&from=next&limit=10"}, queries)
+}
+
+func TestClient_StopSync(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	syncStarted := make(chan struct{}, 1)
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/sync", func(w http.ResponseWriter, r *http.Request) {
+		syncStarted <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			t.Error("Sync request wasn't cancelled")
+		}
+	})
+
+	cli := hs.NewClient()
+	cli.Store.SaveFilterID(cli.UserID, "filter")
+
+	runSync := func(ctx context.Context, stop func()) error {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- cli.SyncWithContext(ctx)
+		}()
+		<-syncStarted
+		stop()
+		select {
+		case err := <-errs:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Sync didn't stop")
+			return nil
+		}
+	}
+
+	assert.NoError(t, runSync(context.Background(), cli.StopSync), "StopSync should make the sync return nil")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.ErrorIs(t, runSync(ctx, cancel), context.Canceled)
+}
+
+func TestClient_GetEvent(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/rooms/!room:example.com/event/$found", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"event_id": "$found", "type": "m.room.message", "sender": "@alice:example.com", "content": {"msgtype": "m.text", "body": "hello"}}`))
+	})
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/rooms/!room:example.com/event/$missing", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteError(w, http.StatusNotFound, mautrix.MNotFound, "Event not found")
+	})
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/rooms/!room:example.com/event/$nocode", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	hs.HandlePrefix(http.MethodGet, "/_matrix/client/v3/rooms/!room:example.com/event/", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteError(w, http.StatusForbidden, mautrix.MForbidden, "Not in room")
+	})
+
+	cli := hs.NewClient()
+	evt, err := cli.GetEvent("!room:example.com", "$found")
+	require.NoError(t, err)
+	require.NotNil(t, evt.Content.AsMessage())
+	assert.Equal(t, "hello", evt.Content.AsMessage().Body)
+
+	_, err = cli.GetEvent("!room:example.com", "$missing")
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+	_, err = cli.GetEvent("!room:example.com", "$nocode")
+	assert.ErrorIs(t, err, mautrix.MNotFound, "404s without an error code should match MNotFound")
+	_, err = cli.GetEvent("!room:example.com", "$forbidden")
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	assert.False(t, errors.Is(err, mautrix.MNotFound))
+}
+
+func TestClient_UpgradeRoom(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/rooms/!old:example.com/upgrade", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespUpgradeRoom{ReplacementRoom: "!new:example.com"})
+	})
+
+	cli := hs.NewClient()
+	resp, err := cli.UpgradeRoom("!old:example.com", "10")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!new:example.com"), resp.ReplacementRoom)
+	requests := hs.Requests()
+	require.Len(t, requests, 1)
+	assert.JSONEq(t, `{"new_version": "10"}`, string(requests[0].Body))
+}
+
+func TestClient_FollowTombstones(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	for roomID, replacement := range map[id.RoomID]id.RoomID{
+		"!a:example.com":    "!b:example.com",
+		"!b:example.com":    "!c:example.com",
+		"!x:example.com":    "!y:example.com",
+		"!y:example.com":    "!x:example.com",
+		"!priv:example.com": "!forbidden:example.com",
+	} {
+		hs.SetState(roomID, event.StateTombstone, "", &event.TombstoneEventContent{Body: "This room has been replaced", ReplacementRoom: replacement})
+	}
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/rooms/!forbidden:example.com/state/m.room.tombstone", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteError(w, http.StatusForbidden, mautrix.MForbidden, "Not in room")
+	})
+
+	cli := hs.NewClient()
+	roomID, err := cli.FollowTombstones("!a:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!c:example.com"), roomID)
+	roomID, err = cli.FollowTombstones("!c:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!c:example.com"), roomID)
+	roomID, err = cli.FollowTombstones("!priv:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!forbidden:example.com"), roomID, "inaccessible replacement rooms should be treated as the newest room")
+
+	_, err = cli.FollowTombstones("!x:example.com")
+	assert.ErrorIs(t, err, mautrix.ErrTombstoneLoop)
+	for _, req := range hs.Requests() {
+		assert.True(t, strings.HasSuffix(req.Path, "/state/m.room.tombstone"), req.Path)
+	}
+}
+
+func TestClient_KnockRoom(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/knock/#room:example.com", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespKnockRoom{RoomID: "!room:example.com"})
+	})
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/knock/!closed:example.com", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteError(w, http.StatusForbidden, mautrix.MForbidden, "You are not allowed to knock on this room")
+	})
+
+	cli := hs.NewClient()
+	resp, err := cli.KnockRoom("#room:example.com", &mautrix.ReqKnockRoom{Via: []string{"example.com", "example.org"}, Reason: "Let me in"})
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!room:example.com"), resp.RoomID)
+	requests := hs.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, []string{"example.com", "example.org"}, requests[0].Query["server_name"])
+	assert.JSONEq(t, `{"reason": "Let me in"}`, string(requests[0].Body))
+
+	_, err = cli.KnockRoom("!closed:example.com")
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	assert.Contains(t, err.Error(), "You are not allowed to knock on this room")
+}
+
+func TestClient_Whoami(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.DeviceID = "DEVICE"
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/account/whoami", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespWhoami{UserID: hs.UserID, DeviceID: hs.DeviceID, IsGuest: true})
+	})
+
+	cli := hs.NewClient()
+	cli.UserID = ""
+	cli.DeviceID = ""
+	_, err := cli.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@user:example.com"), cli.UserID)
+	assert.Equal(t, id.DeviceID("DEVICE"), cli.DeviceID)
+	assert.True(t, cli.IsGuest)
+
+	cli = hs.NewClient()
+	cli.DeviceID = "OTHER"
+	_, err = cli.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, id.DeviceID("OTHER"), cli.DeviceID, "existing device ID shouldn't be overwritten")
+
+	cli = hs.NewClient()
+	cli.UserID = "@someone:example.com"
+	cli.DeviceID = ""
+	resp, err := cli.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@user:example.com"), resp.UserID)
+	assert.Equal(t, id.UserID("@someone:example.com"), cli.UserID)
+	assert.Empty(t, cli.DeviceID, "device ID of a different user shouldn't be stored")
+	assert.False(t, cli.IsGuest)
+}
+
+func TestClient_GetOrCreateFilter(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	var created int
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/user/@user:example.com/filter", func(w http.ResponseWriter, r *http.Request) {
+		created++
+		_, _ = fmt.Fprintf(w, `{"filter_id": "filter%d"}`, created)
+	})
+
+	cli := hs.NewClient()
+	filter := mautrix.DefaultFilter()
+	filterID, err := cli.GetOrCreateFilter(&filter)
+	require.NoError(t, err)
+	assert.Equal(t, "filter1", filterID)
+	sameFilter := mautrix.DefaultFilter()
+	filterID, err = cli.GetOrCreateFilter(&sameFilter)
+	require.NoError(t, err)
+	assert.Equal(t, "filter1", filterID, "filter with the same content should be reused")
+	assert.Equal(t, 1, created)
+
+	filter.Room.Timeline.Limit = 10
+	filterID, err = cli.GetOrCreateFilter(&filter)
+	require.NoError(t, err)
+	assert.Equal(t, "filter2", filterID)
+
+	cli.Store = mautrix.NewAccountDataStore("com.example.batch", cli)
+	filterID, err = cli.GetOrCreateFilter(&sameFilter)
+	require.NoError(t, err)
+	assert.Equal(t, "filter3", filterID, "filters can't be reused without a FilterHashStorer")
+}
+
+func TestDiscoverAndValidateClientAPI(t *testing.T) {
+	hs := mautrixtest.NewTLSHomeserver("@user:example.com")
+	defer hs.Close()
+	var wellKnown string
+	hs.Handle(http.MethodGet, "/.well-known/matrix/client", func(w http.ResponseWriter, r *http.Request) {
+		if wellKnown == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(wellKnown))
+	})
+	hs.Handle(http.MethodGet, "/_matrix/identity/v2", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, struct{}{})
+	})
+	// Discovery always uses HTTPS with the default transport, so make it trust the test server
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = hs.Server.Client().Transport
+	defer func() {
+		http.DefaultTransport = defaultTransport
+	}()
+	serverURL := hs.Server.URL
+	serverName := strings.TrimPrefix(serverURL, "https://")
+
+	for name, tt := range map[string]struct {
+		wellKnown string
+		action    mautrix.DiscoveryAction
+	}{
+		"NotFound":            {wellKnown: "", action: mautrix.DiscoveryIgnore},
+		"NotJSON":             {wellKnown: "not json", action: mautrix.DiscoveryFailPrompt},
+		"NoHomeserver":        {wellKnown: `{"m.homeserver": {}}`, action: mautrix.DiscoveryFailPrompt},
+		"NotMatrixServer":     {wellKnown: `{"m.homeserver": {"base_url": "` + serverURL + `/notmatrix"}}`, action: mautrix.DiscoveryFailError},
+		"BadIdentityServer":   {wellKnown: `{"m.homeserver": {"base_url": "` + serverURL + `"}, "m.identity_server": {"base_url": "` + serverURL + `/notidentity"}}`, action: mautrix.DiscoveryFailError},
+		"Valid":               {wellKnown: `{"m.homeserver": {"base_url": "` + serverURL + `"}}`},
+		"ValidIdentityServer": {wellKnown: `{"m.homeserver": {"base_url": "` + serverURL + `"}, "m.identity_server": {"base_url": "` + serverURL + `/"}}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			wellKnown = tt.wellKnown
+			resp, err := mautrix.DiscoverAndValidateClientAPI(serverName)
+			if tt.action == "" {
+				require.NoError(t, err)
+				assert.Equal(t, serverURL, resp.Homeserver.BaseURL)
+				return
+			}
+			var discoveryErr mautrix.DiscoveryError
+			require.ErrorAs(t, err, &discoveryErr)
+			assert.Equal(t, tt.action, discoveryErr.Action)
+		})
+	}
+}
+
+func TestClient_Search(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/search", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"search_categories": {"room_events": {
+			"count": 1,
+			"highlights": ["hello"],
+			"next_batch": "next",
+			"results": [{
+				"rank": 0.5,
+				"result": {"event_id": "$result", "room_id": "!room:example.com", "type": "m.room.message", "sender": "@alice:example.com", "content": {"msgtype": "m.text", "body": "hello world"}},
+				"context": {
+					"events_before": [{"event_id": "$before", "type": "m.room.message", "sender": "@bob:example.com", "content": {"msgtype": "m.text", "body": "hi"}}],
+					"events_after": [{"event_id": "$after", "type": "m.room.message", "sender": "@bob:example.com", "content": {"msgtype": "m.notice", "body": "bye"}}]
+				}
+			}],
+			"state": {"!room:example.com": [{"event_id": "$name", "type": "m.room.name", "state_key": "", "sender": "@alice:example.com", "content": {"name": "Room"}}]}
+		}}}`))
+	})
+
+	cli := hs.NewClient()
+	resp, err := cli.Search(&mautrix.ReqSearch{
+		SearchCategories: mautrix.SearchCategories{RoomEvents: &mautrix.ReqSearchRoomEvents{
+			SearchTerm:   "hello",
+			EventContext: &mautrix.SearchEventContext{BeforeLimit: 1, AfterLimit: 1},
+			IncludeState: true,
+		}},
+		NextBatch: "token",
+	})
+	require.NoError(t, err)
+	requests := hs.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "token", requests[0].Query.Get("next_batch"))
+	assert.JSONEq(t, `{"search_categories": {"room_events": {"search_term": "hello", "event_context": {"before_limit": 1, "after_limit": 1}, "include_state": true}}}`, string(requests[0].Body))
+	roomEvents := resp.SearchCategories.RoomEvents
+	assert.Equal(t, "next", roomEvents.NextBatch)
+	require.Len(t, roomEvents.Results, 1)
+	result := roomEvents.Results[0]
+	assert.Equal(t, "hello world", result.Result.Content.AsMessage().Body)
+	require.NotNil(t, result.Context)
+	require.Len(t, result.Context.EventsBefore, 1)
+	assert.Equal(t, "hi", result.Context.EventsBefore[0].Content.AsMessage().Body)
+	require.Len(t, result.Context.EventsAfter, 1)
+	assert.Equal(t, event.MsgNotice, result.Context.EventsAfter[0].Content.AsMessage().MsgType)
+	require.Len(t, roomEvents.State["!room:example.com"], 1)
+	assert.Equal(t, "Room", roomEvents.State["!room:example.com"][0].Content.AsRoomName().Name)
+}
+
+func TestClient_ThreePIDs(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	const prefix = "/_matrix/client/v3/account/3pid"
+	hs.Handle(http.MethodGet, prefix, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"threepids": [{"medium": "email", "address": "user@example.com", "added_at": 1, "validated_at": 2}]}`))
+	})
+	handleRequestToken := func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"sid": "session", "submit_url": "https://example.com/submit"}`))
+	}
+	hs.Handle(http.MethodPost, prefix+"/email/requestToken", handleRequestToken)
+	hs.Handle(http.MethodPost, prefix+"/msisdn/requestToken", handleRequestToken)
+	hs.Handle(http.MethodPost, prefix+"/add", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		if !strings.Contains(string(body), `"auth"`) {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"flows": [{"stages": ["m.login.password"]}], "session": "uia"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	})
+	hs.Handle(http.MethodPost, prefix+"/bind", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	})
+	handleUnbind := func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id_server_unbind_result": "success"}`))
+	}
+	hs.Handle(http.MethodPost, prefix+"/delete", handleUnbind)
+	hs.Handle(http.MethodPost, prefix+"/unbind", handleUnbind)
+	bodies := func(path string) []string {
+		var bodies []string
+		for _, req := range hs.RequestsTo(http.MethodPost, prefix+path) {
+			bodies = append(bodies, string(req.Body))
+		}
+		return bodies
+	}
+
+	cli := hs.NewClient()
+
+	threePIDs, err := cli.GetThreePIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []mautrix.ThreePID{{Medium: mautrix.ThreePIDMediumEmail, Address: "user@example.com", AddedAt: 1, ValidatedAt: 2}}, threePIDs.ThreePIDs)
+
+	token, err := cli.RequestEmailToken(&mautrix.ReqRequestEmailToken{ClientSecret: "secret", Email: "new@example.com", SendAttempt: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "session", token.SessionID)
+	assert.Equal(t, "https://example.com/submit", token.SubmitURL)
+	assert.JSONEq(t, `{"client_secret": "secret", "email": "new@example.com", "send_attempt": 1}`, bodies("/email/requestToken")[0])
+	_, err = cli.RequestMSISDNToken(&mautrix.ReqRequestMSISDNToken{ClientSecret: "secret", Country: "FI", PhoneNumber: "0401234567", SendAttempt: 1})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"client_secret": "secret", "country": "FI", "phone_number": "0401234567", "send_attempt": 1}`, bodies("/msisdn/requestToken")[0])
+
+	err = cli.AddThreePID(&mautrix.ReqAddThreePID{ClientSecret: "secret", SessionID: token.SessionID}, func(uia *mautrix.RespUserInteractive) interface{} {
+		return &mautrix.BaseAuthData{Type: mautrix.AuthTypePassword, Session: uia.Session}
+	})
+	require.NoError(t, err)
+	require.Len(t, bodies("/add"), 2)
+	assert.JSONEq(t, `{"client_secret": "secret", "sid": "session"}`, bodies("/add")[0])
+	assert.JSONEq(t, `{"client_secret": "secret", "sid": "session", "auth": {"type": "m.login.password", "session": "uia"}}`, bodies("/add")[1])
+
+	err = cli.BindThreePID(&mautrix.ReqBindThreePID{ClientSecret: "secret", SessionID: "idsession", IDServer: "id.example.com", IDAccessToken: "idtoken"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"client_secret": "secret", "sid": "idsession", "id_server": "id.example.com", "id_access_token": "idtoken"}`, bodies("/bind")[0])
+
+	resp, err := cli.DeleteThreePID(&mautrix.ReqThreePID{Medium: mautrix.ThreePIDMediumEmail, Address: "user@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "success", resp.IDServerUnbindResult)
+	assert.JSONEq(t, `{"medium": "email", "address": "user@example.com"}`, bodies("/delete")[0])
+	_, err = cli.UnbindThreePID(&mautrix.ReqThreePID{Medium: mautrix.ThreePIDMediumMSISDN, Address: "358401234567", IDServer: "id.example.com"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"medium": "msisdn", "address": "358401234567", "id_server": "id.example.com"}`, bodies("/unbind")[0])
+}
+
+func TestClient_BatchSendHistory(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPost, "/_matrix/client/unstable/org.matrix.msc2716/rooms/!room:example.com/batch_send", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespBatchSend{
+			EventIDs:         []id.EventID{"$event"},
+			InsertionEventID: "$insertion",
+			BatchEventID:     "$batch",
+			NextBatchID:      "next",
+		})
+	})
+	cli := hs.NewClient()
+
+	req := &mautrix.ReqBatchSend{
+		PrevEventID: "$ignored",
+		Events:      []*event.Event{{Type: event.EventMessage, Sender: "@ghost:example.com", Timestamp: 1}},
+	}
+	resp, err := cli.BatchSendHistory("!room:example.com", "$prev", "", req)
+	require.NoError(t, err)
+	assert.Equal(t, id.BatchID("next"), resp.NextBatchID)
+	assert.Equal(t, id.EventID("$insertion"), resp.InsertionEventID)
+	assert.Equal(t, []id.EventID{"$event"}, resp.EventIDs)
+	assert.Equal(t, id.EventID("$ignored"), req.PrevEventID)
+
+	_, err = cli.BatchSendHistory("!room:example.com", "$prev", "next", req)
+	require.NoError(t, err)
+
+	requests := hs.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "$prev", requests[0].Query.Get("prev_event_id"))
+	assert.False(t, requests[0].Query.Has("batch_id"))
+	assert.Equal(t, "$prev", requests[1].Query.Get("prev_event_id"))
+	assert.Equal(t, "next", requests[1].Query.Get("batch_id"))
+
+	_, err = cli.BatchSendHistory("!room:example.com", "", "", req)
+	assert.ErrorIs(t, err, mautrix.ErrBatchSendMissingPrevEvent)
+	_, err = cli.BatchSendHistory("!room:example.com", "$prev", "", &mautrix.ReqBatchSend{})
+	assert.ErrorIs(t, err, mautrix.ErrBatchSendNoEvents)
+	_, err = cli.BatchSendHistory("!room:example.com", "$prev", "", nil)
+	assert.ErrorIs(t, err, mautrix.ErrBatchSendNoEvents)
+	assert.Len(t, hs.Requests(), 2)
+}
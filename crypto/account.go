@@ -70,8 +70,12 @@ func (account *OlmAccount) getInitialKeys(userID id.UserID, deviceID id.DeviceID
 	return deviceKeys
 }
 
+// getOneTimeKeys generates enough new one-time keys to fill half of the limit and returns all unpublished keys.
+//
+// Keys that were generated previously but haven't been published yet (e.g. because the upload failed) count towards
+// the limit. The keys are not marked as published here, callers must call markKeysAsPublished after uploading them.
 func (account *OlmAccount) getOneTimeKeys(userID id.UserID, deviceID id.DeviceID, currentOTKCount int) map[id.KeyID]mautrix.OneTimeKey {
-	newCount := int(account.Internal.MaxNumberOfOneTimeKeys()/2) - currentOTKCount
+	newCount := int(account.Internal.MaxNumberOfOneTimeKeys()/2) - currentOTKCount - len(account.Internal.OneTimeKeys())
 	if newCount > 0 {
 		account.Internal.GenOneTimeKeys(uint(newCount))
 	}
@@ -87,6 +91,42 @@ func (account *OlmAccount) getOneTimeKeys(userID id.UserID, deviceID id.DeviceID
 		key.IsSigned = true
 		oneTimeKeys[id.NewKeyID(id.KeyAlgorithmSignedCurve25519, keyID)] = key
 	}
-	account.Internal.MarkKeysAsPublished()
 	return oneTimeKeys
 }
+
+// rotateFallbackKey generates a new fallback key.
+//
+// There is only one fallback key per algorithm. Unlike one-time keys, it is not removed when used,
+// so it's rotated instead when the server reports that it has been used. The previous key is kept
+// until the next rotation, so messages encrypted with it can still be decrypted.
+//
+// If the current fallback key hasn't been published yet (i.e. the previous upload failed), it's kept as-is,
+// so that the old key is only forgotten after its replacement has been uploaded successfully.
+func (account *OlmAccount) rotateFallbackKey() {
+	if len(account.Internal.UnpublishedFallbackKey()) > 0 {
+		return
+	}
+	account.Internal.ForgetOldFallbackKey()
+	account.Internal.GenFallbackKey()
+}
+
+// getFallbackKey returns the fallback key if it hasn't been published yet.
+func (account *OlmAccount) getFallbackKey(userID id.UserID, deviceID id.DeviceID) map[id.KeyID]mautrix.OneTimeKey {
+	fallbackKeys := make(map[id.KeyID]mautrix.OneTimeKey)
+	for keyID, key := range account.Internal.UnpublishedFallbackKey() {
+		key := mautrix.OneTimeKey{Key: key, Fallback: true}
+		signature, _ := account.Internal.SignJSON(key)
+		key.Signatures = mautrix.Signatures{
+			userID: {
+				id.NewKeyID(id.KeyAlgorithmEd25519, deviceID.String()): signature,
+			},
+		}
+		key.IsSigned = true
+		fallbackKeys[id.NewKeyID(id.KeyAlgorithmSignedCurve25519, keyID)] = key
+	}
+	return fallbackKeys
+}
+
+func (account *OlmAccount) markKeysAsPublished() {
+	account.Internal.MarkKeysAsPublished()
+}
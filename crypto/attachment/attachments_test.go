@@ -3,6 +3,8 @@ package attachment
 import (
 	"encoding/base64"
 	"encoding/json"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -83,3 +85,28 @@ func TestTooShortHash(t *testing.T) {
 	err := file.DecryptInPlace([]byte(helloWorldCiphertext))
 	assert.ErrorIs(t, err, InvalidHash)
 }
+
+func TestEncryptDecryptSameFile(t *testing.T) {
+	file := NewEncryptedFile()
+	data := []byte("hello world")
+	file.EncryptInPlace(data)
+	err := file.DecryptInPlace(data)
+	assert.NoError(t, err, "failed to decrypt file")
+	assert.Equal(t, "hello world", string(data), "unexpected decrypt output")
+}
+
+func TestDecryptStream(t *testing.T) {
+	file := parseHelloWorld()
+	reader := file.DecryptStream(strings.NewReader(helloWorldCiphertext))
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err, "failed to read stream")
+	assert.Equal(t, "hello world", string(data), "unexpected decrypt output")
+	assert.NoError(t, reader.Close(), "unexpected error closing stream")
+
+	file = parseHelloWorld()
+	file.Hashes.SHA256 = base64.RawStdEncoding.EncodeToString([]byte(random32Bytes))
+	reader = file.DecryptStream(strings.NewReader(helloWorldCiphertext))
+	_, err = io.ReadAll(reader)
+	assert.NoError(t, err, "failed to read stream")
+	assert.ErrorIs(t, reader.Close(), HashMismatch)
+}
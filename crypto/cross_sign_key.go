@@ -43,7 +43,29 @@ func (mach *OlmMachine) ExportCrossSigningKeys() CrossSigningSeeds {
 	}
 }
 
-func (mach *OlmMachine) ImportCrossSigningKeys(keys CrossSigningSeeds) (err error) {
+// ImportCrossSigningKeys sets the private cross-signing keys of the current user from the given seeds.
+// If the CryptoStore implements CrossSigningPrivateKeyStore, the keys are also saved there.
+func (mach *OlmMachine) ImportCrossSigningKeys(keys CrossSigningSeeds) error {
+	err := mach.setCrossSigningKeys(keys)
+	if err != nil {
+		return err
+	}
+	return mach.saveCrossSigningKeys(keys)
+}
+
+func (mach *OlmMachine) saveCrossSigningKeys(keys CrossSigningSeeds) error {
+	store, ok := mach.CryptoStore.(CrossSigningPrivateKeyStore)
+	if !ok {
+		return nil
+	}
+	err := store.PutCrossSigningSeeds(keys)
+	if err != nil {
+		return fmt.Errorf("failed to store cross-signing keys: %w", err)
+	}
+	return nil
+}
+
+func (mach *OlmMachine) setCrossSigningKeys(keys CrossSigningSeeds) (err error) {
 	var keysCache CrossSigningKeysCache
 	if keysCache.MasterKey, err = olm.NewPkSigningFromSeed(keys.MasterKey); err != nil {
 		return
@@ -82,6 +104,7 @@ func (mach *OlmMachine) GenerateCrossSigningKeys() (*CrossSigningKeysCache, erro
 }
 
 // PublishCrossSigningKeys signs and uploads the public keys of the given cross-signing keys to the server.
+// After a successful upload, the private keys are saved in the CryptoStore if it implements CrossSigningPrivateKeyStore.
 func (mach *OlmMachine) PublishCrossSigningKeys(keys *CrossSigningKeysCache, uiaCallback mautrix.UIACallback) error {
 	userID := mach.Client.UserID
 	masterKeyID := id.NewKeyID(id.KeyAlgorithmEd25519, keys.MasterKey.PublicKey.String())
@@ -139,5 +162,5 @@ func (mach *OlmMachine) PublishCrossSigningKeys(keys *CrossSigningKeysCache, uia
 	mach.CrossSigningKeys = keys
 	mach.crossSigningPubkeys = keys.PublicKeys()
 
-	return nil
+	return mach.saveCrossSigningKeys(mach.ExportCrossSigningKeys())
 }
@@ -37,6 +37,37 @@ func (mach *OlmMachine) FetchCrossSigningKeysFromSSSS(key *ssss.Key) error {
 	})
 }
 
+// BootstrapCrossSigningFromRecoveryKey verifies the given recovery key against the default SSSS key,
+// fetches the cross-signing private keys from SSSS and uses them to sign the current device.
+// If the CryptoStore implements CrossSigningPrivateKeyStore (like SQLCryptoStore), the private keys are saved
+// there encrypted with the pickle key, so they don't need to be fetched again after restarting. Otherwise
+// they're only kept in memory.
+//
+// This is the equivalent of verifying a new login with the recovery key in other clients.
+func (mach *OlmMachine) BootstrapCrossSigningFromRecoveryKey(recoveryKey string) error {
+	_, keyData, err := mach.SSSS.GetDefaultKeyData()
+	if err != nil {
+		return fmt.Errorf("failed to get default SSSS key data: %w", err)
+	}
+	key, err := keyData.VerifyRecoveryKey(recoveryKey)
+	if err != nil {
+		return err
+	}
+	err = mach.FetchCrossSigningKeysFromSSSS(key)
+	if err != nil {
+		return fmt.Errorf("failed to fetch cross-signing keys from SSSS: %w", err)
+	}
+	err = mach.SignOwnDevice(mach.OwnIdentity())
+	if err != nil {
+		return fmt.Errorf("failed to sign own device: %w", err)
+	}
+	err = mach.SignOwnMasterKey()
+	if err != nil {
+		return fmt.Errorf("failed to sign own master key: %w", err)
+	}
+	return nil
+}
+
 // retrieveDecryptXSigningKey retrieves the requested cross-signing key from SSSS and decrypts it using the given SSSS key.
 func (mach *OlmMachine) retrieveDecryptXSigningKey(keyName event.Type, key *ssss.Key) ([utils.AESCTRKeyLength]byte, error) {
 	var decryptedKey [utils.AESCTRKeyLength]byte
@@ -31,6 +31,10 @@ type megolmEvent struct {
 }
 
 // DecryptMegolmEvent decrypts an m.room.encrypted event where the algorithm is m.megolm.v1.aes-sha2
+//
+// The session is looked up using the room ID, sender key and session ID. The message index is checked to prevent
+// replay attacks, and the keys of the sending device are compared to the ones recorded when the session was received.
+// The content of the returned event is already parsed if the event type is known.
 func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, error) {
 	content, ok := evt.Content.Parsed.(*event.EncryptedEventContent)
 	if !ok {
@@ -38,6 +42,7 @@ func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, erro
 	} else if content.Algorithm != id.AlgorithmMegolmV1 {
 		return nil, UnsupportedAlgorithm
 	}
+	log := logWith(mach.Log, "room_id", evt.RoomID, "sender", evt.Sender, "session_id", content.SessionID)
 	sess, err := mach.CryptoStore.GetGroupSession(evt.RoomID, content.SenderKey, content.SessionID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get group session: %w", err)
@@ -45,6 +50,9 @@ func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, erro
 		return nil, fmt.Errorf("%w (ID %s)", NoSessionFound, content.SessionID)
 	} else if content.SenderKey != "" && content.SenderKey != sess.SenderKey {
 		return nil, SenderKeyMismatch
+	} else if sess.RoomID != "" && sess.RoomID != evt.RoomID {
+		// The store should already filter by room ID, but check here too in case a custom store doesn't.
+		return nil, WrongRoom
 	}
 	plaintext, messageIndex, err := sess.Internal.Decrypt(content.MegolmCiphertext)
 	if err != nil {
@@ -65,11 +73,11 @@ func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, erro
 		device, err = mach.GetOrFetchDeviceByKey(evt.Sender, sess.SenderKey)
 		if err != nil {
 			// We don't want to throw these errors as the message can still be decrypted.
-			mach.Log.Debug("Failed to get device %s/%s to verify session %s: %v", evt.Sender, sess.SenderKey, sess.ID(), err)
+			log.Debug("Failed to get device %s/%s to verify session %s: %v", evt.Sender, sess.SenderKey, sess.ID(), err)
 			trustLevel = id.TrustStateUnknownDevice
 		} else if len(sess.ForwardingChains) == 0 || (len(sess.ForwardingChains) == 1 && sess.ForwardingChains[0] == sess.SenderKey.String()) {
 			if device == nil {
-				mach.Log.Debug("Couldn't resolve trust level of session %s: sent by unknown device %s/%s", sess.ID(), evt.Sender, sess.SenderKey)
+				log.Debug("Couldn't resolve trust level of session %s: sent by unknown device %s/%s", sess.ID(), evt.Sender, sess.SenderKey)
 				trustLevel = id.TrustStateUnknownDevice
 			} else if device.SigningKey != sess.SigningKey || device.IdentityKey != sess.SenderKey {
 				return nil, DeviceKeyMismatch
@@ -83,7 +91,7 @@ func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, erro
 			if device != nil {
 				trustLevel = mach.ResolveTrust(device)
 			} else {
-				mach.Log.Debug("Couldn't resolve trust level of session %s: forwarding chain ends with unknown device %s", sess.ID(), lastChainItem)
+				log.Debug("Couldn't resolve trust level of session %s: forwarding chain ends with unknown device %s", sess.ID(), lastChainItem)
 				trustLevel = id.TrustStateForwarded
 			}
 		}
@@ -100,7 +108,7 @@ func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, erro
 	err = megolmEvt.Content.ParseRaw(megolmEvt.Type)
 	if err != nil {
 		if event.IsUnsupportedContentType(err) {
-			mach.Log.Warn("Unsupported event type %s in encrypted event %s", megolmEvt.Type.Repr(), evt.ID)
+			log.Warn("Unsupported event type %s in encrypted event %s", megolmEvt.Type.Repr(), evt.ID)
 		} else {
 			return nil, fmt.Errorf("failed to parse content of megolm payload event: %w", err)
 		}
@@ -111,13 +119,12 @@ func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, erro
 			if relatable.OptionalGetRelatesTo() == nil {
 				relatable.SetRelatesTo(content.RelatesTo)
 			} else {
-				mach.Log.Trace("Not overriding relation data in %s, as encrypted payload already has it", evt.ID)
+				log.Trace("Not overriding relation data in %s, as encrypted payload already has it", evt.ID)
 			}
 		} else {
-			mach.Log.Warn("Encrypted event %s has relation data, but content type %T (%s) doesn't support it", evt.ID, megolmEvt.Content.Parsed, megolmEvt.Type.String())
+			log.Warn("Encrypted event %s has relation data, but content type %T (%s) doesn't support it", evt.ID, megolmEvt.Content.Parsed, megolmEvt.Type.String())
 		}
 	}
-	megolmEvt.Type.Class = evt.Type.Class
 	return &event.Event{
 		Sender:    evt.Sender,
 		Type:      megolmEvt.Type,
@@ -200,6 +200,10 @@ func (mach *OlmMachine) tryDecryptOlmCiphertextWithExistingSession(senderKey id.
 	return nil, nil
 }
 
+// createInboundSession creates a new Olm session from a prekey message.
+//
+// libolm looks up the key used by the sender from both the one-time keys and the current and previous fallback keys.
+// Used one-time keys are removed from the account, while fallback keys are kept until they're rotated.
 func (mach *OlmMachine) createInboundSession(senderKey id.SenderKey, ciphertext string) (*OlmSession, error) {
 	session, err := mach.account.NewInboundSessionFrom(senderKey, ciphertext)
 	if err != nil {
@@ -209,12 +213,51 @@ func (mach *OlmMachine) createInboundSession(senderKey id.SenderKey, ciphertext
 	err = mach.CryptoStore.AddSession(senderKey, session)
 	if err != nil {
 		mach.Log.Error("Failed to store created inbound session: %v", err)
+	} else {
+		mach.pruneOlmSessions(senderKey)
 	}
 	return session, nil
 }
 
+// pruneOlmSessions deletes the Olm sessions with the given sender key that are over the limits
+// set in MaxOlmSessionsPerSender and MaxOlmSessionAge.
+func (mach *OlmMachine) pruneOlmSessions(senderKey id.SenderKey) {
+	if mach.MaxOlmSessionsPerSender <= 0 && mach.MaxOlmSessionAge <= 0 {
+		return
+	}
+	deleter, ok := mach.CryptoStore.(OlmSessionDeleter)
+	if !ok {
+		return
+	}
+	sessions, err := mach.CryptoStore.GetSessions(senderKey)
+	if err != nil {
+		mach.Log.Warn("Failed to get sessions with %s for pruning: %v", senderKey, err)
+		return
+	}
+	cutoff := time.Now().Add(-mach.MaxOlmSessionAge)
+	// The sessions are sorted by last use, so skip the first one to never delete the only usable session
+	for i := 1; i < len(sessions); i++ {
+		session := sessions[i]
+		tooMany := mach.MaxOlmSessionsPerSender > 0 && i >= mach.MaxOlmSessionsPerSender
+		tooOld := mach.MaxOlmSessionAge > 0 && session.LastUsed().Before(cutoff)
+		if !tooMany && !tooOld {
+			continue
+		}
+		err = deleter.DeleteSession(senderKey, session)
+		if err != nil {
+			mach.Log.Warn("Failed to delete old Olm session %s/%s: %v", senderKey, session.ID(), err)
+		} else {
+			mach.Log.Debug("Deleted old Olm session %s/%s (last used at %s)", senderKey, session.ID(), session.LastUsed())
+		}
+	}
+}
+
+// MinUnwedgeInterval is the minimum time between attempts to unwedge the Olm session with a single device.
 const MinUnwedgeInterval = 1 * time.Hour
 
+// unwedgeDevice creates a new Olm session with the given device by claiming a new one-time key and sending an
+// encrypted m.dummy event. This is done when decrypting an Olm event from the device fails, which usually means
+// the sessions have gone out of sync. Attempts are rate limited to one per MinUnwedgeInterval per device.
 func (mach *OlmMachine) unwedgeDevice(sender id.UserID, senderKey id.SenderKey) {
 	mach.recentlyUnwedgedLock.Lock()
 	prevUnwedge, ok := mach.recentlyUnwedged[senderKey]
@@ -81,6 +81,8 @@ func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeU
 		if err != nil {
 			mach.Log.Warn("Failed to filter tracked user list: %v", err)
 		}
+		// The device lists are marked as up-to-date again below if fetching them succeeds
+		mach.markDeviceListsOutdated(users)
 	}
 	if len(users) == 0 {
 		return
@@ -129,6 +131,8 @@ func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeU
 		err = mach.CryptoStore.PutDevices(userID, newDevices)
 		if err != nil {
 			mach.Log.Warn("Failed to update device list for %s: %v", userID, err)
+		} else {
+			mach.markDeviceListUpToDate(userID)
 		}
 		data[userID] = newDevices
 
@@ -148,6 +152,31 @@ func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeU
 	return data
 }
 
+// markDeviceListsOutdated marks the device lists of the given users as outdated,
+// so they'll be fetched again before sharing a group session with them.
+func (mach *OlmMachine) markDeviceListsOutdated(users []id.UserID) {
+	mach.outdatedDeviceListsLock.Lock()
+	for _, userID := range users {
+		mach.outdatedDeviceLists[userID] = struct{}{}
+	}
+	mach.outdatedDeviceListsLock.Unlock()
+}
+
+func (mach *OlmMachine) markDeviceListUpToDate(userID id.UserID) {
+	mach.outdatedDeviceListsLock.Lock()
+	delete(mach.outdatedDeviceLists, userID)
+	mach.outdatedDeviceListsLock.Unlock()
+}
+
+// IsDeviceListOutdated returns true if a device list change has been noticed for the given user,
+// but the new device list hasn't been fetched yet.
+func (mach *OlmMachine) IsDeviceListOutdated(userID id.UserID) bool {
+	mach.outdatedDeviceListsLock.Lock()
+	_, outdated := mach.outdatedDeviceLists[userID]
+	mach.outdatedDeviceListsLock.Unlock()
+	return outdated
+}
+
 // OnDevicesChanged finds all shared rooms with the given user and invalidates outbound sessions in those rooms.
 //
 // This is called automatically whenever a device list change is noticed in ProcessSyncResponse and usually does
@@ -17,8 +17,9 @@ import (
 )
 
 var (
-	AlreadyShared  = errors.New("group session already shared")
-	NoGroupSession = errors.New("no group session created")
+	AlreadyShared    = errors.New("group session already shared")
+	NoGroupSession   = errors.New("no group session created")
+	RoomNotEncrypted = errors.New("room is not encrypted")
 )
 
 func getRelatesTo(content interface{}) *event.RelatesTo {
@@ -48,8 +49,28 @@ func IsShareError(err error) bool {
 //
 // If you use the event.Content struct, make sure you pass a pointer to the struct,
 // as JSON serialization will not work correctly otherwise.
+//
+// RoomNotEncrypted is returned if the StateStore doesn't have a m.room.encryption event for the room.
+// Client.EnableEncryption saves the event in the client's StateStore, so rooms encrypted that way can be
+// used immediately, but rooms where encryption was enabled elsewhere are only known after the event is synced.
+//
+// The outbound session is rotated based on the rotation_period_msgs and rotation_period_ms fields of the room's
+// m.room.encryption event. If there's no session or the session has expired, an error matching IsShareError is
+// returned, and ShareGroupSession must be called with the room members before trying again:
+//
+//	encrypted, err := mach.EncryptMegolmEvent(roomID, event.EventMessage, content)
+//	if crypto.IsShareError(err) {
+//		err = mach.ShareGroupSession(roomID, members)
+//		if err == nil {
+//			encrypted, err = mach.EncryptMegolmEvent(roomID, event.EventMessage, content)
+//		}
+//	}
 func (mach *OlmMachine) EncryptMegolmEvent(roomID id.RoomID, evtType event.Type, content interface{}) (*event.EncryptedEventContent, error) {
-	mach.Log.Trace("Encrypting event of type %s for %s", evtType.Type, roomID)
+	log := logWith(mach.Log, "room_id", roomID)
+	log.Trace("Encrypting event of type %s for %s", evtType.Type, roomID)
+	if !mach.StateStore.IsEncrypted(roomID) {
+		return nil, RoomNotEncrypted
+	}
 	session, err := mach.CryptoStore.GetOutboundGroupSession(roomID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get outbound group session: %w", err)
@@ -70,7 +91,7 @@ func (mach *OlmMachine) EncryptMegolmEvent(roomID id.RoomID, evtType event.Type,
 	}
 	err = mach.CryptoStore.UpdateOutboundGroupSession(session)
 	if err != nil {
-		mach.Log.Warn("Failed to update megolm session in crypto store after encrypting: %v", err)
+		logWith(log, "session_id", session.ID()).Warn("Failed to update megolm session in crypto store after encrypting: %v", err)
 	}
 	return &event.EncryptedEventContent{
 		Algorithm:        id.AlgorithmMegolmV1,
@@ -98,8 +119,11 @@ type deviceSessionWrapper struct {
 
 // ShareGroupSession shares a group session for a specific room with all the devices of the given user list.
 //
-// For devices with TrustStateBlacklisted, a m.room_key.withheld event with code=m.blacklisted is sent.
-// If AllowUnverifiedDevices is false, a similar event with code=m.unverified is sent to devices with TrustStateUnset
+// Olm sessions are created for devices that don't have one yet by claiming one-time keys.
+//
+// Each device is checked with AllowGroupSessionShare. By default, devices with TrustStateBlacklisted get
+// a m.room_key.withheld event with code=m.blacklisted and devices whose trust state is below SendKeysMinTrust
+// get a similar event with code=m.unverified. Skipped devices can be found with OutboundGroupSession.WithheldDevices.
 func (mach *OlmMachine) ShareGroupSession(roomID id.RoomID, users []id.UserID) error {
 	mach.Log.Debug("Sharing group session for room %s to %v", roomID, users)
 	session, err := mach.CryptoStore.GetOutboundGroupSession(roomID)
@@ -118,6 +142,7 @@ func (mach *OlmMachine) ShareGroupSession(roomID id.RoomID, users []id.UserID) e
 	missingSessions := make(map[id.UserID]map[id.DeviceID]*id.Device)
 	missingUserSessions := make(map[id.DeviceID]*id.Device)
 	var fetchKeys []id.UserID
+	cachedDevices := make(map[id.UserID]map[id.DeviceID]*id.Device)
 
 	for _, userID := range users {
 		devices, err := mach.CryptoStore.GetDevices(userID)
@@ -126,6 +151,10 @@ func (mach *OlmMachine) ShareGroupSession(roomID id.RoomID, users []id.UserID) e
 		} else if devices == nil {
 			mach.Log.Trace("GetDevices returned nil for %s, will fetch keys and retry", userID)
 			fetchKeys = append(fetchKeys, userID)
+		} else if mach.IsDeviceListOutdated(userID) {
+			mach.Log.Trace("Device list of %s is outdated, will fetch keys and retry", userID)
+			fetchKeys = append(fetchKeys, userID)
+			cachedDevices[userID] = devices
 		} else if len(devices) == 0 {
 			mach.Log.Trace("%s has no devices, skipping", userID)
 		} else {
@@ -147,9 +176,16 @@ func (mach *OlmMachine) ShareGroupSession(roomID id.RoomID, users []id.UserID) e
 
 	if len(fetchKeys) > 0 {
 		mach.Log.Trace("Fetching missing keys for %v", fetchKeys)
-		for userID, devices := range mach.fetchKeys(fetchKeys, "", true) {
-			mach.Log.Trace("Got %d device keys for %s", len(devices), userID)
-			missingSessions[userID] = devices
+		fetched := mach.fetchKeys(fetchKeys, "", true)
+		for _, userID := range fetchKeys {
+			if devices, ok := fetched[userID]; ok {
+				mach.Log.Trace("Got %d device keys for %s", len(devices), userID)
+				missingSessions[userID] = devices
+			} else if devices, ok = cachedDevices[userID]; ok {
+				// Don't leave the user without the room key just because the re-fetch failed.
+				mach.Log.Warn("Failed to re-fetch outdated device list of %s, using %d cached devices", userID, len(devices))
+				missingSessions[userID] = devices
+			}
 		}
 	}
 
@@ -241,34 +277,18 @@ func (mach *OlmMachine) findOlmSessionsForUser(session *OutboundGroupSession, us
 			continue
 		} else if userID == mach.Client.UserID && deviceID == mach.Client.DeviceID {
 			session.Users[userKey] = OGSIgnored
-		} else if device.Trust == id.TrustStateBlacklisted {
-			mach.Log.Debug(
-				"Not encrypting group session %s for %s of %s: device is blacklisted",
-				session.ID(), deviceID, userID,
-			)
-			withheld[deviceID] = &event.Content{Parsed: &event.RoomKeyWithheldEventContent{
-				RoomID:    session.RoomID,
-				Algorithm: id.AlgorithmMegolmV1,
-				SessionID: session.ID(),
-				SenderKey: mach.account.IdentityKey(),
-				Code:      event.RoomKeyWithheldBlacklisted,
-				Reason:    "Device is blacklisted",
-			}}
-			session.Users[userKey] = OGSIgnored
-		} else if trustState := mach.ResolveTrust(device); trustState < mach.SendKeysMinTrust {
-			mach.Log.Debug(
-				"Not encrypting group session %s for %s of %s: device is not verified (minimum: %s, device: %s)",
-				session.ID(), deviceID, userID, mach.SendKeysMinTrust, trustState,
-			)
-			withheld[deviceID] = &event.Content{Parsed: &event.RoomKeyWithheldEventContent{
-				RoomID:    session.RoomID,
-				Algorithm: id.AlgorithmMegolmV1,
-				SessionID: session.ID(),
-				SenderKey: mach.account.IdentityKey(),
-				Code:      event.RoomKeyWithheldUnverified,
-				Reason:    "This device does not encrypt messages for unverified devices",
-			}}
-			session.Users[userKey] = OGSIgnored
+		} else if rejection := mach.AllowGroupSessionShare(device, session.RoomID); rejection != nil {
+			if rejection.Code != "" {
+				withheld[deviceID] = &event.Content{Parsed: &event.RoomKeyWithheldEventContent{
+					RoomID:    session.RoomID,
+					Algorithm: id.AlgorithmMegolmV1,
+					SessionID: session.ID(),
+					SenderKey: mach.account.IdentityKey(),
+					Code:      rejection.Code,
+					Reason:    rejection.Reason,
+				}}
+			}
+			session.Users[userKey] = OGSWithheld
 		} else if deviceSession, err := mach.CryptoStore.GetLatestSession(device.IdentityKey); err != nil {
 			mach.Log.Error("Failed to get session for %s of %s: %v", deviceID, userID, err)
 		} else if deviceSession == nil {
@@ -285,3 +305,17 @@ func (mach *OlmMachine) findOlmSessionsForUser(session *OutboundGroupSession, us
 		}
 	}
 }
+
+func (mach *OlmMachine) defaultAllowGroupSessionShare(device *id.Device, roomID id.RoomID) *KeyShareRejection {
+	if device.Trust == id.TrustStateBlacklisted {
+		mach.Log.Debug("Not encrypting group session in %s for %s of %s: device is blacklisted", roomID, device.DeviceID, device.UserID)
+		return &GroupSessionShareRejectBlacklisted
+	} else if trustState := mach.ResolveTrust(device); trustState < mach.SendKeysMinTrust {
+		mach.Log.Debug(
+			"Not encrypting group session in %s for %s of %s: device is not verified (minimum: %s, device: %s)",
+			roomID, device.DeviceID, device.UserID, mach.SendKeysMinTrust, trustState,
+		)
+		return &GroupSessionShareRejectUnverified
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/mautrixtest"
+)
+
+type unencryptedStateStore struct {
+	mockStateStore
+}
+
+func (unencryptedStateStore) IsEncrypted(id.RoomID) bool {
+	return false
+}
+
+func TestEncryptMegolmEvent_RoomNotEncrypted(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	machine.StateStore = unencryptedStateStore{}
+
+	_, err := machine.EncryptMegolmEvent("room1", event.EventMessage, &event.MessageEventContent{Body: "hello"})
+	if err != RoomNotEncrypted {
+		t.Errorf("Expected RoomNotEncrypted, got %v", err)
+	}
+}
+
+func TestShareGroupSession_OutdatedDeviceListFetchFails(t *testing.T) {
+	machineOut, storeFileNameOut := newMachine(t, "user1")
+	defer os.Remove(storeFileNameOut)
+	machineIn, storeFileNameIn := newMachine(t, "user2")
+	defer os.Remove(storeFileNameIn)
+
+	hs := mautrixtest.NewHomeserver("user1")
+	defer hs.Close()
+	useHomeserver(machineOut, hs)
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/keys/query", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteError(w, http.StatusInternalServerError, mautrix.RespError{ErrCode: "M_UNKNOWN"}, "internal error")
+	})
+
+	// create an olm session with the receiving device so that no keys need to be claimed
+	otks := machineIn.account.getOneTimeKeys("user2", "device2", 0)
+	var otk mautrix.OneTimeKey
+	for _, otkTmp := range otks {
+		otk = otkTmp
+		break
+	}
+	olmSession, err := machineOut.account.Internal.NewOutboundSession(machineIn.account.IdentityKey(), otk.Key)
+	if err != nil {
+		t.Fatalf("Failed to create outbound olm session: %v", err)
+	}
+	machineOut.CryptoStore.AddSession(machineIn.account.IdentityKey(), wrapSession(olmSession))
+
+	// store the receiving device in the sending machine, but mark the device list as outdated
+	machineOut.CryptoStore.PutDevices("user2", map[id.DeviceID]*id.Device{
+		"device2": {
+			UserID:      "user2",
+			DeviceID:    "device2",
+			IdentityKey: machineIn.account.IdentityKey(),
+			SigningKey:  machineIn.account.SigningKey(),
+		},
+	})
+	machineOut.markDeviceListsOutdated([]id.UserID{"user2"})
+
+	if err = machineOut.ShareGroupSession("room1", []id.UserID{"user2"}); err != nil {
+		t.Fatalf("Failed to share group session: %v", err)
+	}
+	var sentTo []id.UserID
+	for _, msg := range hs.SentToDevice() {
+		if msg.Type.Type == event.ToDeviceEncrypted.Type {
+			sentTo = append(sentTo, msg.UserID)
+		}
+	}
+	if len(sentTo) != 1 || sentTo[0] != "user2" {
+		t.Errorf("Expected room key to be sent to user2 using cached devices, got %v", sentTo)
+	}
+}
+
+func TestShareGroupSession_Withheld(t *testing.T) {
+	machineOut, storeFileNameOut := newMachine(t, "user1")
+	defer os.Remove(storeFileNameOut)
+	machineIn, storeFileNameIn := newMachine(t, "user2")
+	defer os.Remove(storeFileNameIn)
+
+	hs := mautrixtest.NewHomeserver("user1")
+	defer hs.Close()
+	useHomeserver(machineOut, hs)
+
+	otks := machineIn.account.getOneTimeKeys("user2", "device2", 0)
+	var otk mautrix.OneTimeKey
+	for _, otkTmp := range otks {
+		otk = otkTmp
+		break
+	}
+	olmSession, err := machineOut.account.Internal.NewOutboundSession(machineIn.account.IdentityKey(), otk.Key)
+	if err != nil {
+		t.Fatalf("Failed to create outbound olm session: %v", err)
+	}
+	machineOut.CryptoStore.AddSession(machineIn.account.IdentityKey(), wrapSession(olmSession))
+
+	machineOut.CryptoStore.PutDevices("user2", map[id.DeviceID]*id.Device{
+		"device2": {
+			UserID:      "user2",
+			DeviceID:    "device2",
+			IdentityKey: machineIn.account.IdentityKey(),
+			SigningKey:  machineIn.account.SigningKey(),
+		},
+		"blacklisted": {
+			UserID:      "user2",
+			DeviceID:    "blacklisted",
+			IdentityKey: NewOlmAccount().IdentityKey(),
+			Trust:       id.TrustStateBlacklisted,
+		},
+		"silent": {
+			UserID:      "user2",
+			DeviceID:    "silent",
+			IdentityKey: NewOlmAccount().IdentityKey(),
+		},
+	})
+	machineOut.AllowGroupSessionShare = func(device *id.Device, roomID id.RoomID) *KeyShareRejection {
+		if device.DeviceID == "silent" {
+			return &KeyShareRejectNoResponse
+		}
+		return machineOut.defaultAllowGroupSessionShare(device, roomID)
+	}
+
+	if err = machineOut.ShareGroupSession("room1", []id.UserID{"user2"}); err != nil {
+		t.Fatalf("Failed to share group session: %v", err)
+	}
+	sent := make(map[string]map[id.DeviceID]*event.Content)
+	for _, msg := range hs.SentToDevice() {
+		if msg.UserID != "user2" {
+			continue
+		} else if sent[msg.Type.Type] == nil {
+			sent[msg.Type.Type] = make(map[id.DeviceID]*event.Content)
+		}
+		sent[msg.Type.Type][msg.DeviceID] = msg.Content
+	}
+	if _, ok := sent[event.ToDeviceEncrypted.Type]["device2"]; !ok || len(sent[event.ToDeviceEncrypted.Type]) != 1 {
+		t.Errorf("Expected room key to be sent only to device2, got %v", sent[event.ToDeviceEncrypted.Type])
+	}
+	withheld := sent[event.ToDeviceRoomKeyWithheld.Type]
+	if len(withheld) != 1 || withheld["blacklisted"] == nil {
+		t.Fatalf("Expected withheld event to be sent only to the blacklisted device, got %v", withheld)
+	} else if code, _ := withheld["blacklisted"].Raw["code"].(string); code != string(event.RoomKeyWithheldBlacklisted) {
+		t.Errorf("Expected withheld code %s, got %s", event.RoomKeyWithheldBlacklisted, code)
+	}
+
+	session, err := machineOut.CryptoStore.GetOutboundGroupSession("room1")
+	if err != nil || session == nil {
+		t.Fatalf("Failed to get outbound session: %v", err)
+	}
+	withheldDevices := session.WithheldDevices()
+	if len(withheldDevices) != 2 {
+		t.Errorf("Expected 2 withheld devices, got %v", withheldDevices)
+	}
+}
@@ -54,13 +54,18 @@ func (mach *OlmMachine) shouldCreateNewSession(identityKey id.IdentityKey) bool
 	}
 	mach.devicesToUnwedgeLock.Lock()
 	_, shouldUnwedge := mach.devicesToUnwedge[identityKey]
-	if shouldUnwedge {
-		delete(mach.devicesToUnwedge, identityKey)
-	}
 	mach.devicesToUnwedgeLock.Unlock()
 	return shouldUnwedge
 }
 
+// markDeviceUnwedged clears the wedged flag of the given device after a new session has been created with it.
+// The flag isn't cleared earlier, so that failing to claim a one-time key is retried the next time something is sent.
+func (mach *OlmMachine) markDeviceUnwedged(identityKey id.IdentityKey) {
+	mach.devicesToUnwedgeLock.Lock()
+	delete(mach.devicesToUnwedge, identityKey)
+	mach.devicesToUnwedgeLock.Unlock()
+}
+
 func (mach *OlmMachine) createOutboundSessions(input map[id.UserID]map[id.DeviceID]*id.Device) error {
 	request := make(mautrix.OneTimeKeysRequest)
 	for userID, devices := range input {
@@ -110,6 +115,8 @@ func (mach *OlmMachine) createOutboundSessions(input map[id.UserID]map[id.Device
 					mach.Log.Error("Failed to store created session for %s of %s: %v", deviceID, userID, err)
 				} else {
 					mach.Log.Debug("Created new Olm session with %s/%s (OTK ID: %s)", userID, deviceID, keyIndex)
+					mach.markDeviceUnwedged(identity.IdentityKey)
+					mach.pruneOlmSessions(identity.IdentityKey)
 				}
 			}
 		}
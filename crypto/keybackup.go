@@ -0,0 +1,298 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrUnsupportedBackupAlgorithm = errors.New("unsupported key backup algorithm")
+	ErrInvalidBackupRecoveryKey   = errors.New("invalid key backup recovery key")
+	ErrMismatchingBackupKey       = errors.New("recovery key doesn't match the public key of the key backup")
+)
+
+// MegolmBackupAuthData is the auth_data of m.megolm_backup.v1.curve25519-aes-sha2 key backups.
+type MegolmBackupAuthData struct {
+	PublicKey  id.Curve25519      `json:"public_key"`
+	Signatures mautrix.Signatures `json:"signatures,omitempty"`
+}
+
+// EncryptedBackupSessionData is the session_data of a session in a m.megolm_backup.v1.curve25519-aes-sha2 key backup.
+type EncryptedBackupSessionData struct {
+	Ciphertext string `json:"ciphertext"`
+	Ephemeral  string `json:"ephemeral"`
+	MAC        string `json:"mac"`
+}
+
+// BackupSessionData is the decrypted form of EncryptedBackupSessionData.
+type BackupSessionData struct {
+	Algorithm         id.Algorithm      `json:"algorithm"`
+	ForwardingChains  []string          `json:"forwarding_curve25519_key_chain"`
+	SenderClaimedKeys SenderClaimedKeys `json:"sender_claimed_keys"`
+	SenderKey         id.SenderKey      `json:"sender_key"`
+	SessionKey        string            `json:"session_key"`
+}
+
+func (mach *OlmMachine) getMegolmBackupAuthData(version string) (*MegolmBackupAuthData, error) {
+	versionInfo, err := mach.Client.GetKeyBackupVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key backup version info: %w", err)
+	} else if versionInfo.Algorithm != id.KeyBackupAlgorithmMegolmBackupV1 {
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedBackupAlgorithm, versionInfo.Algorithm)
+	}
+	var authData MegolmBackupAuthData
+	err = json.Unmarshal(versionInfo.AuthData, &authData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key backup auth data: %w", err)
+	}
+	return &authData, nil
+}
+
+// CreateKeyBackupVersion generates a new key pair for server-side key backups and creates a new backup version with it.
+//
+// The returned recovery key contains the private key, which is needed for restoring keys from the backup.
+// It's not stored anywhere, so it must be shown to the user (or stored in SSSS).
+func (mach *OlmMachine) CreateKeyBackupVersion() (version, recoveryKey string, err error) {
+	privateKey := make([]byte, olm.PkPrivateKeyLength())
+	_, err = rand.Read(privateKey)
+	if err != nil {
+		panic(olm.NotEnoughGoRandom)
+	}
+	decryption, err := olm.NewPkDecryption(privateKey)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create key pair: %w", err)
+	}
+	authData := MegolmBackupAuthData{PublicKey: decryption.PublicKey}
+	signature, err := mach.account.Internal.SignJSON(authData)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to sign auth data: %w", err)
+	}
+	authData.Signatures = mautrix.Signatures{
+		mach.Client.UserID: {
+			id.NewKeyID(id.KeyAlgorithmEd25519, mach.Client.DeviceID.String()): signature,
+		},
+	}
+	authDataJSON, err := json.Marshal(&authData)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal auth data: %w", err)
+	}
+	resp, err := mach.Client.CreateKeyBackupVersion(&mautrix.ReqRoomKeysVersionCreate{
+		Algorithm: id.KeyBackupAlgorithmMegolmBackupV1,
+		AuthData:  authDataJSON,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return resp.Version, utils.EncodeBase58RecoveryKey(privateKey), nil
+}
+
+// keyBackupBatchSize is the maximum number of sessions BackupRoomKeys uploads in a single request.
+const keyBackupBatchSize = 100
+
+// isSessionVerifiedForBackup checks whether the given session should be marked as verified in the key backup.
+// Sessions are verified if they were created by this device, or received directly from a trusted device
+// whose signing key matches the one claimed by the session.
+func (mach *OlmMachine) isSessionVerifiedForBackup(session *InboundGroupSession) bool {
+	if len(session.ForwardingChains) > 0 {
+		return false
+	}
+	ownSigningKey, ownIdentityKey := mach.account.Keys()
+	if session.SigningKey == ownSigningKey && session.SenderKey == ownIdentityKey {
+		return true
+	}
+	finder, ok := mach.CryptoStore.(DeviceByIdentityKeyFinder)
+	if !ok {
+		return false
+	}
+	device, err := finder.FindDeviceByIdentityKey(session.SenderKey)
+	if err != nil {
+		mach.Log.Warn("Failed to find sender device of Megolm session %s/%s: %v", session.RoomID, session.ID(), err)
+		return false
+	}
+	return device != nil && device.SigningKey == session.SigningKey && mach.IsDeviceTrusted(device)
+}
+
+func encryptSessionForBackup(encryption *olm.PkEncryption, session *InboundGroupSession, isVerified bool) (*mautrix.KeyBackupData, error) {
+	firstKnownIndex := session.Internal.FirstKnownIndex()
+	sessionKey, err := session.Internal.Export(firstKnownIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export session: %w", err)
+	}
+	plaintext, err := json.Marshal(&BackupSessionData{
+		Algorithm:         id.AlgorithmMegolmV1,
+		ForwardingChains:  session.ForwardingChains,
+		SenderClaimedKeys: SenderClaimedKeys{Ed25519: session.SigningKey},
+		SenderKey:         session.SenderKey,
+		SessionKey:        sessionKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal session data: %w", err)
+	}
+	ciphertext, mac, ephemeral, err := encryption.Encrypt(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt session data: %w", err)
+	}
+	sessionData, err := json.Marshal(&EncryptedBackupSessionData{
+		Ciphertext: string(ciphertext),
+		Ephemeral:  string(ephemeral),
+		MAC:        string(mac),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mautrix.KeyBackupData{
+		FirstMessageIndex: int(firstKnownIndex),
+		ForwardedCount:    len(session.ForwardingChains),
+		IsVerified:        isVerified,
+		SessionData:       sessionData,
+	}, nil
+}
+
+// BackupRoomKeys uploads all inbound Megolm sessions in the crypto store to the given server-side key backup version.
+//
+// Sessions that are already in the backup are only uploaded if the local copy is better than the backed up one
+// (see mautrix.KeyBackupData.IsBetterThan). Sessions are uploaded in batches, so if an upload fails, the
+// sessions in earlier batches will still be in the backup. Returns the number of sessions that were uploaded.
+func (mach *OlmMachine) BackupRoomKeys(version string) (int, error) {
+	authData, err := mach.getMegolmBackupAuthData(version)
+	if err != nil {
+		return 0, err
+	}
+	encryption, err := olm.NewPkEncryption(authData.PublicKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to initialize encryption with backup public key: %w", err)
+	}
+	existingBackup, err := mach.Client.GetKeyBackup(version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get existing backed up keys: %w", err)
+	}
+	sessions, err := mach.CryptoStore.GetAllGroupSessions()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get sessions from store: %w", err)
+	}
+
+	req := mautrix.ReqKeyBackup{Rooms: make(map[id.RoomID]mautrix.RoomKeyBackup)}
+	count, batchCount := 0, 0
+	uploadBatch := func() error {
+		if batchCount == 0 {
+			return nil
+		}
+		_, err := mach.Client.PutKeysInBackup(version, &req)
+		if err != nil {
+			return err
+		}
+		count += batchCount
+		batchCount = 0
+		req = mautrix.ReqKeyBackup{Rooms: make(map[id.RoomID]mautrix.RoomKeyBackup)}
+		return nil
+	}
+	for _, session := range sessions {
+		data, err := encryptSessionForBackup(encryption, session, mach.isSessionVerifiedForBackup(session))
+		if err != nil {
+			mach.Log.Warn("Failed to encrypt Megolm session %s/%s for backup: %v", session.RoomID, session.ID(), err)
+			continue
+		}
+		existing, ok := existingBackup.Rooms[session.RoomID].Sessions[session.ID()]
+		if ok && !data.IsBetterThan(&existing) {
+			continue
+		}
+		room, ok := req.Rooms[session.RoomID]
+		if !ok {
+			room = mautrix.RoomKeyBackup{Sessions: make(map[id.SessionID]mautrix.KeyBackupData)}
+			req.Rooms[session.RoomID] = room
+		}
+		room.Sessions[session.ID()] = *data
+		batchCount++
+		if batchCount >= keyBackupBatchSize {
+			if err = uploadBatch(); err != nil {
+				return count, err
+			}
+		}
+	}
+	err = uploadBatch()
+	return count, err
+}
+
+// RestoreKeyBackup downloads all sessions in the given server-side key backup version,
+// decrypts them using the recovery key and imports them into the crypto store.
+//
+// Returns the number of sessions that were imported and the total number of sessions in the backup.
+func (mach *OlmMachine) RestoreKeyBackup(version, recoveryKey string) (int, int, error) {
+	authData, err := mach.getMegolmBackupAuthData(version)
+	if err != nil {
+		return 0, 0, err
+	}
+	privateKey := utils.DecodeBase58RecoveryKey(recoveryKey)
+	if privateKey == nil {
+		return 0, 0, ErrInvalidBackupRecoveryKey
+	}
+	decryption, err := olm.NewPkDecryption(privateKey)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %v", ErrInvalidBackupRecoveryKey, err)
+	} else if decryption.PublicKey != authData.PublicKey {
+		return 0, 0, ErrMismatchingBackupKey
+	}
+	backup, err := mach.Client.GetKeyBackup(version)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get backed up keys: %w", err)
+	}
+
+	count, total := 0, 0
+	for roomID, room := range backup.Rooms {
+		for sessionID, data := range room.Sessions {
+			total++
+			session, err := decryptBackupSession(decryption, data.SessionData)
+			if err != nil {
+				mach.Log.Warn("Failed to decrypt Megolm session %s/%s from backup: %v", roomID, sessionID, err)
+				continue
+			}
+			imported, err := mach.importExportedRoomKey(ExportedSession{
+				Algorithm:         session.Algorithm,
+				ForwardingChains:  session.ForwardingChains,
+				RoomID:            roomID,
+				SenderKey:         session.SenderKey,
+				SenderClaimedKeys: session.SenderClaimedKeys,
+				SessionID:         sessionID,
+				SessionKey:        session.SessionKey,
+			})
+			if err != nil {
+				mach.Log.Warn("Failed to import Megolm session %s/%s from backup: %v", roomID, sessionID, err)
+			} else if imported {
+				mach.Log.Debug("Imported Megolm session %s/%s from backup", roomID, sessionID)
+				count++
+			}
+		}
+	}
+	return count, total, nil
+}
+
+func decryptBackupSession(decryption *olm.PkDecryption, rawSessionData json.RawMessage) (*BackupSessionData, error) {
+	var encrypted EncryptedBackupSessionData
+	err := json.Unmarshal(rawSessionData, &encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse session data: %w", err)
+	}
+	plaintext, err := decryption.Decrypt([]byte(encrypted.Ephemeral), []byte(encrypted.MAC), []byte(encrypted.Ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	var session BackupSessionData
+	err = json.Unmarshal(plaintext, &session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted session data: %w", err)
+	}
+	return &session, nil
+}
@@ -141,8 +141,9 @@ func formatKeyExportData(data []byte) []byte {
 		buf.WriteRune('\n')
 	}
 	buf.WriteString(exportSuffix)
-	if buf.Len() != buf.Cap() || buf.Len() != outputLength {
-		panic(fmt.Errorf("unexpected length %d / %d / %d", buf.Len(), buf.Cap(), outputLength))
+	// The capacity isn't checked, as bytes.Buffer may round it up when growing
+	if buf.Len() != outputLength {
+		panic(fmt.Errorf("unexpected length %d / %d", buf.Len(), outputLength))
 	}
 	return buf.Bytes()
 }
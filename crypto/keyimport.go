@@ -26,14 +26,17 @@ var (
 	ErrMissingExportPrefix          = errors.New("invalid Matrix key export: missing prefix")
 	ErrMissingExportSuffix          = errors.New("invalid Matrix key export: missing suffix")
 	ErrUnsupportedExportVersion     = errors.New("unsupported Matrix key export format version")
+	ErrExportDataTooShort           = errors.New("invalid Matrix key export: data too short")
 	ErrMismatchingExportHash        = errors.New("mismatching hash; incorrect passphrase?")
 	ErrInvalidExportedAlgorithm     = errors.New("session has unknown algorithm")
 	ErrMismatchingExportedSessionID = errors.New("imported session has different ID than expected")
 )
 
-var exportPrefixBytes, exportSuffixBytes = []byte(exportPrefix), []byte(exportSuffix)
+var exportPrefixBytes, exportSuffixBytes = []byte(exportPrefix), bytes.TrimSpace([]byte(exportSuffix))
 
 func decodeKeyExport(data []byte) ([]byte, error) {
+	// Some clients and editors add extra whitespace at the end of the file, so ignore it
+	data = bytes.TrimRight(data, " \t\r\n")
 	// If the valid prefix and suffix aren't there, it's probably not a Matrix key export
 	if !bytes.HasPrefix(data, exportPrefixBytes) {
 		return nil, ErrMissingExportPrefix
@@ -41,7 +44,7 @@ func decodeKeyExport(data []byte) ([]byte, error) {
 		return nil, ErrMissingExportSuffix
 	}
 	// Remove the prefix and suffix, we don't care about them anymore
-	data = data[len(exportPrefix) : len(data)-len(exportSuffix)]
+	data = data[len(exportPrefixBytes) : len(data)-len(exportSuffixBytes)]
 
 	// Allocate space for the decoded data. Ignore newlines when counting the length
 	exportData := make([]byte, base64.StdEncoding.DecodedLen(len(data)-bytes.Count(data, []byte{'\n'})))
@@ -54,7 +57,9 @@ func decodeKeyExport(data []byte) ([]byte, error) {
 }
 
 func decryptKeyExport(passphrase string, exportData []byte) ([]ExportedSession, error) {
-	if exportData[0] != exportVersion1 {
+	if len(exportData) < exportHeaderLength+exportHashLength {
+		return nil, ErrExportDataTooShort
+	} else if exportData[0] != exportVersion1 {
 		return nil, ErrUnsupportedExportVersion
 	}
 
@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeKeyExport_TrailingWhitespace(t *testing.T) {
+	export, err := ExportKeys("passphrase", nil)
+	if err != nil {
+		t.Fatalf("Error exporting keys: %v", err)
+	}
+	for name, suffix := range map[string]string{
+		"None":     "",
+		"Newlines": "\n\n",
+		"CRLF":     "\r\n",
+		"Spaces":   "  \t\n ",
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, err := decodeKeyExport(append(append([]byte{}, export...), suffix...))
+			if err != nil {
+				t.Fatalf("Error decoding export: %v", err)
+			}
+			if _, err = decryptKeyExport("passphrase", data); err != nil {
+				t.Fatalf("Error decrypting export: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeKeyExport_Invalid(t *testing.T) {
+	for name, tt := range map[string]struct {
+		data     string
+		expected error
+	}{
+		"NoPrefix":  {data: "AQ==\n" + exportSuffix, expected: ErrMissingExportPrefix},
+		"NoSuffix":  {data: exportPrefix + "AQ==\n", expected: ErrMissingExportSuffix},
+		"Truncated": {data: exportPrefix + "AQID\n" + exportSuffix, expected: ErrExportDataTooShort},
+		"Empty":     {data: exportPrefix + exportSuffix, expected: ErrExportDataTooShort},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, err := decodeKeyExport([]byte(tt.data))
+			if err == nil {
+				_, err = decryptKeyExport("passphrase", data)
+			}
+			if !errors.Is(err, tt.expected) {
+				t.Fatalf("Expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
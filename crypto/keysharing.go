@@ -33,6 +33,9 @@ var (
 	KeyShareRejectOtherUser     = KeyShareRejection{event.RoomKeyWithheldUnauthorized, "This device does not share keys to other users"}
 	KeyShareRejectUnavailable   = KeyShareRejection{event.RoomKeyWithheldUnavailable, "Requested session ID not found on this device"}
 	KeyShareRejectInternalError = KeyShareRejection{event.RoomKeyWithheldUnavailable, "An internal error occurred while trying to share the requested session"}
+
+	GroupSessionShareRejectBlacklisted = KeyShareRejection{event.RoomKeyWithheldBlacklisted, "Device is blacklisted"}
+	GroupSessionShareRejectUnverified  = KeyShareRejection{event.RoomKeyWithheldUnverified, "This device does not encrypt messages for unverified devices"}
 )
 
 // RequestRoomKey sends a key request for a room to the current user's devices. If the context is cancelled, then so is the key request.
@@ -66,28 +69,64 @@ func (mach *OlmMachine) RequestRoomKey(ctx context.Context, toUser id.UserID, to
 
 		// send a message to all devices cancelling this key request
 		mach.roomKeyRequestFilled.Delete(sessionID)
+		_ = mach.sendRoomKeyRequestCancellation(requestID, map[id.UserID][]id.DeviceID{toUser: {toDevice}})
+	}()
+	return resChan, nil
+}
 
-		cancelEvtContent := &event.Content{
-			Parsed: event.RoomKeyRequestEventContent{
-				Action:             event.KeyRequestActionCancel,
-				RequestID:          requestID,
-				RequestingDeviceID: mach.Client.DeviceID,
-			},
-		}
+// RequestRoomKeyFromOwnDevices sends a key request for the given session to all of the current user's devices.
+//
+// When the session arrives (either as a response to this request or in any other way) or the context is cancelled,
+// a request cancellation is sent to all the devices. The returned channel receives true if the session arrived,
+// or false if the context was cancelled first.
+func (mach *OlmMachine) RequestRoomKeyFromOwnDevices(ctx context.Context, roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (chan bool, error) {
+	requestID := mach.Client.TxnID()
+	targets := map[id.UserID][]id.DeviceID{mach.Client.UserID: {id.AllDevices}}
+	received := mach.sessionReceivedChan(sessionID)
+	err := mach.SendRoomKeyRequest(roomID, senderKey, sessionID, requestID, targets)
+	if err != nil {
+		return nil, err
+	}
 
-		toDeviceCancel := &mautrix.ReqSendToDevice{
-			Messages: map[id.UserID]map[id.DeviceID]*event.Content{
-				toUser: {
-					toDevice: cancelEvtContent,
-				},
-			},
+	resChan := make(chan bool, 1)
+	go func() {
+		select {
+		case <-received:
+			mach.Log.Debug("Key for session %s was received, cancelling key request %s", sessionID, requestID)
+			resChan <- true
+		case <-ctx.Done():
+			mach.Log.Debug("Context closed (%v) before key for session %s was received, cancelling key request %s", ctx.Err(), sessionID, requestID)
+			resChan <- false
+		}
+		err := mach.sendRoomKeyRequestCancellation(requestID, targets)
+		if err != nil {
+			mach.Log.Warn("Failed to send cancellation for key request %s: %v", requestID, err)
 		}
-
-		mach.Client.SendToDevice(event.ToDeviceRoomKeyRequest, toDeviceCancel)
 	}()
 	return resChan, nil
 }
 
+func (mach *OlmMachine) sendRoomKeyRequestCancellation(requestID string, users map[id.UserID][]id.DeviceID) error {
+	cancelEvent := &event.Content{
+		Parsed: &event.RoomKeyRequestEventContent{
+			Action:             event.KeyRequestActionCancel,
+			RequestID:          requestID,
+			RequestingDeviceID: mach.Client.DeviceID,
+		},
+	}
+	toDeviceReq := &mautrix.ReqSendToDevice{
+		Messages: make(map[id.UserID]map[id.DeviceID]*event.Content, len(users)),
+	}
+	for user, devices := range users {
+		toDeviceReq.Messages[user] = make(map[id.DeviceID]*event.Content, len(devices))
+		for _, device := range devices {
+			toDeviceReq.Messages[user][device] = cancelEvent
+		}
+	}
+	_, err := mach.Client.SendToDevice(event.ToDeviceRoomKeyRequest, toDeviceReq)
+	return err
+}
+
 // SendRoomKeyRequest sends a key request for the given key (identified by the room ID, sender key and session ID) to the given users.
 //
 // The request ID parameter is optional. If it's empty, a random ID will be generated.
@@ -128,9 +167,31 @@ func (mach *OlmMachine) SendRoomKeyRequest(roomID id.RoomID, senderKey id.Sender
 	return err
 }
 
+func (mach *OlmMachine) defaultAllowForwardedRoomKey(device *id.Device, _ *event.ForwardedRoomKeyEventContent) bool {
+	if mach.Client.UserID != device.UserID {
+		mach.Log.Debug("Ignoring forwarded room key from a different user (%s)", device.UserID)
+		return false
+	} else if trustState := mach.ResolveTrust(device); trustState < mach.ShareKeysMinTrust {
+		mach.Log.Debug("Ignoring forwarded room key from unverified device %s (trust state: %s)", device.DeviceID, trustState)
+		return false
+	}
+	return true
+}
+
 func (mach *OlmMachine) importForwardedRoomKey(evt *DecryptedOlmEvent, content *event.ForwardedRoomKeyEventContent) bool {
-	if content.Algorithm != id.AlgorithmMegolmV1 || evt.Keys.Ed25519 == "" {
-		mach.Log.Debug("Ignoring weird forwarded room key from %s/%s: alg=%s, ed25519=%s, sessionid=%s, roomid=%s", evt.Sender, evt.SenderDevice, content.Algorithm, evt.Keys.Ed25519, content.SessionID, content.RoomID)
+	if content.Algorithm != id.AlgorithmMegolmV1 || evt.Keys.Ed25519 == "" || content.SenderClaimedKey == "" {
+		mach.Log.Debug("Ignoring weird forwarded room key from %s/%s: alg=%s, ed25519=%s, claimed ed25519=%s, sessionid=%s, roomid=%s", evt.Sender, evt.SenderDevice, content.Algorithm, evt.Keys.Ed25519, content.SenderClaimedKey, content.SessionID, content.RoomID)
+		return false
+	}
+
+	device, err := mach.GetOrFetchDeviceByKey(evt.Sender, evt.SenderKey)
+	if err != nil {
+		mach.Log.Error("Failed to get device %s/%s that forwarded room key: %v", evt.Sender, evt.SenderKey, err)
+		return false
+	} else if device == nil {
+		mach.Log.Debug("Ignoring forwarded room key from unknown device %s/%s", evt.Sender, evt.SenderKey)
+		return false
+	} else if !mach.AllowForwardedRoomKey(device, content) {
 		return false
 	}
 
@@ -143,13 +204,20 @@ func (mach *OlmMachine) importForwardedRoomKey(evt *DecryptedOlmEvent, content *
 		return false
 	}
 	igs := &InboundGroupSession{
-		Internal:         *igsInternal,
-		SigningKey:       evt.Keys.Ed25519,
-		SenderKey:        content.SenderKey,
-		RoomID:           content.RoomID,
+		Internal:   *igsInternal,
+		SigningKey: content.SenderClaimedKey,
+		SenderKey:  content.SenderKey,
+		RoomID:     content.RoomID,
+		// The forwarding chain marks the session as forwarded, which makes decryption report
+		// the trust level of the forwarding device rather than the original sender.
 		ForwardingChains: append(content.ForwardingKeyChain, evt.SenderKey.String()),
 		id:               content.SessionID,
 	}
+	existingIGS, _ := mach.CryptoStore.GetGroupSession(igs.RoomID, igs.SenderKey, igs.ID())
+	if existingIGS != nil && existingIGS.Internal.FirstKnownIndex() <= igs.Internal.FirstKnownIndex() {
+		mach.Log.Debug("Ignoring forwarded room key %s/%s: already have an equivalent or better session", content.RoomID, content.SessionID)
+		return false
+	}
 	err = mach.CryptoStore.PutGroupSession(content.RoomID, content.SenderKey, content.SessionID, igs)
 	if err != nil {
 		mach.Log.Error("Failed to store new inbound group session: %v", err)
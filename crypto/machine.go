@@ -29,6 +29,36 @@ type Logger interface {
 	Trace(message string, args ...interface{})
 }
 
+// FieldLogger is an optional interface for Loggers that support structured fields. If the OlmMachine's logger
+// implements it, fields like room_id, sender and session_id are attached to messages about specific events.
+type FieldLogger interface {
+	Logger
+	// With returns a Logger that includes the given key-value pairs (e.g. "room_id", roomID) in all messages.
+	With(keysAndValues ...interface{}) Logger
+}
+
+// logWith adds the given fields to the logger if it supports them, or returns it as-is otherwise.
+func logWith(log Logger, keysAndValues ...interface{}) Logger {
+	if fieldLog, ok := log.(FieldLogger); ok {
+		return fieldLog.With(keysAndValues...)
+	}
+	return log
+}
+
+type noopLogger struct{}
+
+// NoopLogger is a Logger that discards all messages. It's used by NewOlmMachine if no logger is given.
+var NoopLogger Logger = &noopLogger{}
+
+var _ FieldLogger = (*noopLogger)(nil)
+
+func (n *noopLogger) With(keysAndValues ...interface{}) Logger { return n }
+
+func (n noopLogger) Error(message string, args ...interface{}) {}
+func (n noopLogger) Warn(message string, args ...interface{})  {}
+func (n noopLogger) Debug(message string, args ...interface{}) {}
+func (n noopLogger) Trace(message string, args ...interface{}) {}
+
 // OlmMachine is the main struct for handling Matrix end-to-end encryption.
 type OlmMachine struct {
 	Client *mautrix.Client
@@ -38,10 +68,30 @@ type OlmMachine struct {
 	CryptoStore Store
 	StateStore  StateStore
 
+	// SendKeysMinTrust is the minimum trust state a device must have to receive megolm sessions when encrypting.
+	// TrustStateUnset shares with all devices that aren't blacklisted, higher values block unverified devices.
 	SendKeysMinTrust  id.TrustState
 	ShareKeysMinTrust id.TrustState
 
 	AllowKeyShare func(*id.Device, event.RequestedKeyInfo) *KeyShareRejection
+	// AllowForwardedRoomKey determines whether a m.forwarded_room_key event sent by the given device should be imported.
+	// By default, only forwards from the user's own devices that are trusted at least at the ShareKeysMinTrust level
+	// are accepted.
+	AllowForwardedRoomKey func(*id.Device, *event.ForwardedRoomKeyEventContent) bool
+	// AllowGroupSessionShare determines whether an outbound megolm session for the given room
+	// should be shared with the given device. Returning nil shares the session, returning a rejection
+	// with a code sends a m.room_key.withheld event and returning KeyShareRejectNoResponse skips the device silently.
+	AllowGroupSessionShare func(*id.Device, id.RoomID) *KeyShareRejection
+
+	// MaxOlmSessionsPerSender is the maximum number of Olm sessions to keep per sender key.
+	// When a new session is created, the least recently used sessions over the limit are deleted. 0 means no limit.
+	MaxOlmSessionsPerSender int
+	// MaxOlmSessionAge is the time after which unused Olm sessions are deleted when a new session is created
+	// with the same sender key. 0 means sessions are never deleted based on age.
+	//
+	// Pruning requires the CryptoStore to implement OlmSessionDeleter. The most recently used session of each
+	// sender key is never deleted.
+	MaxOlmSessionAge time.Duration
 
 	DefaultSASTimeout time.Duration
 	// AcceptVerificationFrom determines whether the machine will accept verification requests from this device.
@@ -60,6 +110,9 @@ type OlmMachine struct {
 	recentlyUnwedged     map[id.IdentityKey]time.Time
 	recentlyUnwedgedLock sync.Mutex
 
+	outdatedDeviceLists     map[id.UserID]struct{}
+	outdatedDeviceListsLock sync.Mutex
+
 	olmLock sync.Mutex
 
 	CrossSigningKeys    *CrossSigningKeysCache
@@ -79,7 +132,11 @@ type StateStore interface {
 }
 
 // NewOlmMachine creates an OlmMachine with the given client, logger and stores.
+// If the logger is nil, NoopLogger is used.
 func NewOlmMachine(client *mautrix.Client, log Logger, cryptoStore Store, stateStore StateStore) *OlmMachine {
+	if log == nil {
+		log = NoopLogger
+	}
 	mach := &OlmMachine{
 		Client:      client,
 		SSSS:        ssss.NewSSSSMachine(client),
@@ -103,12 +160,17 @@ func NewOlmMachine(client *mautrix.Client, log Logger, cryptoStore Store, stateS
 
 		devicesToUnwedge: make(map[id.IdentityKey]bool),
 		recentlyUnwedged: make(map[id.IdentityKey]time.Time),
+
+		outdatedDeviceLists: make(map[id.UserID]struct{}),
 	}
 	mach.AllowKeyShare = mach.defaultAllowKeyShare
+	mach.AllowForwardedRoomKey = mach.defaultAllowForwardedRoomKey
+	mach.AllowGroupSessionShare = mach.defaultAllowGroupSessionShare
 	return mach
 }
 
 // Load loads the Olm account information from the crypto store. If there's no olm account, a new one is created.
+// Private cross-signing keys are also loaded if the store supports persisting them (see CrossSigningPrivateKeyStore).
 // This must be called before using the machine.
 func (mach *OlmMachine) Load() (err error) {
 	mach.account, err = mach.CryptoStore.GetAccount()
@@ -118,6 +180,17 @@ func (mach *OlmMachine) Load() (err error) {
 	if mach.account == nil {
 		mach.account = NewOlmAccount()
 	}
+	if store, ok := mach.CryptoStore.(CrossSigningPrivateKeyStore); ok {
+		var seeds *CrossSigningSeeds
+		seeds, err = store.GetCrossSigningSeeds()
+		if err != nil {
+			return fmt.Errorf("failed to load cross-signing keys: %w", err)
+		} else if seeds != nil {
+			if err = mach.setCrossSigningKeys(*seeds); err != nil {
+				return fmt.Errorf("failed to import stored cross-signing keys: %w", err)
+			}
+		}
+	}
 	return nil
 }
 
@@ -128,6 +201,24 @@ func (mach *OlmMachine) saveAccount() {
 	}
 }
 
+// ErrStoreNotRekeyable is returned by RekeyStore if the CryptoStore doesn't implement RekeyableStore.
+var ErrStoreNotRekeyable = errors.New("crypto store doesn't support changing the pickle key")
+
+// RekeyStore re-pickles the Olm account and all sessions in the CryptoStore with a new pickle key,
+// which can be used to rotate the key that the crypto data is encrypted with at rest.
+//
+// The store must implement RekeyableStore. For SQLCryptoStore, the change is atomic: if anything can't be
+// decrypted with the old key, nothing is changed and a RekeyError listing the failed items is returned.
+func (mach *OlmMachine) RekeyStore(oldKey, newKey []byte) error {
+	store, ok := mach.CryptoStore.(RekeyableStore)
+	if !ok {
+		return ErrStoreNotRekeyable
+	}
+	mach.olmLock.Lock()
+	defer mach.olmLock.Unlock()
+	return store.Rekey(oldKey, newKey)
+}
+
 // FlushStore calls the Flush method of the CryptoStore.
 func (mach *OlmMachine) FlushStore() error {
 	return mach.CryptoStore.Flush()
@@ -177,12 +268,27 @@ func (mach *OlmMachine) AddAppserviceListener(ep *appservice.EventProcessor, az
 	ep.On(event.ToDeviceVerificationKey, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationMAC, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationCancel, mach.HandleToDeviceEvent)
+	ep.On(event.ToDeviceVerificationDone, mach.HandleToDeviceEvent)
 	ep.OnOTK(mach.HandleOTKCounts)
 	ep.OnDeviceList(mach.HandleDeviceLists)
 	mach.Log.Trace("Added listeners for encryption data coming from appservice transactions")
 }
 
+// HandleDeviceLists handles the device_lists field in /sync responses.
+//
+// The device lists of tracked users in the changed list are marked as outdated and fetched immediately. If fetching
+// fails, they stay outdated and will be fetched again before the next group session is shared with those users.
+// Users in the left list are marked as outdated, so their devices are fetched again if an encrypted room is shared
+// with them later. Users whose device lists aren't tracked (i.e. who aren't in any encrypted rooms) are ignored.
 func (mach *OlmMachine) HandleDeviceLists(dl *mautrix.DeviceLists, since string) {
+	if len(dl.Left) > 0 {
+		left, err := mach.CryptoStore.FilterTrackedUsers(dl.Left)
+		if err != nil {
+			mach.Log.Warn("Failed to filter tracked user list: %v", err)
+		}
+		mach.Log.Trace("Marking device lists of users who left as outdated: %v", left)
+		mach.markDeviceListsOutdated(left)
+	}
 	if len(dl.Changed) > 0 {
 		traceID := time.Now().Format("15:04:05.000000")
 		mach.Log.Trace("Device list changes in /sync: %v (trace: %s)", dl.Changed, traceID)
@@ -197,12 +303,24 @@ func (mach *OlmMachine) HandleOTKCounts(otkCount *mautrix.OTKCount) {
 		mach.Log.Debug("Dropping OTK counts targeted to %s/%s (not us)", otkCount.UserID, otkCount.DeviceID)
 		return
 	}
+	mach.replenishOneTimeKeys(otkCount.SignedCurve25519)
+}
 
+// ProcessOTKCounts handles the one-time key counts from the device_one_time_keys_count field in /sync responses.
+//
+// If the server has less than half of the maximum number of signed curve25519 keys left, new keys will be generated
+// and uploaded to bring it back up to half of the maximum. A missing count is treated as zero, i.e. the server
+// doesn't have any keys left, so half of the maximum number of keys is uploaded.
+func (mach *OlmMachine) ProcessOTKCounts(counts map[id.KeyAlgorithm]int) {
+	mach.replenishOneTimeKeys(counts[id.KeyAlgorithmSignedCurve25519])
+}
+
+func (mach *OlmMachine) replenishOneTimeKeys(signedCurve25519Count int) {
 	minCount := mach.account.Internal.MaxNumberOfOneTimeKeys() / 2
-	if otkCount.SignedCurve25519 < int(minCount) {
+	if signedCurve25519Count < int(minCount) {
 		traceID := time.Now().Format("15:04:05.000000")
-		mach.Log.Debug("Sync response said we have %d signed curve25519 keys left, sharing new ones... (trace: %s)", otkCount.SignedCurve25519, traceID)
-		err := mach.ShareKeys(otkCount.SignedCurve25519)
+		mach.Log.Debug("Sync response said we have %d signed curve25519 keys left, sharing new ones... (trace: %s)", signedCurve25519Count, traceID)
+		err := mach.ShareKeys(signedCurve25519Count)
 		if err != nil {
 			mach.Log.Error("Failed to share keys: %v (trace: %s)", err, traceID)
 		} else {
@@ -230,9 +348,46 @@ func (mach *OlmMachine) ProcessSyncResponse(resp *mautrix.RespSync, since string
 	}
 
 	mach.HandleOTKCounts(&resp.DeviceOTKCount)
+	if resp.DeviceUnusedFallbackKeyTypes != nil {
+		mach.HandleUnusedFallbackKeyTypes(resp.DeviceUnusedFallbackKeyTypes)
+	}
 	return true
 }
 
+// RegisterSyncer registers the machine into the given syncer, so that sync responses are processed with
+// ProcessSyncResponse and encrypted timeline events are transparently decrypted with DecryptMegolmEvent.
+//
+// The sync handler runs before any events are forwarded to listeners, so room keys received in the same sync
+// response are already stored when the timeline events are decrypted. Events that can't be decrypted are forwarded
+// as m.room.encrypted events with evt.Mautrix.DecryptionError set.
+func (mach *OlmMachine) RegisterSyncer(syncer *mautrix.DefaultSyncer) {
+	syncer.OnSync(mach.ProcessSyncResponse)
+	syncer.DecryptEvent = mach.DecryptMegolmEvent
+}
+
+// HandleUnusedFallbackKeyTypes handles the device_unused_fallback_key_types field in /sync responses.
+//
+// If the server doesn't have an unused signed curve25519 fallback key, a new fallback key is generated and uploaded.
+// The previous fallback key is kept, so messages encrypted with it can still be decrypted.
+func (mach *OlmMachine) HandleUnusedFallbackKeyTypes(unusedTypes []id.KeyAlgorithm) {
+	for _, algorithm := range unusedTypes {
+		if algorithm == id.KeyAlgorithmSignedCurve25519 {
+			return
+		}
+	}
+	traceID := time.Now().Format("15:04:05.000000")
+	mach.Log.Debug("Sync response said we don't have an unused fallback key, generating a new one... (trace: %s)", traceID)
+	if mach.account.Shared {
+		mach.account.rotateFallbackKey()
+	}
+	err := mach.ShareKeys(-1)
+	if err != nil {
+		mach.Log.Error("Failed to share fallback key: %v (trace: %s)", err, traceID)
+	} else {
+		mach.Log.Debug("Successfully shared fallback key (trace: %s)", traceID)
+	}
+}
+
 // HandleMemberEvent handles a single membership event.
 //
 // Currently this is not automatically called, so you must add a listener yourself:
@@ -257,7 +412,10 @@ func (mach *OlmMachine) HandleMemberEvent(evt *event.Event) {
 	if prevContent.Membership == content.Membership ||
 		(prevContent.Membership == event.MembershipInvite && content.Membership == event.MembershipJoin) ||
 		(prevContent.Membership == event.MembershipBan && content.Membership == event.MembershipLeave) ||
-		(prevContent.Membership == event.MembershipLeave && content.Membership == event.MembershipBan) {
+		(prevContent.Membership == event.MembershipLeave && content.Membership == event.MembershipBan) ||
+		// Knocking users don't receive keys, so knocks and rejected knocks don't change the recipient list
+		content.Membership == event.MembershipKnock ||
+		(prevContent.Membership == event.MembershipKnock && content.Membership.IsLeaveOrBan()) {
 		return
 	}
 	mach.Log.Trace("Got membership state event in %s changing %s from %s to %s, invalidating group session", evt.RoomID, evt.GetStateKey(), prevContent.Membership, content.Membership)
@@ -320,6 +478,8 @@ func (mach *OlmMachine) HandleToDeviceEvent(evt *event.Event) {
 		mach.handleVerificationMAC(evt.Sender, content, content.TransactionID)
 	case *event.VerificationCancelEventContent:
 		mach.handleVerificationCancel(evt.Sender, content, content.TransactionID)
+	case *event.VerificationDoneEventContent:
+		mach.handleVerificationDone(evt.Sender, content.TransactionID)
 	case *event.VerificationRequestEventContent:
 		mach.handleVerificationRequest(evt.Sender, content, content.TransactionID, "")
 	case *event.RoomKeyWithheldEventContent:
@@ -437,15 +597,21 @@ func (mach *OlmMachine) markSessionReceived(id id.SessionID) {
 	mach.keyWaitersLock.Unlock()
 }
 
-// WaitForSession waits for the given Megolm session to arrive.
-func (mach *OlmMachine) WaitForSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, timeout time.Duration) bool {
+// sessionReceivedChan returns a channel that is closed when the given Megolm session is received.
+func (mach *OlmMachine) sessionReceivedChan(sessionID id.SessionID) chan struct{} {
 	mach.keyWaitersLock.Lock()
+	defer mach.keyWaitersLock.Unlock()
 	ch, ok := mach.keyWaiters[sessionID]
 	if !ok {
-		ch := make(chan struct{})
+		ch = make(chan struct{})
 		mach.keyWaiters[sessionID] = ch
 	}
-	mach.keyWaitersLock.Unlock()
+	return ch
+}
+
+// WaitForSession waits for the given Megolm session to arrive.
+func (mach *OlmMachine) WaitForSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, timeout time.Duration) bool {
+	ch := mach.sessionReceivedChan(sessionID)
 	select {
 	case <-ch:
 		return true
@@ -480,29 +646,36 @@ func (mach *OlmMachine) handleRoomKeyWithheld(content *event.RoomKeyWithheldEven
 
 // ShareKeys uploads necessary keys to the server.
 //
-// If the Olm account hasn't been shared, the account keys will be uploaded.
+// If the Olm account hasn't been shared, the account keys and a fallback key will be uploaded.
 // If currentOTKCount is less than half of the limit (100 / 2 = 50), enough one-time keys will be uploaded so exactly
-// half of the limit is filled.
+// half of the limit is filled. A negative currentOTKCount means that only the fallback key should be uploaded.
 func (mach *OlmMachine) ShareKeys(currentOTKCount int) error {
 	var deviceKeys *mautrix.DeviceKeys
 	if !mach.account.Shared {
 		deviceKeys = mach.account.getInitialKeys(mach.Client.UserID, mach.Client.DeviceID)
+		mach.account.rotateFallbackKey()
 		mach.Log.Trace("Going to upload initial account keys")
 	}
-	oneTimeKeys := mach.account.getOneTimeKeys(mach.Client.UserID, mach.Client.DeviceID, currentOTKCount)
-	if len(oneTimeKeys) == 0 && deviceKeys == nil {
-		mach.Log.Trace("No one-time keys nor device keys got when trying to share keys")
+	var oneTimeKeys map[id.KeyID]mautrix.OneTimeKey
+	if currentOTKCount >= 0 {
+		oneTimeKeys = mach.account.getOneTimeKeys(mach.Client.UserID, mach.Client.DeviceID, currentOTKCount)
+	}
+	fallbackKeys := mach.account.getFallbackKey(mach.Client.UserID, mach.Client.DeviceID)
+	if len(oneTimeKeys) == 0 && len(fallbackKeys) == 0 && deviceKeys == nil {
+		mach.Log.Trace("No one-time keys, fallback keys nor device keys got when trying to share keys")
 		return nil
 	}
 	req := &mautrix.ReqUploadKeys{
-		DeviceKeys:  deviceKeys,
-		OneTimeKeys: oneTimeKeys,
+		DeviceKeys:   deviceKeys,
+		OneTimeKeys:  oneTimeKeys,
+		FallbackKeys: fallbackKeys,
 	}
-	mach.Log.Trace("Uploading %d one-time keys", len(oneTimeKeys))
+	mach.Log.Trace("Uploading %d one-time keys and %d fallback keys", len(oneTimeKeys), len(fallbackKeys))
 	_, err := mach.Client.UploadKeys(req)
 	if err != nil {
 		return err
 	}
+	mach.account.markKeysAsPublished()
 	mach.account.Shared = true
 	mach.saveAccount()
 	return nil
@@ -7,12 +7,16 @@
 package crypto
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/url"
 	"os"
 	"testing"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/mautrixtest"
 )
 
 type emptyLogger struct{}
@@ -61,6 +65,12 @@ func newMachine(t *testing.T, userID id.UserID) (*OlmMachine, string) {
 	return machine, storeFileName
 }
 
+// useHomeserver makes the machine's client talk to the given mock homeserver.
+func useHomeserver(machine *OlmMachine, hs *mautrixtest.Homeserver) {
+	machine.Client.HomeserverURL, _ = url.Parse(hs.Server.URL)
+	machine.Client.AccessToken = hs.AccessToken
+}
+
 func TestOlmMachineOlmMegolmSessions(t *testing.T) {
 	machineOut, storeFileNameOut := newMachine(t, "user1")
 	defer os.Remove(storeFileNameOut)
@@ -167,3 +177,95 @@ func TestOlmMachineOlmMegolmSessions(t *testing.T) {
 		t.Error("Megolm outbound session not expired after 3rd message")
 	}
 }
+
+func TestOlmMachine_ProcessOTKCounts_Zero(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	hs := mautrixtest.NewHomeserver("user1")
+	defer hs.Close()
+	useHomeserver(machine, hs)
+	var uploaded []map[id.KeyID]mautrix.OneTimeKey
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/keys/upload", func(w http.ResponseWriter, r *http.Request) {
+		var req mautrix.ReqUploadKeys
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode key upload: %v", err)
+		}
+		uploaded = append(uploaded, req.OneTimeKeys)
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespUploadKeys{})
+	})
+
+	halfMax := int(machine.account.Internal.MaxNumberOfOneTimeKeys() / 2)
+	// A missing count is the same as zero
+	machine.ProcessOTKCounts(map[id.KeyAlgorithm]int{})
+	if len(uploaded) != 1 || len(uploaded[0]) != halfMax {
+		t.Fatalf("Expected %d one-time keys to be uploaded for a zero count, got %v", halfMax, uploaded)
+	}
+	for keyID := range uploaded[0] {
+		if algorithm, _ := keyID.Parse(); algorithm != id.KeyAlgorithmSignedCurve25519 {
+			t.Errorf("Expected signed curve25519 one-time key, got %s", keyID)
+		}
+	}
+
+	machine.ProcessOTKCounts(map[id.KeyAlgorithm]int{id.KeyAlgorithmSignedCurve25519: halfMax})
+	if len(uploaded) != 1 {
+		t.Errorf("Expected no upload when the server has half of the maximum number of keys, got %d uploads", len(uploaded))
+	}
+
+	machine.ProcessOTKCounts(map[id.KeyAlgorithm]int{id.KeyAlgorithmSignedCurve25519: 0})
+	if len(uploaded) != 2 || len(uploaded[1]) != halfMax {
+		t.Errorf("Expected %d new one-time keys to be uploaded after the server ran out, got %v", halfMax, uploaded)
+	}
+}
+
+func TestOlmMachine_FallbackKeyRotationUploadFails(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	hs := mautrixtest.NewHomeserver("user1")
+	defer hs.Close()
+	useHomeserver(machine, hs)
+	failUpload := false
+	var uploaded []map[id.KeyID]mautrix.OneTimeKey
+	hs.Handle(http.MethodPost, "/_matrix/client/v3/keys/upload", func(w http.ResponseWriter, r *http.Request) {
+		if failUpload {
+			mautrixtest.WriteError(w, http.StatusInternalServerError, mautrix.RespError{ErrCode: "M_UNKNOWN"}, "internal error")
+			return
+		}
+		var req mautrix.ReqUploadKeys
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode key upload: %v", err)
+		}
+		uploaded = append(uploaded, req.FallbackKeys)
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespUploadKeys{})
+	})
+
+	if err := machine.ShareKeys(-1); err != nil {
+		t.Fatalf("Failed to share initial keys: %v", err)
+	}
+	if len(uploaded) != 1 || len(uploaded[0]) != 1 {
+		t.Fatalf("Expected initial fallback key to be uploaded, got %v", uploaded)
+	}
+
+	failUpload = true
+	machine.HandleUnusedFallbackKeyTypes(nil)
+	unpublished := machine.account.Internal.UnpublishedFallbackKey()
+	if len(unpublished) != 1 {
+		t.Fatalf("Expected new fallback key to be pending after failed upload, got %v", unpublished)
+	}
+
+	// Retrying must upload the same pending key instead of generating another one and forgetting the published key
+	failUpload = false
+	machine.HandleUnusedFallbackKeyTypes(nil)
+	if len(uploaded) != 2 {
+		t.Fatalf("Expected rotated fallback key to be uploaded on retry, got %d uploads", len(uploaded))
+	}
+	for keyID, key := range uploaded[1] {
+		if _, rawKeyID := keyID.Parse(); unpublished[rawKeyID] != key.Key {
+			t.Errorf("Expected pending fallback key %v to be uploaded, got %s=%s", unpublished, keyID, key.Key)
+		}
+	}
+	if len(machine.account.Internal.UnpublishedFallbackKey()) != 0 {
+		t.Error("Expected fallback key to be marked as published after successful upload")
+	}
+}
@@ -308,6 +308,65 @@ func (a *Account) GenOneTimeKeys(num uint) {
 	}
 }
 
+// genFallbackKeyRandomLen returns the number of random bytes needed to
+// generate a new fallback key.
+func (a *Account) genFallbackKeyRandomLen() uint {
+	return uint(C.olm_account_generate_fallback_key_random_length((*C.OlmAccount)(a.int)))
+}
+
+// GenFallbackKey generates a new fallback key. The previous fallback key is
+// kept so that messages encrypted with it can still be decrypted, and any
+// older fallback key is discarded.
+func (a *Account) GenFallbackKey() {
+	random := make([]byte, a.genFallbackKeyRandomLen()+1)
+	_, err := rand.Read(random)
+	if err != nil {
+		panic(NotEnoughGoRandom)
+	}
+	r := C.olm_account_generate_fallback_key(
+		(*C.OlmAccount)(a.int),
+		unsafe.Pointer(&random[0]),
+		C.size_t(len(random)))
+	if r == errorVal() {
+		panic(a.lastError())
+	}
+}
+
+// unpublishedFallbackKeyLen returns the size of the output buffer needed to
+// hold the unpublished fallback key.
+func (a *Account) unpublishedFallbackKeyLen() uint {
+	return uint(C.olm_account_unpublished_fallback_key_length((*C.OlmAccount)(a.int)))
+}
+
+// UnpublishedFallbackKey returns the current fallback key if it hasn't been
+// published yet. The returned map is empty if there is no unpublished key.
+// MarkKeysAsPublished marks the fallback key as published too.
+func (a *Account) UnpublishedFallbackKey() map[string]id.Curve25519 {
+	fallbackKeyJSON := make([]byte, a.unpublishedFallbackKeyLen())
+	r := C.olm_account_unpublished_fallback_key(
+		(*C.OlmAccount)(a.int),
+		unsafe.Pointer(&fallbackKeyJSON[0]),
+		C.size_t(len(fallbackKeyJSON)))
+	if r == errorVal() {
+		panic(a.lastError())
+	}
+	var fallbackKey struct {
+		Curve25519 map[string]id.Curve25519 `json:"curve25519"`
+	}
+	err := json.Unmarshal(fallbackKeyJSON, &fallbackKey)
+	if err != nil {
+		panic(err)
+	}
+	return fallbackKey.Curve25519
+}
+
+// ForgetOldFallbackKey discards the previous fallback key. This should be
+// called once it's unlikely that any messages encrypted with the previous
+// key are still in flight.
+func (a *Account) ForgetOldFallbackKey() {
+	C.olm_account_forget_old_fallback_key((*C.OlmAccount)(a.int))
+}
+
 // NewOutboundSession creates a new out-bound session for sending messages to a
 // given curve25519 identityKey and oneTimeKey.  Returns error on failure.  If the
 // keys couldn't be decoded as base64 then the error will be "INVALID_BASE64"
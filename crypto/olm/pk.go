@@ -109,3 +109,132 @@ func (p *PkSigning) SignJSON(obj interface{}) (string, error) {
 func (p *PkSigning) lastError() error {
 	return convertError(C.GoString(C.olm_pk_signing_last_error((*C.OlmPkSigning)(p.int))))
 }
+
+// PkEncryption stores the public key of a recipient for encrypting messages to it.
+// It's used for encrypting Megolm sessions for server-side key backups.
+type PkEncryption struct {
+	int *C.OlmPkEncryption
+	mem []byte
+}
+
+func pkEncryptionSize() uint {
+	return uint(C.olm_pk_encryption_size())
+}
+
+// NewPkEncryption creates a new PkEncryption object that encrypts messages to the given public key.
+func NewPkEncryption(recipientKey id.Curve25519) (*PkEncryption, error) {
+	if len(recipientKey) == 0 {
+		return nil, EmptyInput
+	}
+	memory := make([]byte, pkEncryptionSize())
+	p := &PkEncryption{
+		int: C.olm_pk_encryption(unsafe.Pointer(&memory[0])),
+		mem: memory,
+	}
+	keyBytes := []byte(recipientKey)
+	if C.olm_pk_encryption_set_recipient_key((*C.OlmPkEncryption)(p.int),
+		unsafe.Pointer(&keyBytes[0]), C.size_t(len(keyBytes))) == errorVal() {
+		return nil, p.lastError()
+	}
+	return p, nil
+}
+
+// Clear clears the underlying memory of a PkEncryption object.
+func (p *PkEncryption) Clear() {
+	C.olm_clear_pk_encryption((*C.OlmPkEncryption)(p.int))
+}
+
+// Encrypt encrypts the given plaintext. The returned ciphertext, MAC and ephemeral key are unpadded base64.
+func (p *PkEncryption) Encrypt(plaintext []byte) (ciphertext, mac, ephemeralKey []byte, err error) {
+	if len(plaintext) == 0 {
+		return nil, nil, nil, EmptyInput
+	}
+	ciphertext = make([]byte, C.olm_pk_ciphertext_length((*C.OlmPkEncryption)(p.int), C.size_t(len(plaintext))))
+	mac = make([]byte, C.olm_pk_mac_length((*C.OlmPkEncryption)(p.int)))
+	ephemeralKey = make([]byte, C.olm_pk_key_length())
+	random := make([]byte, C.olm_pk_encrypt_random_length((*C.OlmPkEncryption)(p.int)))
+	_, err = rand.Read(random)
+	if err != nil {
+		panic(NotEnoughGoRandom)
+	}
+	if C.olm_pk_encrypt((*C.OlmPkEncryption)(p.int),
+		unsafe.Pointer(&plaintext[0]), C.size_t(len(plaintext)),
+		unsafe.Pointer(&ciphertext[0]), C.size_t(len(ciphertext)),
+		unsafe.Pointer(&mac[0]), C.size_t(len(mac)),
+		unsafe.Pointer(&ephemeralKey[0]), C.size_t(len(ephemeralKey)),
+		unsafe.Pointer(&random[0]), C.size_t(len(random))) == errorVal() {
+		return nil, nil, nil, p.lastError()
+	}
+	return
+}
+
+// lastError returns the last error that happened in relation to this PkEncryption object.
+func (p *PkEncryption) lastError() error {
+	return convertError(C.GoString(C.olm_pk_encryption_last_error((*C.OlmPkEncryption)(p.int))))
+}
+
+// PkDecryption stores a key pair for decrypting messages encrypted with PkEncryption.
+type PkDecryption struct {
+	int       *C.OlmPkDecryption
+	mem       []byte
+	PublicKey id.Curve25519
+}
+
+func pkDecryptionSize() uint {
+	return uint(C.olm_pk_decryption_size())
+}
+
+// PkPrivateKeyLength returns the length of the private keys used by PkDecryption.
+func PkPrivateKeyLength() int {
+	return int(C.olm_pk_private_key_length())
+}
+
+// NewPkDecryption creates a new PkDecryption object using the given private key.
+func NewPkDecryption(privateKey []byte) (*PkDecryption, error) {
+	if len(privateKey) == 0 {
+		return nil, EmptyInput
+	}
+	memory := make([]byte, pkDecryptionSize())
+	p := &PkDecryption{
+		int: C.olm_pk_decryption(unsafe.Pointer(&memory[0])),
+		mem: memory,
+	}
+	pubKey := make([]byte, C.olm_pk_key_length())
+	if C.olm_pk_key_from_private((*C.OlmPkDecryption)(p.int),
+		unsafe.Pointer(&pubKey[0]), C.size_t(len(pubKey)),
+		unsafe.Pointer(&privateKey[0]), C.size_t(len(privateKey))) == errorVal() {
+		return nil, p.lastError()
+	}
+	p.PublicKey = id.Curve25519(pubKey)
+	return p, nil
+}
+
+// Clear clears the underlying memory of a PkDecryption object.
+func (p *PkDecryption) Clear() {
+	C.olm_clear_pk_decryption((*C.OlmPkDecryption)(p.int))
+}
+
+// Decrypt decrypts a message that was encrypted with PkEncryption. All inputs are unpadded base64.
+func (p *PkDecryption) Decrypt(ephemeralKey, mac, ciphertext []byte) ([]byte, error) {
+	if len(ephemeralKey) == 0 || len(mac) == 0 || len(ciphertext) == 0 {
+		return nil, EmptyInput
+	}
+	// olm_pk_decrypt destroys the input ciphertext, so make a copy
+	ciphertextCopy := make([]byte, len(ciphertext))
+	copy(ciphertextCopy, ciphertext)
+	plaintext := make([]byte, C.olm_pk_max_plaintext_length((*C.OlmPkDecryption)(p.int), C.size_t(len(ciphertext))))
+	r := C.olm_pk_decrypt((*C.OlmPkDecryption)(p.int),
+		unsafe.Pointer(&ephemeralKey[0]), C.size_t(len(ephemeralKey)),
+		unsafe.Pointer(&mac[0]), C.size_t(len(mac)),
+		unsafe.Pointer(&ciphertextCopy[0]), C.size_t(len(ciphertextCopy)),
+		unsafe.Pointer(&plaintext[0]), C.size_t(len(plaintext)))
+	if r == errorVal() {
+		return nil, p.lastError()
+	}
+	return plaintext[:r], nil
+}
+
+// lastError returns the last error that happened in relation to this PkDecryption object.
+func (p *PkDecryption) lastError() error {
+	return convertError(C.GoString(C.olm_pk_decryption_last_error((*C.OlmPkDecryption)(p.int))))
+}
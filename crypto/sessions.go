@@ -30,7 +30,7 @@ func (o OlmSessionList) Len() int {
 }
 
 func (o OlmSessionList) Less(i, j int) bool {
-	return o[i].LastDecryptedTime.After(o[j].LastEncryptedTime)
+	return o[i].LastDecryptedTime.After(o[j].LastDecryptedTime)
 }
 
 func (o OlmSessionList) Swap(i, j int) {
@@ -50,6 +50,14 @@ func (session *OlmSession) ID() id.SessionID {
 	return session.id
 }
 
+// LastUsed returns the last time the session was used for encrypting or decrypting.
+func (session *OlmSession) LastUsed() time.Time {
+	if session.LastEncryptedTime.After(session.LastDecryptedTime) {
+		return session.LastEncryptedTime
+	}
+	return session.LastDecryptedTime
+}
+
 func (session *OlmSession) Describe() string {
 	return session.Internal.Describe()
 }
@@ -128,6 +136,7 @@ const (
 	OGSNotShared OGSState = iota
 	OGSAlreadyShared
 	OGSIgnored
+	OGSWithheld
 )
 
 type UserDevice struct {
@@ -188,6 +197,21 @@ func (ogs *OutboundGroupSession) ShareContent() event.Content {
 	return event.Content{Parsed: ogs.content}
 }
 
+// WithheldDevices returns the devices that the session was not shared with because of their trust state
+// or the OlmMachine.AllowGroupSessionShare callback. This can be used to warn the user about devices
+// that won't be able to decrypt messages.
+//
+// The list is only tracked in memory, so it may be empty for sessions loaded from a persistent store.
+func (ogs *OutboundGroupSession) WithheldDevices() []UserDevice {
+	var devices []UserDevice
+	for userDevice, state := range ogs.Users {
+		if state == OGSWithheld {
+			devices = append(devices, userDevice)
+		}
+	}
+	return devices
+}
+
 func (ogs *OutboundGroupSession) ID() id.SessionID {
 	if ogs.id == "" {
 		ogs.id = ogs.Internal.ID()
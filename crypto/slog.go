@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build go1.21
+
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// LevelTrace is the slog level used for Logger.Trace messages.
+const LevelTrace = slog.LevelDebug - 4
+
+// SlogLogger is a Logger that writes to a log/slog logger, which can in turn be routed into
+// any structured logging backend. The messages are formatted with fmt.Sprintf.
+type SlogLogger struct {
+	Logger *slog.Logger
+}
+
+var _ FieldLogger = (*SlogLogger)(nil)
+
+// NewSlogLogger wraps the given slog logger. If it's nil, slog.Default() is used.
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogLogger{Logger: logger}
+}
+
+// With returns a new SlogLogger that includes the given attributes (e.g. "room_id", roomID) in all messages.
+func (sl *SlogLogger) With(args ...any) Logger {
+	return &SlogLogger{Logger: sl.Logger.With(args...)}
+}
+
+func (sl *SlogLogger) log(level slog.Level, message string, args []interface{}) {
+	ctx := context.Background()
+	if !sl.Logger.Enabled(ctx, level) {
+		return
+	}
+	sl.Logger.Log(ctx, level, strings.TrimSuffix(fmt.Sprintf(message, args...), "\n"))
+}
+
+func (sl *SlogLogger) Error(message string, args ...interface{}) {
+	sl.log(slog.LevelError, message, args)
+}
+
+func (sl *SlogLogger) Warn(message string, args ...interface{}) {
+	sl.log(slog.LevelWarn, message, args)
+}
+
+func (sl *SlogLogger) Debug(message string, args ...interface{}) {
+	sl.log(slog.LevelDebug, message, args)
+}
+
+func (sl *SlogLogger) Trace(message string, args ...interface{}) {
+	sl.log(LevelTrace, message, args)
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build go1.21
+
+package crypto
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNoopLogger(t *testing.T) {
+	log := logWith(NoopLogger, "room_id", "!room:example.com")
+	if log != NoopLogger {
+		t.Errorf("Expected NoopLogger.With to return itself, got %T", log)
+	}
+	// None of these should panic
+	log.Error("error %d", 1)
+	log.Warn("warn %d", 2)
+	log.Debug("debug %d", 3)
+	log.Trace("trace %d", 4)
+
+	var plain Logger = emptyLogger{}
+	if logWith(plain, "room_id", "!room:example.com") != plain {
+		t.Error("Expected logWith to return loggers without field support as-is")
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	log := logWith(NewSlogLogger(slog.New(handler)), "room_id", "!room:example.com", "session_id", "abc")
+
+	log.Trace("hidden %s", "trace")
+	if buf.Len() != 0 {
+		t.Errorf("Expected trace message to be filtered out, got %q", buf.String())
+	}
+
+	log.Warn("Failed to decrypt %s\n", "$event")
+	output := buf.String()
+	for _, expected := range []string{"level=WARN", `msg="Failed to decrypt $event"`, "room_id=!room:example.com", "session_id=abc"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q in log output %q", expected, output)
+		}
+	}
+	if strings.Count(output, "\n") != 1 {
+		t.Errorf("Expected exactly one line of output, got %q", output)
+	}
+}
@@ -7,6 +7,8 @@
 package crypto
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
 	"database/sql/driver"
 	"errors"
@@ -16,6 +18,7 @@ import (
 
 	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
+	"maunium.net/go/mautrix/crypto/utils"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util/dbutil"
@@ -41,6 +44,10 @@ type SQLCryptoStore struct {
 }
 
 var _ Store = (*SQLCryptoStore)(nil)
+var _ OlmSessionDeleter = (*SQLCryptoStore)(nil)
+var _ DeviceByIdentityKeyFinder = (*SQLCryptoStore)(nil)
+var _ RekeyableStore = (*SQLCryptoStore)(nil)
+var _ CrossSigningPrivateKeyStore = (*SQLCryptoStore)(nil)
 
 // NewSQLCryptoStore initializes a new crypto Store using the given database, for a device's crypto material.
 // The stored material will be encrypted with the given key.
@@ -224,6 +231,15 @@ func (store *SQLCryptoStore) UpdateSession(_ id.SenderKey, session *OlmSession)
 	return err
 }
 
+// DeleteSession deletes an Olm session for a sender from the database.
+func (store *SQLCryptoStore) DeleteSession(key id.SenderKey, session *OlmSession) error {
+	store.olmSessionCacheLock.Lock()
+	defer store.olmSessionCacheLock.Unlock()
+	_, err := store.DB.Exec("DELETE FROM crypto_olm_session WHERE session_id=$1 AND account_id=$2", session.ID(), store.AccountID)
+	delete(store.getOlmSessionCache(key), session.ID())
+	return err
+}
+
 // PutGroupSession stores an inbound Megolm group session for a room, sender and session.
 func (store *SQLCryptoStore) PutGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, session *InboundGroupSession) error {
 	sessionBytes := session.Internal.Pickle(store.PickleKey)
@@ -498,6 +514,24 @@ func (store *SQLCryptoStore) FindDeviceByKey(userID id.UserID, identityKey id.Id
 	return &identity, nil
 }
 
+// FindDeviceByIdentityKey finds a device of any user by its identity key.
+func (store *SQLCryptoStore) FindDeviceByIdentityKey(identityKey id.IdentityKey) (*id.Device, error) {
+	var identity id.Device
+	err := store.DB.QueryRow(`
+		SELECT user_id, device_id, signing_key, trust, deleted, name
+		FROM crypto_device WHERE identity_key=$1 LIMIT 1`,
+		identityKey,
+	).Scan(&identity.UserID, &identity.DeviceID, &identity.SigningKey, &identity.Trust, &identity.Deleted, &identity.Name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	identity.IdentityKey = identityKey
+	return &identity, nil
+}
+
 const deviceInsertQuery = `
 INSERT INTO crypto_device (user_id, device_id, identity_key, signing_key, trust, deleted, name)
 VALUES ($1, $2, $3, $4, $5, $6, $7)
@@ -634,6 +668,84 @@ func (store *SQLCryptoStore) GetCrossSigningKeys(userID id.UserID) (map[id.Cross
 	return data, nil
 }
 
+// pickledCrossSigningSeeds is the three private cross-signing key seeds, encrypted with the pickle key
+// using AES-256-CTR and HMAC-SHA256 in the same way as SSSS.
+type pickledCrossSigningSeeds struct {
+	seeds CrossSigningSeeds
+}
+
+const (
+	crossSigningSeedsKeyName = "m.cross_signing.private_keys"
+	// crossSigningSeedLength is the length of an Ed25519 seed, which is what olm.PkSigning uses.
+	crossSigningSeedLength = 32
+)
+
+var ErrCrossSigningSeedsMACMismatch = errors.New("cross-signing seed MAC mismatch")
+
+func (pcs *pickledCrossSigningSeeds) Pickle(key []byte) []byte {
+	aesKey, hmacKey := utils.DeriveKeysSHA256(key, crossSigningSeedsKeyName)
+	iv := utils.GenA256CTRIV()
+	payload := make([]byte, 0, len(pcs.seeds.MasterKey)+len(pcs.seeds.SelfSigningKey)+len(pcs.seeds.UserSigningKey))
+	payload = append(payload, pcs.seeds.MasterKey...)
+	payload = append(payload, pcs.seeds.SelfSigningKey...)
+	payload = append(payload, pcs.seeds.UserSigningKey...)
+	utils.XorA256CTR(payload, aesKey, iv)
+	mac := hmac.New(sha256.New, hmacKey[:])
+	mac.Write(iv[:])
+	mac.Write(payload)
+	return mac.Sum(append(iv[:], payload...))
+}
+
+func (pcs *pickledCrossSigningSeeds) Unpickle(pickled, key []byte) error {
+	if len(pickled) != utils.AESCTRIVLength+3*crossSigningSeedLength+sha256.Size {
+		return fmt.Errorf("unexpected pickled cross-signing seed length %d", len(pickled))
+	}
+	aesKey, hmacKey := utils.DeriveKeysSHA256(key, crossSigningSeedsKeyName)
+	macStart := len(pickled) - sha256.Size
+	mac := hmac.New(sha256.New, hmacKey[:])
+	mac.Write(pickled[:macStart])
+	if !hmac.Equal(mac.Sum(nil), pickled[macStart:]) {
+		return ErrCrossSigningSeedsMACMismatch
+	}
+	var iv [utils.AESCTRIVLength]byte
+	copy(iv[:], pickled)
+	payload := make([]byte, macStart-utils.AESCTRIVLength)
+	copy(payload, pickled[utils.AESCTRIVLength:macStart])
+	utils.XorA256CTR(payload, aesKey, iv)
+	pcs.seeds = CrossSigningSeeds{
+		MasterKey:      payload[:crossSigningSeedLength],
+		SelfSigningKey: payload[crossSigningSeedLength : 2*crossSigningSeedLength],
+		UserSigningKey: payload[2*crossSigningSeedLength:],
+	}
+	return nil
+}
+
+// PutCrossSigningSeeds stores the private cross-signing key seeds of the current user, encrypted with the pickle key.
+func (store *SQLCryptoStore) PutCrossSigningSeeds(seeds CrossSigningSeeds) error {
+	pickled := (&pickledCrossSigningSeeds{seeds}).Pickle(store.PickleKey)
+	_, err := store.DB.Exec(`
+		INSERT INTO crypto_cross_signing_private_keys (account_id, keys) VALUES ($1, $2)
+		ON CONFLICT (account_id) DO UPDATE SET keys=excluded.keys
+	`, store.AccountID, pickled)
+	return err
+}
+
+// GetCrossSigningSeeds retrieves the private cross-signing key seeds of the current user.
+func (store *SQLCryptoStore) GetCrossSigningSeeds() (*CrossSigningSeeds, error) {
+	var pickled []byte
+	err := store.DB.QueryRow("SELECT keys FROM crypto_cross_signing_private_keys WHERE account_id=$1", store.AccountID).Scan(&pickled)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var pcs pickledCrossSigningSeeds
+	if err = pcs.Unpickle(pickled, store.PickleKey); err != nil {
+		return nil, err
+	}
+	return &pcs.seeds, nil
+}
+
 // PutSignature stores a signature of a cross-signing or device key along with the signer's user ID and key.
 func (store *SQLCryptoStore) PutSignature(signedUserID id.UserID, signedKey id.Ed25519, signerUserID id.UserID, signerKey id.Ed25519, signature string) error {
 	_, err := store.DB.Exec(`
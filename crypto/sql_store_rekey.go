@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// RekeyFailure is a single item that couldn't be re-pickled in SQLCryptoStore.Rekey.
+type RekeyFailure struct {
+	Table string
+	ID    string
+	Err   error
+}
+
+// RekeyError is returned by SQLCryptoStore.Rekey if some items couldn't be unpickled with the old key.
+// No changes are saved if this is returned.
+type RekeyError struct {
+	Failures []RekeyFailure
+}
+
+func (err RekeyError) Error() string {
+	first := err.Failures[0]
+	return fmt.Sprintf("failed to re-pickle %d items (first failure: %s/%s: %v)", len(err.Failures), first.Table, first.ID, first.Err)
+}
+
+type pickleable interface {
+	Pickle(key []byte) []byte
+	Unpickle(pickled, key []byte) error
+}
+
+type pickledColumn struct {
+	table    string
+	idColumn string
+	column   string
+	newBlank func() pickleable
+}
+
+// pickledColumns are all the database columns that are encrypted with the pickle key.
+var pickledColumns = []pickledColumn{
+	{"crypto_account", "account_id", "account", func() pickleable { return olm.NewBlankAccount() }},
+	{"crypto_olm_session", "session_id", "session", func() pickleable { return olm.NewBlankSession() }},
+	{"crypto_megolm_inbound_session", "session_id", "session", func() pickleable { return olm.NewBlankInboundGroupSession() }},
+	{"crypto_megolm_outbound_session", "session_id", "session", func() pickleable { return olm.NewBlankOutboundGroupSession() }},
+	{"crypto_cross_signing_private_keys", "account_id", "keys", func() pickleable { return &pickledCrossSigningSeeds{} }},
+}
+
+type pickledItem struct {
+	id      string
+	pickled []byte
+}
+
+func (col *pickledColumn) repickle(txn *dbutil.LoggingTxn, accountID string, oldKey, newKey []byte) ([]RekeyFailure, error) {
+	rows, err := txn.Query(fmt.Sprintf("SELECT %s, %s FROM %s WHERE account_id=$1 AND %s IS NOT NULL", col.idColumn, col.column, col.table, col.column), accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %w", col.table, err)
+	}
+	var items []pickledItem
+	for rows.Next() {
+		var item pickledItem
+		err = rows.Scan(&item.id, &item.pickled)
+		if err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to scan %s row: %w", col.table, err)
+		}
+		items = append(items, item)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s rows: %w", col.table, err)
+	}
+
+	var failures []RekeyFailure
+	for _, item := range items {
+		obj := col.newBlank()
+		if err = obj.Unpickle(item.pickled, oldKey); err != nil {
+			failures = append(failures, RekeyFailure{Table: col.table, ID: item.id, Err: err})
+			continue
+		}
+		_, err = txn.Exec(fmt.Sprintf("UPDATE %s SET %s=$1 WHERE account_id=$2 AND %s=$3", col.table, col.column, col.idColumn), obj.Pickle(newKey), accountID, item.id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update %s/%s: %w", col.table, item.id, err)
+		}
+	}
+	return failures, nil
+}
+
+// Rekey re-pickles the Olm account, all Olm and Megolm sessions and the private cross-signing keys in the database
+// with a new pickle key.
+//
+// Everything is done in a single transaction: if any item can't be unpickled with the old key, nothing is changed
+// and a RekeyError listing the failed items is returned. On success, PickleKey is set to the new key.
+// Other operations on the store shouldn't be running at the same time.
+func (store *SQLCryptoStore) Rekey(oldKey, newKey []byte) error {
+	txn, err := store.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	var failures []RekeyFailure
+	for _, col := range pickledColumns {
+		colFailures, err := col.repickle(txn, store.AccountID, oldKey, newKey)
+		if err != nil {
+			_ = txn.Rollback()
+			return err
+		}
+		failures = append(failures, colFailures...)
+	}
+	if len(failures) > 0 {
+		_ = txn.Rollback()
+		return RekeyError{Failures: failures}
+	}
+	err = txn.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	store.PickleKey = newKey
+	return nil
+}
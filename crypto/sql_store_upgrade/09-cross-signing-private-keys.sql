@@ -0,0 +1,5 @@
+-- v9: Add table for own private cross-signing keys
+CREATE TABLE crypto_cross_signing_private_keys (
+	account_id TEXT  PRIMARY KEY,
+	keys       bytea NOT NULL
+);
@@ -14,6 +14,16 @@ import (
 )
 
 // Machine contains utility methods for interacting with SSSS data on the server.
+//
+// Secrets are stored as account data encrypted with m.secret_storage.v1.aes-hmac-sha2. To read a secret,
+// get the metadata of the default key and derive the key from a recovery key or passphrase. Both methods
+// check the MAC in the key metadata, so a wrong recovery key or passphrase is rejected before decrypting anything:
+//
+//	_, keyData, err := mach.GetDefaultKeyData()
+//	key, err := keyData.VerifyRecoveryKey(recoveryKey) // or keyData.VerifyPassphrase(passphrase)
+//	secret, err := mach.GetDecryptedAccountData(event.AccountDataCrossSigningMaster, key)
+//
+// New secrets can be stored with SetEncryptedAccountData using one or more keys.
 type Machine struct {
 	Client *mautrix.Client
 }
@@ -118,6 +118,38 @@ type Store interface {
 	DropSignaturesByKey(id.UserID, id.Ed25519) (int64, error)
 }
 
+// RekeyableStore is an optional interface for stores that encrypt data at rest with a pickle key
+// and support changing the key. See OlmMachine.RekeyStore.
+type RekeyableStore interface {
+	// Rekey re-encrypts everything in the store that was encrypted with oldKey using newKey.
+	Rekey(oldKey, newKey []byte) error
+}
+
+// OlmSessionDeleter is an optional interface for stores that support deleting Olm sessions.
+// It's required for pruning old sessions (see OlmMachine.MaxOlmSessionsPerSender and OlmMachine.MaxOlmSessionAge).
+type OlmSessionDeleter interface {
+	// DeleteSession deletes an Olm session that has previously been inserted with AddSession.
+	DeleteSession(id.SenderKey, *OlmSession) error
+}
+
+// DeviceByIdentityKeyFinder is an optional interface for stores that can find a device by its identity key
+// without knowing the owner of the device. It's used to determine whether sessions uploaded to the
+// server-side key backup are verified (see OlmMachine.BackupRoomKeys).
+type DeviceByIdentityKeyFinder interface {
+	// FindDeviceByIdentityKey finds a device of any user by its identity key.
+	FindDeviceByIdentityKey(id.IdentityKey) (*id.Device, error)
+}
+
+// CrossSigningPrivateKeyStore is an optional interface for stores that can persist the private keys of the
+// current user's cross-signing keys. If the store implements it, the keys are saved whenever they're imported
+// or published, and restored in OlmMachine.Load.
+type CrossSigningPrivateKeyStore interface {
+	// PutCrossSigningSeeds stores the seeds of the current user's private cross-signing keys.
+	PutCrossSigningSeeds(CrossSigningSeeds) error
+	// GetCrossSigningSeeds retrieves the stored private cross-signing key seeds, or nil if there are none.
+	GetCrossSigningSeeds() (*CrossSigningSeeds, error)
+}
+
 type messageIndexKey struct {
 	SenderKey id.SenderKey
 	SessionID id.SessionID
@@ -129,12 +161,13 @@ type messageIndexValue struct {
 	Timestamp int64
 }
 
-// GobStore is a simple Store implementation that dumps everything into a .gob file.
+// MemoryStore is a Store implementation that keeps everything in memory.
 //
-// Deprecated: this is not atomic and can lose data. Using SQLCryptoStore or a custom implementation is recommended.
-type GobStore struct {
-	lock sync.RWMutex
-	path string
+// It's useful for tests and bots that don't need to persist their encryption keys. Note that the Olm account
+// and all sessions are lost when the program exits, so a new device must be created on every start.
+type MemoryStore struct {
+	lock         sync.RWMutex
+	saveCallback func() error
 
 	Account               *OlmAccount
 	Sessions              map[id.SenderKey]OlmSessionList
@@ -147,14 +180,16 @@ type GobStore struct {
 	KeySignatures         map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string
 }
 
-var _ Store = (*GobStore)(nil)
+var _ Store = (*MemoryStore)(nil)
+var _ OlmSessionDeleter = (*MemoryStore)(nil)
+var _ DeviceByIdentityKeyFinder = (*MemoryStore)(nil)
 
-// NewGobStore creates a new GobStore that saves everything to the given file.
+// NewMemoryStore creates a new empty MemoryStore.
 //
-// Deprecated: this is not atomic and can lose data. Using SQLCryptoStore or a custom implementation is recommended.
-func NewGobStore(path string) (*GobStore, error) {
-	gs := &GobStore{
-		path:                  path,
+// The save callback is called after each change to the store (with the lock held). It can be nil.
+func NewMemoryStore(saveCallback func() error) *MemoryStore {
+	return &MemoryStore{
+		saveCallback:          saveCallback,
 		Sessions:              make(map[id.SenderKey]OlmSessionList),
 		GroupSessions:         make(map[id.RoomID]map[id.SenderKey]map[id.SessionID]*InboundGroupSession),
 		WithheldGroupSessions: make(map[id.RoomID]map[id.SenderKey]map[id.SessionID]*event.RoomKeyWithheldEventContent),
@@ -164,6 +199,39 @@ func NewGobStore(path string) (*GobStore, error) {
 		CrossSigningKeys:      make(map[id.UserID]map[id.CrossSigningUsage]id.CrossSigningKey),
 		KeySignatures:         make(map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string),
 	}
+}
+
+func (ms *MemoryStore) save() error {
+	if ms.saveCallback == nil {
+		return nil
+	}
+	return ms.saveCallback()
+}
+
+// Flush calls the save callback of the store.
+func (ms *MemoryStore) Flush() error {
+	ms.lock.Lock()
+	err := ms.save()
+	ms.lock.Unlock()
+	return err
+}
+
+// GobStore is a simple Store implementation that dumps everything into a .gob file.
+//
+// Deprecated: this is not atomic and can lose data. Using SQLCryptoStore or a custom implementation is recommended.
+type GobStore struct {
+	*MemoryStore
+	path string
+}
+
+var _ Store = (*GobStore)(nil)
+
+// NewGobStore creates a new GobStore that saves everything to the given file.
+//
+// Deprecated: this is not atomic and can lose data. Using SQLCryptoStore or a custom implementation is recommended.
+func NewGobStore(path string) (*GobStore, error) {
+	gs := &GobStore{path: path}
+	gs.MemoryStore = NewMemoryStore(gs.save)
 	return gs, gs.load()
 }
 
@@ -172,7 +240,7 @@ func (gs *GobStore) save() error {
 	if err != nil {
 		return err
 	}
-	err = gob.NewEncoder(file).Encode(gs)
+	err = gob.NewEncoder(file).Encode(gs.MemoryStore)
 	_ = file.Close()
 	return err
 }
@@ -185,78 +253,87 @@ func (gs *GobStore) load() error {
 		}
 		return err
 	}
-	err = gob.NewDecoder(file).Decode(gs)
+	err = gob.NewDecoder(file).Decode(gs.MemoryStore)
 	_ = file.Close()
 	return err
 }
 
-func (gs *GobStore) Flush() error {
-	gs.lock.Lock()
-	err := gs.save()
-	gs.lock.Unlock()
-	return err
+func (ms *MemoryStore) GetAccount() (*OlmAccount, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.Account, nil
 }
 
-func (gs *GobStore) GetAccount() (*OlmAccount, error) {
-	return gs.Account, nil
-}
-
-func (gs *GobStore) PutAccount(account *OlmAccount) error {
-	gs.lock.Lock()
-	gs.Account = account
-	err := gs.save()
-	gs.lock.Unlock()
+func (ms *MemoryStore) PutAccount(account *OlmAccount) error {
+	ms.lock.Lock()
+	ms.Account = account
+	err := ms.save()
+	ms.lock.Unlock()
 	return err
 }
 
-func (gs *GobStore) GetSessions(senderKey id.SenderKey) (OlmSessionList, error) {
-	gs.lock.Lock()
-	sessions, ok := gs.Sessions[senderKey]
-	if !ok {
-		sessions = []*OlmSession{}
-		gs.Sessions[senderKey] = sessions
-	}
-	gs.lock.Unlock()
+func (ms *MemoryStore) GetSessions(senderKey id.SenderKey) (OlmSessionList, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	// Return a copy so that re-sorting the stored list doesn't affect callers iterating over it
+	sessions := make(OlmSessionList, len(ms.Sessions[senderKey]))
+	copy(sessions, ms.Sessions[senderKey])
 	return sessions, nil
 }
 
-func (gs *GobStore) AddSession(senderKey id.SenderKey, session *OlmSession) error {
-	gs.lock.Lock()
-	sessions, _ := gs.Sessions[senderKey]
-	gs.Sessions[senderKey] = append(sessions, session)
-	sort.Sort(gs.Sessions[senderKey])
-	err := gs.save()
-	gs.lock.Unlock()
+func (ms *MemoryStore) AddSession(senderKey id.SenderKey, session *OlmSession) error {
+	ms.lock.Lock()
+	sessions, _ := ms.Sessions[senderKey]
+	ms.Sessions[senderKey] = append(sessions, session)
+	sort.Sort(ms.Sessions[senderKey])
+	err := ms.save()
+	ms.lock.Unlock()
 	return err
 }
 
-func (gs *GobStore) UpdateSession(_ id.SenderKey, _ *OlmSession) error {
-	// we don't need to do anything here because the session is a pointer and already stored in our map
-	return gs.save()
+func (ms *MemoryStore) UpdateSession(senderKey id.SenderKey, _ *OlmSession) error {
+	// The session is a pointer and already stored in our map, but the last use time may have changed the order
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	sort.Sort(ms.Sessions[senderKey])
+	return ms.save()
+}
+
+func (ms *MemoryStore) DeleteSession(senderKey id.SenderKey, session *OlmSession) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	sessions := ms.Sessions[senderKey]
+	for i, existing := range sessions {
+		if existing == session {
+			ms.Sessions[senderKey] = append(sessions[:i:i], sessions[i+1:]...)
+			return ms.save()
+		}
+	}
+	return nil
 }
 
-func (gs *GobStore) HasSession(senderKey id.SenderKey) bool {
-	gs.lock.RLock()
-	sessions, ok := gs.Sessions[senderKey]
-	gs.lock.RUnlock()
+func (ms *MemoryStore) HasSession(senderKey id.SenderKey) bool {
+	ms.lock.RLock()
+	sessions, ok := ms.Sessions[senderKey]
+	ms.lock.RUnlock()
 	return ok && len(sessions) > 0 && !sessions[0].Expired()
 }
 
-func (gs *GobStore) GetLatestSession(senderKey id.SenderKey) (*OlmSession, error) {
-	gs.lock.RLock()
-	sessions, ok := gs.Sessions[senderKey]
-	gs.lock.RUnlock()
+func (ms *MemoryStore) GetLatestSession(senderKey id.SenderKey) (*OlmSession, error) {
+	ms.lock.RLock()
+	sessions, ok := ms.Sessions[senderKey]
+	ms.lock.RUnlock()
 	if !ok || len(sessions) == 0 {
 		return nil, nil
 	}
 	return sessions[0], nil
 }
 
-func (gs *GobStore) getGroupSessions(roomID id.RoomID, senderKey id.SenderKey) map[id.SessionID]*InboundGroupSession {
-	room, ok := gs.GroupSessions[roomID]
+func (ms *MemoryStore) getGroupSessions(roomID id.RoomID, senderKey id.SenderKey) map[id.SessionID]*InboundGroupSession {
+	room, ok := ms.GroupSessions[roomID]
 	if !ok {
 		room = make(map[id.SenderKey]map[id.SessionID]*InboundGroupSession)
-		gs.GroupSessions[roomID] = room
+		ms.GroupSessions[roomID] = room
 	}
 	sender, ok := room[senderKey]
 	if !ok {
@@ -266,34 +343,34 @@ func (gs *GobStore) getGroupSessions(roomID id.RoomID, senderKey id.SenderKey) m
 	return sender
 }
 
-func (gs *GobStore) PutGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, igs *InboundGroupSession) error {
-	gs.lock.Lock()
-	gs.getGroupSessions(roomID, senderKey)[sessionID] = igs
-	err := gs.save()
-	gs.lock.Unlock()
+func (ms *MemoryStore) PutGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, igs *InboundGroupSession) error {
+	ms.lock.Lock()
+	ms.getGroupSessions(roomID, senderKey)[sessionID] = igs
+	err := ms.save()
+	ms.lock.Unlock()
 	return err
 }
 
-func (gs *GobStore) GetGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*InboundGroupSession, error) {
-	gs.lock.Lock()
-	session, ok := gs.getGroupSessions(roomID, senderKey)[sessionID]
+func (ms *MemoryStore) GetGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*InboundGroupSession, error) {
+	ms.lock.Lock()
+	session, ok := ms.getGroupSessions(roomID, senderKey)[sessionID]
 	if !ok {
-		withheld, ok := gs.getWithheldGroupSessions(roomID, senderKey)[sessionID]
-		gs.lock.Unlock()
+		withheld, ok := ms.getWithheldGroupSessions(roomID, senderKey)[sessionID]
+		ms.lock.Unlock()
 		if ok {
 			return nil, fmt.Errorf("%w (%s)", ErrGroupSessionWithheld, withheld.Code)
 		}
 		return nil, nil
 	}
-	gs.lock.Unlock()
+	ms.lock.Unlock()
 	return session, nil
 }
 
-func (gs *GobStore) getWithheldGroupSessions(roomID id.RoomID, senderKey id.SenderKey) map[id.SessionID]*event.RoomKeyWithheldEventContent {
-	room, ok := gs.WithheldGroupSessions[roomID]
+func (ms *MemoryStore) getWithheldGroupSessions(roomID id.RoomID, senderKey id.SenderKey) map[id.SessionID]*event.RoomKeyWithheldEventContent {
+	room, ok := ms.WithheldGroupSessions[roomID]
 	if !ok {
 		room = make(map[id.SenderKey]map[id.SessionID]*event.RoomKeyWithheldEventContent)
-		gs.WithheldGroupSessions[roomID] = room
+		ms.WithheldGroupSessions[roomID] = room
 	}
 	sender, ok := room[senderKey]
 	if !ok {
@@ -303,28 +380,28 @@ func (gs *GobStore) getWithheldGroupSessions(roomID id.RoomID, senderKey id.Send
 	return sender
 }
 
-func (gs *GobStore) PutWithheldGroupSession(content event.RoomKeyWithheldEventContent) error {
-	gs.lock.Lock()
-	gs.getWithheldGroupSessions(content.RoomID, content.SenderKey)[content.SessionID] = &content
-	err := gs.save()
-	gs.lock.Unlock()
+func (ms *MemoryStore) PutWithheldGroupSession(content event.RoomKeyWithheldEventContent) error {
+	ms.lock.Lock()
+	ms.getWithheldGroupSessions(content.RoomID, content.SenderKey)[content.SessionID] = &content
+	err := ms.save()
+	ms.lock.Unlock()
 	return err
 }
 
-func (gs *GobStore) GetWithheldGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*event.RoomKeyWithheldEventContent, error) {
-	gs.lock.Lock()
-	session, ok := gs.getWithheldGroupSessions(roomID, senderKey)[sessionID]
-	gs.lock.Unlock()
+func (ms *MemoryStore) GetWithheldGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*event.RoomKeyWithheldEventContent, error) {
+	ms.lock.Lock()
+	session, ok := ms.getWithheldGroupSessions(roomID, senderKey)[sessionID]
+	ms.lock.Unlock()
 	if !ok {
 		return nil, nil
 	}
 	return session, nil
 }
 
-func (gs *GobStore) GetGroupSessionsForRoom(roomID id.RoomID) ([]*InboundGroupSession, error) {
-	gs.lock.Lock()
-	defer gs.lock.Unlock()
-	room, ok := gs.GroupSessions[roomID]
+func (ms *MemoryStore) GetGroupSessionsForRoom(roomID id.RoomID) ([]*InboundGroupSession, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	room, ok := ms.GroupSessions[roomID]
 	if !ok {
 		return []*InboundGroupSession{}, nil
 	}
@@ -337,70 +414,72 @@ func (gs *GobStore) GetGroupSessionsForRoom(roomID id.RoomID) ([]*InboundGroupSe
 	return result, nil
 }
 
-func (gs *GobStore) GetAllGroupSessions() ([]*InboundGroupSession, error) {
-	gs.lock.Lock()
+func (ms *MemoryStore) GetAllGroupSessions() ([]*InboundGroupSession, error) {
+	ms.lock.Lock()
 	var result []*InboundGroupSession
-	for _, room := range gs.GroupSessions {
+	for _, room := range ms.GroupSessions {
 		for _, sessions := range room {
 			for _, session := range sessions {
 				result = append(result, session)
 			}
 		}
 	}
-	gs.lock.Unlock()
+	ms.lock.Unlock()
 	return result, nil
 }
 
-func (gs *GobStore) AddOutboundGroupSession(session *OutboundGroupSession) error {
-	gs.lock.Lock()
-	gs.OutGroupSessions[session.RoomID] = session
-	err := gs.save()
-	gs.lock.Unlock()
+func (ms *MemoryStore) AddOutboundGroupSession(session *OutboundGroupSession) error {
+	ms.lock.Lock()
+	ms.OutGroupSessions[session.RoomID] = session
+	err := ms.save()
+	ms.lock.Unlock()
 	return err
 }
 
-func (gs *GobStore) UpdateOutboundGroupSession(_ *OutboundGroupSession) error {
+func (ms *MemoryStore) UpdateOutboundGroupSession(_ *OutboundGroupSession) error {
 	// we don't need to do anything here because the session is a pointer and already stored in our map
-	return gs.save()
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.save()
 }
 
-func (gs *GobStore) GetOutboundGroupSession(roomID id.RoomID) (*OutboundGroupSession, error) {
-	gs.lock.RLock()
-	session, ok := gs.OutGroupSessions[roomID]
-	gs.lock.RUnlock()
+func (ms *MemoryStore) GetOutboundGroupSession(roomID id.RoomID) (*OutboundGroupSession, error) {
+	ms.lock.RLock()
+	session, ok := ms.OutGroupSessions[roomID]
+	ms.lock.RUnlock()
 	if !ok {
 		return nil, nil
 	}
 	return session, nil
 }
 
-func (gs *GobStore) RemoveOutboundGroupSession(roomID id.RoomID) error {
-	gs.lock.Lock()
-	session, ok := gs.OutGroupSessions[roomID]
+func (ms *MemoryStore) RemoveOutboundGroupSession(roomID id.RoomID) error {
+	ms.lock.Lock()
+	session, ok := ms.OutGroupSessions[roomID]
 	if !ok || session == nil {
-		gs.lock.Unlock()
+		ms.lock.Unlock()
 		return nil
 	}
-	delete(gs.OutGroupSessions, roomID)
-	gs.lock.Unlock()
+	delete(ms.OutGroupSessions, roomID)
+	ms.lock.Unlock()
 	return nil
 }
 
-func (gs *GobStore) ValidateMessageIndex(senderKey id.SenderKey, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) (bool, error) {
-	gs.lock.Lock()
-	defer gs.lock.Unlock()
+func (ms *MemoryStore) ValidateMessageIndex(senderKey id.SenderKey, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
 	key := messageIndexKey{
 		SenderKey: senderKey,
 		SessionID: sessionID,
 		Index:     index,
 	}
-	val, ok := gs.MessageIndices[key]
+	val, ok := ms.MessageIndices[key]
 	if !ok {
-		gs.MessageIndices[key] = messageIndexValue{
+		ms.MessageIndices[key] = messageIndexValue{
 			EventID:   eventID,
 			Timestamp: timestamp,
 		}
-		_ = gs.save()
+		_ = ms.save()
 		return true, nil
 	}
 	if val.EventID != eventID || val.Timestamp != timestamp {
@@ -409,20 +488,20 @@ func (gs *GobStore) ValidateMessageIndex(senderKey id.SenderKey, sessionID id.Se
 	return true, nil
 }
 
-func (gs *GobStore) GetDevices(userID id.UserID) (map[id.DeviceID]*id.Device, error) {
-	gs.lock.RLock()
-	devices, ok := gs.Devices[userID]
+func (ms *MemoryStore) GetDevices(userID id.UserID) (map[id.DeviceID]*id.Device, error) {
+	ms.lock.RLock()
+	devices, ok := ms.Devices[userID]
 	if !ok {
 		devices = nil
 	}
-	gs.lock.RUnlock()
+	ms.lock.RUnlock()
 	return devices, nil
 }
 
-func (gs *GobStore) GetDevice(userID id.UserID, deviceID id.DeviceID) (*id.Device, error) {
-	gs.lock.RLock()
-	defer gs.lock.RUnlock()
-	devices, ok := gs.Devices[userID]
+func (ms *MemoryStore) GetDevice(userID id.UserID, deviceID id.DeviceID) (*id.Device, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	devices, ok := ms.Devices[userID]
 	if !ok {
 		return nil, nil
 	}
@@ -433,10 +512,23 @@ func (gs *GobStore) GetDevice(userID id.UserID, deviceID id.DeviceID) (*id.Devic
 	return device, nil
 }
 
-func (gs *GobStore) FindDeviceByKey(userID id.UserID, identityKey id.IdentityKey) (*id.Device, error) {
-	gs.lock.RLock()
-	defer gs.lock.RUnlock()
-	devices, ok := gs.Devices[userID]
+func (ms *MemoryStore) FindDeviceByIdentityKey(identityKey id.IdentityKey) (*id.Device, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	for _, devices := range ms.Devices {
+		for _, device := range devices {
+			if device.IdentityKey == identityKey {
+				return device, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (ms *MemoryStore) FindDeviceByKey(userID id.UserID, identityKey id.IdentityKey) (*id.Device, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	devices, ok := ms.Devices[userID]
 	if !ok {
 		return nil, nil
 	}
@@ -448,47 +540,47 @@ func (gs *GobStore) FindDeviceByKey(userID id.UserID, identityKey id.IdentityKey
 	return nil, nil
 }
 
-func (gs *GobStore) PutDevice(userID id.UserID, device *id.Device) error {
-	gs.lock.Lock()
-	devices, ok := gs.Devices[userID]
+func (ms *MemoryStore) PutDevice(userID id.UserID, device *id.Device) error {
+	ms.lock.Lock()
+	devices, ok := ms.Devices[userID]
 	if !ok {
 		devices = make(map[id.DeviceID]*id.Device)
-		gs.Devices[userID] = devices
+		ms.Devices[userID] = devices
 	}
 	devices[device.DeviceID] = device
-	err := gs.save()
-	gs.lock.Unlock()
+	err := ms.save()
+	ms.lock.Unlock()
 	return err
 }
 
-func (gs *GobStore) PutDevices(userID id.UserID, devices map[id.DeviceID]*id.Device) error {
-	gs.lock.Lock()
-	gs.Devices[userID] = devices
-	err := gs.save()
-	gs.lock.Unlock()
+func (ms *MemoryStore) PutDevices(userID id.UserID, devices map[id.DeviceID]*id.Device) error {
+	ms.lock.Lock()
+	ms.Devices[userID] = devices
+	err := ms.save()
+	ms.lock.Unlock()
 	return err
 }
 
-func (gs *GobStore) FilterTrackedUsers(users []id.UserID) ([]id.UserID, error) {
-	gs.lock.RLock()
+func (ms *MemoryStore) FilterTrackedUsers(users []id.UserID) ([]id.UserID, error) {
+	ms.lock.RLock()
 	var ptr int
 	for _, userID := range users {
-		_, ok := gs.Devices[userID]
+		_, ok := ms.Devices[userID]
 		if ok {
 			users[ptr] = userID
 			ptr++
 		}
 	}
-	gs.lock.RUnlock()
+	ms.lock.RUnlock()
 	return users[:ptr], nil
 }
 
-func (gs *GobStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUsage, key id.Ed25519) error {
-	gs.lock.RLock()
-	userKeys, ok := gs.CrossSigningKeys[userID]
+func (ms *MemoryStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUsage, key id.Ed25519) error {
+	ms.lock.Lock()
+	userKeys, ok := ms.CrossSigningKeys[userID]
 	if !ok {
 		userKeys = make(map[id.CrossSigningUsage]id.CrossSigningKey)
-		gs.CrossSigningKeys[userID] = userKeys
+		ms.CrossSigningKeys[userID] = userKeys
 	}
 	existing, ok := userKeys[usage]
 	if ok {
@@ -500,27 +592,27 @@ func (gs *GobStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUs
 			First: key,
 		}
 	}
-	err := gs.save()
-	gs.lock.RUnlock()
+	err := ms.save()
+	ms.lock.Unlock()
 	return err
 }
 
-func (gs *GobStore) GetCrossSigningKeys(userID id.UserID) (map[id.CrossSigningUsage]id.CrossSigningKey, error) {
-	gs.lock.RLock()
-	defer gs.lock.RUnlock()
-	keys, ok := gs.CrossSigningKeys[userID]
+func (ms *MemoryStore) GetCrossSigningKeys(userID id.UserID) (map[id.CrossSigningUsage]id.CrossSigningKey, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	keys, ok := ms.CrossSigningKeys[userID]
 	if !ok {
 		return map[id.CrossSigningUsage]id.CrossSigningKey{}, nil
 	}
 	return keys, nil
 }
 
-func (gs *GobStore) PutSignature(signedUserID id.UserID, signedKey id.Ed25519, signerUserID id.UserID, signerKey id.Ed25519, signature string) error {
-	gs.lock.RLock()
-	signedUserSigs, ok := gs.KeySignatures[signedUserID]
+func (ms *MemoryStore) PutSignature(signedUserID id.UserID, signedKey id.Ed25519, signerUserID id.UserID, signerKey id.Ed25519, signature string) error {
+	ms.lock.Lock()
+	signedUserSigs, ok := ms.KeySignatures[signedUserID]
 	if !ok {
 		signedUserSigs = make(map[id.Ed25519]map[id.UserID]map[id.Ed25519]string)
-		gs.KeySignatures[signedUserID] = signedUserSigs
+		ms.KeySignatures[signedUserID] = signedUserSigs
 	}
 	signaturesForKey, ok := signedUserSigs[signedKey]
 	if !ok {
@@ -533,15 +625,15 @@ func (gs *GobStore) PutSignature(signedUserID id.UserID, signedKey id.Ed25519, s
 		signaturesForKey[signerUserID] = signedByUser
 	}
 	signedByUser[signerKey] = signature
-	err := gs.save()
-	gs.lock.RUnlock()
+	err := ms.save()
+	ms.lock.Unlock()
 	return err
 }
 
-func (gs *GobStore) GetSignaturesForKeyBy(userID id.UserID, key id.Ed25519, signerID id.UserID) (map[id.Ed25519]string, error) {
-	gs.lock.RLock()
-	defer gs.lock.RUnlock()
-	userKeys, ok := gs.KeySignatures[userID]
+func (ms *MemoryStore) GetSignaturesForKeyBy(userID id.UserID, key id.Ed25519, signerID id.UserID) (map[id.Ed25519]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	userKeys, ok := ms.KeySignatures[userID]
 	if !ok {
 		return map[id.Ed25519]string{}, nil
 	}
@@ -556,8 +648,8 @@ func (gs *GobStore) GetSignaturesForKeyBy(userID id.UserID, key id.Ed25519, sign
 	return sigsBySigner, nil
 }
 
-func (gs *GobStore) IsKeySignedBy(userID id.UserID, key id.Ed25519, signerID id.UserID, signerKey id.Ed25519) (bool, error) {
-	sigs, err := gs.GetSignaturesForKeyBy(userID, key, signerID)
+func (ms *MemoryStore) IsKeySignedBy(userID id.UserID, key id.Ed25519, signerID id.UserID, signerKey id.Ed25519) (bool, error) {
+	sigs, err := ms.GetSignaturesForKeyBy(userID, key, signerID)
 	if err != nil {
 		return false, err
 	}
@@ -565,10 +657,10 @@ func (gs *GobStore) IsKeySignedBy(userID id.UserID, key id.Ed25519, signerID id.
 	return ok, nil
 }
 
-func (gs *GobStore) DropSignaturesByKey(userID id.UserID, key id.Ed25519) (int64, error) {
+func (ms *MemoryStore) DropSignaturesByKey(userID id.UserID, key id.Ed25519) (int64, error) {
 	var count int64
-	gs.lock.RLock()
-	for _, userSigs := range gs.KeySignatures {
+	ms.lock.Lock()
+	for _, userSigs := range ms.KeySignatures {
 		for _, keySigs := range userSigs {
 			if signedBySigner, ok := keySigs[userID]; ok {
 				if _, ok := signedBySigner[key]; ok {
@@ -578,6 +670,6 @@ func (gs *GobStore) DropSignaturesByKey(userID id.UserID, key id.Ed25519) (int64
 			}
 		}
 	}
-	gs.lock.RUnlock()
+	ms.lock.Unlock()
 	return count, nil
 }
@@ -7,10 +7,14 @@
 package crypto
 
 import (
+	"bytes"
 	"database/sql"
+	"errors"
 	"os"
+	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -49,6 +53,7 @@ func getCryptoStores(t *testing.T) (map[string]Store, func()) {
 	return map[string]Store{
 			"sql": sqlStore,
 			"gob": gobStore,
+			"memory": NewMemoryStore(nil),
 		}, func() {
 			os.Remove("gob_store_test.gob")
 		}
@@ -269,3 +274,83 @@ func TestStoreDevices(t *testing.T) {
 		})
 	}
 }
+
+func TestMemoryStoreSessionOrder(t *testing.T) {
+	store := NewMemoryStore(nil)
+	now := time.Now()
+	older := &OlmSession{id: "older", ExpirationMixin: ExpirationMixin{TimeMixin: TimeMixin{LastDecryptedTime: now.Add(-time.Hour)}}}
+	newer := &OlmSession{id: "newer", ExpirationMixin: ExpirationMixin{TimeMixin: TimeMixin{LastDecryptedTime: now.Add(-time.Minute)}}}
+	_ = store.AddSession("sender", older)
+	_ = store.AddSession("sender", newer)
+	if sessions, _ := store.GetSessions("sender"); len(sessions) != 2 || sessions[0] != newer {
+		t.Fatalf("Most recently used session is not first")
+	}
+	older.LastDecryptedTime = now
+	_ = store.UpdateSession("sender", older)
+	if sessions, _ := store.GetSessions("sender"); sessions[0] != older {
+		t.Errorf("Session order was not updated after using the older session")
+	}
+	_ = store.DeleteSession("sender", newer)
+	if sessions, _ := store.GetSessions("sender"); len(sessions) != 1 || sessions[0] != older {
+		t.Errorf("Session was not deleted")
+	}
+}
+
+func TestSQLStoreRekey(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	store := stores["sql"].(*SQLCryptoStore)
+	acc := NewOlmAccount()
+	_ = store.PutAccount(acc)
+
+	var rekeyErr RekeyError
+	if err := store.Rekey([]byte("wrong"), []byte("new")); !errors.As(err, &rekeyErr) || len(rekeyErr.Failures) != 1 {
+		t.Fatalf("Expected rekey with wrong old key to fail, got %v", err)
+	}
+	if err := store.Rekey([]byte("test"), []byte("new")); err != nil {
+		t.Fatalf("Error rekeying store: %v", err)
+	}
+	store.Account = nil
+	retrieved, err := store.GetAccount()
+	if err != nil {
+		t.Fatalf("Error retrieving account after rekeying: %v", err)
+	} else if retrieved.IdentityKey() != acc.IdentityKey() {
+		t.Errorf("Stored identity key %v, got %v after rekeying", acc.IdentityKey(), retrieved.IdentityKey())
+	}
+}
+
+func TestSQLStoreCrossSigningSeeds(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	store := stores["sql"].(*SQLCryptoStore)
+
+	if seeds, err := store.GetCrossSigningSeeds(); err != nil || seeds != nil {
+		t.Fatalf("Expected no stored seeds, got %v (error %v)", seeds, err)
+	}
+	seeds := CrossSigningSeeds{
+		MasterKey:      bytes.Repeat([]byte{1}, 32),
+		SelfSigningKey: bytes.Repeat([]byte{2}, 32),
+		UserSigningKey: bytes.Repeat([]byte{3}, 32),
+	}
+	if err := store.PutCrossSigningSeeds(seeds); err != nil {
+		t.Fatalf("Error storing seeds: %v", err)
+	}
+	var pickled []byte
+	_ = store.DB.QueryRow("SELECT keys FROM crypto_cross_signing_private_keys WHERE account_id=$1", store.AccountID).Scan(&pickled)
+	if bytes.Contains(pickled, seeds.MasterKey) {
+		t.Errorf("Seeds were stored unencrypted")
+	}
+	if err := store.Rekey([]byte("test"), []byte("new")); err != nil {
+		t.Fatalf("Error rekeying store: %v", err)
+	}
+	retrieved, err := store.GetCrossSigningSeeds()
+	if err != nil {
+		t.Fatalf("Error retrieving seeds after rekeying: %v", err)
+	} else if !reflect.DeepEqual(*retrieved, seeds) {
+		t.Errorf("Stored seeds %v, got %v", seeds, *retrieved)
+	}
+	store.PickleKey = []byte("wrong")
+	if _, err = store.GetCrossSigningSeeds(); !errors.Is(err, ErrCrossSigningSeedsMACMismatch) {
+		t.Errorf("Expected MAC mismatch with wrong pickle key, got %v", err)
+	}
+}
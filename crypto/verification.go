@@ -542,10 +542,25 @@ func (mach *OlmMachine) handleVerificationMAC(userID id.UserID, content *event.V
 
 		mach.Log.Debug("Device %v of user %v verified successfully!", device.DeviceID, device.UserID)
 
+		if verState.inRoomID == "" {
+			err = mach.SendSASVerificationDone(device.UserID, device.DeviceID, transactionID)
+		} else {
+			err = mach.SendInRoomSASVerificationDone(verState.inRoomID, transactionID)
+		}
+		if err != nil {
+			mach.Log.Warn("Failed to send verification done message for transaction %v: %v", transactionID, err)
+		}
+
 		verState.hooks.OnSuccess()
 	}()
 }
 
+// handleVerificationDone handles an incoming m.key.verification.done message.
+// The transaction state is already removed when the MAC is received, so this is only logged.
+func (mach *OlmMachine) handleVerificationDone(userID id.UserID, transactionID string) {
+	mach.Log.Debug("SAS verification %v was marked as done by %v", transactionID, userID)
+}
+
 // handleVerificationCancel handles an incoming m.key.verification.cancel message.
 // It cancels the verification process for the given reason.
 func (mach *OlmMachine) handleVerificationCancel(userID id.UserID, content *event.VerificationCancelEventContent, transactionID string) {
@@ -684,6 +699,14 @@ func (mach *OlmMachine) SendSASVerificationCancel(userID id.UserID, deviceID id.
 	return mach.sendToOneDevice(userID, deviceID, event.ToDeviceVerificationCancel, content)
 }
 
+// SendSASVerificationDone is used to send the m.key.verification.done message after a successful verification.
+func (mach *OlmMachine) SendSASVerificationDone(userID id.UserID, deviceID id.DeviceID, transactionID string) error {
+	content := &event.VerificationDoneEventContent{
+		TransactionID: transactionID,
+	}
+	return mach.sendToOneDevice(userID, deviceID, event.ToDeviceVerificationDone, content)
+}
+
 // SendSASVerificationStart is used to manually send the SAS verification start message to another device.
 func (mach *OlmMachine) SendSASVerificationStart(toUserID id.UserID, toDeviceID id.DeviceID, transactionID string, methods []VerificationMethod) (*event.VerificationStartEventContent, error) {
 	sasMethods := make([]event.SASMethod, len(methods))
@@ -67,6 +67,8 @@ func (mach *OlmMachine) ProcessInRoomVerification(evt *event.Event) error {
 		mach.handleVerificationMAC(evt.Sender, content, content.RelatesTo.EventID.String())
 	case *event.VerificationCancelEventContent:
 		mach.handleVerificationCancel(evt.Sender, content, content.RelatesTo.EventID.String())
+	case *event.VerificationDoneEventContent:
+		mach.handleVerificationDone(evt.Sender, content.RelatesTo.EventID.String())
 	}
 	return nil
 }
@@ -88,6 +90,20 @@ func (mach *OlmMachine) SendInRoomSASVerificationCancel(roomID id.RoomID, userID
 	return err
 }
 
+// SendInRoomSASVerificationDone is used to send the in-room m.key.verification.done message after a successful verification.
+func (mach *OlmMachine) SendInRoomSASVerificationDone(roomID id.RoomID, transactionID string) error {
+	content := &event.VerificationDoneEventContent{
+		RelatesTo: &event.RelatesTo{Type: event.RelReference, EventID: id.EventID(transactionID)},
+	}
+
+	encrypted, err := mach.EncryptMegolmEvent(roomID, event.InRoomVerificationDone, content)
+	if err != nil {
+		return err
+	}
+	_, err = mach.Client.SendMessageEvent(roomID, event.EventEncrypted, encrypted)
+	return err
+}
+
 // SendInRoomSASVerificationRequest is used to manually send an in-room SAS verification request message to another user.
 func (mach *OlmMachine) SendInRoomSASVerificationRequest(roomID id.RoomID, toUserID id.UserID, methods []VerificationMethod) (string, error) {
 	content := &event.MessageEventContent{
@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 )
 
 // Common error codes from https://matrix.org/docs/spec/client_server/latest#api-standards
@@ -34,6 +35,8 @@ var (
 	MNotJSON = RespError{ErrCode: "M_NOT_JSON"}
 	// No resource was found for this request.
 	MNotFound = RespError{ErrCode: "M_NOT_FOUND"}
+	// The server did not understand the request, e.g. because the endpoint isn't implemented.
+	MUnrecognized = RespError{ErrCode: "M_UNRECOGNIZED"}
 	// Too many requests have been sent in a short period of time. Wait a while then try again.
 	MLimitExceeded = RespError{ErrCode: "M_LIMIT_EXCEEDED"}
 	// The user ID associated with the request has been deactivated.
@@ -56,8 +59,16 @@ var (
 	// The client attempted to join a room that has a version the server does not support.
 	// Inspect the room_version property of the error response for the room's version.
 	MIncompatibleRoomVersion = RespError{ErrCode: "M_INCOMPATIBLE_ROOM_VERSION"}
+	// The media was created with an asynchronous upload (MSC2246), but the content hasn't been uploaded yet.
+	MNotYetUploaded = RespError{ErrCode: "M_NOT_YET_UPLOADED"}
+	// The user has already sent a reaction with the same key to the event. This is not specified, but Synapse uses it.
+	MDuplicateAnnotation = RespError{ErrCode: "M_DUPLICATE_ANNOTATION"}
+	// The user is a guest and guests aren't allowed to use the endpoint or access the room.
+	MGuestAccessForbidden = RespError{ErrCode: "M_GUEST_ACCESS_FORBIDDEN"}
 )
 
+const unstableNotYetUploadedErrCode = "FI.MAU.MSC2246_NOT_YET_UPLOADED"
+
 // HTTPError An HTTP Error response, which may wrap an underlying native Go Error.
 type HTTPError struct {
 	Request      *http.Request
@@ -67,6 +78,12 @@ type HTTPError struct {
 	WrappedError error
 	RespError    *RespError
 	Message      string
+
+	// The number of attempts that were made before giving up on the request.
+	Attempts int
+	// An additional explanation of the error that's appended to the message, e.g. that the client is a guest user.
+	// The RespError is kept as-is, so the server's original error message can still be read from it.
+	Hint string
 }
 
 func (e HTTPError) Is(err error) bool {
@@ -77,12 +94,24 @@ func (e HTTPError) IsStatus(code int) bool {
 	return e.Response != nil && e.Response.StatusCode == code
 }
 
+// StatusCode returns the HTTP status code of the response, or 0 if the request failed without a response.
+func (e HTTPError) StatusCode() int {
+	if e.Response == nil {
+		return 0
+	}
+	return e.Response.StatusCode
+}
+
 func (e HTTPError) Error() string {
 	if e.WrappedError != nil {
 		return fmt.Sprintf("%s: %v", e.Message, e.WrappedError)
 	} else if e.RespError != nil {
-		return fmt.Sprintf("failed to %s %s: %s (HTTP %d): %s", e.Request.Method, e.Request.URL.Path,
+		msg := fmt.Sprintf("failed to %s %s: %s (HTTP %d): %s", e.Request.Method, e.Request.URL.Path,
 			e.RespError.ErrCode, e.Response.StatusCode, e.RespError.Err)
+		if len(e.Hint) > 0 {
+			msg = fmt.Sprintf("%s (%s)", msg, e.Hint)
+		}
+		return msg
 	} else {
 		msg := fmt.Sprintf("failed to %s %s: %s", e.Request.Method, e.Request.URL.Path, e.Response.Status)
 		if len(e.ResponseBody) > 0 {
@@ -128,6 +157,23 @@ func (e *RespError) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&e.ExtraData)
 }
 
+// RetryAfter returns the retry_after_ms field of M_LIMIT_EXCEEDED errors.
+func (e RespError) RetryAfter() (time.Duration, bool) {
+	retryAfterMS, ok := e.ExtraData["retry_after_ms"].(float64)
+	if !ok || retryAfterMS < 0 {
+		return 0, false
+	}
+	return time.Duration(retryAfterMS) * time.Millisecond, true
+}
+
+// SoftLogout returns the soft_logout field of M_UNKNOWN_TOKEN errors. If true, the client should
+// log in again with the same device ID instead of discarding all data.
+// See https://spec.matrix.org/v1.2/client-server-api/#soft-logout
+func (e RespError) SoftLogout() bool {
+	softLogout, _ := e.ExtraData["soft_logout"].(bool)
+	return softLogout
+}
+
 // Error returns the errcode and error message.
 func (e RespError) Error() string {
 	return e.ErrCode + ": " + e.Err
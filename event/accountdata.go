@@ -20,6 +20,13 @@ type TagEventContent struct {
 
 type Tags map[string]Tag
 
+// Tag names defined in the spec. Custom tags should use the u. prefix.
+const (
+	RoomTagFavourite    = "m.favourite"
+	RoomTagLowPriority  = "m.lowpriority"
+	RoomTagServerNotice = "m.server_notice"
+)
+
 type Tag struct {
 	Order json.Number `json:"order,omitempty"`
 }
@@ -7,6 +7,7 @@
 package event
 
 import (
+	"bytes"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
@@ -16,6 +17,9 @@ import (
 
 // TypeMap is a mapping from event type to the content struct type.
 // This is used by Content.ParseRaw() for creating the correct type of struct.
+//
+// Custom event types can be added with RegisterContentType. Content of types that aren't in the map
+// can't be parsed, but the raw JSON is still available in Content.Raw and Content.VeryRaw.
 var TypeMap = map[Type]reflect.Type{
 	StateMember:            reflect.TypeOf(MemberEventContent{}),
 	StatePowerLevels:       reflect.TypeOf(PowerLevelsEventContent{}),
@@ -48,6 +52,10 @@ var TypeMap = map[Type]reflect.Type{
 
 	BeeperMessageStatus: reflect.TypeOf(BeeperMessageStatusEventContent{}),
 
+	EventUnstablePollStart:    reflect.TypeOf(PollStartEventContent{}),
+	EventUnstablePollResponse: reflect.TypeOf(PollResponseEventContent{}),
+	EventUnstablePollEnd:      reflect.TypeOf(PollEndEventContent{}),
+
 	AccountDataRoomTags:        reflect.TypeOf(TagEventContent{}),
 	AccountDataDirectChats:     reflect.TypeOf(DirectChatsEventContent{}),
 	AccountDataFullyRead:       reflect.TypeOf(FullyReadEventContent{}),
@@ -63,6 +71,7 @@ var TypeMap = map[Type]reflect.Type{
 	InRoomVerificationKey:    reflect.TypeOf(VerificationKeyEventContent{}),
 	InRoomVerificationMAC:    reflect.TypeOf(VerificationMacEventContent{}),
 	InRoomVerificationCancel: reflect.TypeOf(VerificationCancelEventContent{}),
+	InRoomVerificationDone:   reflect.TypeOf(VerificationDoneEventContent{}),
 
 	ToDeviceRoomKey:          reflect.TypeOf(RoomKeyEventContent{}),
 	ToDeviceForwardedRoomKey: reflect.TypeOf(ForwardedRoomKeyEventContent{}),
@@ -76,6 +85,7 @@ var TypeMap = map[Type]reflect.Type{
 	ToDeviceVerificationKey:     reflect.TypeOf(VerificationKeyEventContent{}),
 	ToDeviceVerificationMAC:     reflect.TypeOf(VerificationMacEventContent{}),
 	ToDeviceVerificationCancel:  reflect.TypeOf(VerificationCancelEventContent{}),
+	ToDeviceVerificationDone:    reflect.TypeOf(VerificationDoneEventContent{}),
 	ToDeviceVerificationRequest: reflect.TypeOf(VerificationRequestEventContent{}),
 
 	ToDeviceOrgMatrixRoomKeyWithheld: reflect.TypeOf(RoomKeyWithheldEventContent{}),
@@ -105,6 +115,14 @@ type Content struct {
 	Parsed  interface{}
 }
 
+// UseJSONNumber makes Content.UnmarshalJSON decode numbers in Content.Raw as json.Number instead of float64,
+// which preserves the exact value of integers larger than 2^53. It's disabled by default, as code that reads
+// numbers from Raw would have to handle json.Number instead of float64.
+//
+// This is a process-wide setting that affects every Content decoded afterwards, so it should only be set once
+// during startup. To decode a single content with numbers preserved, use Content.RawWithNumbers instead.
+var UseJSONNumber = false
+
 type Relatable interface {
 	GetRelatesTo() *RelatesTo
 	OptionalGetRelatesTo() *RelatesTo
@@ -113,10 +131,27 @@ type Relatable interface {
 
 func (content *Content) UnmarshalJSON(data []byte) error {
 	content.VeryRaw = data
+	if UseJSONNumber {
+		return unmarshalWithNumbers(data, &content.Raw)
+	}
 	err := json.Unmarshal(data, &content.Raw)
 	return err
 }
 
+func unmarshalWithNumbers(data []byte, into interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(into)
+}
+
+// RawWithNumbers decodes VeryRaw into a new map like Raw, but with numbers decoded as json.Number
+// regardless of UseJSONNumber, so that integers can be extracted exactly with json.Number.Int64.
+func (content *Content) RawWithNumbers() (map[string]interface{}, error) {
+	var raw map[string]interface{}
+	err := unmarshalWithNumbers(content.VeryRaw, &raw)
+	return raw, err
+}
+
 func (content *Content) MarshalJSON() ([]byte, error) {
 	if content.Raw == nil {
 		if content.Parsed == nil {
@@ -157,6 +192,23 @@ func (content *Content) MarshalJSON() ([]byte, error) {
 	return json.Marshal(content.Raw)
 }
 
+// RegisterContentType registers a custom content struct for the given event type, so that Content.ParseRaw
+// (and therefore the sync and appservice event parsing) creates a struct of that type. The content parameter
+// should be a zero value of the struct, either as a value or a pointer, e.g.
+//
+//	event.RegisterContentType(event.Type{Type: "org.example.custom", Class: event.MessageEventType}, &CustomEventContent{})
+//
+// The struct type is also registered with gob, like the built-in content types. This should be called during
+// initialization, as TypeMap isn't safe for concurrent modification.
+func RegisterContentType(evtType Type, content interface{}) {
+	structType := reflect.TypeOf(content)
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	TypeMap[evtType] = structType
+	gob.Register(reflect.New(structType).Interface())
+}
+
 func IsUnsupportedContentType(err error) bool {
 	return errors.Is(err, ErrUnsupportedContentType)
 }
@@ -215,6 +267,9 @@ func init() {
 	gob.Register(&EncryptedEventContent{})
 	gob.Register(&RedactionEventContent{})
 	gob.Register(&ReactionEventContent{})
+	gob.Register(&PollStartEventContent{})
+	gob.Register(&PollResponseEventContent{})
+	gob.Register(&PollEndEventContent{})
 	gob.Register(&TagEventContent{})
 	gob.Register(&DirectChatsEventContent{})
 	gob.Register(&FullyReadEventContent{})
@@ -370,6 +425,27 @@ func (content *Content) AsReaction() *ReactionEventContent {
 	}
 	return casted
 }
+func (content *Content) AsPollStart() *PollStartEventContent {
+	casted, ok := content.Parsed.(*PollStartEventContent)
+	if !ok {
+		return &PollStartEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsPollResponse() *PollResponseEventContent {
+	casted, ok := content.Parsed.(*PollResponseEventContent)
+	if !ok {
+		return &PollResponseEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsPollEnd() *PollEndEventContent {
+	casted, ok := content.Parsed.(*PollEndEventContent)
+	if !ok {
+		return &PollEndEventContent{}
+	}
+	return casted
+}
 func (content *Content) AsTag() *TagEventContent {
 	casted, ok := content.Parsed.(*TagEventContent)
 	if !ok {
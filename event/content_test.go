@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+type customEventContent struct {
+	Value string `json:"value"`
+}
+
+var customEventType = event.Type{Type: "org.example.custom", Class: event.MessageEventType}
+
+func TestRegisterContentType(t *testing.T) {
+	var content event.Content
+	require.NoError(t, json.Unmarshal([]byte(`{"value": "hello", "extra": 1}`), &content))
+	assert.True(t, event.IsUnsupportedContentType(content.ParseRaw(customEventType)))
+	assert.Equal(t, "hello", content.Raw["value"])
+
+	event.RegisterContentType(customEventType, &customEventContent{})
+	defer delete(event.TypeMap, customEventType)
+	content.Parsed = nil
+	require.NoError(t, content.ParseRaw(customEventType))
+	parsed, ok := content.Parsed.(*customEventContent)
+	require.True(t, ok)
+	assert.Equal(t, "hello", parsed.Value)
+	assert.EqualValues(t, 1, content.Raw["extra"])
+}
+
+func TestContent_RawWithNumbers(t *testing.T) {
+	const input = `{"big": 9007199254740993, "nested": {"level": 100}}`
+	var content event.Content
+	require.NoError(t, json.Unmarshal([]byte(input), &content))
+	assert.IsType(t, float64(0), content.Raw["big"])
+
+	raw, err := content.RawWithNumbers()
+	require.NoError(t, err)
+	big, err := raw["big"].(json.Number).Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(9007199254740993), big)
+
+	assert.Equal(t, json.Number("100"), raw["nested"].(map[string]interface{})["level"])
+	content.Raw = raw
+	data, err := json.Marshal(&content)
+	require.NoError(t, err)
+	assert.JSONEq(t, input, string(data))
+}
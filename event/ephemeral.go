@@ -42,6 +42,9 @@ const (
 	ReceiptTypeReadPrivate ReceiptType = "m.read.private"
 )
 
+// ReadReceiptThreadMain is the thread ID used for receipts of events that aren't in any thread.
+const ReadReceiptThreadMain = "main"
+
 type Receipts map[ReceiptType]UserReceipts
 
 func (rps Receipts) GetOrCreate(receiptType ReceiptType) UserReceipts {
@@ -61,6 +64,9 @@ func (ur UserReceipts) Set(userID id.UserID, receipt ReadReceipt) {
 
 type ReadReceipt struct {
 	Timestamp int64 `json:"ts"`
+	// ThreadID is the thread that the receipt applies to. It's either the thread root event ID,
+	// ReadReceiptThreadMain for the main timeline, or empty for unthreaded receipts.
+	ThreadID string `json:"thread_id,omitempty"`
 
 	// Extra contains any unknown fields in the read receipt event.
 	// Most servers don't allow clients to set them, so this will be empty in most cases.
@@ -86,8 +92,11 @@ func (rr *ReadReceipt) UnmarshalJSON(data []byte) error {
 	}
 	ts, _ := parsed["ts"].(float64)
 	delete(parsed, "ts")
+	threadID, _ := parsed["thread_id"].(string)
+	delete(parsed, "thread_id")
 	*rr = ReadReceipt{
 		Timestamp: int64(ts),
+		ThreadID:  threadID,
 		Extra:     parsed,
 	}
 	return nil
@@ -112,6 +112,8 @@ type MautrixInfo struct {
 
 	ReceivedAt         time.Time
 	DecryptionDuration time.Duration
+	// DecryptionError is set if the event is still encrypted because decrypting it failed.
+	DecryptionError error
 
 	CheckpointSent bool
 }
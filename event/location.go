@@ -0,0 +1,164 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// LocationAssetType is the type of the thing whose location is shared in a m.location message.
+type LocationAssetType string
+
+const (
+	// AssetSelf means that the location is the sender's own location.
+	AssetSelf LocationAssetType = "m.self"
+	// AssetPin means that the location is a pin dropped at some other location.
+	AssetPin LocationAssetType = "m.pin"
+)
+
+// LocationInfo is the m.location content block from MSC3488.
+type LocationInfo struct {
+	URI         string `json:"uri"`
+	Description string `json:"description,omitempty"`
+}
+
+// LocationAsset is the m.asset content block from MSC3488.
+type LocationAsset struct {
+	Type LocationAssetType `json:"type"`
+}
+
+// LocationMessageEventContent represents the content of a m.room.message event with the m.location msgtype,
+// including the extensible event content blocks from MSC3488.
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/3488
+//
+// The content blocks are included with both the stable and unstable prefixes, as clients haven't switched to the
+// stable ones yet. The top-level body and geo_uri are the fallback for clients that don't support MSC3488.
+type LocationMessageEventContent struct {
+	MsgType MessageType `json:"msgtype"`
+	Body    string      `json:"body"`
+	GeoURI  string      `json:"geo_uri"`
+
+	Location         *LocationInfo  `json:"m.location,omitempty"`
+	UnstableLocation *LocationInfo  `json:"org.matrix.msc3488.location,omitempty"`
+	Asset            *LocationAsset `json:"m.asset,omitempty"`
+	UnstableAsset    *LocationAsset `json:"org.matrix.msc3488.asset,omitempty"`
+	Timestamp        int64          `json:"m.ts,omitempty"`
+	UnstableTS       int64          `json:"org.matrix.msc3488.ts,omitempty"`
+	UnstableText     string         `json:"org.matrix.msc1767.text,omitempty"`
+}
+
+// ErrInvalidGeoURI is returned if a geo URI doesn't have the geo:latitude,longitude format (RFC 5870).
+var ErrInvalidGeoURI = errors.New("invalid geo URI")
+
+// ErrNotLocation is returned by LocationFromEvent if the event doesn't contain a location.
+var ErrNotLocation = errors.New("event doesn't contain a location")
+
+var geoURIRegex = regexp.MustCompile(`^geo:(-?\d+(?:\.\d+)?),(-?\d+(?:\.\d+)?)(?:,-?\d+(?:\.\d+)?)?(?:;.*)?$`)
+
+// ParseGeoURI parses the latitude and longitude from a geo URI like geo:51.5008,0.1247;u=35.
+func ParseGeoURI(uri string) (latitude, longitude float64, err error) {
+	match := geoURIRegex.FindStringSubmatch(uri)
+	if match == nil {
+		err = fmt.Errorf("%w: %q", ErrInvalidGeoURI, uri)
+		return
+	}
+	// The regex ensures that the numbers are valid
+	latitude, _ = strconv.ParseFloat(match[1], 64)
+	longitude, _ = strconv.ParseFloat(match[2], 64)
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		err = fmt.Errorf("%w: coordinates out of range in %q", ErrInvalidGeoURI, uri)
+	}
+	return
+}
+
+// NewLocationMessage creates the content for a m.location message, with both the MSC3488 content blocks and
+// the legacy fallback fields. The timestamp is in milliseconds. If the asset type is empty, AssetSelf is used.
+func NewLocationMessage(geoURI, description string, assetType LocationAssetType, timestamp int64) (*LocationMessageEventContent, error) {
+	if _, _, err := ParseGeoURI(geoURI); err != nil {
+		return nil, err
+	}
+	if assetType == "" {
+		assetType = AssetSelf
+	}
+	body := fmt.Sprintf("Location: %s", geoURI)
+	if description != "" {
+		body = fmt.Sprintf("%s (%s)", description, geoURI)
+	}
+	location := &LocationInfo{URI: geoURI, Description: description}
+	asset := &LocationAsset{Type: assetType}
+	return &LocationMessageEventContent{
+		MsgType:          MsgLocation,
+		Body:             body,
+		GeoURI:           geoURI,
+		Location:         location,
+		UnstableLocation: location,
+		Asset:            asset,
+		UnstableAsset:    asset,
+		Timestamp:        timestamp,
+		UnstableTS:       timestamp,
+		UnstableText:     body,
+	}, nil
+}
+
+// Location is a location parsed from an event with LocationFromEvent.
+type Location struct {
+	GeoURI      string
+	Latitude    float64
+	Longitude   float64
+	Description string
+	AssetType   LocationAssetType
+	// The time when the location was sampled in milliseconds. Falls back to the event timestamp.
+	Timestamp int64
+}
+
+// LocationFromEvent reads the location from a message event. Both the MSC3488 m.location content block
+// (with stable or unstable prefix) and the legacy top-level geo_uri are supported.
+func LocationFromEvent(evt *Event) (*Location, error) {
+	raw := evt.Content.VeryRaw
+	if len(raw) == 0 && evt.Content.Parsed != nil {
+		var err error
+		raw, err = json.Marshal(evt.Content.Parsed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var content LocationMessageEventContent
+	if len(raw) == 0 || json.Unmarshal(raw, &content) != nil {
+		return nil, ErrNotLocation
+	}
+	loc := &Location{GeoURI: content.GeoURI, AssetType: AssetSelf, Timestamp: evt.Timestamp}
+	if info := content.Location; info != nil || content.UnstableLocation != nil {
+		if info == nil {
+			info = content.UnstableLocation
+		}
+		loc.GeoURI = info.URI
+		loc.Description = info.Description
+	}
+	if loc.GeoURI == "" {
+		return nil, ErrNotLocation
+	}
+	if content.Asset != nil && content.Asset.Type != "" {
+		loc.AssetType = content.Asset.Type
+	} else if content.UnstableAsset != nil && content.UnstableAsset.Type != "" {
+		loc.AssetType = content.UnstableAsset.Type
+	}
+	if content.Timestamp != 0 {
+		loc.Timestamp = content.Timestamp
+	} else if content.UnstableTS != 0 {
+		loc.Timestamp = content.UnstableTS
+	}
+	var err error
+	loc.Latitude, loc.Longitude, err = ParseGeoURI(loc.GeoURI)
+	if err != nil {
+		return nil, err
+	}
+	return loc, nil
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestLocationFromEvent(t *testing.T) {
+	content, err := event.NewLocationMessage("geo:51.5008,0.1247;u=35", "Big Ben", event.AssetPin, 1636829458432)
+	require.NoError(t, err)
+	raw, err := json.Marshal(content)
+	require.NoError(t, err)
+	loc, err := event.LocationFromEvent(&event.Event{Content: event.Content{VeryRaw: raw}})
+	require.NoError(t, err)
+	assert.Equal(t, 51.5008, loc.Latitude)
+	assert.Equal(t, 0.1247, loc.Longitude)
+	assert.Equal(t, "Big Ben", loc.Description)
+	assert.Equal(t, event.AssetPin, loc.AssetType)
+	assert.Equal(t, int64(1636829458432), loc.Timestamp)
+
+	legacy := &event.Event{Timestamp: 123, Content: event.Content{VeryRaw: json.RawMessage(`{"msgtype":"m.location","body":"Location","geo_uri":"geo:-33.8,151.2"}`)}}
+	loc, err = event.LocationFromEvent(legacy)
+	require.NoError(t, err)
+	assert.Equal(t, -33.8, loc.Latitude)
+	assert.Equal(t, event.AssetSelf, loc.AssetType)
+	assert.Equal(t, int64(123), loc.Timestamp)
+
+	_, err = event.NewLocationMessage("51.5008,0.1247", "", event.AssetSelf, 0)
+	assert.ErrorIs(t, err, event.ErrInvalidGeoURI)
+	_, err = event.NewLocationMessage("geo:91,0", "", event.AssetSelf, 0)
+	assert.ErrorIs(t, err, event.ErrInvalidGeoURI)
+	_, err = event.LocationFromEvent(&event.Event{Content: event.Content{VeryRaw: json.RawMessage(`{"msgtype":"m.text","body":"hi"}`)}})
+	assert.ErrorIs(t, err, event.ErrNotLocation)
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"mime"
+	"path/filepath"
+
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/id"
+)
+
+// MaxWaveformValue is the maximum value of a single point in MSC1767Audio.Waveform.
+const MaxWaveformValue = 1024
+
+// MSC1767Audio is the extensible audio content block from MSC1767, including the waveform from MSC3246.
+type MSC1767Audio struct {
+	// The duration of the audio in milliseconds.
+	Duration int `json:"duration"`
+	// The waveform of the audio as values between 0 and MaxWaveformValue.
+	Waveform []int `json:"waveform,omitempty"`
+}
+
+// MSC3245Voice marks an audio message as a voice message. It has no fields.
+type MSC3245Voice struct{}
+
+func newMediaMessage(msgType MessageType, url id.ContentURIString, filename string, info *FileInfo) *MessageEventContent {
+	if info == nil {
+		info = &FileInfo{}
+	}
+	if info.MimeType == "" {
+		info.MimeType = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	return &MessageEventContent{
+		MsgType: msgType,
+		Body:    filename,
+		URL:     url,
+		Info:    info,
+	}
+}
+
+// NewFileMessage creates the content for a m.file message. The file name is used as the body.
+//
+// The info should contain at least the size of the file. If it doesn't have a mimetype,
+// one is guessed from the file extension.
+func NewFileMessage(url id.ContentURIString, filename string, info *FileInfo) *MessageEventContent {
+	return newMediaMessage(MsgFile, url, filename, info)
+}
+
+// NewImageMessage creates the content for a m.image message. In addition to the fields mentioned in NewFileMessage,
+// the info should have the width and height of the image. Use SetThumbnail to add a thumbnail.
+func NewImageMessage(url id.ContentURIString, filename string, info *FileInfo) *MessageEventContent {
+	return newMediaMessage(MsgImage, url, filename, info)
+}
+
+// NewVideoMessage creates the content for a m.video message. In addition to the fields mentioned in NewFileMessage,
+// the info should have the width, height and duration (in milliseconds) of the video.
+func NewVideoMessage(url id.ContentURIString, filename string, info *FileInfo) *MessageEventContent {
+	return newMediaMessage(MsgVideo, url, filename, info)
+}
+
+// NewAudioMessage creates the content for a m.audio message. In addition to the fields mentioned in NewFileMessage,
+// the info should have the duration (in milliseconds) of the audio.
+//
+// If a waveform is given, the MSC1767 audio block is included with the duration and waveform.
+// Values outside 0-MaxWaveformValue are clamped. Set MSC3245Voice to mark the message as a voice message.
+func NewAudioMessage(url id.ContentURIString, filename string, info *FileInfo, waveform []int) *MessageEventContent {
+	content := newMediaMessage(MsgAudio, url, filename, info)
+	if waveform != nil {
+		clamped := make([]int, len(waveform))
+		for i, value := range waveform {
+			if value < 0 {
+				value = 0
+			} else if value > MaxWaveformValue {
+				value = MaxWaveformValue
+			}
+			clamped[i] = value
+		}
+		content.MSC1767Audio = &MSC1767Audio{Duration: content.Info.Duration, Waveform: clamped}
+	}
+	return content
+}
+
+// SetThumbnail sets the thumbnail of an image or video message.
+func (content *MessageEventContent) SetThumbnail(url id.ContentURIString, info *FileInfo) {
+	fileInfo := content.GetInfo()
+	fileInfo.ThumbnailURL = url
+	fileInfo.ThumbnailInfo = info
+}
+
+// SetEncryptedFile marks the media as encrypted with the given key, for sending in encrypted rooms.
+// The URL is moved into the file block, as the top-level url field must not be used for encrypted media.
+func (content *MessageEventContent) SetEncryptedFile(file *attachment.EncryptedFile) {
+	content.File = &EncryptedFileInfo{EncryptedFile: *file, URL: content.URL}
+	content.URL = ""
+}
+
+// SetEncryptedThumbnail marks the thumbnail as encrypted with the given key, like SetEncryptedFile.
+// SetThumbnail must be called first.
+func (content *MessageEventContent) SetEncryptedThumbnail(file *attachment.EncryptedFile) {
+	fileInfo := content.GetInfo()
+	fileInfo.ThumbnailFile = &EncryptedFileInfo{EncryptedFile: *file, URL: fileInfo.ThumbnailURL}
+	fileInfo.ThumbnailURL = ""
+}
+
+// EncryptAttachment encrypts a file for sending in an encrypted room using the Matrix attachment encryption scheme
+// (AES-CTR with a random key, see https://spec.matrix.org/v1.4/client-server-api/#sending-encrypted-attachments).
+//
+// The returned info contains the key, IV and SHA-256 hash of the ciphertext. The URL field must be set to the mxc URI
+// after the ciphertext has been uploaded. The plaintext slice is not modified.
+func EncryptAttachment(plaintext []byte) ([]byte, *EncryptedFileInfo) {
+	file := attachment.NewEncryptedFile()
+	ciphertext := make([]byte, len(plaintext))
+	copy(ciphertext, plaintext)
+	file.EncryptInPlace(ciphertext)
+	return ciphertext, &EncryptedFileInfo{EncryptedFile: *file}
+}
+
+// DecryptAttachment verifies the SHA-256 hash of the given ciphertext and decrypts it using the keys in the info.
+// If the hash doesn't match, attachment.HashMismatch is returned and the data must not be used.
+// The ciphertext slice is not modified.
+func DecryptAttachment(ciphertext []byte, info *EncryptedFileInfo) ([]byte, error) {
+	plaintext := make([]byte, len(ciphertext))
+	copy(plaintext, ciphertext)
+	err := info.DecryptInPlace(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
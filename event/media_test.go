@@ -0,0 +1,69 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestNewImageMessage_Encrypted(t *testing.T) {
+	content := event.NewImageMessage("mxc://example.com/image", "cat.png", &event.FileInfo{Width: 64, Height: 48, Size: 1234})
+	content.SetThumbnail("mxc://example.com/thumb", &event.FileInfo{MimeType: "image/jpeg", Width: 32, Height: 24})
+	content.SetEncryptedFile(attachment.NewEncryptedFile())
+	content.SetEncryptedThumbnail(attachment.NewEncryptedFile())
+
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	var raw map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &raw))
+	assert.Equal(t, "m.image", raw["msgtype"])
+	assert.Equal(t, "cat.png", raw["body"])
+	assert.NotContains(t, raw, "url")
+	assert.Equal(t, "mxc://example.com/image", raw["file"].(map[string]interface{})["url"])
+	info := raw["info"].(map[string]interface{})
+	assert.Equal(t, "image/png", info["mimetype"])
+	assert.Equal(t, float64(64), info["w"])
+	assert.Equal(t, float64(1234), info["size"])
+	assert.NotContains(t, info, "thumbnail_url")
+	assert.Equal(t, "mxc://example.com/thumb", info["thumbnail_file"].(map[string]interface{})["url"])
+}
+
+func TestNewAudioMessage_Waveform(t *testing.T) {
+	content := event.NewAudioMessage("mxc://example.com/audio", "voice.ogg", &event.FileInfo{Duration: 5000}, []int{-5, 100, 2000})
+	require.NotNil(t, content.MSC1767Audio)
+	assert.Equal(t, 5000, content.MSC1767Audio.Duration)
+	assert.Equal(t, []int{0, 100, event.MaxWaveformValue}, content.MSC1767Audio.Waveform)
+	assert.Equal(t, event.MsgAudio, content.MsgType)
+}
+
+func TestEncryptDecryptAttachment(t *testing.T) {
+	ciphertext, info := event.EncryptAttachment([]byte("hello world"))
+	assert.NotEqual(t, "hello world", string(ciphertext))
+	info.URL = "mxc://example.com/file"
+
+	// The info must survive a round trip through JSON, like it does when it's sent in an event
+	data, err := json.Marshal(info)
+	require.NoError(t, err)
+	var parsedInfo event.EncryptedFileInfo
+	require.NoError(t, json.Unmarshal(data, &parsedInfo))
+	assert.NotContains(t, parsedInfo.Key.Key, "=")
+
+	plaintext, err := event.DecryptAttachment(ciphertext, &parsedInfo)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(plaintext))
+
+	ciphertext[0] ^= 1
+	_, err = event.DecryptAttachment(ciphertext, &parsedInfo)
+	assert.ErrorIs(t, err, attachment.HashMismatch)
+}
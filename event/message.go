@@ -52,6 +52,8 @@ const (
 // https://spec.matrix.org/v1.2/client-server-api/#mroomredaction
 type RedactionEventContent struct {
 	Reason string `json:"reason,omitempty"`
+	// Redacts is the event ID that was redacted. It's only present in the content in room version 11 and later.
+	Redacts id.EventID `json:"redacts,omitempty"`
 }
 
 // ReactionEventContent represents the content of a m.reaction message event.
@@ -97,6 +99,10 @@ type MessageEventContent struct {
 
 	FileName string `json:"filename,omitempty"`
 
+	// Extensible audio (MSC1767) and voice message (MSC3245) blocks
+	MSC1767Audio *MSC1767Audio `json:"org.matrix.msc1767.audio,omitempty"`
+	MSC3245Voice *MSC3245Voice `json:"org.matrix.msc3245.voice,omitempty"`
+
 	// Edits and relations
 	NewContent *MessageEventContent `json:"m.new_content,omitempty"`
 	RelatesTo  *RelatesTo           `json:"m.relates_to,omitempty"`
@@ -126,11 +132,18 @@ func (content *MessageEventContent) SetRelatesTo(rel *RelatesTo) {
 	content.RelatesTo = rel
 }
 
+// SetEdit turns the content into an edit of the given event.
+//
+// The current content (with the same msgtype) is moved into m.new_content, and the top-level content is kept as
+// a fallback for clients that don't support edits. For text, notice and emote messages, the fallback body is
+// prefixed with "* ". Relations are not copied to the new content, as edits can't change them.
 func (content *MessageEventContent) SetEdit(original id.EventID) {
 	newContent := *content
+	newContent.RelatesTo = nil
+	newContent.NewContent = nil
 	content.NewContent = &newContent
 	content.RelatesTo = (&RelatesTo{}).SetReplace(original)
-	if content.MsgType == MsgText || content.MsgType == MsgNotice {
+	if content.MsgType == MsgText || content.MsgType == MsgNotice || content.MsgType == MsgEmote {
 		content.Body = "* " + content.Body
 		if content.Format == FormatHTML && len(content.FormattedBody) > 0 {
 			content.FormattedBody = "* " + content.FormattedBody
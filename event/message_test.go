@@ -87,6 +87,26 @@ func TestMessageEventContent__ParseEdit(t *testing.T) {
 	assert.Equal(t, "<strong>Hello</strong>, World!", content.NewContent.FormattedBody)
 }
 
+func TestMessageEventContent_SetEdit(t *testing.T) {
+	content := &event.MessageEventContent{
+		MsgType:   event.MsgEmote,
+		Body:      "waves",
+		RelatesTo: (&event.RelatesTo{}).SetReplyTo("$reply"),
+	}
+	content.SetEdit("$original")
+	assert.Equal(t, "* waves", content.Body)
+	assert.Equal(t, event.MsgEmote, content.MsgType)
+	require.NotNil(t, content.NewContent)
+	assert.Equal(t, "waves", content.NewContent.Body)
+	assert.Equal(t, event.MsgEmote, content.NewContent.MsgType)
+	assert.Nil(t, content.NewContent.RelatesTo)
+
+	evt := &event.Event{Type: event.EventMessage, Content: event.Content{Parsed: content}}
+	target, isEdit := evt.GetEditTarget()
+	assert.True(t, isEdit)
+	assert.Equal(t, id.EventID("$original"), target)
+}
+
 const imageMessageEvent = `{
 	"sender": "@tulir:maunium.net",
 	"type": "m.room.message",
@@ -0,0 +1,235 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// PollKind specifies whether the results of a poll are visible before the poll ends.
+type PollKind string
+
+const (
+	PollKindDisclosed   PollKind = "org.matrix.msc3381.poll.disclosed"
+	PollKindUndisclosed PollKind = "org.matrix.msc3381.poll.undisclosed"
+)
+
+// PollAnswer is an answer option in a poll.
+type PollAnswer struct {
+	ID   string `json:"id"`
+	Text string `json:"org.matrix.msc1767.text"`
+}
+
+// PollQuestion is the question of a poll.
+type PollQuestion struct {
+	Text string `json:"org.matrix.msc1767.text"`
+}
+
+// PollStart is the org.matrix.msc3381.poll.start content block.
+type PollStart struct {
+	Question      PollQuestion `json:"question"`
+	Kind          PollKind     `json:"kind"`
+	MaxSelections int          `json:"max_selections"`
+	Answers       []PollAnswer `json:"answers"`
+}
+
+// PollStartEventContent represents the content of a org.matrix.msc3381.poll.start event.
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/3381
+type PollStartEventContent struct {
+	PollStart PollStart `json:"org.matrix.msc3381.poll.start"`
+	// Fallback text for clients that don't support polls.
+	Text      string     `json:"org.matrix.msc1767.text,omitempty"`
+	RelatesTo *RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+// NewPollStart creates the content for a poll. The answers get IDs based on their index.
+// If maxSelections is less than 1, it's set to 1. If the kind is empty, PollKindDisclosed is used.
+func NewPollStart(question string, answers []string, kind PollKind, maxSelections int) *PollStartEventContent {
+	if maxSelections < 1 {
+		maxSelections = 1
+	}
+	if kind == "" {
+		kind = PollKindDisclosed
+	}
+	content := &PollStartEventContent{
+		PollStart: PollStart{
+			Question:      PollQuestion{Text: question},
+			Kind:          kind,
+			MaxSelections: maxSelections,
+			Answers:       make([]PollAnswer, len(answers)),
+		},
+	}
+	fallback := []string{question}
+	for i, answer := range answers {
+		content.PollStart.Answers[i] = PollAnswer{ID: strconv.Itoa(i + 1), Text: answer}
+		fallback = append(fallback, fmt.Sprintf("%d. %s", i+1, answer))
+	}
+	content.Text = strings.Join(fallback, "\n")
+	return content
+}
+
+func (content *PollStartEventContent) GetRelatesTo() *RelatesTo {
+	if content.RelatesTo == nil {
+		content.RelatesTo = &RelatesTo{}
+	}
+	return content.RelatesTo
+}
+
+func (content *PollStartEventContent) OptionalGetRelatesTo() *RelatesTo {
+	return content.RelatesTo
+}
+
+func (content *PollStartEventContent) SetRelatesTo(rel *RelatesTo) {
+	content.RelatesTo = rel
+}
+
+// PollResponse is the org.matrix.msc3381.poll.response content block.
+type PollResponse struct {
+	Answers []string `json:"answers"`
+}
+
+// PollResponseEventContent represents the content of a org.matrix.msc3381.poll.response event.
+type PollResponseEventContent struct {
+	RelatesTo RelatesTo    `json:"m.relates_to"`
+	Response  PollResponse `json:"org.matrix.msc3381.poll.response"`
+}
+
+func (content *PollResponseEventContent) GetRelatesTo() *RelatesTo {
+	return &content.RelatesTo
+}
+
+func (content *PollResponseEventContent) OptionalGetRelatesTo() *RelatesTo {
+	return &content.RelatesTo
+}
+
+func (content *PollResponseEventContent) SetRelatesTo(rel *RelatesTo) {
+	content.RelatesTo = *rel
+}
+
+// PollEndEventContent represents the content of a org.matrix.msc3381.poll.end event.
+type PollEndEventContent struct {
+	RelatesTo RelatesTo `json:"m.relates_to"`
+	End       struct{}  `json:"org.matrix.msc3381.poll.end"`
+	// Fallback text for clients that don't support polls.
+	Text string `json:"org.matrix.msc1767.text,omitempty"`
+}
+
+func (content *PollEndEventContent) GetRelatesTo() *RelatesTo {
+	return &content.RelatesTo
+}
+
+func (content *PollEndEventContent) OptionalGetRelatesTo() *RelatesTo {
+	return &content.RelatesTo
+}
+
+func (content *PollEndEventContent) SetRelatesTo(rel *RelatesTo) {
+	content.RelatesTo = *rel
+}
+
+// PollResults contains the tallied results of a poll.
+type PollResults struct {
+	// The number of votes for each answer ID. All answers of the poll are included, even if they have no votes.
+	Counts map[string]int
+	// The answers each user voted for. Users whose last response was spoiled aren't included.
+	Votes map[id.UserID][]string
+	// Whether the poll has been ended by its creator.
+	Ended bool
+	// The timestamp of the end event. Responses sent after this are ignored.
+	EndedAt int64
+}
+
+// ensureParsed parses the content of a message event if it hasn't been parsed yet.
+func ensureParsed(evt *Event) {
+	if evt.Content.Parsed == nil {
+		evt.Type.Class = MessageEventType
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+}
+
+// TallyPoll counts the votes of a poll from the response and end events related to the poll start event
+// (e.g. fetched with the relations endpoint). Events of other types or events relating to other polls are ignored.
+//
+// As specified in MSC3381:
+//   - only the latest response of each user counts,
+//   - responses after the poll was ended by its creator are ignored,
+//   - only the first max_selections answers of a response are used,
+//   - a response without any valid answers is spoiled, i.e. it removes the user's previous vote.
+func TallyPoll(start *Event, related []*Event) *PollResults {
+	poll := start.Content.AsPollStart().PollStart
+	maxSelections := poll.MaxSelections
+	if maxSelections < 1 {
+		maxSelections = 1
+	}
+	validAnswers := make(map[string]struct{}, len(poll.Answers))
+	results := &PollResults{
+		Counts: make(map[string]int, len(poll.Answers)),
+		Votes:  make(map[id.UserID][]string),
+	}
+	for _, answer := range poll.Answers {
+		validAnswers[answer.ID] = struct{}{}
+		results.Counts[answer.ID] = 0
+	}
+
+	var responses []*Event
+	for _, evt := range related {
+		if evt.Type.Type != EventUnstablePollEnd.Type && evt.Type.Type != EventUnstablePollResponse.Type {
+			continue
+		}
+		ensureParsed(evt)
+		switch content := evt.Content.Parsed.(type) {
+		case *PollEndEventContent:
+			if evt.Sender != start.Sender || content.RelatesTo.GetReferenceID() != start.ID {
+				continue
+			} else if !results.Ended || evt.Timestamp < results.EndedAt {
+				results.Ended = true
+				results.EndedAt = evt.Timestamp
+			}
+		case *PollResponseEventContent:
+			if content.RelatesTo.GetReferenceID() == start.ID {
+				responses = append(responses, evt)
+			}
+		}
+	}
+	sort.SliceStable(responses, func(i, j int) bool {
+		return responses[i].Timestamp < responses[j].Timestamp
+	})
+	for _, evt := range responses {
+		if results.Ended && evt.Timestamp > results.EndedAt {
+			break
+		}
+		answers := evt.Content.AsPollResponse().Response.Answers
+		if len(answers) > maxSelections {
+			answers = answers[:maxSelections]
+		}
+		var vote []string
+		seen := make(map[string]struct{}, len(answers))
+		for _, answer := range answers {
+			_, isValid := validAnswers[answer]
+			_, isDuplicate := seen[answer]
+			if isValid && !isDuplicate {
+				seen[answer] = struct{}{}
+				vote = append(vote, answer)
+			}
+		}
+		if len(vote) == 0 {
+			delete(results.Votes, evt.Sender)
+		} else {
+			results.Votes[evt.Sender] = vote
+		}
+	}
+	for _, vote := range results.Votes {
+		for _, answer := range vote {
+			results.Counts[answer]++
+		}
+	}
+	return results
+}
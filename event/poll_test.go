@@ -0,0 +1,67 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func pollResponse(sender id.UserID, ts int64, answers ...string) *event.Event {
+	raw, _ := json.Marshal(answers)
+	return &event.Event{
+		Type:      event.EventUnstablePollResponse,
+		Sender:    sender,
+		Timestamp: ts,
+		Content: event.Content{VeryRaw: json.RawMessage(fmt.Sprintf(
+			`{"m.relates_to":{"rel_type":"m.reference","event_id":"$poll"},"org.matrix.msc3381.poll.response":{"answers":%s}}`, raw,
+		))},
+	}
+}
+
+func TestTallyPoll(t *testing.T) {
+	start := &event.Event{
+		ID:      "$poll",
+		Type:    event.EventUnstablePollStart,
+		Sender:  "@creator:example.com",
+		Content: event.Content{Parsed: event.NewPollStart("Favorite?", []string{"A", "B", "C"}, "", 2)},
+	}
+	end := &event.Event{
+		Type:      event.EventUnstablePollEnd,
+		Sender:    "@creator:example.com",
+		Timestamp: 100,
+		Content:   event.Content{VeryRaw: json.RawMessage(`{"m.relates_to":{"rel_type":"m.reference","event_id":"$poll"},"org.matrix.msc3381.poll.end":{}}`)},
+	}
+	fakeEnd := &event.Event{
+		Type:      event.EventUnstablePollEnd,
+		Sender:    "@other:example.com",
+		Timestamp: 10,
+		Content:   event.Content{VeryRaw: json.RawMessage(`{"m.relates_to":{"rel_type":"m.reference","event_id":"$poll"},"org.matrix.msc3381.poll.end":{}}`)},
+	}
+	results := event.TallyPoll(start, []*event.Event{
+		pollResponse("@alice:example.com", 20, "1"),
+		pollResponse("@alice:example.com", 30, "2", "2", "3"), // replaces the previous vote, truncated and deduplicated
+		pollResponse("@bob:example.com", 20, "1", "2", "3"),   // truncated to max_selections
+		pollResponse("@carol:example.com", 20, "1"),
+		pollResponse("@carol:example.com", 30, "invalid"), // spoiled
+		pollResponse("@dave:example.com", 200, "1"),       // after the poll ended
+		fakeEnd, end,
+	})
+	assert.True(t, results.Ended)
+	assert.Equal(t, int64(100), results.EndedAt)
+	assert.Equal(t, map[string]int{"1": 1, "2": 2, "3": 0}, results.Counts)
+	assert.Equal(t, map[id.UserID][]string{
+		"@alice:example.com": {"2"},
+		"@bob:example.com":   {"1", "2"},
+	}, results.Votes)
+}
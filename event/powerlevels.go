@@ -30,6 +30,21 @@ type PowerLevelsEventContent struct {
 	BanPtr        *int `json:"ban,omitempty"`
 	RedactPtr     *int `json:"redact,omitempty"`
 	HistoricalPtr *int `json:"historical,omitempty"`
+
+	Notifications *NotificationPowerLevels `json:"notifications,omitempty"`
+}
+
+// NotificationPowerLevels contains the power levels required to trigger specific notifications.
+type NotificationPowerLevels struct {
+	RoomPtr *int `json:"room,omitempty"`
+}
+
+// Room returns the power level required to trigger an @room notification. It's safe to call this on a nil pointer.
+func (npl *NotificationPowerLevels) Room() int {
+	if npl != nil && npl.RoomPtr != nil {
+		return *npl.RoomPtr
+	}
+	return 50
 }
 
 func (pl *PowerLevelsEventContent) Invite() int {
@@ -0,0 +1,130 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// latestKnownRoomVersion is used for the redaction rules of unknown (e.g. unstable) room versions.
+const latestKnownRoomVersion = 11
+
+func parseRoomVersion(roomVersion string) int {
+	if roomVersion == "" {
+		// Rooms without a room_version in the create event are version 1
+		return 1
+	}
+	version, err := strconv.Atoi(roomVersion)
+	if err != nil {
+		return latestKnownRoomVersion
+	}
+	return version
+}
+
+// allowedRedactedContentKeys returns the content keys that are preserved when redacting an event.
+// If keepAll is true, all keys are preserved.
+func allowedRedactedContentKeys(evtType Type, version int) (keys map[string]struct{}, keepAll bool) {
+	keys = make(map[string]struct{})
+	add := func(names ...string) {
+		for _, name := range names {
+			keys[name] = struct{}{}
+		}
+	}
+	switch evtType.Type {
+	case StateMember.Type:
+		add("membership")
+		if version >= 9 {
+			add("join_authorised_via_users_server")
+		}
+		if version >= 11 {
+			add("third_party_invite")
+		}
+	case StateCreate.Type:
+		if version >= 11 {
+			return nil, true
+		}
+		add("creator")
+	case StateJoinRules.Type:
+		add("join_rule")
+		if version >= 8 {
+			add("allow")
+		}
+	case StatePowerLevels.Type:
+		add("ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default")
+		if version >= 11 {
+			add("invite")
+		}
+	case StateHistoryVisibility.Type:
+		add("history_visibility")
+	case StateAliases.Type:
+		if version <= 5 {
+			add("aliases")
+		}
+	case EventRedaction.Type:
+		if version >= 11 {
+			add("redacts")
+		}
+	}
+	return
+}
+
+// GetRedacts returns the ID of the event that a redaction event redacts.
+// In room version 11 and later, it's in the content instead of the top level of the event.
+func (evt *Event) GetRedacts() id.EventID {
+	if len(evt.Redacts) > 0 {
+		return evt.Redacts
+	}
+	redacts, _ := evt.Content.Raw["redacts"].(string)
+	return id.EventID(redacts)
+}
+
+// Redact applies the redaction algorithm of the given room version to the event, which can be used to keep
+// local copies of events consistent with the server after receiving a m.room.redaction event.
+// See https://spec.matrix.org/v1.4/rooms/v9/#redactions
+//
+// All content keys that aren't allowed to be kept in the room version are removed,
+// and the unsigned data is replaced with a redacted_because field containing the given redaction event.
+func (evt *Event) Redact(roomVersion string, redactedBecause *Event) error {
+	rawContent, err := json.Marshal(&evt.Content)
+	if err != nil {
+		return err
+	}
+	var content map[string]interface{}
+	err = json.Unmarshal(rawContent, &content)
+	if err != nil {
+		return err
+	}
+	version := parseRoomVersion(roomVersion)
+	allowedKeys, keepAll := allowedRedactedContentKeys(evt.Type, version)
+	if !keepAll {
+		for key := range content {
+			if _, allowed := allowedKeys[key]; !allowed {
+				delete(content, key)
+			}
+		}
+	}
+	if thirdPartyInvite, ok := content["third_party_invite"].(map[string]interface{}); ok && evt.Type.Type == StateMember.Type {
+		content["third_party_invite"] = map[string]interface{}{"signed": thirdPartyInvite["signed"]}
+	}
+	if content == nil {
+		content = make(map[string]interface{})
+	}
+	rawContent, err = json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	wasParsed := evt.Content.Parsed != nil
+	evt.Content = Content{VeryRaw: rawContent, Raw: content}
+	if wasParsed {
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+	evt.Unsigned = Unsigned{RedactedBecause: redactedBecause}
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+const memberEventToRedact = `{
+	"type": "m.room.member",
+	"state_key": "@alice:example.com",
+	"sender": "@alice:example.com",
+	"event_id": "$member",
+	"content": {
+		"membership": "join",
+		"displayname": "Alice",
+		"join_authorised_via_users_server": "@bob:example.com",
+		"third_party_invite": {"display_name": "alice", "signed": {"token": "abc"}}
+	},
+	"unsigned": {"age": 1234}
+}`
+
+func TestEvent_Redact(t *testing.T) {
+	redaction := &event.Event{Type: event.EventRedaction, ID: "$redaction", Redacts: "$member"}
+	for version, expected := range map[string]string{
+		"1":  `{"membership":"join"}`,
+		"9":  `{"join_authorised_via_users_server":"@bob:example.com","membership":"join"}`,
+		"11": `{"join_authorised_via_users_server":"@bob:example.com","membership":"join","third_party_invite":{"signed":{"token":"abc"}}}`,
+	} {
+		t.Run("v"+version, func(t *testing.T) {
+			var evt event.Event
+			require.NoError(t, json.Unmarshal([]byte(memberEventToRedact), &evt))
+			require.NoError(t, evt.Content.ParseRaw(evt.Type))
+			require.NoError(t, evt.Redact(version, redaction))
+			assert.JSONEq(t, expected, string(evt.Content.VeryRaw))
+			assert.Equal(t, event.MembershipJoin, evt.Content.AsMember().Membership)
+			assert.Empty(t, evt.Content.AsMember().Displayname)
+			assert.Equal(t, redaction, evt.Unsigned.RedactedBecause)
+			assert.Zero(t, evt.Unsigned.Age)
+		})
+	}
+}
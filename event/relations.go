@@ -106,6 +106,64 @@ func (rel *RelatesTo) SetThread(mxid, fallback id.EventID) *RelatesTo {
 	return rel
 }
 
+// SetThread makes this message a part of the thread with the given root event.
+// See https://spec.matrix.org/v1.4/client-server-api/#threading
+//
+// The latest event in the thread is set as the m.in_reply_to with is_falling_back, so that clients without thread
+// support render the message as a reply to it. If the latest event ID is empty, the thread root is used instead.
+// The message isn't changed into a real reply, so no reply fallback is added to the body.
+func (content *MessageEventContent) SetThread(threadRoot, latestEvent id.EventID) {
+	if latestEvent == "" {
+		latestEvent = threadRoot
+	}
+	if content.RelatesTo == nil {
+		content.RelatesTo = &RelatesTo{}
+	}
+	content.RelatesTo.SetThread(threadRoot, latestEvent)
+}
+
+// optionalGetRelatesTo returns the m.relates_to content of any event with parsed content that implements Relatable,
+// as well as unparsed and encrypted content.
+func (evt *Event) optionalGetRelatesTo() *RelatesTo {
+	if relatable, ok := evt.Content.Parsed.(Relatable); ok {
+		return relatable.OptionalGetRelatesTo()
+	} else if encrypted, ok := evt.Content.Parsed.(*EncryptedEventContent); ok {
+		return encrypted.RelatesTo
+	} else if len(evt.Content.VeryRaw) > 0 {
+		var raw struct {
+			RelatesTo *RelatesTo `json:"m.relates_to"`
+		}
+		_ = json.Unmarshal(evt.Content.VeryRaw, &raw)
+		return raw.RelatesTo
+	}
+	return nil
+}
+
+// GetThreadParent returns the thread root event ID if the event is a part of a thread.
+//
+// This works for any event with parsed content that implements Relatable, as well as unparsed and encrypted content.
+func (evt *Event) GetThreadParent() (id.EventID, bool) {
+	relatesTo := evt.optionalGetRelatesTo()
+	if relatesTo == nil {
+		return "", false
+	}
+	threadRoot := relatesTo.GetThreadParent()
+	return threadRoot, threadRoot != ""
+}
+
+// GetEditTarget returns the ID of the event that this event edits, if the event is an edit (has a m.replace relation).
+//
+// Like GetThreadParent, this works for parsed, unparsed and encrypted content.
+// For parsed message content, the new content of the edit is in MessageEventContent.NewContent.
+func (evt *Event) GetEditTarget() (id.EventID, bool) {
+	relatesTo := evt.optionalGetRelatesTo()
+	if relatesTo == nil {
+		return "", false
+	}
+	target := relatesTo.GetReplaceID()
+	return target, target != ""
+}
+
 func (rel *RelatesTo) SetAnnotation(mxid id.EventID, key string) *RelatesTo {
 	rel.Type = RelAnnotation
 	rel.EventID = mxid
@@ -34,6 +34,7 @@ func TrimReplyFallbackText(text string) string {
 	return strings.TrimSpace(strings.Join(lines, "\n"))
 }
 
+// RemoveReplyFallback strips the reply fallback from the body and formatted body if the message is a reply.
 func (content *MessageEventContent) RemoveReplyFallback() {
 	if len(content.GetReplyTo()) > 0 && !content.replyFallbackRemoved {
 		if content.Format == FormatHTML {
@@ -63,6 +64,9 @@ func (evt *Event) GenerateReplyFallbackHTML() string {
 	if len(body) == 0 {
 		body = strings.ReplaceAll(html.EscapeString(parsedContent.Body), "\n", "<br/>")
 	}
+	if parsedContent.MsgType == MsgEmote {
+		body = "* " + body
+	}
 
 	senderDisplayName := evt.Sender
 
@@ -82,7 +86,12 @@ func (evt *Event) GenerateReplyFallbackText() string {
 	senderDisplayName := evt.Sender
 
 	var fallbackText strings.Builder
-	_, _ = fmt.Fprintf(&fallbackText, "> <%s> %s", senderDisplayName, firstLine)
+	if parsedContent.MsgType == MsgEmote {
+		// Emotes use the "* user message" format instead of "<user> message"
+		_, _ = fmt.Fprintf(&fallbackText, "> * <%s> %s", senderDisplayName, firstLine)
+	} else {
+		_, _ = fmt.Fprintf(&fallbackText, "> <%s> %s", senderDisplayName, firstLine)
+	}
 	for _, line := range lines {
 		_, _ = fmt.Fprintf(&fallbackText, "\n> %s", line)
 	}
@@ -90,10 +99,16 @@ func (evt *Event) GenerateReplyFallbackText() string {
 	return fallbackText.String()
 }
 
+// SetReply makes this message a rich reply to the given event.
+// See https://spec.matrix.org/v1.4/client-server-api/#rich-replies
+//
+// The m.in_reply_to relation is always set. For text, notice and emote messages, the reply fallback quoting
+// the original message is also prepended to the body and formatted body (HTML in the quoted message is escaped
+// unless the original message was already formatted). RemoveReplyFallback can be used to strip the fallback again.
 func (content *MessageEventContent) SetReply(inReplyTo *Event) {
 	content.RelatesTo = (&RelatesTo{}).SetReplyTo(inReplyTo.ID)
 
-	if content.MsgType == MsgText || content.MsgType == MsgNotice {
+	if content.MsgType == MsgText || content.MsgType == MsgNotice || content.MsgType == MsgEmote {
 		content.EnsureHasHTML()
 		content.FormattedBody = inReplyTo.GenerateReplyFallbackHTML() + content.FormattedBody
 		content.Body = inReplyTo.GenerateReplyFallbackText() + content.Body
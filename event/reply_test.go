@@ -0,0 +1,52 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestMessageEventContent_SetReply(t *testing.T) {
+	original := &event.Event{
+		Sender: "@alice:example.com",
+		RoomID: "!room:example.com",
+		ID:     "$original",
+		Content: event.Content{Parsed: &event.MessageEventContent{
+			MsgType: event.MsgEmote,
+			Body:    "waves <3",
+		}},
+	}
+	reply := &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}
+	reply.SetReply(original)
+
+	assert.Equal(t, id.EventID("$original"), reply.GetReplyTo())
+	assert.Equal(t, "> * <@alice:example.com> waves <3\n\nhi", reply.Body)
+	assert.Contains(t, reply.FormattedBody, "<br>* waves &lt;3</blockquote></mx-reply>")
+
+	reply.RemoveReplyFallback()
+	assert.Equal(t, "hi", reply.Body)
+	assert.Equal(t, "hi", reply.FormattedBody)
+}
+
+func TestMessageEventContent_SetThread(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "in thread"}
+	content.SetThread("$root", "$latest")
+	assert.Equal(t, event.RelThread, content.RelatesTo.Type)
+	assert.Equal(t, id.EventID("$latest"), content.GetReplyTo())
+	assert.True(t, content.RelatesTo.IsFallingBack)
+	assert.Equal(t, "in thread", content.Body)
+
+	evt := &event.Event{Content: event.Content{VeryRaw: []byte(`{"m.relates_to": {"rel_type": "m.thread", "event_id": "$root"}}`)}}
+	threadRoot, ok := evt.GetThreadParent()
+	assert.True(t, ok)
+	assert.Equal(t, id.EventID("$root"), threadRoot)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+// compileACLGlob converts a server ACL glob into a regex. In ACLs, * matches zero or more characters
+// and ? matches exactly one character. Matching is case-insensitive.
+func compileACLGlob(pattern string) *regexp.Regexp {
+	regex := regexp.QuoteMeta(pattern)
+	regex = strings.ReplaceAll(regex, `\*`, ".*")
+	regex = strings.ReplaceAll(regex, `\?`, ".")
+	return regexp.MustCompile("(?i)^" + regex + "$")
+}
+
+func matchesAnyACLGlob(patterns []string, serverName string) bool {
+	for _, pattern := range patterns {
+		if compileACLGlob(pattern).MatchString(serverName) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPort removes the port from a server name, e.g. example.com:8448 -> example.com and [::1]:8448 -> [::1].
+func stripPort(serverName string) string {
+	if strings.HasPrefix(serverName, "[") {
+		if end := strings.IndexRune(serverName, ']'); end > 0 {
+			return serverName[:end+1]
+		}
+		return serverName
+	}
+	if colon := strings.LastIndexByte(serverName, ':'); colon >= 0 {
+		return serverName[:colon]
+	}
+	return serverName
+}
+
+func isIPLiteral(host string) bool {
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")) != nil
+}
+
+// IsAllowed checks whether the given server is allowed to participate in the room according to the ACL.
+// The server name may include a port, which is ignored.
+//
+// See https://spec.matrix.org/v1.4/client-server-api/#server-access-control-lists-acls-for-rooms for the rules.
+func (acl *ServerACLEventContent) IsAllowed(serverName string) bool {
+	host := stripPort(serverName)
+	if !acl.AllowIPLiterals && isIPLiteral(host) {
+		return false
+	} else if matchesAnyACLGlob(acl.Deny, host) {
+		return false
+	}
+	return matchesAnyACLGlob(acl.Allow, host)
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestServerACLEventContent_IsAllowed(t *testing.T) {
+	acl := &event.ServerACLEventContent{
+		Allow: []string{"*"},
+		Deny:  []string{"*.evil.example", "bad?.example"},
+	}
+	assert.True(t, acl.IsAllowed("example.com"))
+	assert.True(t, acl.IsAllowed("example.com:8448"))
+	assert.False(t, acl.IsAllowed("matrix.evil.example"))
+	assert.False(t, acl.IsAllowed("BAD1.example"))
+	assert.True(t, acl.IsAllowed("bad12.example"))
+	assert.False(t, acl.IsAllowed("1.2.3.4:8448"))
+	assert.False(t, acl.IsAllowed("[::1]:8448"))
+
+	acl.AllowIPLiterals = true
+	assert.True(t, acl.IsAllowed("[::1]:8448"))
+	assert.False(t, (&event.ServerACLEventContent{Allow: []string{"*.example.com"}}).IsAllowed("example.com"))
+}
@@ -32,6 +32,9 @@ type RoomAvatarEventContent struct {
 
 // ServerACLEventContent represents the content of a m.room.server_acl state event.
 // https://spec.matrix.org/v1.2/client-server-api/#server-access-control-lists-acls-for-rooms
+//
+// The allow and deny lists contain globs where * matches zero or more characters and ? matches one character.
+// Use IsAllowed to check whether a server matches the ACL.
 type ServerACLEventContent struct {
 	Allow           []string `json:"allow,omitempty"`
 	AllowIPLiterals bool     `json:"allow_ip_literals"`
@@ -51,6 +54,7 @@ type TombstoneEventContent struct {
 	ReplacementRoom id.RoomID `json:"replacement_room"`
 }
 
+// Predecessor is the predecessor field of m.room.create events. It points at the last event of the room that was upgraded.
 type Predecessor struct {
 	RoomID  id.RoomID  `json:"room_id"`
 	EventID id.EventID `json:"event_id"`
@@ -151,11 +155,18 @@ type BridgeEventContent struct {
 	Channel   BridgeInfoSection  `json:"channel"`
 }
 
+// SpaceChildEventContent represents the content of a m.space.child state event.
+// The state key is the ID of the child room, and the child is removed by setting via to an empty list.
+// https://spec.matrix.org/v1.4/client-server-api/#mspacechild
 type SpaceChildEventContent struct {
-	Via   []string `json:"via,omitempty"`
-	Order string   `json:"order,omitempty"`
+	Via       []string `json:"via,omitempty"`
+	Order     string   `json:"order,omitempty"`
+	Suggested bool     `json:"suggested,omitempty"`
 }
 
+// SpaceParentEventContent represents the content of a m.space.parent state event.
+// The state key is the ID of the parent space.
+// https://spec.matrix.org/v1.4/client-server-api/#mspaceparent
 type SpaceParentEventContent struct {
 	Via       []string `json:"via,omitempty"`
 	Canonical bool     `json:"canonical,omitempty"`
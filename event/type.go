@@ -83,7 +83,8 @@ func (et *Type) IsToDevice() bool {
 func (et *Type) IsInRoomVerification() bool {
 	switch et.Type {
 	case InRoomVerificationStart.Type, InRoomVerificationReady.Type, InRoomVerificationAccept.Type,
-		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type:
+		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type,
+		InRoomVerificationDone.Type:
 		return true
 	default:
 		return false
@@ -121,8 +122,9 @@ func (et *Type) GuessClass() TypeClass {
 	case EventRedaction.Type, EventMessage.Type, EventEncrypted.Type, EventReaction.Type, EventSticker.Type,
 		InRoomVerificationStart.Type, InRoomVerificationReady.Type, InRoomVerificationAccept.Type,
 		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type,
-		CallInvite.Type, CallCandidates.Type, CallAnswer.Type, CallReject.Type, CallSelectAnswer.Type,
-		CallNegotiate.Type, CallHangup.Type, BeeperMessageStatus.Type:
+		InRoomVerificationDone.Type, CallInvite.Type, CallCandidates.Type, CallAnswer.Type, CallReject.Type, CallSelectAnswer.Type,
+		CallNegotiate.Type, CallHangup.Type, BeeperMessageStatus.Type,
+		EventUnstablePollStart.Type, EventUnstablePollResponse.Type, EventUnstablePollEnd.Type:
 		return MessageEventType
 	case ToDeviceRoomKey.Type, ToDeviceRoomKeyRequest.Type, ToDeviceForwardedRoomKey.Type, ToDeviceRoomKeyWithheld.Type:
 		return ToDeviceEventType
@@ -203,6 +205,7 @@ var (
 	InRoomVerificationKey    = Type{"m.key.verification.key", MessageEventType}
 	InRoomVerificationMAC    = Type{"m.key.verification.mac", MessageEventType}
 	InRoomVerificationCancel = Type{"m.key.verification.cancel", MessageEventType}
+	InRoomVerificationDone   = Type{"m.key.verification.done", MessageEventType}
 
 	CallInvite       = Type{"m.call.invite", MessageEventType}
 	CallCandidates   = Type{"m.call.candidates", MessageEventType}
@@ -213,6 +216,10 @@ var (
 	CallHangup       = Type{"m.call.hangup", MessageEventType}
 
 	BeeperMessageStatus = Type{"com.beeper.message_send_status", MessageEventType}
+
+	EventUnstablePollStart    = Type{"org.matrix.msc3381.poll.start", MessageEventType}
+	EventUnstablePollResponse = Type{"org.matrix.msc3381.poll.response", MessageEventType}
+	EventUnstablePollEnd      = Type{"org.matrix.msc3381.poll.end", MessageEventType}
 )
 
 // Ephemeral events
@@ -251,6 +258,7 @@ var (
 	ToDeviceVerificationKey     = Type{"m.key.verification.key", ToDeviceEventType}
 	ToDeviceVerificationMAC     = Type{"m.key.verification.mac", ToDeviceEventType}
 	ToDeviceVerificationCancel  = Type{"m.key.verification.cancel", ToDeviceEventType}
+	ToDeviceVerificationDone    = Type{"m.key.verification.done", ToDeviceEventType}
 
 	ToDeviceOrgMatrixRoomKeyWithheld = Type{"org.matrix.room_key.withheld", ToDeviceEventType}
 )
@@ -305,3 +305,27 @@ func (vcec *VerificationCancelEventContent) OptionalGetRelatesTo() *RelatesTo {
 func (vcec *VerificationCancelEventContent) SetRelatesTo(rel *RelatesTo) {
 	vcec.RelatesTo = rel
 }
+
+// VerificationDoneEventContent represents the content of a m.key.verification.done event.
+// https://spec.matrix.org/v1.2/client-server-api/#mkeyverificationdone
+type VerificationDoneEventContent struct {
+	// The opaque identifier for the verification process/request.
+	TransactionID string `json:"transaction_id,omitempty"`
+	// Original event ID for in-room verification.
+	RelatesTo *RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+func (vdec *VerificationDoneEventContent) GetRelatesTo() *RelatesTo {
+	if vdec.RelatesTo == nil {
+		vdec.RelatesTo = &RelatesTo{}
+	}
+	return vdec.RelatesTo
+}
+
+func (vdec *VerificationDoneEventContent) OptionalGetRelatesTo() *RelatesTo {
+	return vdec.RelatesTo
+}
+
+func (vdec *VerificationDoneEventContent) SetRelatesTo(rel *RelatesTo) {
+	vdec.RelatesTo = rel
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MaxBatchRateLimitRetries is the number of times SendEventBatch will retry a single event
+// after it was rejected with M_LIMIT_EXCEEDED even after the retries of the RetryPolicy.
+var MaxBatchRateLimitRetries = 3
+
+// BatchEvent is a single event to send with Client.SendEventBatch.
+type BatchEvent struct {
+	RoomID  id.RoomID
+	Type    event.Type
+	Content interface{}
+	Extra   ReqSendEvent
+}
+
+// BatchEventResult is the result of sending a single event with Client.SendEventBatch.
+type BatchEventResult struct {
+	TransactionID string
+	EventID       id.EventID
+	Error         error
+}
+
+type batchRateLimiter struct {
+	until time.Time
+	lock  sync.Mutex
+}
+
+func (rl *batchRateLimiter) pause(duration time.Duration) {
+	rl.lock.Lock()
+	if until := time.Now().Add(duration); until.After(rl.until) {
+		rl.until = until
+	}
+	rl.lock.Unlock()
+}
+
+func (rl *batchRateLimiter) wait(ctx context.Context) error {
+	rl.lock.Lock()
+	until := rl.until
+	rl.lock.Unlock()
+	if duration := time.Until(until); duration > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(duration):
+		}
+	}
+	return ctx.Err()
+}
+
+// rateLimitBackoff returns how long to wait before retrying a request that failed with M_LIMIT_EXCEEDED.
+func rateLimitBackoff(err error) (time.Duration, bool) {
+	var httpErr HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RespError == nil || httpErr.RespError.ErrCode != MLimitExceeded.ErrCode {
+		return 0, false
+	}
+	if retryAfter, ok := httpErr.RespError.RetryAfter(); ok {
+		return retryAfter, true
+	}
+	return 5 * time.Second, true
+}
+
+// SendEventBatch sends many message events, e.g. when backfilling messages in a bridge.
+//
+// Transaction IDs are generated for each event in advance (unless set in BatchEvent.Extra), so retrying is safe.
+// Events in the same room are always sent sequentially in the given order, while up to concurrency rooms are
+// handled in parallel. If an event is rate limited after the retries of the client's RetryPolicy, all workers
+// pause for the time requested by the server before continuing.
+//
+// A failure doesn't abort the batch: the returned slice contains the result of each event at the same index as
+// the input. If the context is cancelled, the remaining events will have the context error as their result.
+func (cli *Client) SendEventBatch(ctx context.Context, events []BatchEvent, concurrency int) []BatchEventResult {
+	results := make([]BatchEventResult, len(events))
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var roomOrder []id.RoomID
+	eventsByRoom := make(map[id.RoomID][]int)
+	for i, evt := range events {
+		if _, ok := eventsByRoom[evt.RoomID]; !ok {
+			roomOrder = append(roomOrder, evt.RoomID)
+		}
+		eventsByRoom[evt.RoomID] = append(eventsByRoom[evt.RoomID], i)
+	}
+	if concurrency > len(roomOrder) {
+		concurrency = len(roomOrder)
+	}
+
+	var limiter batchRateLimiter
+	queue := make(chan []int)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for indices := range queue {
+				for _, index := range indices {
+					results[index] = cli.sendBatchEvent(ctx, &events[index], &limiter)
+				}
+			}
+		}()
+	}
+	for _, roomID := range roomOrder {
+		queue <- eventsByRoom[roomID]
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+func (cli *Client) sendBatchEvent(ctx context.Context, evt *BatchEvent, limiter *batchRateLimiter) (result BatchEventResult) {
+	extra := evt.Extra
+	if extra.TransactionID == "" {
+		extra.TransactionID = cli.TxnID()
+	}
+	result.TransactionID = extra.TransactionID
+	for attempt := 0; ; attempt++ {
+		if result.Error = limiter.wait(ctx); result.Error != nil {
+			return
+		}
+		var resp *RespSendEvent
+		resp, result.Error = cli.SendMessageEvent(evt.RoomID, evt.Type, evt.Content, extra)
+		if result.Error == nil {
+			result.EventID = resp.EventID
+			return
+		} else if backoff, isRateLimited := rateLimitBackoff(result.Error); isRateLimited && attempt < MaxBatchRateLimitRetries {
+			cli.logWarning("Event %s in %s was rate limited, pausing batch for %s", result.TransactionID, evt.RoomID, backoff)
+			limiter.pause(backoff)
+		} else {
+			return
+		}
+	}
+}
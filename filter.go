@@ -3,8 +3,12 @@
 package mautrix
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 
+	"maunium.net/go/mautrix/crypto/canonicaljson"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -50,6 +54,10 @@ type FilterPart struct {
 
 	LazyLoadMembers         bool `json:"lazy_load_members,omitempty"`
 	IncludeRedundantMembers bool `json:"include_redundant_members,omitempty"`
+
+	UnreadThreadNotifications bool `json:"unread_thread_notifications,omitempty"`
+	// https://github.com/matrix-org/matrix-spec-proposals/pull/3773
+	MSC3773UnreadThreadNotifications bool `json:"org.matrix.msc3773.unread_thread_notifications,omitempty"`
 }
 
 // Validate checks if the filter contains valid property values
@@ -60,6 +68,17 @@ func (filter *Filter) Validate() error {
 	return nil
 }
 
+// Hash returns a hash of the canonical JSON representation of the filter.
+// The hash only changes if the content of the filter changes.
+func (filter *Filter) Hash() (string, error) {
+	data, err := json.Marshal(filter)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(canonicaljson.CanonicalJSONAssumeValid(data))
+	return base64.RawStdEncoding.EncodeToString(hash[:]), nil
+}
+
 // DefaultFilter returns the default filter used by the Matrix server if no filter is provided in the request
 func DefaultFilter() Filter {
 	return Filter{
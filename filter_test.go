@@ -0,0 +1,41 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestFilter_Hash(t *testing.T) {
+	filterA := mautrix.DefaultFilter()
+	filterB := mautrix.DefaultFilter()
+	hashA, err := filterA.Hash()
+	require.NoError(t, err)
+	hashB, err := filterB.Hash()
+	require.NoError(t, err)
+	assert.Equal(t, hashA, hashB, "identical filters should have the same hash")
+
+	filterB.Room.Timeline.Limit = 10
+	hashB, err = filterB.Hash()
+	require.NoError(t, err)
+	assert.NotEqual(t, hashA, hashB, "changing the filter should change the hash")
+
+	filterA.Room.Timeline.Limit = 10
+	hashA, err = filterA.Hash()
+	require.NoError(t, err)
+	assert.Equal(t, hashA, hashB)
+	filterA.Room.Timeline.Types = []event.Type{event.EventMessage}
+	hashA, err = filterA.Hash()
+	require.NoError(t, err)
+	assert.NotEqual(t, hashA, hashB)
+}
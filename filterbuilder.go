@@ -0,0 +1,134 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrConflictingFilter is returned by FilterBuilder.Build if the same value is both included and excluded.
+var ErrConflictingFilter = errors.New("conflicting filter")
+
+// FilterBuilder is a helper for building sync filters for common cases, e.g.
+//
+//	filter, err := mautrix.NewFilterBuilder().
+//		Rooms(roomID).
+//		Types(event.EventMessage).
+//		LimitTimeline(10).
+//		NoPresence().
+//		Build()
+//
+// Room and type filters apply to the state and timeline of rooms. In the Matrix spec, excluding takes precedence
+// over including (e.g. a room in both not_rooms and rooms is excluded), but Build returns an error for such
+// overlaps instead of letting them silently conflict.
+type FilterBuilder struct {
+	filter Filter
+}
+
+// NewFilterBuilder creates a new FilterBuilder with an empty filter that uses the client event format.
+func NewFilterBuilder() *FilterBuilder {
+	return &FilterBuilder{filter: Filter{EventFormat: EventFormatClient}}
+}
+
+// Rooms only includes the given rooms in the sync response.
+func (fb *FilterBuilder) Rooms(roomIDs ...id.RoomID) *FilterBuilder {
+	fb.filter.Room.Rooms = append(fb.filter.Room.Rooms, roomIDs...)
+	return fb
+}
+
+// NotRooms excludes the given rooms from the sync response.
+func (fb *FilterBuilder) NotRooms(roomIDs ...id.RoomID) *FilterBuilder {
+	fb.filter.Room.NotRooms = append(fb.filter.Room.NotRooms, roomIDs...)
+	return fb
+}
+
+// Types only includes the given event types in the state and timeline of rooms.
+// The types may contain * as a wildcard, e.g. m.room.*.
+func (fb *FilterBuilder) Types(types ...event.Type) *FilterBuilder {
+	fb.filter.Room.State.Types = append(fb.filter.Room.State.Types, types...)
+	fb.filter.Room.Timeline.Types = append(fb.filter.Room.Timeline.Types, types...)
+	return fb
+}
+
+// NotTypes excludes the given event types from the state and timeline of rooms.
+func (fb *FilterBuilder) NotTypes(types ...event.Type) *FilterBuilder {
+	fb.filter.Room.State.NotTypes = append(fb.filter.Room.State.NotTypes, types...)
+	fb.filter.Room.Timeline.NotTypes = append(fb.filter.Room.Timeline.NotTypes, types...)
+	return fb
+}
+
+// LimitTimeline sets the maximum number of timeline events to return per room.
+func (fb *FilterBuilder) LimitTimeline(limit int) *FilterBuilder {
+	fb.filter.Room.Timeline.Limit = limit
+	return fb
+}
+
+// LazyLoadMembers enables or disables lazy-loading room members.
+// See https://spec.matrix.org/v1.4/client-server-api/#lazy-loading-room-members
+func (fb *FilterBuilder) LazyLoadMembers(enabled bool) *FilterBuilder {
+	fb.filter.Room.State.LazyLoadMembers = enabled
+	fb.filter.Room.Timeline.LazyLoadMembers = enabled
+	return fb
+}
+
+// IncludeLeave enables or disables including rooms that the user has left in the sync response.
+func (fb *FilterBuilder) IncludeLeave(include bool) *FilterBuilder {
+	fb.filter.Room.IncludeLeave = include
+	return fb
+}
+
+// NoPresence excludes all presence events from the sync response.
+func (fb *FilterBuilder) NoPresence() *FilterBuilder {
+	fb.filter.Presence.NotTypes = []event.Type{{Type: "*"}}
+	return fb
+}
+
+// NoEphemeral excludes all ephemeral room events (e.g. typing notifications and receipts) from the sync response.
+func (fb *FilterBuilder) NoEphemeral() *FilterBuilder {
+	fb.filter.Room.Ephemeral.NotTypes = []event.Type{{Type: "*"}}
+	return fb
+}
+
+func findOverlappingRoom(included, excluded []id.RoomID) (id.RoomID, bool) {
+	for _, roomID := range excluded {
+		for _, includedRoomID := range included {
+			if roomID == includedRoomID {
+				return roomID, true
+			}
+		}
+	}
+	return "", false
+}
+
+func findOverlappingType(included, excluded []event.Type) (event.Type, bool) {
+	for _, evtType := range excluded {
+		for _, includedType := range included {
+			if evtType.Type == includedType.Type {
+				return evtType, true
+			}
+		}
+	}
+	return event.Type{}, false
+}
+
+// Build validates and returns the filter.
+func (fb *FilterBuilder) Build() (*Filter, error) {
+	if roomID, found := findOverlappingRoom(fb.filter.Room.Rooms, fb.filter.Room.NotRooms); found {
+		return nil, fmt.Errorf("%w: %s is both included and excluded", ErrConflictingFilter, roomID)
+	} else if evtType, found := findOverlappingType(fb.filter.Room.Timeline.Types, fb.filter.Room.Timeline.NotTypes); found {
+		return nil, fmt.Errorf("%w: %s is both included and excluded", ErrConflictingFilter, evtType.Type)
+	}
+	filter := fb.filter
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	return &filter, nil
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestFilterBuilder(t *testing.T) {
+	filter, err := mautrix.NewFilterBuilder().
+		Rooms("!room:example.com").
+		Types(event.EventMessage).
+		LimitTimeline(10).
+		LazyLoadMembers(true).
+		NoPresence().
+		Build()
+	require.NoError(t, err)
+	assert.Equal(t, 10, filter.Room.Timeline.Limit)
+	assert.True(t, filter.Room.State.LazyLoadMembers)
+
+	data, err := json.Marshal(filter)
+	require.NoError(t, err)
+	var roundtripped mautrix.Filter
+	require.NoError(t, json.Unmarshal(data, &roundtripped))
+	assert.Equal(t, filter.Room.Rooms, roundtripped.Room.Rooms)
+	assert.Equal(t, "m.room.message", roundtripped.Room.Timeline.Types[0].Type)
+	assert.Equal(t, "*", roundtripped.Presence.NotTypes[0].Type)
+
+	_, err = mautrix.NewFilterBuilder().Types(event.EventMessage).NotTypes(event.EventMessage).Build()
+	assert.ErrorIs(t, err, mautrix.ErrConflictingFilter)
+	_, err = mautrix.NewFilterBuilder().Rooms("!room:example.com").NotRooms("!room:example.com").Build()
+	assert.ErrorIs(t, err, mautrix.ErrConflictingFilter)
+}
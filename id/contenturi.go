@@ -50,12 +50,15 @@ func MustParseContentURI(uri string) ContentURI {
 }
 
 // ParseContentURI parses a Matrix content URI.
+//
+// An empty string is parsed into an empty ContentURI without an error. Other inputs must have the mxc:// scheme
+// and a non-empty server name and media ID. The media ID must not contain slashes.
 func ParseContentURI(uri string) (parsed ContentURI, err error) {
 	if len(uri) == 0 {
 		return
 	} else if !strings.HasPrefix(uri, "mxc://") {
 		err = InvalidContentURI
-	} else if index := strings.IndexRune(uri[6:], '/'); index == -1 || index == len(uri)-7 {
+	} else if index := strings.IndexRune(uri[6:], '/'); index <= 0 || index == len(uri)-7 || strings.ContainsRune(uri[6+index+1:], '/') {
 		err = InvalidContentURI
 	} else {
 		parsed.Homeserver = uri[6 : 6+index]
@@ -71,7 +74,7 @@ func ParseContentURIBytes(uri []byte) (parsed ContentURI, err error) {
 		return
 	} else if !bytes.HasPrefix(uri, mxcBytes) {
 		err = InvalidContentURI
-	} else if index := bytes.IndexRune(uri[6:], '/'); index == -1 || index == len(uri)-7 {
+	} else if index := bytes.IndexRune(uri[6:], '/'); index <= 0 || index == len(uri)-7 || bytes.IndexByte(uri[6+index+1:], '/') != -1 {
 		err = InvalidContentURI
 	} else {
 		parsed.Homeserver = string(uri[6 : 6+index])
@@ -153,6 +156,15 @@ func (uri ContentURI) CUString() ContentURIString {
 	return ContentURIString(uri.String())
 }
 
+// Validate checks that both parts of the content URI are set and that they don't contain slashes,
+// which is useful for content URIs that were constructed manually instead of being parsed.
+func (uri ContentURI) Validate() error {
+	if uri.IsEmpty() || strings.ContainsRune(uri.Homeserver, '/') || strings.ContainsRune(uri.FileID, '/') {
+		return InvalidContentURI
+	}
+	return nil
+}
+
 func (uri ContentURI) IsEmpty() bool {
 	return len(uri.Homeserver) == 0 || len(uri.FileID) == 0
 }
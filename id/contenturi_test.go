@@ -0,0 +1,45 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestParseContentURI(t *testing.T) {
+	parsed, err := id.ParseContentURI("mxc://example.com/abcDEF123")
+	require.NoError(t, err)
+	assert.Equal(t, id.ContentURI{Homeserver: "example.com", FileID: "abcDEF123"}, parsed)
+	assert.Equal(t, "mxc://example.com/abcDEF123", parsed.String())
+
+	for _, input := range []string{"https://example.com/abc", "mxc://example.com", "mxc://example.com/", "mxc:///abc", "mxc://example.com/a/b"} {
+		_, err = id.ParseContentURI(input)
+		assert.ErrorIs(t, err, id.InvalidContentURI, input)
+		_, err = id.ParseContentURIBytes([]byte(input))
+		assert.ErrorIs(t, err, id.InvalidContentURI, input)
+	}
+}
+
+func TestContentURI_JSON(t *testing.T) {
+	var content struct {
+		URL id.ContentURI `json:"url"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"url": "mxc://example.com/abc"}`), &content))
+	assert.Equal(t, id.ContentURI{Homeserver: "example.com", FileID: "abc"}, content.URL)
+	data, err := json.Marshal(&content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"url": "mxc://example.com/abc"}`, string(data))
+
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"url": "mxc:///abc"}`), &content), id.InvalidContentURI)
+	assert.ErrorIs(t, id.ContentURI{Homeserver: "example.com", FileID: "../abc"}.Validate(), id.InvalidContentURI)
+}
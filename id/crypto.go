@@ -28,6 +28,14 @@ const (
 	AlgorithmMegolmV1 Algorithm = "m.megolm.v1.aes-sha2"
 )
 
+// KeyBackupAlgorithm is the algorithm used for server-side key backups.
+// https://spec.matrix.org/v1.4/client-server-api/#backup-algorithm-mmegolm_backupv1curve25519-aes-sha2
+type KeyBackupAlgorithm string
+
+const (
+	KeyBackupAlgorithmMegolmBackupV1 KeyBackupAlgorithm = "m.megolm_backup.v1.curve25519-aes-sha2"
+)
+
 type KeyAlgorithm string
 
 const (
@@ -85,6 +93,9 @@ func (curve25519 Curve25519) String() string {
 // A DeviceID is an arbitrary string that references a specific device.
 type DeviceID string
 
+// AllDevices can be used as the device ID in to-device messages to send the message to all devices of a user.
+const AllDevices DeviceID = "*"
+
 func (deviceID DeviceID) String() string {
 	return string(deviceID)
 }
@@ -0,0 +1,465 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package mautrixtest contains a mock homeserver for testing code that uses mautrix.Client.
+package mautrixtest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MaxSyncWait is the maximum time the mock /sync endpoint waits for a queued response before returning an empty one.
+// The timeout requested by the client is used if it's shorter.
+var MaxSyncWait = 5 * time.Second
+
+// Request is a request received by the mock homeserver.
+type Request struct {
+	Method string
+	// The path of the request with escaping removed.
+	Path string
+	// The path of the request as it was sent.
+	RawPath string
+	Query   url.Values
+	Header  http.Header
+	Body    []byte
+}
+
+// ToDeviceMessage is a single message sent to a device with the sendToDevice endpoint.
+type ToDeviceMessage struct {
+	Type     event.Type
+	UserID   id.UserID
+	DeviceID id.DeviceID
+	Content  *event.Content
+}
+
+type prefixHandler struct {
+	method  string
+	prefix  string
+	handler http.HandlerFunc
+}
+
+// Homeserver is a mock Matrix homeserver backed by an httptest.Server.
+//
+// It implements a small subset of the client-server API: /versions, login, whoami, /sync, sending message and
+// state events, getting room state and sending to-device events. Sync responses are returned from a queue filled
+// with QueueSync, sent events are recorded and can be inspected with SentEvents and SentToDevice, and any other
+// endpoint can be implemented with Handle or HandlePrefix.
+type Homeserver struct {
+	Server      *httptest.Server
+	UserID      id.UserID
+	DeviceID    id.DeviceID
+	AccessToken string
+
+	lock      sync.Mutex
+	handlers  map[string]http.HandlerFunc
+	prefixes  []prefixHandler
+	requests  []Request
+	sent      []*event.Event
+	toDevice  []ToDeviceMessage
+	txnIDs    map[string]id.EventID
+	state     map[id.RoomID]map[event.Type]map[string]*event.Event
+	syncQueue []*mautrix.RespSync
+	syncReady chan struct{}
+	batch     int
+
+	eventCounter int
+}
+
+// NewHomeserver starts a new mock homeserver. The given user ID is returned from login and whoami.
+// The server must be closed with Close after the test.
+func NewHomeserver(userID id.UserID) *Homeserver {
+	hs := newHomeserver(userID)
+	hs.Server = httptest.NewServer(http.HandlerFunc(hs.ServeHTTP))
+	return hs
+}
+
+// NewTLSHomeserver starts a new mock homeserver that uses HTTPS. Clients must use Server.Client() or its transport
+// to trust the self-signed certificate. Clients created with NewClient trust it automatically.
+func NewTLSHomeserver(userID id.UserID) *Homeserver {
+	hs := newHomeserver(userID)
+	hs.Server = httptest.NewTLSServer(http.HandlerFunc(hs.ServeHTTP))
+	return hs
+}
+
+func newHomeserver(userID id.UserID) *Homeserver {
+	return &Homeserver{
+		UserID:      userID,
+		DeviceID:    "MOCKDEVICE",
+		AccessToken: "mock_access_token",
+		handlers:    make(map[string]http.HandlerFunc),
+		txnIDs:      make(map[string]id.EventID),
+		state:       make(map[id.RoomID]map[event.Type]map[string]*event.Event),
+		syncReady:   make(chan struct{}),
+	}
+}
+
+// Close shuts down the server.
+func (hs *Homeserver) Close() {
+	hs.Server.Close()
+}
+
+// NewClient creates a mautrix.Client that is logged into the mock homeserver.
+func (hs *Homeserver) NewClient() *mautrix.Client {
+	cli, err := mautrix.NewClient(hs.Server.URL, hs.UserID, hs.AccessToken)
+	if err != nil {
+		panic(err)
+	}
+	cli.DeviceID = hs.DeviceID
+	if hs.Server.TLS != nil {
+		cli.Client.Transport = hs.Server.Client().Transport
+	}
+	return cli
+}
+
+// Handle registers a custom handler for the given method and path, e.g. ("GET", "/_matrix/client/v3/profile/@user:example.com").
+// The path is matched exactly after removing URL escaping, and an empty method matches any method.
+// Custom handlers take priority over the built-in endpoints.
+func (hs *Homeserver) Handle(method, path string, handler http.HandlerFunc) {
+	hs.lock.Lock()
+	hs.handlers[method+" "+path] = handler
+	hs.lock.Unlock()
+}
+
+// HandlePrefix registers a custom handler for all paths that start with the given prefix. An empty method matches
+// any method. Handlers registered with Handle take priority, and the longest matching prefix is used if there are
+// multiple.
+func (hs *Homeserver) HandlePrefix(method, prefix string, handler http.HandlerFunc) {
+	hs.lock.Lock()
+	hs.prefixes = append(hs.prefixes, prefixHandler{method: method, prefix: prefix, handler: handler})
+	sort.SliceStable(hs.prefixes, func(i, j int) bool {
+		return len(hs.prefixes[i].prefix) > len(hs.prefixes[j].prefix)
+	})
+	hs.lock.Unlock()
+}
+
+// QueueSync adds a response to the sync queue. The next_batch token is filled automatically if it's empty.
+func (hs *Homeserver) QueueSync(resp *mautrix.RespSync) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.syncQueue = append(hs.syncQueue, resp)
+	close(hs.syncReady)
+	hs.syncReady = make(chan struct{})
+}
+
+// SetState sets a state event in the room, which will be returned by the state endpoints.
+func (hs *Homeserver) SetState(roomID id.RoomID, evtType event.Type, stateKey string, content interface{}) *event.Event {
+	data, err := json.Marshal(content)
+	if err != nil {
+		panic(err)
+	}
+	evtType.Class = event.StateEventType
+	evt := &event.Event{
+		StateKey:  &stateKey,
+		Sender:    hs.UserID,
+		Type:      evtType,
+		Timestamp: time.Now().UnixMilli(),
+		RoomID:    roomID,
+	}
+	_ = json.Unmarshal(data, &evt.Content)
+	_ = evt.Content.ParseRaw(evt.Type)
+	hs.lock.Lock()
+	evt.ID = hs.nextEventID()
+	hs.setState(evt)
+	hs.lock.Unlock()
+	return evt
+}
+
+// SentEvents returns the message and state events that have been sent to the server, in order.
+func (hs *Homeserver) SentEvents() []*event.Event {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	return append([]*event.Event{}, hs.sent...)
+}
+
+// SentToDevice returns the to-device messages that have been sent to the server, in order.
+// Messages sent in the same request are ordered by user and device ID.
+func (hs *Homeserver) SentToDevice() []ToDeviceMessage {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	return append([]ToDeviceMessage{}, hs.toDevice...)
+}
+
+// Requests returns all requests that the server has received, in order.
+func (hs *Homeserver) Requests() []Request {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	return append([]Request{}, hs.requests...)
+}
+
+// RequestsTo returns the requests that the server has received to the given unescaped path, in order.
+// An empty method matches any method.
+func (hs *Homeserver) RequestsTo(method, path string) []Request {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	var requests []Request
+	for _, req := range hs.requests {
+		if req.Path == path && (method == "" || req.Method == method) {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+// ResetRequests forgets all requests received so far.
+func (hs *Homeserver) ResetRequests() {
+	hs.lock.Lock()
+	hs.requests = nil
+	hs.lock.Unlock()
+}
+
+// WriteJSON writes the given data as a JSON response.
+func WriteJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+// WriteError writes a standard Matrix error response.
+func WriteError(w http.ResponseWriter, status int, errcode mautrix.RespError, message string) {
+	errcode.Err = message
+	WriteJSON(w, status, &errcode)
+}
+
+func (hs *Homeserver) nextEventID() id.EventID {
+	hs.eventCounter++
+	return id.EventID("$mock_event_" + strconv.Itoa(hs.eventCounter))
+}
+
+func (hs *Homeserver) setState(evt *event.Event) {
+	roomState, ok := hs.state[evt.RoomID]
+	if !ok {
+		roomState = make(map[event.Type]map[string]*event.Event)
+		hs.state[evt.RoomID] = roomState
+	}
+	typeState, ok := roomState[evt.Type]
+	if !ok {
+		typeState = make(map[string]*event.Event)
+		roomState[evt.Type] = typeState
+	}
+	typeState[*evt.StateKey] = evt
+}
+
+func (hs *Homeserver) findHandler(method, path string) (http.HandlerFunc, bool) {
+	if handler, ok := hs.handlers[method+" "+path]; ok {
+		return handler, true
+	} else if handler, ok = hs.handlers[" "+path]; ok {
+		return handler, true
+	}
+	for _, ph := range hs.prefixes {
+		if strings.HasPrefix(path, ph.prefix) && (ph.method == "" || ph.method == method) {
+			return ph.handler, true
+		}
+	}
+	return nil, false
+}
+
+func splitPath(escapedPath string) []string {
+	parts := strings.Split(strings.TrimPrefix(escapedPath, "/"), "/")
+	for i, part := range parts {
+		if unescaped, err := url.PathUnescape(part); err == nil {
+			parts[i] = unescaped
+		}
+	}
+	return parts
+}
+
+// ServeHTTP records the request and dispatches it to a custom handler or one of the built-in endpoints.
+func (hs *Homeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	path := splitPath(r.URL.EscapedPath())
+	joinedPath := "/" + strings.Join(path, "/")
+	hs.lock.Lock()
+	hs.requests = append(hs.requests, Request{
+		Method:  r.Method,
+		Path:    joinedPath,
+		RawPath: r.URL.EscapedPath(),
+		Query:   r.URL.Query(),
+		Header:  r.Header.Clone(),
+		Body:    body,
+	})
+	handler, ok := hs.findHandler(r.Method, joinedPath)
+	hs.lock.Unlock()
+	if ok {
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		handler(w, r)
+		return
+	}
+
+	if len(path) < 3 || path[0] != "_matrix" || path[1] != "client" {
+		WriteError(w, http.StatusNotFound, mautrix.MUnrecognized, "Unrecognized request")
+		return
+	} else if len(path) == 3 && path[2] == "versions" {
+		WriteJSON(w, http.StatusOK, &mautrix.RespVersions{Versions: []mautrix.SpecVersion{mautrix.SpecV11, mautrix.SpecV12, mautrix.SpecV13}})
+		return
+	}
+	path = path[3:]
+	if len(path) == 1 && path[0] == "login" && r.Method == http.MethodPost {
+		WriteJSON(w, http.StatusOK, &mautrix.RespLogin{AccessToken: hs.AccessToken, DeviceID: hs.DeviceID, UserID: hs.UserID})
+		return
+	} else if r.Header.Get("Authorization") != "Bearer "+hs.AccessToken {
+		WriteError(w, http.StatusUnauthorized, mautrix.MUnknownToken, "Unknown access token")
+		return
+	}
+	switch {
+	case len(path) == 2 && path[0] == "account" && path[1] == "whoami":
+		WriteJSON(w, http.StatusOK, &mautrix.RespWhoami{UserID: hs.UserID, DeviceID: hs.DeviceID})
+	case len(path) == 1 && path[0] == "sync" && r.Method == http.MethodGet:
+		hs.handleSync(w, r)
+	case len(path) == 5 && path[0] == "rooms" && path[2] == "send" && r.Method == http.MethodPut:
+		hs.handleSend(w, id.RoomID(path[1]), event.Type{Type: path[3], Class: event.MessageEventType}, nil, path[4], body)
+	case len(path) >= 4 && len(path) <= 5 && path[0] == "rooms" && path[2] == "state":
+		var stateKey string
+		if len(path) == 5 {
+			stateKey = path[4]
+		}
+		evtType := event.Type{Type: path[3], Class: event.StateEventType}
+		if r.Method == http.MethodPut {
+			hs.handleSend(w, id.RoomID(path[1]), evtType, &stateKey, "", body)
+		} else {
+			hs.handleGetState(w, id.RoomID(path[1]), evtType, stateKey)
+		}
+	case len(path) == 3 && path[0] == "rooms" && path[2] == "state" && r.Method == http.MethodGet:
+		hs.handleGetFullState(w, id.RoomID(path[1]))
+	case len(path) == 3 && path[0] == "sendToDevice" && r.Method == http.MethodPut:
+		hs.handleSendToDevice(w, event.Type{Type: path[1], Class: event.ToDeviceEventType}, body)
+	default:
+		WriteError(w, http.StatusNotFound, mautrix.MUnrecognized, "Unrecognized request")
+	}
+}
+
+func (hs *Homeserver) handleSync(w http.ResponseWriter, r *http.Request) {
+	wait := MaxSyncWait
+	if timeout, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && time.Duration(timeout)*time.Millisecond < wait {
+		wait = time.Duration(timeout) * time.Millisecond
+	}
+	deadline := time.After(wait)
+	for {
+		hs.lock.Lock()
+		var resp *mautrix.RespSync
+		if len(hs.syncQueue) > 0 {
+			resp = hs.syncQueue[0]
+			hs.syncQueue = hs.syncQueue[1:]
+		}
+		ready := hs.syncReady
+		if resp == nil {
+			hs.lock.Unlock()
+			select {
+			case <-ready:
+				continue
+			case <-r.Context().Done():
+				return
+			case <-deadline:
+				resp = &mautrix.RespSync{}
+			}
+			hs.lock.Lock()
+		}
+		if resp.NextBatch == "" {
+			hs.batch++
+			resp.NextBatch = "mock_batch_" + strconv.Itoa(hs.batch)
+		}
+		hs.lock.Unlock()
+		WriteJSON(w, http.StatusOK, resp)
+		return
+	}
+}
+
+func (hs *Homeserver) handleSend(w http.ResponseWriter, roomID id.RoomID, evtType event.Type, stateKey *string, txnID string, body []byte) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if txnID != "" {
+		if eventID, ok := hs.txnIDs[txnID]; ok {
+			WriteJSON(w, http.StatusOK, &mautrix.RespSendEvent{EventID: eventID})
+			return
+		}
+	}
+	evt := &event.Event{
+		StateKey:  stateKey,
+		Sender:    hs.UserID,
+		Type:      evtType,
+		Timestamp: time.Now().UnixMilli(),
+		ID:        hs.nextEventID(),
+		RoomID:    roomID,
+	}
+	if err := json.Unmarshal(body, &evt.Content); err != nil {
+		WriteError(w, http.StatusBadRequest, mautrix.MNotJSON, "Content is not valid JSON")
+		return
+	}
+	_ = evt.Content.ParseRaw(evt.Type)
+	if txnID != "" {
+		hs.txnIDs[txnID] = evt.ID
+	}
+	hs.sent = append(hs.sent, evt)
+	if stateKey != nil {
+		hs.setState(evt)
+	}
+	WriteJSON(w, http.StatusOK, &mautrix.RespSendEvent{EventID: evt.ID})
+}
+
+func (hs *Homeserver) handleSendToDevice(w http.ResponseWriter, evtType event.Type, body []byte) {
+	var req struct {
+		Messages map[id.UserID]map[id.DeviceID]*event.Content `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		WriteError(w, http.StatusBadRequest, mautrix.MNotJSON, "Content is not valid JSON")
+		return
+	}
+	var messages []ToDeviceMessage
+	for userID, devices := range req.Messages {
+		for deviceID, content := range devices {
+			if content == nil {
+				content = &event.Content{}
+			}
+			_ = content.ParseRaw(evtType)
+			messages = append(messages, ToDeviceMessage{Type: evtType, UserID: userID, DeviceID: deviceID, Content: content})
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].UserID != messages[j].UserID {
+			return messages[i].UserID < messages[j].UserID
+		}
+		return messages[i].DeviceID < messages[j].DeviceID
+	})
+	hs.lock.Lock()
+	hs.toDevice = append(hs.toDevice, messages...)
+	hs.lock.Unlock()
+	WriteJSON(w, http.StatusOK, struct{}{})
+}
+
+func (hs *Homeserver) handleGetState(w http.ResponseWriter, roomID id.RoomID, evtType event.Type, stateKey string) {
+	hs.lock.Lock()
+	evt, ok := hs.state[roomID][evtType][stateKey]
+	hs.lock.Unlock()
+	if !ok {
+		WriteError(w, http.StatusNotFound, mautrix.MNotFound, "Event not found")
+		return
+	}
+	WriteJSON(w, http.StatusOK, &evt.Content)
+}
+
+func (hs *Homeserver) handleGetFullState(w http.ResponseWriter, roomID id.RoomID) {
+	hs.lock.Lock()
+	events := make([]*event.Event, 0)
+	for _, typeState := range hs.state[roomID] {
+		for _, evt := range typeState {
+			events = append(events, evt)
+		}
+	}
+	hs.lock.Unlock()
+	WriteJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrixtest_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/mautrixtest"
+)
+
+func TestHomeserver(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@bot:example.com")
+	defer hs.Close()
+	cli := hs.NewClient()
+
+	resp, err := cli.SendText("!room:example.com", "hello")
+	require.NoError(t, err)
+	_, err = cli.SendStateEvent("!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "Testing"})
+	require.NoError(t, err)
+	sent := hs.SentEvents()
+	require.Len(t, sent, 2)
+	assert.Equal(t, resp.EventID, sent[0].ID)
+	assert.Equal(t, "hello", sent[0].Content.AsMessage().Body)
+	var topic event.TopicEventContent
+	require.NoError(t, cli.StateEvent("!room:example.com", event.StateTopic, "", &topic))
+	assert.Equal(t, "Testing", topic.Topic)
+	assert.ErrorIs(t, cli.StateEvent("!room:example.com", event.StateRoomName, "", &topic), mautrix.MNotFound)
+
+	hs.QueueSync(&mautrix.RespSync{Rooms: mautrix.RespSyncRooms{Join: map[id.RoomID]mautrix.SyncJoinedRoom{
+		"!room:example.com": {},
+	}}})
+	syncResp, err := cli.SyncRequest(30000, "", "", false, event.PresenceOnline, context.Background())
+	require.NoError(t, err)
+	assert.Contains(t, syncResp.Rooms.Join, id.RoomID("!room:example.com"))
+	assert.NotEmpty(t, syncResp.NextBatch)
+
+	hs.Handle(http.MethodGet, "/_matrix/client/v3/profile/@bot:example.com", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespUserProfile{DisplayName: "Bot"})
+	})
+	profile, err := cli.GetProfile("@bot:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Bot", profile.DisplayName)
+
+	cli.AccessToken = "wrong"
+	_, err = cli.Whoami()
+	assert.ErrorIs(t, err, mautrix.MUnknownToken)
+}
+
+func TestHomeserver_Handlers(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@bot:example.com")
+	defer hs.Close()
+	cli := hs.NewClient()
+
+	hs.HandlePrefix("", "/_matrix/client/v3/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteError(w, http.StatusForbidden, mautrix.MForbidden, "Not in room")
+	})
+	hs.HandlePrefix(http.MethodGet, "/_matrix/client/v3/rooms/!room:example.com/", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespJoinedMembers{})
+	})
+	hs.Handle("", "/_matrix/client/v3/rooms/!room:example.com/typing/@bot:example.com", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, struct{}{})
+	})
+	_, err := cli.JoinedMembers("!room:example.com")
+	assert.NoError(t, err, "longest prefix should be used")
+	_, err = cli.JoinedMembers("!other:example.com")
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	_, err = cli.SendText("!room:example.com", "hello")
+	assert.ErrorIs(t, err, mautrix.MForbidden, "prefix handler should only match GET")
+	assert.Empty(t, hs.SentEvents())
+	_, err = cli.UserTyping("!room:example.com", true, 0)
+	assert.NoError(t, err)
+
+	requests := hs.RequestsTo(http.MethodGet, "/_matrix/client/v3/rooms/!room:example.com/joined_members")
+	require.Len(t, requests, 1)
+	assert.Equal(t, "/_matrix/client/v3/rooms/%21room:example.com/joined_members", requests[0].RawPath)
+	assert.Equal(t, "Bearer "+hs.AccessToken, requests[0].Header.Get("Authorization"))
+	hs.ResetRequests()
+	assert.Empty(t, hs.Requests())
+
+	_, err = cli.SendToDevice(event.ToDeviceRoomKeyRequest, &mautrix.ReqSendToDevice{
+		Messages: map[id.UserID]map[id.DeviceID]*event.Content{
+			"@bob:example.com":   {"DEVICE": {Raw: map[string]interface{}{"action": "request"}}},
+			"@alice:example.com": {"DEVICE": {Raw: map[string]interface{}{"action": "request_cancellation"}}},
+		},
+	})
+	require.NoError(t, err)
+	toDevice := hs.SentToDevice()
+	require.Len(t, toDevice, 2)
+	assert.Equal(t, id.UserID("@alice:example.com"), toDevice[0].UserID)
+	assert.Equal(t, event.ToDeviceRoomKeyRequest.Type, toDevice[0].Type.Type)
+	assert.EqualValues(t, event.KeyRequestActionCancel, toDevice[0].Content.AsRoomKeyRequest().Action)
+	assert.Equal(t, id.DeviceID("DEVICE"), toDevice[1].DeviceID)
+}
+
+func TestNewTLSHomeserver(t *testing.T) {
+	hs := mautrixtest.NewTLSHomeserver("@bot:example.com")
+	defer hs.Close()
+	resp, err := hs.NewClient().Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@bot:example.com"), resp.UserID)
+}
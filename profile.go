@@ -0,0 +1,114 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type cachedProfile struct {
+	profile *RespUserProfile
+	expires time.Time
+}
+
+// ProfileCache is a simple in-memory cache for user profiles used by Client.GetProfile.
+//
+// Entries expire after the TTL and are invalidated when a m.room.member event for the user is seen in sync.
+// The zero value is an empty cache with no TTL, so either NewProfileCache or a struct literal with TTL can be used.
+type ProfileCache struct {
+	TTL time.Duration
+
+	profiles map[id.UserID]cachedProfile
+	lock     sync.RWMutex
+}
+
+// NewProfileCache creates a new ProfileCache with the given TTL.
+func NewProfileCache(ttl time.Duration) *ProfileCache {
+	return &ProfileCache{
+		TTL:      ttl,
+		profiles: make(map[id.UserID]cachedProfile),
+	}
+}
+
+// Get returns the cached profile of the given user, or nil if there's no unexpired entry.
+// Expired entries are removed from the cache.
+func (pc *ProfileCache) Get(userID id.UserID) *RespUserProfile {
+	pc.lock.RLock()
+	cached, ok := pc.profiles[userID]
+	pc.lock.RUnlock()
+	if !ok {
+		return nil
+	} else if time.Now().After(cached.expires) {
+		pc.lock.Lock()
+		// Only delete the entry if it wasn't replaced with a fresh one in the meantime
+		if current, ok := pc.profiles[userID]; ok && current.expires.Equal(cached.expires) {
+			delete(pc.profiles, userID)
+		}
+		pc.lock.Unlock()
+		return nil
+	}
+	return cached.profile
+}
+
+// Set stores the profile of the given user in the cache.
+func (pc *ProfileCache) Set(userID id.UserID, profile *RespUserProfile) {
+	pc.lock.Lock()
+	if pc.profiles == nil {
+		pc.profiles = make(map[id.UserID]cachedProfile)
+	}
+	pc.profiles[userID] = cachedProfile{profile: profile, expires: time.Now().Add(pc.TTL)}
+	pc.lock.Unlock()
+}
+
+// Invalidate removes the given user from the cache.
+func (pc *ProfileCache) Invalidate(userID id.UserID) {
+	pc.lock.Lock()
+	delete(pc.profiles, userID)
+	pc.lock.Unlock()
+}
+
+func (pc *ProfileCache) invalidateMembers(events []*event.Event) {
+	for _, evt := range events {
+		if evt.Type == event.StateMember && evt.StateKey != nil {
+			pc.Invalidate(id.UserID(*evt.StateKey))
+		}
+	}
+}
+
+// UpdateFromSync invalidates the cached profiles of all users who have m.room.member events in the given sync response.
+func (pc *ProfileCache) UpdateFromSync(resp *RespSync) {
+	for _, room := range resp.Rooms.Join {
+		pc.invalidateMembers(room.State.Events)
+		pc.invalidateMembers(room.Timeline.Events)
+	}
+	for _, room := range resp.Rooms.Leave {
+		pc.invalidateMembers(room.State.Events)
+		pc.invalidateMembers(room.Timeline.Events)
+	}
+}
+
+// GetProfile gets the display name and avatar URL of the user with the specified MXID.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3profileuserid
+//
+// If Client.ProfileCache is set, cached profiles are returned without making a request.
+func (cli *Client) GetProfile(mxid id.UserID) (resp *RespUserProfile, err error) {
+	if cli.ProfileCache != nil {
+		if resp = cli.ProfileCache.Get(mxid); resp != nil {
+			return
+		}
+	}
+	urlPath := cli.BuildClientURL("v3", "profile", mxid)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	if err == nil && cli.ProfileCache != nil {
+		cli.ProfileCache.Set(mxid, resp)
+	}
+	return
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestProfileCache(t *testing.T) {
+	cache := mautrix.NewProfileCache(time.Hour)
+	alice := id.UserID("@alice:example.com")
+	bob := id.UserID("@bob:example.com")
+	cache.Set(alice, &mautrix.RespUserProfile{DisplayName: "Alice"})
+	cache.Set(bob, &mautrix.RespUserProfile{DisplayName: "Bob"})
+	assert.Equal(t, "Alice", cache.Get(alice).DisplayName)
+
+	aliceStr := alice.String()
+	cache.UpdateFromSync(&mautrix.RespSync{Rooms: mautrix.RespSyncRooms{
+		Join: map[id.RoomID]mautrix.SyncJoinedRoom{
+			"!foo:example.com": {Timeline: mautrix.SyncTimeline{SyncEventsList: mautrix.SyncEventsList{
+				Events: []*event.Event{{Type: event.StateMember, StateKey: &aliceStr}},
+			}}},
+		},
+	}})
+	assert.Nil(t, cache.Get(alice))
+	assert.Equal(t, "Bob", cache.Get(bob).DisplayName)
+
+	expired := mautrix.NewProfileCache(-time.Second)
+	expired.Set(alice, &mautrix.RespUserProfile{DisplayName: "Alice"})
+	assert.Nil(t, expired.Get(alice))
+
+	zero := &mautrix.ProfileCache{TTL: time.Hour}
+	assert.Nil(t, zero.Get(alice))
+	zero.Set(alice, &mautrix.RespUserProfile{DisplayName: "Alice"})
+	assert.Equal(t, "Alice", zero.Get(alice).DisplayName)
+}
@@ -22,6 +22,12 @@ type Room interface {
 	GetMemberCount() int
 }
 
+// PowerLevelfulRoom is an extension of Room to support the sender_notification_permission condition.
+type PowerLevelfulRoom interface {
+	Room
+	GetPowerLevels() *event.PowerLevelsEventContent
+}
+
 // PushCondKind is the type of a push condition.
 type PushCondKind string
 
@@ -30,6 +36,8 @@ const (
 	KindEventMatch          PushCondKind = "event_match"
 	KindContainsDisplayName PushCondKind = "contains_display_name"
 	KindRoomMemberCount     PushCondKind = "room_member_count"
+
+	KindSenderNotificationPermission PushCondKind = "sender_notification_permission"
 )
 
 // PushCondition wraps a condition that is required for a specific PushRule to be used.
@@ -37,6 +45,7 @@ type PushCondition struct {
 	// The type of the condition.
 	Kind PushCondKind `json:"kind"`
 	// The dot-separated field of the event to match. Only applicable if kind is EventMatch.
+	// For SenderNotificationPermission-type conditions, the notification power level key, e.g. "room".
 	Key string `json:"key,omitempty"`
 	// The glob-style pattern to match the field against. Only applicable if kind is EventMatch.
 	Pattern string `json:"pattern,omitempty"`
@@ -57,6 +66,8 @@ func (cond *PushCondition) Match(room Room, evt *event.Event) bool {
 		return cond.matchDisplayName(room, evt)
 	case KindRoomMemberCount:
 		return cond.matchMemberCount(room)
+	case KindSenderNotificationPermission:
+		return cond.matchSenderNotificationPermission(room, evt)
 	default:
 		return false
 	}
@@ -147,3 +158,20 @@ func (cond *PushCondition) matchMemberCount(room Room) bool {
 		return false
 	}
 }
+
+func (cond *PushCondition) matchSenderNotificationPermission(room Room, evt *event.Event) bool {
+	plRoom, ok := room.(PowerLevelfulRoom)
+	if !ok {
+		return false
+	}
+	pl := plRoom.GetPowerLevels()
+	if pl == nil {
+		return false
+	}
+	switch cond.Key {
+	case "room":
+		return pl.GetUserLevel(evt.Sender) >= pl.Notifications.Room()
+	default:
+		return false
+	}
+}
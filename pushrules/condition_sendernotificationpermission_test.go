@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+type powerLevelfulFakeRoom struct {
+	*FakeRoom
+	powerLevels *event.PowerLevelsEventContent
+}
+
+func (room *powerLevelfulFakeRoom) GetPowerLevels() *event.PowerLevelsEventContent {
+	return room.powerLevels
+}
+
+var senderNotificationPermissionCondition = &pushrules.PushCondition{
+	Kind: pushrules.KindSenderNotificationPermission,
+	Key:  "room",
+}
+
+func TestPushCondition_Match_KindSenderNotificationPermission(t *testing.T) {
+	room := &powerLevelfulFakeRoom{
+		FakeRoom:    newFakeRoom(2),
+		powerLevels: &event.PowerLevelsEventContent{Users: map[id.UserID]int{"@tulir:maunium.net": 50}},
+	}
+	assert.True(t, senderNotificationPermissionCondition.Match(room, countConditionTestEvent))
+}
+
+func TestPushCondition_Match_KindSenderNotificationPermission_CustomLevel(t *testing.T) {
+	roomLevel := 75
+	room := &powerLevelfulFakeRoom{
+		FakeRoom: newFakeRoom(2),
+		powerLevels: &event.PowerLevelsEventContent{
+			Users:         map[id.UserID]int{"@tulir:maunium.net": 50},
+			Notifications: &event.NotificationPowerLevels{RoomPtr: &roomLevel},
+		},
+	}
+	assert.False(t, senderNotificationPermissionCondition.Match(room, countConditionTestEvent))
+}
+
+func TestPushCondition_Match_KindSenderNotificationPermission_NoPowerLevels(t *testing.T) {
+	assert.False(t, senderNotificationPermissionCondition.Match(newFakeRoom(2), countConditionTestEvent))
+}
@@ -2,6 +2,7 @@ package mautrix
 
 import (
 	"encoding/json"
+	"strconv"
 
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -70,6 +71,7 @@ type ReqLogin struct {
 	Token                    string         `json:"token,omitempty"`
 	DeviceID                 id.DeviceID    `json:"device_id,omitempty"`
 	InitialDeviceDisplayName string         `json:"initial_device_display_name,omitempty"`
+	RefreshToken             bool           `json:"refresh_token,omitempty"`
 
 	// Whether or not the returned credentials should be stored in the Client
 	StoreCredentials bool `json:"-"`
@@ -77,6 +79,11 @@ type ReqLogin struct {
 	StoreHomeserverURL bool `json:"-"`
 }
 
+// ReqRefresh is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3refresh
+type ReqRefresh struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 type ReqUIAuthFallback struct {
 	Session string `json:"session"`
 	User    string `json:"user"`
@@ -88,6 +95,11 @@ type ReqUIAuthLogin struct {
 	Password string `json:"password"`
 }
 
+// ReqUpgradeRoom is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidupgrade
+type ReqUpgradeRoom struct {
+	NewVersion string `json:"new_version"`
+}
+
 // ReqCreateRoom is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3createroom
 type ReqCreateRoom struct {
 	Visibility      string                 `json:"visibility,omitempty"`
@@ -102,9 +114,14 @@ type ReqCreateRoom struct {
 	IsDirect        bool                   `json:"is_direct,omitempty"`
 	RoomVersion     string                 `json:"room_version,omitempty"`
 
+	// Power levels to apply on top of the defaults generated by the server. Only the fields that are set are overridden,
+	// e.g. setting Users to a map that doesn't include the creator means that the creator won't get PL 100.
 	PowerLevelOverride *event.PowerLevelsEventContent `json:"power_level_content_override,omitempty"`
 
 	MeowRoomID id.RoomID `json:"fi.mau.room_id,omitempty"`
+
+	// If true and IsDirect is set, the created room is added to the m.direct account data for each invited user.
+	AddToDirectChats bool `json:"-"`
 }
 
 // ReqRedact is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidredacteventidtxnid
@@ -128,6 +145,20 @@ type ReqInvite3PID struct {
 	Address  string `json:"address"`
 }
 
+// ReqJoinRoom is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3joinroomidoralias
+type ReqJoinRoom struct {
+	// Via is a list of servers to attempt to join the room through. They're sent as server_name query parameters.
+	Via    []string `json:"-"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// ReqKnockRoom is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3knockroomidoralias
+type ReqKnockRoom struct {
+	// Via is a list of servers to attempt to knock on the room through. They're sent as server_name query parameters.
+	Via    []string `json:"-"`
+	Reason string   `json:"reason,omitempty"`
+}
+
 type ReqLeave struct {
 	Reason string `json:"reason,omitempty"`
 }
@@ -162,8 +193,12 @@ type ReqTyping struct {
 	Timeout int64 `json:"timeout,omitempty"`
 }
 
+// ReqPresence is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#put_matrixclientv3presenceuseridstatus
 type ReqPresence struct {
 	Presence event.Presence `json:"presence"`
+	// The status message to set. If nil, the existing status message is left unchanged,
+	// while an empty string clears it.
+	StatusMsg *string `json:"status_msg,omitempty"`
 }
 
 type ReqAliasCreate struct {
@@ -172,6 +207,7 @@ type ReqAliasCreate struct {
 
 type OneTimeKey struct {
 	Key        id.Curve25519          `json:"key"`
+	Fallback   bool                   `json:"fallback,omitempty"`
 	IsSigned   bool                   `json:"-"`
 	Signatures Signatures             `json:"signatures,omitempty"`
 	Unsigned   map[string]interface{} `json:"unsigned,omitempty"`
@@ -201,8 +237,9 @@ func (otk *OneTimeKey) MarshalJSON() ([]byte, error) {
 }
 
 type ReqUploadKeys struct {
-	DeviceKeys  *DeviceKeys             `json:"device_keys,omitempty"`
-	OneTimeKeys map[id.KeyID]OneTimeKey `json:"one_time_keys"`
+	DeviceKeys   *DeviceKeys             `json:"device_keys,omitempty"`
+	OneTimeKeys  map[id.KeyID]OneTimeKey `json:"one_time_keys,omitempty"`
+	FallbackKeys map[id.KeyID]OneTimeKey `json:"fallback_keys,omitempty"`
 }
 
 type ReqKeysSignatures struct {
@@ -216,6 +253,45 @@ type ReqKeysSignatures struct {
 
 type ReqUploadSignatures map[id.UserID]map[string]ReqKeysSignatures
 
+// ReqRoomKeysVersionCreate is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3room_keysversion
+type ReqRoomKeysVersionCreate struct {
+	Algorithm id.KeyBackupAlgorithm `json:"algorithm"`
+	AuthData  json.RawMessage       `json:"auth_data"`
+}
+
+// KeyBackupData is a single backed up Megolm session.
+// See https://spec.matrix.org/v1.4/client-server-api/#definition-keybackupdata
+type KeyBackupData struct {
+	FirstMessageIndex int             `json:"first_message_index"`
+	ForwardedCount    int             `json:"forwarded_count"`
+	IsVerified        bool            `json:"is_verified"`
+	SessionData       json.RawMessage `json:"session_data"`
+}
+
+// IsBetterThan checks whether this backed up session should replace the other one,
+// following the rules in https://spec.matrix.org/v1.4/client-server-api/#put_matrixclientv3room_keyskeysroomidsessionid
+//
+// Verified sessions always win over unverified ones. If both have the same verification status,
+// the session with the lower first message index wins, and if those are equal too, the one with the lower forwarded count.
+func (kbd *KeyBackupData) IsBetterThan(other *KeyBackupData) bool {
+	if kbd.IsVerified != other.IsVerified {
+		return kbd.IsVerified
+	} else if kbd.FirstMessageIndex != other.FirstMessageIndex {
+		return kbd.FirstMessageIndex < other.FirstMessageIndex
+	}
+	return kbd.ForwardedCount < other.ForwardedCount
+}
+
+// RoomKeyBackup contains the backed up sessions of a single room.
+type RoomKeyBackup struct {
+	Sessions map[id.SessionID]KeyBackupData `json:"sessions"`
+}
+
+// ReqKeyBackup is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#put_matrixclientv3room_keyskeys
+type ReqKeyBackup struct {
+	Rooms map[id.RoomID]RoomKeyBackup `json:"rooms"`
+}
+
 type DeviceKeys struct {
 	UserID     id.UserID              `json:"user_id"`
 	DeviceID   id.DeviceID            `json:"device_id"`
@@ -294,6 +370,75 @@ type ReqDeviceInfo struct {
 	DisplayName string `json:"display_name,omitempty"`
 }
 
+// ReqChangePassword is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3accountpassword
+type ReqChangePassword struct {
+	NewPassword string `json:"new_password"`
+	// Whether the user's other access tokens and devices should be revoked. The server defaults to true if this is nil.
+	LogoutDevices *bool       `json:"logout_devices,omitempty"`
+	Auth          interface{} `json:"auth,omitempty"`
+}
+
+// ReqDeactivateAccount is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3accountdeactivate
+type ReqDeactivateAccount struct {
+	Auth interface{} `json:"auth,omitempty"`
+	// The identity server to unbind 3PIDs from. If empty, the server uses the identity server the 3PIDs were bound with.
+	IDServer string `json:"id_server,omitempty"`
+	// Whether the user would like their content to be erased as much as possible from the server.
+	Erase bool `json:"erase,omitempty"`
+}
+
+type ThreePIDMedium string
+
+const (
+	ThreePIDMediumEmail  ThreePIDMedium = "email"
+	ThreePIDMediumMSISDN ThreePIDMedium = "msisdn"
+)
+
+// ReqRequestEmailToken is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3pidemailrequesttoken
+type ReqRequestEmailToken struct {
+	// A random secret generated by the client, which is also used when adding the 3PID.
+	ClientSecret string `json:"client_secret"`
+	Email        string `json:"email"`
+	// Incremented by the client to request a new email to be sent. Requests with the same attempt are ignored.
+	SendAttempt int    `json:"send_attempt"`
+	NextLink    string `json:"next_link,omitempty"`
+}
+
+// ReqRequestMSISDNToken is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3pidmsisdnrequesttoken
+type ReqRequestMSISDNToken struct {
+	ClientSecret string `json:"client_secret"`
+	// The two-letter uppercase ISO-3166-1 alpha-2 country code that the number in PhoneNumber should be parsed as.
+	Country     string `json:"country"`
+	PhoneNumber string `json:"phone_number"`
+	SendAttempt int    `json:"send_attempt"`
+	NextLink    string `json:"next_link,omitempty"`
+}
+
+// ReqAddThreePID is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3pidadd
+type ReqAddThreePID struct {
+	ClientSecret string      `json:"client_secret"`
+	SessionID    string      `json:"sid"`
+	Auth         interface{} `json:"auth,omitempty"`
+}
+
+// ReqBindThreePID is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3pidbind
+type ReqBindThreePID struct {
+	ClientSecret string `json:"client_secret"`
+	SessionID    string `json:"sid"`
+	// The identity server that validated the 3PID, and an access token for it.
+	IDServer      string `json:"id_server"`
+	IDAccessToken string `json:"id_access_token"`
+}
+
+// ReqThreePID is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3piddelete
+// and https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3pidunbind
+type ReqThreePID struct {
+	Medium  ThreePIDMedium `json:"medium"`
+	Address string         `json:"address"`
+	// The identity server to unbind from. If empty, the homeserver uses the identity server the 3PID was bound with.
+	IDServer string `json:"id_server,omitempty"`
+}
+
 // ReqDeleteDevice is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#delete_matrixclientv3devicesdeviceid
 type ReqDeleteDevice struct {
 	Auth interface{} `json:"auth,omitempty"`
@@ -310,13 +455,43 @@ type ReqPutPushRule struct {
 	After  string `json:"-"`
 
 	Actions    []pushrules.PushActionType `json:"actions"`
-	Conditions []pushrules.PushCondition  `json:"conditions"`
-	Pattern    string                     `json:"pattern"`
+	Conditions []pushrules.PushCondition  `json:"conditions,omitempty"`
+	Pattern    string                     `json:"pattern,omitempty"`
+
+	// ActionsWithTweaks can be used instead of Actions to include set_tweak actions in the rule.
+	// If set, Actions is ignored.
+	ActionsWithTweaks pushrules.PushActionArray `json:"-"`
 }
 
+type serializableReqPutPushRule ReqPutPushRule
+
+func (req *ReqPutPushRule) MarshalJSON() ([]byte, error) {
+	if req.ActionsWithTweaks == nil {
+		return json.Marshal((*serializableReqPutPushRule)(req))
+	}
+	return json.Marshal(&struct {
+		*serializableReqPutPushRule
+		Actions pushrules.PushActionArray `json:"actions"`
+	}{(*serializableReqPutPushRule)(req), req.ActionsWithTweaks})
+}
+
+// ReqPutPushRuleEnabled is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3pushrulesscopekindruleidenabled
+type ReqPutPushRuleEnabled struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ReqPutPushRuleActions is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3pushrulesscopekindruleidactions
+type ReqPutPushRuleActions struct {
+	Actions pushrules.PushActionArray `json:"actions"`
+}
+
+// ReqBatchSend is the JSON request for https://github.com/matrix-org/matrix-spec-proposals/pull/2716
 type ReqBatchSend struct {
+	// PrevEventID is the event after which the batch will be inserted.
 	PrevEventID id.EventID `json:"-"`
-	BatchID     id.BatchID `json:"-"`
+	// BatchID is the NextBatchID returned by the previous request. It should be empty for the first batch
+	// after PrevEventID. Subsequent batches are inserted chronologically before the previous batch.
+	BatchID id.BatchID `json:"-"`
 
 	BeeperNewMessages bool `json:"-"`
 
@@ -324,12 +499,247 @@ type ReqBatchSend struct {
 	Events             []*event.Event `json:"events"`
 }
 
+// ReqSetReadMarkers is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3roomsroomidread_markers
 type ReqSetReadMarkers struct {
-	Read        id.EventID `json:"m.read"`
-	ReadPrivate id.EventID `json:"m.read.private"`
-	FullyRead   id.EventID `json:"m.fully_read"`
+	Read        id.EventID `json:"m.read,omitempty"`
+	ReadPrivate id.EventID `json:"m.read.private,omitempty"`
+	FullyRead   id.EventID `json:"m.fully_read,omitempty"`
+
+	BeeperReadExtra        interface{} `json:"com.beeper.read.extra,omitempty"`
+	BeeperReadPrivateExtra interface{} `json:"com.beeper.read.private.extra,omitempty"`
+	BeeperFullyReadExtra   interface{} `json:"com.beeper.fully_read.extra,omitempty"`
+}
+
+// ReqSendReceipt is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3roomsroomidreceiptreceipttypeeventid
+type ReqSendReceipt struct {
+	// ThreadID is the thread root event ID, or event.ReadReceiptThreadMain for the main timeline.
+	// If empty, the receipt is unthreaded and applies to all threads.
+	ThreadID string `json:"thread_id,omitempty"`
+}
+
+// ReqGetRelations contains the optional parameters for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+type ReqGetRelations struct {
+	// Only return relations of this type.
+	RelationType event.RelationType
+	// Only return relations with this event type. Can only be used together with RelationType.
+	EventType event.Type
+
+	Dir   rune
+	From  string
+	To    string
+	Limit int
+}
+
+// PathSuffix returns the optional rel_type and event_type path segments.
+func (rgr *ReqGetRelations) PathSuffix() ClientURLPath {
+	if rgr.RelationType == "" {
+		return nil
+	} else if rgr.EventType.Type == "" {
+		return ClientURLPath{rgr.RelationType}
+	}
+	return ClientURLPath{rgr.RelationType, rgr.EventType.Type}
+}
 
-	BeeperReadExtra        interface{} `json:"com.beeper.read.extra"`
-	BeeperReadPrivateExtra interface{} `json:"com.beeper.read.private.extra"`
-	BeeperFullyReadExtra   interface{} `json:"com.beeper.fully_read.extra"`
+// Query returns the pagination query parameters.
+func (rgr *ReqGetRelations) Query() map[string]string {
+	query := map[string]string{}
+	if rgr.Dir != 0 {
+		query["dir"] = string(rgr.Dir)
+	}
+	if rgr.From != "" {
+		query["from"] = rgr.From
+	}
+	if rgr.To != "" {
+		query["to"] = rgr.To
+	}
+	if rgr.Limit > 0 {
+		query["limit"] = strconv.Itoa(rgr.Limit)
+	}
+	return query
+}
+
+type SearchKey string
+
+const (
+	SearchKeyContentBody  SearchKey = "content.body"
+	SearchKeyContentName  SearchKey = "content.name"
+	SearchKeyContentTopic SearchKey = "content.topic"
+)
+
+type SearchOrder string
+
+const (
+	SearchOrderRank   SearchOrder = "rank"
+	SearchOrderRecent SearchOrder = "recent"
+)
+
+type SearchGroupKey string
+
+const (
+	SearchGroupKeyRoomID SearchGroupKey = "room_id"
+	SearchGroupKeySender SearchGroupKey = "sender"
+)
+
+// ReqSearch is the JSON request for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3search
+type ReqSearch struct {
+	SearchCategories SearchCategories `json:"search_categories"`
+
+	// The next_batch token from a previous response to get the next page of results.
+	NextBatch string `json:"-"`
+}
+
+type SearchCategories struct {
+	RoomEvents *ReqSearchRoomEvents `json:"room_events,omitempty"`
+}
+
+type ReqSearchRoomEvents struct {
+	SearchTerm string `json:"search_term"`
+	// The keys to search. Defaults to all keys (content.body, content.name and content.topic).
+	Keys   []SearchKey `json:"keys,omitempty"`
+	Filter *FilterPart `json:"filter,omitempty"`
+	// The order to return results in. Defaults to rank.
+	OrderBy SearchOrder `json:"order_by,omitempty"`
+	// Request context events around each result. If nil, no context is returned.
+	EventContext *SearchEventContext `json:"event_context,omitempty"`
+	// Request the current state of the rooms that have results.
+	IncludeState bool             `json:"include_state,omitempty"`
+	Groupings    *SearchGroupings `json:"groupings,omitempty"`
+}
+
+// SearchEventContext specifies how many context events to return around each search result.
+// Zero limits use the server defaults (5 events in both directions).
+type SearchEventContext struct {
+	BeforeLimit    int  `json:"before_limit,omitempty"`
+	AfterLimit     int  `json:"after_limit,omitempty"`
+	IncludeProfile bool `json:"include_profile,omitempty"`
+}
+
+type SearchGroupings struct {
+	GroupBy []SearchGroup `json:"group_by,omitempty"`
+}
+
+type SearchGroup struct {
+	Key SearchGroupKey `json:"key"`
+}
+
+// RoomDirectoryVisibility is the visibility of a room in the public room directory.
+type RoomDirectoryVisibility string
+
+const (
+	RoomDirectoryVisibilityPublic  RoomDirectoryVisibility = "public"
+	RoomDirectoryVisibilityPrivate RoomDirectoryVisibility = "private"
+)
+
+// ThumbnailMethod is the method used to resize images in Client.DownloadThumbnail.
+type ThumbnailMethod string
+
+const (
+	// ThumbnailMethodCrop crops the image to exactly the requested size.
+	ThumbnailMethodCrop ThumbnailMethod = "crop"
+	// ThumbnailMethodScale scales the image to fit within the requested size while keeping the aspect ratio.
+	ThumbnailMethodScale ThumbnailMethod = "scale"
+)
+
+// ReqThumbnail contains the optional parameters for https://spec.matrix.org/v1.4/client-server-api/#get_matrixmediav3thumbnailservernamemediaid
+type ReqThumbnail struct {
+	// Whether the server should fetch the media from other servers. Defaults to true on the server side.
+	AllowRemote *bool
+	// Request an animated thumbnail for animated images (MSC2705). Servers that don't support it return a static one.
+	Animated bool
+}
+
+// ReqDownloadMedia contains the optional parameters for Client.DownloadMedia.
+type ReqDownloadMedia struct {
+	// Whether the server should fetch the media from other servers. Defaults to true on the server side.
+	AllowRemote *bool
+	// Request a byte range of the file with a HTTP Range header. Offset is the first byte to download and
+	// Length is the number of bytes to download. If Length is zero, the file is downloaded until the end.
+	Offset int64
+	Length int64
+	// Use the authenticated media endpoints (MSC3916) even if the server doesn't advertise support for them.
+	Authenticated bool
+}
+
+// ReqPublicRooms is the request for Client.PublicRooms.
+//
+// See https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3publicrooms
+// and https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3publicrooms
+type ReqPublicRooms struct {
+	// The pagination token from a previous response (next_batch or prev_batch).
+	Since string `json:"since,omitempty"`
+	// The maximum number of rooms to return.
+	Limit int `json:"limit,omitempty"`
+	// A filter for the rooms. If set, the request is made with POST.
+	Filter *PublicRoomsFilter `json:"filter,omitempty"`
+	// Whether to include rooms from all third party networks (e.g. bridges) on the server. If set, the request is made with POST.
+	IncludeAllNetworks bool `json:"include_all_networks,omitempty"`
+	// A specific third party network to return rooms from. If set, the request is made with POST.
+	ThirdPartyInstanceID string `json:"third_party_instance_id,omitempty"`
+
+	// The server to fetch the directory from, for listing the directory of a remote server.
+	// Defaults to the local server.
+	Server string `json:"-"`
+}
+
+// needsPost returns true if the request has fields that are only supported by the POST variant of /publicRooms.
+func (req *ReqPublicRooms) needsPost() bool {
+	return req.Filter != nil || req.IncludeAllNetworks || req.ThirdPartyInstanceID != ""
+}
+
+// Query returns the query parameters for the request. Since and Limit are only included for GET requests.
+func (req *ReqPublicRooms) Query(post bool) map[string]string {
+	query := map[string]string{}
+	if req.Server != "" {
+		query["server"] = req.Server
+	}
+	if !post {
+		if req.Since != "" {
+			query["since"] = req.Since
+		}
+		if req.Limit > 0 {
+			query["limit"] = strconv.Itoa(req.Limit)
+		}
+	}
+	return query
+}
+
+type PublicRoomsFilter struct {
+	// A string to search for in the room name, topic and canonical alias.
+	GenericSearchTerm string `json:"generic_search_term,omitempty"`
+	// The room types to include, e.g. event.RoomTypeSpace to only list spaces.
+	RoomTypes []event.RoomType `json:"room_types,omitempty"`
+}
+
+type ReqRoomDirectoryVisibility struct {
+	Visibility RoomDirectoryVisibility `json:"visibility"`
+}
+
+// ReqHierarchy contains the optional parameters for https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv1roomsroomidhierarchy
+type ReqHierarchy struct {
+	// The pagination token from a previous response.
+	From string
+	// The maximum number of rooms to return per page.
+	Limit int
+	// The maximum depth of the tree to return. If nil, the server's default (and maximum) limit is used.
+	MaxDepth *int
+	// Only return rooms (and recurse into spaces) that are marked as suggested in the m.space.child event.
+	SuggestedOnly bool
+}
+
+// Query returns the query parameters for the request.
+func (req *ReqHierarchy) Query() map[string]string {
+	query := map[string]string{}
+	if req.From != "" {
+		query["from"] = req.From
+	}
+	if req.Limit > 0 {
+		query["limit"] = strconv.Itoa(req.Limit)
+	}
+	if req.MaxDepth != nil {
+		query["max_depth"] = strconv.Itoa(*req.MaxDepth)
+	}
+	if req.SuggestedOnly {
+		query["suggested_only"] = "true"
+	}
+	return query
 }
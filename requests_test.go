@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix"
+)
+
+func TestKeyBackupData_IsBetterThan(t *testing.T) {
+	for name, tt := range map[string]struct {
+		data     mautrix.KeyBackupData
+		other    mautrix.KeyBackupData
+		expected bool
+	}{
+		"VerifiedWins": {
+			data:     mautrix.KeyBackupData{IsVerified: true, FirstMessageIndex: 10, ForwardedCount: 2},
+			other:    mautrix.KeyBackupData{IsVerified: false, FirstMessageIndex: 0, ForwardedCount: 0},
+			expected: true,
+		},
+		"UnverifiedLoses": {
+			data:     mautrix.KeyBackupData{IsVerified: false, FirstMessageIndex: 0},
+			other:    mautrix.KeyBackupData{IsVerified: true, FirstMessageIndex: 10},
+			expected: false,
+		},
+		"LowerFirstMessageIndexWins": {
+			data:     mautrix.KeyBackupData{FirstMessageIndex: 1, ForwardedCount: 5},
+			other:    mautrix.KeyBackupData{FirstMessageIndex: 2, ForwardedCount: 0},
+			expected: true,
+		},
+		"HigherFirstMessageIndexLoses": {
+			data:     mautrix.KeyBackupData{IsVerified: true, FirstMessageIndex: 3},
+			other:    mautrix.KeyBackupData{IsVerified: true, FirstMessageIndex: 2},
+			expected: false,
+		},
+		"LowerForwardedCountWins": {
+			data:     mautrix.KeyBackupData{FirstMessageIndex: 2, ForwardedCount: 0},
+			other:    mautrix.KeyBackupData{FirstMessageIndex: 2, ForwardedCount: 1},
+			expected: true,
+		},
+		"EqualIsNotBetter": {
+			data:     mautrix.KeyBackupData{IsVerified: true, FirstMessageIndex: 2, ForwardedCount: 1},
+			other:    mautrix.KeyBackupData{IsVerified: true, FirstMessageIndex: 2, ForwardedCount: 1},
+			expected: false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.data.IsBetterThan(&tt.other))
+		})
+	}
+}
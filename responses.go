@@ -3,6 +3,8 @@ package mautrix
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"reflect"
 	"strconv"
 	"strings"
@@ -16,8 +18,10 @@ import (
 
 // RespWhoami is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3accountwhoami
 type RespWhoami struct {
-	UserID   id.UserID   `json:"user_id"`
-	DeviceID id.DeviceID `json:"device_id"`
+	UserID id.UserID `json:"user_id"`
+	// DeviceID is not returned by older servers or for appservice users without a device.
+	DeviceID id.DeviceID `json:"device_id,omitempty"`
+	IsGuest  bool        `json:"is_guest,omitempty"`
 }
 
 // RespCreateFilter is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3useruseridfilter
@@ -30,6 +34,11 @@ type RespJoinRoom struct {
 	RoomID id.RoomID `json:"room_id"`
 }
 
+// RespKnockRoom is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3knockroomidoralias
+type RespKnockRoom struct {
+	RoomID id.RoomID `json:"room_id"`
+}
+
 // RespLeaveRoom is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidleave
 type RespLeaveRoom struct{}
 
@@ -54,9 +63,9 @@ type RespTyping struct{}
 // RespPresence is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3presenceuseridstatus
 type RespPresence struct {
 	Presence        event.Presence `json:"presence"`
-	LastActiveAgo   int            `json:"last_active_ago"`
-	StatusMsg       string         `json:"status_msg"`
-	CurrentlyActive bool           `json:"currently_active"`
+	LastActiveAgo   int            `json:"last_active_ago,omitempty"`
+	StatusMsg       string         `json:"status_msg,omitempty"`
+	CurrentlyActive bool           `json:"currently_active,omitempty"`
 }
 
 // RespJoinedRooms is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3joined_rooms
@@ -78,10 +87,17 @@ type JoinedMember struct {
 type RespMessages struct {
 	Start string         `json:"start"`
 	Chunk []*event.Event `json:"chunk"`
+	// State contains the member events of the senders in Chunk if lazy loading members was requested
+	// using the LazyLoadMembers field in the filter.
 	State []*event.Event `json:"state"`
 	End   string         `json:"end"`
 }
 
+// UpdateStateStore stores the lazy-loaded member events from the state block in the given state store.
+func (rm *RespMessages) UpdateStateStore(roomID id.RoomID, store MemberStateStore) {
+	storeLazyLoadedMembers(roomID, rm.State, store)
+}
+
 // RespContext is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3roomsroomidcontexteventid
 type RespContext struct {
 	End          string         `json:"end"`
@@ -92,6 +108,36 @@ type RespContext struct {
 	State        []*event.Event `json:"state"`
 }
 
+// UpdateStateStore stores the lazy-loaded member events from the state block in the given state store.
+func (rc *RespContext) UpdateStateStore(roomID id.RoomID, store MemberStateStore) {
+	storeLazyLoadedMembers(roomID, rc.State, store)
+}
+
+// MemberStateStore is the part of a state store that is needed for caching lazy-loaded room members.
+type MemberStateStore interface {
+	SetMember(roomID id.RoomID, userID id.UserID, member *event.MemberEventContent)
+}
+
+func storeLazyLoadedMembers(roomID id.RoomID, state []*event.Event, store MemberStateStore) {
+	for _, evt := range state {
+		if evt.Type != event.StateMember || evt.StateKey == nil {
+			continue
+		}
+		err := evt.Content.ParseRaw(evt.Type)
+		if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+			continue
+		}
+		store.SetMember(roomID, id.UserID(*evt.StateKey), evt.Content.AsMember())
+	}
+}
+
+// RespGetRelations is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+type RespGetRelations struct {
+	Chunk     []*event.Event `json:"chunk"`
+	NextBatch string         `json:"next_batch,omitempty"`
+	PrevBatch string         `json:"prev_batch,omitempty"`
+}
+
 // RespSendEvent is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidsendeventtypetxnid
 type RespSendEvent struct {
 	EventID id.EventID `json:"event_id"`
@@ -102,6 +148,28 @@ type RespMediaUpload struct {
 	ContentURI id.ContentURI `json:"content_uri"`
 }
 
+// RespDownloadMedia is the response of Client.DownloadMedia. The body must be closed by the caller.
+type RespDownloadMedia struct {
+	Body io.ReadCloser
+	// The Content-Type header of the response.
+	ContentType string
+	// The length of the body, or -1 if it's unknown.
+	ContentLength int64
+	// The file name from the Content-Disposition header, if the server sent one.
+	FileName string
+	// Whether the server returned only the requested byte range (HTTP 206). Servers that don't support range
+	// requests return the whole file instead, in which case this is false.
+	Partial bool
+	// The total size of the file from the Content-Range header of partial responses, or -1 if it's unknown.
+	TotalSize int64
+}
+
+// RespMediaConfig is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#get_matrixmediav3config
+type RespMediaConfig struct {
+	// The maximum size of an upload in bytes. Zero means the server didn't advertise a limit.
+	UploadSize int64 `json:"m.upload.size,omitempty"`
+}
+
 // RespCreateMXC is the JSON response for /_matrix/media/v3/create as specified in https://github.com/matrix-org/matrix-spec-proposals/pull/2246
 type RespCreateMXC struct {
 	ContentURI      id.ContentURI `json:"content_uri"`
@@ -149,6 +217,64 @@ func (r RespUserInteractive) HasSingleStageFlow(stageName AuthType) bool {
 	return false
 }
 
+// RespDeactivateAccount is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3accountdeactivate
+type RespDeactivateAccount struct {
+	// Either "success" or "no-support" depending on whether 3PIDs were unbound from the identity server.
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// IsCompleted returns true if the given stage has already been completed in this UIA session.
+func (r RespUserInteractive) IsCompleted(stage AuthType) bool {
+	for _, completed := range r.Completed {
+		if completed == string(stage) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextStage returns the first stage in the given flow that hasn't been completed yet.
+func (r RespUserInteractive) NextStage(flow UIAFlow) (AuthType, bool) {
+	for _, stage := range flow.Stages {
+		if !r.IsCompleted(stage) {
+			return stage, true
+		}
+	}
+	return "", false
+}
+
+// RespThreePIDs is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3account3pid
+type RespThreePIDs struct {
+	ThreePIDs []ThreePID `json:"threepids"`
+}
+
+type ThreePID struct {
+	Medium  ThreePIDMedium `json:"medium"`
+	Address string         `json:"address"`
+	// Unix timestamps in milliseconds
+	AddedAt     int64 `json:"added_at"`
+	ValidatedAt int64 `json:"validated_at"`
+}
+
+// RespRequestToken is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3pidemailrequesttoken
+type RespRequestToken struct {
+	SessionID string `json:"sid"`
+	// If set, the validation token must be submitted to this URL instead of the user clicking a link.
+	SubmitURL string `json:"submit_url,omitempty"`
+}
+
+// RespThreePIDUnbind is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3account3piddelete
+type RespThreePIDUnbind struct {
+	// Either "success" or "no-support" depending on whether the 3PID was unbound from the identity server.
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// RespUserProfile is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3profileuserid
+type RespUserProfile struct {
+	DisplayName string              `json:"displayname,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+}
+
 // RespUserDisplayName is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3profileuseriddisplayname
 type RespUserDisplayName struct {
 	DisplayName string `json:"displayname"`
@@ -169,6 +295,18 @@ type RespRegister struct {
 
 type LoginFlow struct {
 	Type AuthType `json:"type"`
+
+	// The identity providers available for m.login.sso flows.
+	IdentityProviders []IdentityProvider `json:"identity_providers,omitempty"`
+}
+
+// IdentityProvider is an identity provider in a m.login.sso login flow.
+// See https://spec.matrix.org/v1.3/client-server-api/#definition-mloginsso-identity-provider
+type IdentityProvider struct {
+	ID    string              `json:"id"`
+	Name  string              `json:"name"`
+	Icon  id.ContentURIString `json:"icon,omitempty"`
+	Brand string              `json:"brand,omitempty"`
 }
 
 // RespLoginFlows is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3login
@@ -197,6 +335,16 @@ type RespLogin struct {
 	DeviceID    id.DeviceID      `json:"device_id"`
 	UserID      id.UserID        `json:"user_id"`
 	WellKnown   *ClientWellKnown `json:"well_known,omitempty"`
+
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
+}
+
+// RespRefresh is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3refresh
+type RespRefresh struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 // RespLogout is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3logout
@@ -207,6 +355,11 @@ type RespCreateRoom struct {
 	RoomID id.RoomID `json:"room_id"`
 }
 
+// RespUpgradeRoom is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3roomsroomidupgrade
+type RespUpgradeRoom struct {
+	ReplacementRoom id.RoomID `json:"replacement_room"`
+}
+
 type RespMembers struct {
 	Chunk []*event.Event `json:"chunk"`
 }
@@ -237,6 +390,9 @@ type RespSync struct {
 
 	DeviceLists    DeviceLists `json:"device_lists"`
 	DeviceOTKCount OTKCount    `json:"device_one_time_keys_count"`
+	// The key algorithms for which the server has an unused fallback key.
+	// This is nil if the server doesn't support fallback keys.
+	DeviceUnusedFallbackKeyTypes []id.KeyAlgorithm `json:"device_unused_fallback_key_types,omitempty"`
 
 	Rooms RespSyncRooms `json:"rooms"`
 }
@@ -245,6 +401,7 @@ type RespSyncRooms struct {
 	Leave  map[id.RoomID]SyncLeftRoom    `json:"leave,omitempty"`
 	Join   map[id.RoomID]SyncJoinedRoom  `json:"join,omitempty"`
 	Invite map[id.RoomID]SyncInvitedRoom `json:"invite,omitempty"`
+	Knock  map[id.RoomID]SyncKnockedRoom `json:"knock,omitempty"`
 }
 
 type marshalableRespSync RespSync
@@ -270,14 +427,15 @@ type OTKCount struct {
 }
 
 type SyncLeftRoom struct {
-	Summary  LazyLoadSummary `json:"summary"`
-	State    SyncEventsList  `json:"state"`
-	Timeline SyncTimeline    `json:"timeline"`
+	Summary     LazyLoadSummary `json:"summary"`
+	State       SyncEventsList  `json:"state"`
+	Timeline    SyncTimeline    `json:"timeline"`
+	AccountData SyncEventsList  `json:"account_data"`
 }
 
 type marshalableSyncLeftRoom SyncLeftRoom
 
-var syncLeftRoomPathsToDelete = []string{"summary", "state", "timeline"}
+var syncLeftRoomPathsToDelete = []string{"summary", "state", "timeline", "account_data"}
 
 func (slr SyncLeftRoom) MarshalJSON() ([]byte, error) {
 	return util.MarshalAndDeleteEmpty((marshalableSyncLeftRoom)(slr), syncLeftRoomPathsToDelete)
@@ -291,6 +449,12 @@ type SyncJoinedRoom struct {
 	AccountData SyncEventsList  `json:"account_data"`
 
 	UnreadNotifications *UnreadNotificationCounts `json:"unread_notifications,omitempty"`
+	// UnreadThreadNotifications contains the notification counts of each thread in the room, keyed by thread root.
+	// They're only included if unread_thread_notifications is enabled in the sync filter.
+	// When unmarshaling, the unstable field is used as a fallback if the server doesn't send the stable one.
+	UnreadThreadNotifications map[id.EventID]*UnreadNotificationCounts `json:"unread_thread_notifications,omitempty"`
+	// https://github.com/matrix-org/matrix-spec-proposals/pull/3773
+	MSC3773UnreadThreadNotifications map[id.EventID]*UnreadNotificationCounts `json:"org.matrix.msc3773.unread_thread_notifications,omitempty"`
 	// https://github.com/matrix-org/matrix-spec-proposals/pull/2654
 	MSC2654UnreadCount *int `json:"org.matrix.msc2654.unread_count,omitempty"`
 }
@@ -308,6 +472,17 @@ func (sjr SyncJoinedRoom) MarshalJSON() ([]byte, error) {
 	return util.MarshalAndDeleteEmpty((marshalableSyncJoinedRoom)(sjr), syncJoinedRoomPathsToDelete)
 }
 
+func (sjr *SyncJoinedRoom) UnmarshalJSON(data []byte) error {
+	err := json.Unmarshal(data, (*marshalableSyncJoinedRoom)(sjr))
+	if err != nil {
+		return err
+	}
+	if sjr.UnreadThreadNotifications == nil {
+		sjr.UnreadThreadNotifications = sjr.MSC3773UnreadThreadNotifications
+	}
+	return nil
+}
+
 type SyncInvitedRoom struct {
 	Summary LazyLoadSummary `json:"summary"`
 	State   SyncEventsList  `json:"invite_state"`
@@ -321,6 +496,10 @@ func (sir SyncInvitedRoom) MarshalJSON() ([]byte, error) {
 	return util.MarshalAndDeleteEmpty((marshalableSyncInvitedRoom)(sir), syncInvitedRoomPathsToDelete)
 }
 
+type SyncKnockedRoom struct {
+	State SyncEventsList `json:"knock_state"`
+}
+
 type RespTurnServer struct {
 	Username string   `json:"username"`
 	Password string   `json:"password"`
@@ -366,6 +545,31 @@ type RespKeyChanges struct {
 
 type RespSendToDevice struct{}
 
+// RespRoomKeysVersion is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3room_keysversion
+type RespRoomKeysVersion struct {
+	Algorithm id.KeyBackupAlgorithm `json:"algorithm"`
+	AuthData  json.RawMessage       `json:"auth_data"`
+	Count     int                   `json:"count"`
+	ETag      string                `json:"etag"`
+	Version   string                `json:"version"`
+}
+
+// RespRoomKeysVersionCreate is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3room_keysversion
+type RespRoomKeysVersionCreate struct {
+	Version string `json:"version"`
+}
+
+// RespRoomKeys is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3room_keyskeys
+type RespRoomKeys struct {
+	Rooms map[id.RoomID]RoomKeyBackup `json:"rooms"`
+}
+
+// RespRoomKeysUpdate is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#put_matrixclientv3room_keyskeys
+type RespRoomKeysUpdate struct {
+	Count int    `json:"count"`
+	ETag  string `json:"etag"`
+}
+
 // RespDevicesInfo is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3devices
 type RespDevicesInfo struct {
 	Devices []RespDeviceInfo `json:"devices"`
@@ -379,6 +583,7 @@ type RespDeviceInfo struct {
 	LastSeenTS  int64       `json:"last_seen_ts"`
 }
 
+// RespBatchSend is the JSON response for https://github.com/matrix-org/matrix-spec-proposals/pull/2716
 type RespBatchSend struct {
 	StateEventIDs []id.EventID `json:"state_event_ids"`
 	EventIDs      []id.EventID `json:"event_ids"`
@@ -398,6 +603,8 @@ type RespCapabilities struct {
 	SetAvatarURL    *CapBooleanTrue  `json:"m.set_avatar_url,omitempty"`
 	ThreePIDChanges *CapBooleanTrue  `json:"m.3pid_changes,omitempty"`
 
+	// Capabilities that don't have a field in this struct. When unmarshaling, the values are stored as json.RawMessage,
+	// so unknown capabilities survive a round trip unchanged. Use GetCustom to parse them into a struct.
 	Custom map[string]interface{} `json:"-"`
 }
 
@@ -417,7 +624,8 @@ func (rc *RespCapabilities) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(data, &rc.Custom)
+	var rawCaps map[string]json.RawMessage
+	err = json.Unmarshal(data, &rawCaps)
 	if err != nil {
 		return err
 	}
@@ -425,12 +633,34 @@ func (rc *RespCapabilities) UnmarshalJSON(data []byte) error {
 	for _, field := range reflect.VisibleFields(reflect.TypeOf(rc).Elem()) {
 		jsonTag := strings.Split(field.Tag.Get("json"), ",")[0]
 		if jsonTag != "-" && jsonTag != "" {
-			delete(rc.Custom, jsonTag)
+			delete(rawCaps, jsonTag)
 		}
 	}
+	rc.Custom = make(map[string]interface{}, len(rawCaps))
+	for key, value := range rawCaps {
+		rc.Custom[key] = value
+	}
 	return nil
 }
 
+// GetCustom parses the custom capability with the given key into the given struct.
+// It returns false if the capability isn't present.
+func (rc *RespCapabilities) GetCustom(key string, into interface{}) (bool, error) {
+	value, ok := rc.Custom[key]
+	if !ok {
+		return false, nil
+	}
+	raw, ok := value.(json.RawMessage)
+	if !ok {
+		var err error
+		raw, err = json.Marshal(value)
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, json.Unmarshal(raw, into)
+}
+
 func (rc *RespCapabilities) MarshalJSON() ([]byte, error) {
 	marshalableCopy := make(map[string]interface{}, len(rc.Custom))
 	val := reflect.ValueOf(rc).Elem()
@@ -504,3 +734,84 @@ func (vers *CapRoomVersions) IsAvailable(version string) bool {
 	_, available := vers.Available[version]
 	return available
 }
+
+// RespSearch is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#post_matrixclientv3search
+type RespSearch struct {
+	SearchCategories RespSearchCategories `json:"search_categories"`
+}
+
+type RespSearchCategories struct {
+	RoomEvents RespSearchRoomEvents `json:"room_events"`
+}
+
+type RespSearchRoomEvents struct {
+	// An approximate count of the total number of results.
+	Count int `json:"count,omitempty"`
+	// Words that should be highlighted in the results, e.g. due to stemming.
+	Highlights []string       `json:"highlights"`
+	Results    []SearchResult `json:"results"`
+	// The token for getting the next page of results. Empty if there are no more results.
+	NextBatch string                                         `json:"next_batch,omitempty"`
+	Groups    map[SearchGroupKey]map[string]SearchGroupValue `json:"groups,omitempty"`
+	// The current state of the rooms that have results, if IncludeState was set in the request.
+	State map[id.RoomID][]*event.Event `json:"state,omitempty"`
+}
+
+type SearchResult struct {
+	Rank    float64              `json:"rank"`
+	Result  *event.Event         `json:"result"`
+	Context *SearchResultContext `json:"context,omitempty"`
+}
+
+type SearchResultContext struct {
+	Start        string                        `json:"start,omitempty"`
+	End          string                        `json:"end,omitempty"`
+	EventsBefore []*event.Event                `json:"events_before"`
+	EventsAfter  []*event.Event                `json:"events_after"`
+	ProfileInfo  map[id.UserID]RespUserProfile `json:"profile_info,omitempty"`
+}
+
+type SearchGroupValue struct {
+	NextBatch string       `json:"next_batch,omitempty"`
+	Order     int          `json:"order"`
+	Results   []id.EventID `json:"results"`
+}
+
+// RespPublicRooms is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3publicrooms
+type RespPublicRooms struct {
+	Chunk                  []PublicRoomInfo `json:"chunk"`
+	NextBatch              string           `json:"next_batch,omitempty"`
+	PrevBatch              string           `json:"prev_batch,omitempty"`
+	TotalRoomCountEstimate int              `json:"total_room_count_estimate,omitempty"`
+}
+
+type PublicRoomInfo struct {
+	RoomID           id.RoomID           `json:"room_id"`
+	Name             string              `json:"name,omitempty"`
+	Topic            string              `json:"topic,omitempty"`
+	CanonicalAlias   id.RoomAlias        `json:"canonical_alias,omitempty"`
+	AvatarURL        id.ContentURIString `json:"avatar_url,omitempty"`
+	NumJoinedMembers int                 `json:"num_joined_members"`
+	WorldReadable    bool                `json:"world_readable"`
+	GuestCanJoin     bool                `json:"guest_can_join"`
+	JoinRule         event.JoinRule      `json:"join_rule,omitempty"`
+	RoomType         event.RoomType      `json:"room_type,omitempty"`
+}
+
+// RespRoomDirectoryVisibility is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3directorylistroomroomid
+type RespRoomDirectoryVisibility struct {
+	Visibility RoomDirectoryVisibility `json:"visibility"`
+}
+
+// RespHierarchy is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv1roomsroomidhierarchy
+type RespHierarchy struct {
+	Rooms     []*HierarchyRoom `json:"rooms"`
+	NextBatch string           `json:"next_batch,omitempty"`
+}
+
+// HierarchyRoom is a room in a space hierarchy.
+type HierarchyRoom struct {
+	PublicRoomInfo
+	// The stripped m.space.child events of the room. Only spaces have children.
+	ChildrenState []*event.Event `json:"children_state"`
+}
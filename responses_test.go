@@ -16,6 +16,8 @@ import (
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 const sampleData = `{
@@ -101,6 +103,26 @@ func TestRespCapabilities_UnmarshalJSON(t *testing.T) {
 
 	assert.Contains(t, caps.Custom, "fi.mau.custom_field")
 	assert.NotContains(t, caps.Custom, "m.room_versions")
+
+	var customField map[string]bool
+	found, err := caps.GetCustom("fi.mau.custom_field", &customField)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, customField["🐈️"])
+	found, err = caps.GetCustom("fi.mau.missing_field", &customField)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestRespCapabilities_RoundTrip(t *testing.T) {
+	var caps mautrix.RespCapabilities
+	err := json.Unmarshal([]byte(sampleData), &caps)
+	require.NoError(t, err)
+	data, err := json.Marshal(&caps)
+	require.NoError(t, err)
+	marshaledString := string(canonicaljson.CanonicalJSONAssumeValid(data))
+	origString := string(canonicaljson.CanonicalJSONAssumeValid([]byte(sampleData)))
+	assert.Equal(t, origString, marshaledString)
 }
 
 func TestRespCapabilities_MarshalJSON(t *testing.T) {
@@ -111,3 +133,58 @@ func TestRespCapabilities_MarshalJSON(t *testing.T) {
 	assert.Equal(t, marshaledString, origString)
 	assert.Len(t, sampleObject.Custom, 1)
 }
+
+type memberMapStore map[id.UserID]*event.MemberEventContent
+
+func (mms memberMapStore) SetMember(_ id.RoomID, userID id.UserID, member *event.MemberEventContent) {
+	mms[userID] = member
+}
+
+const sampleMessagesData = `{
+  "start": "t47429-4392820_219380_26003_2265",
+  "end": "t47409-4357353_219380_26003_2265",
+  "chunk": [{
+    "type": "m.room.message",
+    "event_id": "$143273582443PhrSn:example.org",
+    "room_id": "!636q39766251:example.com",
+    "sender": "@example:example.org",
+    "origin_server_ts": 1432735824653,
+    "content": {"msgtype": "m.text", "body": "hello"}
+  }],
+  "state": [{
+    "type": "m.room.member",
+    "state_key": "@example:example.org",
+    "event_id": "$143273582443PhrSm:example.org",
+    "room_id": "!636q39766251:example.com",
+    "sender": "@example:example.org",
+    "origin_server_ts": 1432735824000,
+    "content": {"membership": "join", "displayname": "Example User"}
+  }]
+}`
+
+func TestRespMessages_UpdateStateStore(t *testing.T) {
+	var resp mautrix.RespMessages
+	err := json.Unmarshal([]byte(sampleMessagesData), &resp)
+	require.NoError(t, err)
+	store := make(memberMapStore)
+	resp.UpdateStateStore("!636q39766251:example.com", store)
+	require.Contains(t, store, id.UserID("@example:example.org"))
+	assert.Equal(t, event.MembershipJoin, store["@example:example.org"].Membership)
+	assert.Equal(t, "Example User", store["@example:example.org"].Displayname)
+}
+
+func TestSyncJoinedRoom_UnmarshalJSON_ThreadNotifications(t *testing.T) {
+	var unstableOnly mautrix.SyncJoinedRoom
+	err := json.Unmarshal([]byte(`{"org.matrix.msc3773.unread_thread_notifications": {"$root": {"highlight_count": 1, "notification_count": 2}}}`), &unstableOnly)
+	require.NoError(t, err)
+	require.Contains(t, unstableOnly.UnreadThreadNotifications, id.EventID("$root"))
+	assert.Equal(t, 2, unstableOnly.UnreadThreadNotifications["$root"].NotificationCount)
+
+	var both mautrix.SyncJoinedRoom
+	err = json.Unmarshal([]byte(`{
+		"unread_thread_notifications": {"$root": {"highlight_count": 0, "notification_count": 5}},
+		"org.matrix.msc3773.unread_thread_notifications": {"$root": {"highlight_count": 1, "notification_count": 2}}
+	}`), &both)
+	require.NoError(t, err)
+	assert.Equal(t, 5, both.UnreadThreadNotifications["$root"].NotificationCount)
+}
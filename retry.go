@@ -0,0 +1,109 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy configures how the Client retries failed HTTP requests.
+//
+// If Client.RetryPolicy is nil, requests with idempotent methods are retried Client.DefaultHTTPRetries times
+// with a base delay of 4 seconds. POST requests are only retried if a policy with RetryNonIdempotent is set.
+type RetryPolicy struct {
+	// The maximum number of attempts to make, including the first one. Values less than 1 are treated as 1.
+	MaxAttempts int
+	// The delay before the first retry. The delay is doubled after each retry.
+	BaseDelay time.Duration
+	// The maximum amount of random jitter to add to each delay.
+	Jitter time.Duration
+	// By default, only requests with idempotent methods (GET, HEAD, PUT, DELETE and OPTIONS) are retried.
+	// PUT endpoints in the client-server API either replace a value (e.g. state events and account data)
+	// or include a transaction ID (e.g. sending events), so repeating them doesn't have additional effects.
+	// Set this to true to retry POST requests too.
+	RetryNonIdempotent bool
+	// ShouldRetry decides whether a failed request should be retried. Exactly one of res and err is non-nil.
+	// If nil, DefaultShouldRetry is used. Rate limited requests are never retried if Client.IgnoreRateLimit is set.
+	ShouldRetry func(req *http.Request, res *http.Response, err error) bool
+}
+
+// DefaultShouldRetry retries requests that failed entirely (e.g. connection resets),
+// requests that returned a gateway error (502-504) and rate limited (HTTP 429) requests.
+// The latter are not retried if Client.IgnoreRateLimit is set.
+func DefaultShouldRetry(_ *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusBadGateway ||
+		res.StatusCode == http.StatusServiceUnavailable ||
+		res.StatusCode == http.StatusGatewayTimeout ||
+		res.StatusCode == http.StatusTooManyRequests
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cli *Client) getRetryPolicy() *RetryPolicy {
+	if cli.RetryPolicy != nil {
+		return cli.RetryPolicy
+	}
+	return &RetryPolicy{
+		MaxAttempts: 1 + cli.DefaultHTTPRetries,
+		BaseDelay:   4 * time.Second,
+		ShouldRetry: func(_ *http.Request, res *http.Response, err error) bool {
+			return err != nil || cli.shouldRetry(res)
+		},
+	}
+}
+
+func (policy *RetryPolicy) canRetry(req *http.Request, res *http.Response, err error, ignoreRateLimit bool) bool {
+	if !policy.RetryNonIdempotent && !isIdempotentMethod(req.Method) {
+		return false
+	} else if ignoreRateLimit && res != nil && res.StatusCode == http.StatusTooManyRequests {
+		return false
+	}
+	if policy.ShouldRetry != nil {
+		return policy.ShouldRetry(req, res, err)
+	}
+	return DefaultShouldRetry(req, res, err)
+}
+
+func (policy *RetryPolicy) addJitter(delay time.Duration) time.Duration {
+	if policy.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(policy.Jitter)))
+	}
+	return delay
+}
+
+// parseRetryAfterMSFromResponse extracts the retry_after_ms field from M_LIMIT_EXCEEDED error responses.
+// The response body is restored afterwards so that it can still be read by the caller.
+func parseRetryAfterMSFromResponse(res *http.Response) (time.Duration, bool) {
+	if res.Body == nil {
+		return 0, false
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return 0, false
+	}
+	var respErr RespError
+	if json.Unmarshal(body, &respErr) != nil || respErr.ErrCode != MLimitExceeded.ErrCode {
+		return 0, false
+	}
+	return respErr.RetryAfter()
+}
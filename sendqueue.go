@@ -0,0 +1,169 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// SendQueue serializes and paces outgoing events in each room. See Client.SendQueue.
+//
+// Events in the same room are sent one at a time in the order the send methods were called,
+// while events in different rooms are sent concurrently.
+type SendQueue struct {
+	// The minimum time between two events sent to the same room.
+	MinInterval time.Duration
+	// The maximum number of times to retry sending an event if the server responds with M_LIMIT_EXCEEDED.
+	MaxRateLimitRetries int
+	// The time to wait before retrying if a M_LIMIT_EXCEEDED error doesn't include retry_after_ms.
+	DefaultRetryAfter time.Duration
+
+	lock  sync.Mutex
+	rooms map[id.RoomID]*roomSendQueue
+}
+
+type roomSendQueue struct {
+	tail     chan struct{}
+	depth    int
+	lastSend time.Time
+}
+
+// NewSendQueue creates a send queue with the given minimum interval between events in the same room.
+func NewSendQueue(minInterval time.Duration) *SendQueue {
+	return &SendQueue{
+		MinInterval:         minInterval,
+		MaxRateLimitRetries: 5,
+		DefaultRetryAfter:   5 * time.Second,
+		rooms:               make(map[id.RoomID]*roomSendQueue),
+	}
+}
+
+// Depth returns the number of events that are waiting to be sent or being sent in the given room.
+func (sq *SendQueue) Depth(roomID id.RoomID) int {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	if room, ok := sq.rooms[roomID]; ok {
+		return room.depth
+	}
+	return 0
+}
+
+// TotalDepth returns the number of events that are waiting to be sent or being sent in all rooms.
+func (sq *SendQueue) TotalDepth() (depth int) {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	for _, room := range sq.rooms {
+		depth += room.depth
+	}
+	return
+}
+
+func (sq *SendQueue) enqueue(roomID id.RoomID) (room *roomSendQueue, prev, done chan struct{}) {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	if sq.rooms == nil {
+		sq.rooms = make(map[id.RoomID]*roomSendQueue)
+	}
+	room, ok := sq.rooms[roomID]
+	if !ok {
+		room = &roomSendQueue{}
+		sq.rooms[roomID] = room
+	}
+	prev = room.tail
+	done = make(chan struct{})
+	room.tail = done
+	room.depth++
+	return
+}
+
+func (sq *SendQueue) finish(roomID id.RoomID, room *roomSendQueue, done chan struct{}) {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	room.depth--
+	close(done)
+	if room.depth > 0 {
+		return
+	}
+	// Forget idle rooms, but only after the minimum interval has passed, so that the next event is still paced.
+	removeIfIdle := func() {
+		if room.depth == 0 && sq.rooms[roomID] == room {
+			delete(sq.rooms, roomID)
+		}
+	}
+	if sq.MinInterval <= 0 {
+		removeIfIdle()
+	} else {
+		time.AfterFunc(sq.MinInterval, func() {
+			sq.lock.Lock()
+			removeIfIdle()
+			sq.lock.Unlock()
+		})
+	}
+}
+
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run calls fn once it's the given room's turn to send an event. The error from fn is returned as-is,
+// unless it's a rate limit error, in which case fn is called again after the delay requested by the server.
+func (sq *SendQueue) Run(ctx context.Context, roomID id.RoomID, fn func() error) error {
+	room, prev, done := sq.enqueue(roomID)
+	if prev != nil {
+		select {
+		case <-prev:
+		case <-ctx.Done():
+			// Don't let events queued after this one skip ahead of the ones before it.
+			go func() {
+				<-prev
+				sq.finish(roomID, room, done)
+			}()
+			return ctx.Err()
+		}
+	}
+	defer sq.finish(roomID, room, done)
+	for attempt := 0; ; attempt++ {
+		sq.lock.Lock()
+		wait := sq.MinInterval - time.Since(room.lastSend)
+		sq.lock.Unlock()
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+		err := fn()
+		sq.lock.Lock()
+		room.lastSend = time.Now()
+		sq.lock.Unlock()
+
+		var httpErr HTTPError
+		if attempt >= sq.MaxRateLimitRetries || !errors.As(err, &httpErr) ||
+			httpErr.RespError == nil || httpErr.RespError.ErrCode != MLimitExceeded.ErrCode {
+			return err
+		}
+		retryAfter, ok := httpErr.RespError.RetryAfter()
+		if !ok {
+			retryAfter = sq.DefaultRetryAfter
+		}
+		if err = sleepContext(ctx, retryAfter); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/mautrixtest"
+)
+
+func TestSendQueue(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	var lock sync.Mutex
+	rateLimited := false
+	release := make(chan struct{})
+	hs.HandlePrefix(http.MethodPut, "/_matrix/client/v3/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		var content struct {
+			Body string `json:"body"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&content)
+		lock.Lock()
+		limit := content.Body == "limited" && !rateLimited
+		rateLimited = rateLimited || limit
+		lock.Unlock()
+		if content.Body == "first" {
+			<-release
+		} else if limit {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 10}`))
+			return
+		}
+		mautrixtest.WriteJSON(w, http.StatusOK, &mautrix.RespSendEvent{EventID: "$event"})
+	})
+	getReceived := func() []string {
+		var received []string
+		for _, req := range hs.Requests() {
+			var content struct {
+				Body string `json:"body"`
+			}
+			_ = json.Unmarshal(req.Body, &content)
+			received = append(received, content.Body)
+		}
+		return received
+	}
+
+	cli := hs.NewClient()
+	cli.SendQueue = mautrix.NewSendQueue(0)
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := cli.SendText("!room1:example.com", "first")
+		errs <- err
+	}()
+	require.Eventually(t, func() bool { return len(getReceived()) == 1 }, time.Second, time.Millisecond)
+	go func() {
+		_, err := cli.SendText("!room1:example.com", "second")
+		errs <- err
+	}()
+	require.Eventually(t, func() bool { return cli.SendQueue.Depth("!room1:example.com") == 2 }, time.Second, time.Millisecond)
+
+	// Other rooms aren't blocked by the busy room, and rate limited events are retried
+	_, err := cli.SendText("!room2:example.com", "limited")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first", "limited", "limited"}, getReceived())
+	assert.Equal(t, 2, cli.SendQueue.TotalDepth())
+
+	close(release)
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	assert.Equal(t, []string{"first", "limited", "limited", "second"}, getReceived())
+	assert.Equal(t, 0, cli.SendQueue.TotalDepth())
+}
@@ -0,0 +1,447 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MUnknownPos is returned by the sliding sync endpoint when the pos token has expired.
+// The session must be restarted without a pos token.
+var MUnknownPos = RespError{ErrCode: "M_UNKNOWN_POS"}
+
+// Sort orders for sliding sync lists.
+const (
+	SlidingSyncSortByRecency           = "by_recency"
+	SlidingSyncSortByName              = "by_name"
+	SlidingSyncSortByNotificationCount = "by_notification_count"
+)
+
+// SlidingSyncRoomSubscription contains the parameters for which data to return for rooms, either in a list or
+// in an explicit room subscription.
+type SlidingSyncRoomSubscription struct {
+	// Pairs of event type and state key to include in the room data. "*" can be used as a wildcard for either one.
+	RequiredState [][2]string `json:"required_state,omitempty"`
+	// The maximum number of timeline events to return per room.
+	TimelineLimit int `json:"timeline_limit,omitempty"`
+}
+
+// SlidingSyncFilters are the filters for a sliding sync list. Nil fields aren't filtered.
+type SlidingSyncFilters struct {
+	IsDM         *bool            `json:"is_dm,omitempty"`
+	IsEncrypted  *bool            `json:"is_encrypted,omitempty"`
+	IsInvite     *bool            `json:"is_invite,omitempty"`
+	RoomNameLike string           `json:"room_name_like,omitempty"`
+	RoomTypes    []event.RoomType `json:"room_types,omitempty"`
+}
+
+// SlidingSyncList is a list of rooms in a sliding sync request.
+type SlidingSyncList struct {
+	SlidingSyncRoomSubscription
+	// The index ranges (inclusive) of the list to return, e.g. [[0, 19]] for the first 20 rooms.
+	Ranges [][2]int `json:"ranges"`
+	// The sort order of the list. The first sort order is applied first, the following ones are tiebreakers.
+	Sort    []string            `json:"sort,omitempty"`
+	Filters *SlidingSyncFilters `json:"filters,omitempty"`
+}
+
+// ReqSlidingSync is the request body for the MSC3575 sliding sync endpoint.
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/3575
+type ReqSlidingSync struct {
+	TxnID             string                                     `json:"txn_id,omitempty"`
+	Lists             map[string]*SlidingSyncList                `json:"lists,omitempty"`
+	RoomSubscriptions map[id.RoomID]*SlidingSyncRoomSubscription `json:"room_subscriptions,omitempty"`
+	UnsubscribeRooms  []id.RoomID                                `json:"unsubscribe_rooms,omitempty"`
+	Extensions        map[string]interface{}                     `json:"extensions,omitempty"`
+}
+
+// SlidingSyncOpType is the type of an operation on a sliding sync list.
+type SlidingSyncOpType string
+
+const (
+	// SlidingSyncOpSync replaces the rooms in the given range.
+	SlidingSyncOpSync SlidingSyncOpType = "SYNC"
+	// SlidingSyncOpInsert inserts a room at the given index, shifting the following rooms down.
+	SlidingSyncOpInsert SlidingSyncOpType = "INSERT"
+	// SlidingSyncOpDelete removes the room at the given index, shifting the following rooms up.
+	SlidingSyncOpDelete SlidingSyncOpType = "DELETE"
+	// SlidingSyncOpInvalidate forgets the rooms in the given range, e.g. because it's no longer in the requested ranges.
+	SlidingSyncOpInvalidate SlidingSyncOpType = "INVALIDATE"
+)
+
+// SlidingSyncOp is an operation on a sliding sync list.
+type SlidingSyncOp struct {
+	Op SlidingSyncOpType `json:"op"`
+	// The inclusive index range for SYNC and INVALIDATE.
+	Range *[2]int `json:"range,omitempty"`
+	// The index for INSERT and DELETE.
+	Index *int `json:"index,omitempty"`
+	// The rooms for SYNC.
+	RoomIDs []id.RoomID `json:"room_ids,omitempty"`
+	// The room for INSERT.
+	RoomID id.RoomID `json:"room_id,omitempty"`
+}
+
+// SlidingSyncListResponse contains the changes to a sliding sync list.
+type SlidingSyncListResponse struct {
+	// The total number of rooms in the list, including ones outside the requested ranges.
+	Count int             `json:"count"`
+	Ops   []SlidingSyncOp `json:"ops,omitempty"`
+}
+
+// SlidingSyncRoom contains the changes to a room in a sliding sync response.
+type SlidingSyncRoom struct {
+	Name          string         `json:"name,omitempty"`
+	RequiredState []*event.Event `json:"required_state,omitempty"`
+	Timeline      []*event.Event `json:"timeline,omitempty"`
+	InviteState   []*event.Event `json:"invite_state,omitempty"`
+	PrevBatch     string         `json:"prev_batch,omitempty"`
+	Limited       bool           `json:"limited,omitempty"`
+	// Whether this is the first time the room is sent in this session, i.e. whether the data replaces everything
+	// that was previously known about the room.
+	Initial bool `json:"initial,omitempty"`
+	IsDM    bool `json:"is_dm,omitempty"`
+
+	NotificationCount int `json:"notification_count"`
+	HighlightCount    int `json:"highlight_count"`
+	JoinedCount       int `json:"joined_count,omitempty"`
+	InvitedCount      int `json:"invited_count,omitempty"`
+}
+
+// RespSlidingSync is the response of the MSC3575 sliding sync endpoint.
+type RespSlidingSync struct {
+	Pos        string                              `json:"pos"`
+	TxnID      string                              `json:"txn_id,omitempty"`
+	Lists      map[string]*SlidingSyncListResponse `json:"lists,omitempty"`
+	Rooms      map[id.RoomID]*SlidingSyncRoom      `json:"rooms,omitempty"`
+	Extensions map[string]json.RawMessage          `json:"extensions,omitempty"`
+}
+
+func parseSlidingSyncEvents(roomID id.RoomID, events []*event.Event) {
+	for _, evt := range events {
+		evt.RoomID = roomID
+		_ = parseFetchedEvent(evt)
+	}
+}
+
+// SlidingSyncRequest makes a single request to the MSC3575 sliding sync endpoint.
+//
+// The pos parameter is the pos token from the previous response, or an empty string to start a new session.
+// The timeout is in milliseconds.
+func (cli *Client) SlidingSyncRequest(ctx context.Context, pos string, timeout int, req *ReqSlidingSync) (resp *RespSlidingSync, err error) {
+	query := map[string]string{}
+	if pos != "" {
+		query["pos"] = pos
+		query["timeout"] = strconv.Itoa(timeout)
+	}
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"unstable", "org.matrix.msc3575", "sync"}, query)
+	_, err = cli.MakeFullRequest(FullRequest{
+		Method:       http.MethodPost,
+		URL:          urlPath,
+		RequestJSON:  req,
+		ResponseJSON: &resp,
+		Context:      ctx,
+		// Like FullSyncRequest, retries are handled by the SlidingSync loop
+		MaxAttempts: 1,
+	})
+	if err == nil && resp != nil {
+		for roomID, room := range resp.Rooms {
+			parseSlidingSyncEvents(roomID, room.RequiredState)
+			parseSlidingSyncEvents(roomID, room.Timeline)
+			parseSlidingSyncEvents(roomID, room.InviteState)
+		}
+	}
+	return
+}
+
+// SlidingSyncer is the sliding sync equivalent of Syncer. See Client.SlidingSync.
+type SlidingSyncer interface {
+	// GetSlidingSyncRequest returns the request body for the next sliding sync request.
+	GetSlidingSyncRequest() *ReqSlidingSync
+	// ProcessSlidingSyncResponse processes a sliding sync response. The pos parameter is the pos token that was used
+	// to produce the response (empty for the first response of a session). If an error is returned, syncing is stopped.
+	ProcessSlidingSyncResponse(resp *RespSlidingSync, pos string) error
+	// OnFailedSlidingSync returns either the time to wait before retrying or an error to stop syncing permanently.
+	// If the error is MUnknownPos, the session is restarted from scratch, so all list state should be reset.
+	OnFailedSlidingSync(err error) (time.Duration, error)
+}
+
+// SlidingSync starts syncing with the MSC3575 sliding sync endpoint until the context is cancelled or the syncer
+// returns an error. It's an alternative to Sync and doesn't use Client.Syncer or Client.Store.
+//
+// The pos token is only kept in memory, as the list state in the syncer has to match it. If the context is
+// cancelled, ctx.Err() is returned.
+func (cli *Client) SlidingSync(ctx context.Context, syncer SlidingSyncer) error {
+	var pos string
+	for {
+		resp, err := cli.SlidingSyncRequest(ctx, pos, 30000, syncer.GetSlidingSyncRequest())
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, MUnknownPos) {
+				pos = ""
+			}
+			duration, err2 := syncer.OnFailedSlidingSync(err)
+			if err2 != nil {
+				return err2
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(duration):
+				continue
+			}
+		}
+		if cli.StateStore != nil {
+			for roomID, room := range resp.Rooms {
+				updateStateStoreFromList(cli.StateStore, roomID, room.RequiredState)
+				updateStateStoreFromList(cli.StateStore, roomID, room.Timeline)
+			}
+		}
+		if err = syncer.ProcessSlidingSyncResponse(resp, pos); err != nil {
+			return err
+		}
+		pos = resp.Pos
+	}
+}
+
+// ErrInvalidSlidingSyncOp is returned by SlidingSyncListState.Apply if an operation is missing required fields.
+var ErrInvalidSlidingSyncOp = errors.New("invalid sliding sync list operation")
+
+// SlidingSyncListState is the client-side copy of the ordered room list of a sliding sync list.
+type SlidingSyncListState struct {
+	// The total number of rooms in the list.
+	Count int
+	// The rooms in the list. The length always matches Count. Positions that haven't been synced
+	// (or have been invalidated) contain an empty room ID.
+	Rooms []id.RoomID
+}
+
+func (state *SlidingSyncListState) ensureLength(length int) {
+	for len(state.Rooms) < length {
+		state.Rooms = append(state.Rooms, "")
+	}
+}
+
+// Apply applies the operations in the given list response to the room list.
+func (state *SlidingSyncListState) Apply(resp *SlidingSyncListResponse) error {
+	for _, op := range resp.Ops {
+		switch op.Op {
+		case SlidingSyncOpSync, SlidingSyncOpInvalidate:
+			if op.Range == nil || op.Range[0] < 0 || op.Range[1] < op.Range[0] {
+				return fmt.Errorf("%w: %s without valid range", ErrInvalidSlidingSyncOp, op.Op)
+			}
+			state.ensureLength(op.Range[1] + 1)
+			for i := op.Range[0]; i <= op.Range[1]; i++ {
+				if op.Op == SlidingSyncOpSync && i-op.Range[0] < len(op.RoomIDs) {
+					state.Rooms[i] = op.RoomIDs[i-op.Range[0]]
+				} else {
+					state.Rooms[i] = ""
+				}
+			}
+		case SlidingSyncOpDelete:
+			if op.Index == nil || *op.Index < 0 {
+				return fmt.Errorf("%w: %s without valid index", ErrInvalidSlidingSyncOp, op.Op)
+			}
+			if *op.Index < len(state.Rooms) {
+				state.Rooms = append(state.Rooms[:*op.Index], state.Rooms[*op.Index+1:]...)
+			}
+		case SlidingSyncOpInsert:
+			if op.Index == nil || *op.Index < 0 {
+				return fmt.Errorf("%w: %s without valid index", ErrInvalidSlidingSyncOp, op.Op)
+			}
+			state.ensureLength(*op.Index)
+			state.Rooms = append(state.Rooms, "")
+			copy(state.Rooms[*op.Index+1:], state.Rooms[*op.Index:])
+			state.Rooms[*op.Index] = op.RoomID
+		default:
+			return fmt.Errorf("%w: unknown op %s", ErrInvalidSlidingSyncOp, op.Op)
+		}
+	}
+	state.Count = resp.Count
+	state.ensureLength(resp.Count)
+	state.Rooms = state.Rooms[:resp.Count]
+	return nil
+}
+
+// SlidingSyncRoomHandler is called for each room in a sliding sync response.
+type SlidingSyncRoomHandler func(roomID id.RoomID, room *SlidingSyncRoom)
+
+// SlidingSyncListHandler is called when a sliding sync list changes. The rooms slice must not be modified.
+type SlidingSyncListHandler func(name string, rooms []id.RoomID)
+
+// DefaultSlidingSyncer is the default SlidingSyncer implementation. It keeps track of the requested lists and room
+// subscriptions, maintains the ordered room lists and calls handlers for list changes and room updates.
+type DefaultSlidingSyncer struct {
+	// The time to wait before retrying after a failed request. Expired pos tokens are retried immediately.
+	RetryDelay time.Duration
+
+	lists         map[string]*SlidingSyncList
+	subscriptions map[id.RoomID]*SlidingSyncRoomSubscription
+	unsubscribe   map[id.RoomID]struct{}
+	listStates    map[string]*SlidingSyncListState
+	roomHandlers  []SlidingSyncRoomHandler
+	listHandlers  []SlidingSyncListHandler
+	lock          sync.RWMutex
+}
+
+var _ SlidingSyncer = (*DefaultSlidingSyncer)(nil)
+
+// NewDefaultSlidingSyncer creates a new DefaultSlidingSyncer without any lists or room subscriptions.
+func NewDefaultSlidingSyncer() *DefaultSlidingSyncer {
+	return &DefaultSlidingSyncer{
+		RetryDelay:    10 * time.Second,
+		lists:         make(map[string]*SlidingSyncList),
+		subscriptions: make(map[id.RoomID]*SlidingSyncRoomSubscription),
+		unsubscribe:   make(map[id.RoomID]struct{}),
+		listStates:    make(map[string]*SlidingSyncListState),
+	}
+}
+
+// SetList adds or replaces a list. The change is sent in the next request.
+func (s *DefaultSlidingSyncer) SetList(name string, list *SlidingSyncList) {
+	s.lock.Lock()
+	s.lists[name] = list
+	s.lock.Unlock()
+}
+
+// RemoveList removes a list and forgets its room list.
+func (s *DefaultSlidingSyncer) RemoveList(name string) {
+	s.lock.Lock()
+	delete(s.lists, name)
+	delete(s.listStates, name)
+	s.lock.Unlock()
+}
+
+// Subscribe adds a subscription to a room, so that the room is always included in responses.
+func (s *DefaultSlidingSyncer) Subscribe(roomID id.RoomID, sub *SlidingSyncRoomSubscription) {
+	s.lock.Lock()
+	s.subscriptions[roomID] = sub
+	delete(s.unsubscribe, roomID)
+	s.lock.Unlock()
+}
+
+// Unsubscribe removes a room subscription.
+func (s *DefaultSlidingSyncer) Unsubscribe(roomID id.RoomID) {
+	s.lock.Lock()
+	if _, ok := s.subscriptions[roomID]; ok {
+		delete(s.subscriptions, roomID)
+		s.unsubscribe[roomID] = struct{}{}
+	}
+	s.lock.Unlock()
+}
+
+// OnRoomUpdate adds a handler that is called for each room in each response.
+func (s *DefaultSlidingSyncer) OnRoomUpdate(handler SlidingSyncRoomHandler) {
+	s.lock.Lock()
+	s.roomHandlers = append(s.roomHandlers, handler)
+	s.lock.Unlock()
+}
+
+// OnListUpdate adds a handler that is called whenever a list changes.
+func (s *DefaultSlidingSyncer) OnListUpdate(handler SlidingSyncListHandler) {
+	s.lock.Lock()
+	s.listHandlers = append(s.listHandlers, handler)
+	s.lock.Unlock()
+}
+
+// GetListRooms returns a copy of the current room list of the given list. See SlidingSyncListState.Rooms.
+func (s *DefaultSlidingSyncer) GetListRooms(name string) []id.RoomID {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	state, ok := s.listStates[name]
+	if !ok {
+		return nil
+	}
+	rooms := make([]id.RoomID, len(state.Rooms))
+	copy(rooms, state.Rooms)
+	return rooms
+}
+
+// GetSlidingSyncRequest implements SlidingSyncer.
+func (s *DefaultSlidingSyncer) GetSlidingSyncRequest() *ReqSlidingSync {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	req := &ReqSlidingSync{
+		Lists:             make(map[string]*SlidingSyncList, len(s.lists)),
+		RoomSubscriptions: make(map[id.RoomID]*SlidingSyncRoomSubscription, len(s.subscriptions)),
+	}
+	for name, list := range s.lists {
+		req.Lists[name] = list
+	}
+	for roomID, sub := range s.subscriptions {
+		req.RoomSubscriptions[roomID] = sub
+	}
+	for roomID := range s.unsubscribe {
+		req.UnsubscribeRooms = append(req.UnsubscribeRooms, roomID)
+	}
+	return req
+}
+
+// ProcessSlidingSyncResponse implements SlidingSyncer.
+func (s *DefaultSlidingSyncer) ProcessSlidingSyncResponse(resp *RespSlidingSync, _ string) error {
+	s.lock.Lock()
+	// The unsubscriptions have been sent now
+	s.unsubscribe = make(map[id.RoomID]struct{})
+	changedLists := make(map[string][]id.RoomID, len(resp.Lists))
+	for name, listResp := range resp.Lists {
+		state, ok := s.listStates[name]
+		if !ok {
+			state = &SlidingSyncListState{}
+			s.listStates[name] = state
+		}
+		if err := state.Apply(listResp); err != nil {
+			s.lock.Unlock()
+			return fmt.Errorf("failed to update list %s: %w", name, err)
+		}
+		changedLists[name] = state.Rooms
+	}
+	listHandlers := s.listHandlers
+	roomHandlers := s.roomHandlers
+	s.lock.Unlock()
+
+	for name, rooms := range changedLists {
+		for _, handler := range listHandlers {
+			handler(name, rooms)
+		}
+	}
+	roomIDs := make([]id.RoomID, 0, len(resp.Rooms))
+	for roomID := range resp.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	for _, roomID := range sortRoomIDs(roomIDs) {
+		for _, handler := range roomHandlers {
+			handler(roomID, resp.Rooms[roomID])
+		}
+	}
+	return nil
+}
+
+// OnFailedSlidingSync implements SlidingSyncer. If the pos token has expired, the room lists are reset and
+// the request is retried immediately. Otherwise, the request is retried after RetryDelay.
+func (s *DefaultSlidingSyncer) OnFailedSlidingSync(err error) (time.Duration, error) {
+	if errors.Is(err, MUnknownToken) {
+		return 0, err
+	} else if errors.Is(err, MUnknownPos) {
+		s.lock.Lock()
+		s.listStates = make(map[string]*SlidingSyncListState)
+		s.lock.Unlock()
+		return 0, nil
+	}
+	return s.RetryDelay, nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/mautrixtest"
+)
+
+func applyListOps(t *testing.T, state *mautrix.SlidingSyncListState, data string) {
+	var resp mautrix.SlidingSyncListResponse
+	require.NoError(t, json.Unmarshal([]byte(data), &resp))
+	require.NoError(t, state.Apply(&resp))
+}
+
+func TestSlidingSyncListState_Apply(t *testing.T) {
+	var state mautrix.SlidingSyncListState
+	applyListOps(t, &state, `{"count":5,"ops":[{"op":"SYNC","range":[0,2],"room_ids":["!a","!b","!c"]}]}`)
+	assert.Equal(t, []id.RoomID{"!a", "!b", "!c", "", ""}, state.Rooms)
+
+	// !c moves to the top
+	applyListOps(t, &state, `{"count":5,"ops":[{"op":"DELETE","index":2},{"op":"INSERT","index":0,"room_id":"!c"}]}`)
+	assert.Equal(t, []id.RoomID{"!c", "!a", "!b", "", ""}, state.Rooms)
+
+	// A new room is added and one is removed from the end
+	applyListOps(t, &state, `{"count":5,"ops":[{"op":"DELETE","index":4},{"op":"INSERT","index":1,"room_id":"!d"}]}`)
+	assert.Equal(t, []id.RoomID{"!c", "!d", "!a", "!b", ""}, state.Rooms)
+
+	applyListOps(t, &state, `{"count":4,"ops":[{"op":"INVALIDATE","range":[2,3]}]}`)
+	assert.Equal(t, []id.RoomID{"!c", "!d", "", ""}, state.Rooms)
+
+	var resp mautrix.SlidingSyncListResponse
+	require.NoError(t, json.Unmarshal([]byte(`{"count":4,"ops":[{"op":"DELETE"}]}`), &resp))
+	assert.ErrorIs(t, state.Apply(&resp), mautrix.ErrInvalidSlidingSyncOp)
+}
+
+func TestClient_SlidingSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	const syncPath = "/_matrix/client/unstable/org.matrix.msc3575/sync"
+	hs.Handle(http.MethodPost, syncPath, func(w http.ResponseWriter, r *http.Request) {
+		switch len(hs.RequestsTo(http.MethodPost, syncPath)) {
+		case 1:
+			_, _ = w.Write([]byte(`{"pos":"1","lists":{"all":{"count":2,"ops":[{"op":"SYNC","range":[0,1],"room_ids":["!a:example.com","!b:example.com"]}]}},
+				"rooms":{"!a:example.com":{"name":"A","initial":true,"timeline":[{"type":"m.room.message","sender":"@user:example.com","event_id":"$1","content":{"msgtype":"m.text","body":"hi"}}]}}}`))
+		case 2:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN_POS","error":"Unknown pos"}`))
+		default:
+			cancel()
+			_, _ = w.Write([]byte(`{"pos":"2"}`))
+		}
+	})
+
+	cli := hs.NewClient()
+	syncer := mautrix.NewDefaultSlidingSyncer()
+	syncer.SetList("all", &mautrix.SlidingSyncList{
+		Ranges: [][2]int{{0, 19}},
+		Sort:   []string{mautrix.SlidingSyncSortByRecency},
+	})
+	syncer.Subscribe("!sub:example.com", &mautrix.SlidingSyncRoomSubscription{TimelineLimit: 1})
+	var updatedRooms []id.RoomID
+	var listRooms []id.RoomID
+	syncer.OnRoomUpdate(func(roomID id.RoomID, room *mautrix.SlidingSyncRoom) {
+		updatedRooms = append(updatedRooms, roomID)
+		assert.Equal(t, "hi", room.Timeline[0].Content.AsMessage().Body)
+	})
+	syncer.OnListUpdate(func(name string, rooms []id.RoomID) {
+		listRooms = append([]id.RoomID{}, rooms...)
+	})
+
+	err := cli.SlidingSync(ctx, syncer)
+	assert.ErrorIs(t, err, context.Canceled)
+	var requests []mautrix.ReqSlidingSync
+	var positions []string
+	for _, httpReq := range hs.RequestsTo(http.MethodPost, syncPath) {
+		var req mautrix.ReqSlidingSync
+		require.NoError(t, json.Unmarshal(httpReq.Body, &req))
+		requests = append(requests, req)
+		positions = append(positions, httpReq.Query.Get("pos"))
+	}
+	require.Len(t, requests, 3)
+	assert.Equal(t, []string{"", "1", ""}, positions, "expired pos should restart the session")
+	assert.Equal(t, [][2]int{{0, 19}}, requests[0].Lists["all"].Ranges)
+	assert.Contains(t, requests[0].RoomSubscriptions, id.RoomID("!sub:example.com"))
+	assert.Equal(t, []id.RoomID{"!a:example.com"}, updatedRooms)
+	assert.Equal(t, []id.RoomID{"!a:example.com", "!b:example.com"}, listRooms)
+	assert.Empty(t, syncer.GetListRooms("all"), "list state should be reset after the pos expired")
+}
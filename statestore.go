@@ -0,0 +1,423 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// StateStore is an interface for storing basic room state information.
+//
+// If Client.StateStore is set, member, power level and encryption events from sync responses are stored automatically.
+// Implementations also satisfy the StateStore interface of the crypto module, so the same store can be used
+// for finding the members and encryption settings of rooms when encrypting.
+type StateStore interface {
+	IsInRoom(roomID id.RoomID, userID id.UserID) bool
+	IsInvited(roomID id.RoomID, userID id.UserID) bool
+	IsMembership(roomID id.RoomID, userID id.UserID, allowedMemberships ...event.Membership) bool
+	GetMember(roomID id.RoomID, userID id.UserID) *event.MemberEventContent
+	TryGetMember(roomID id.RoomID, userID id.UserID) (*event.MemberEventContent, bool)
+	SetMembership(roomID id.RoomID, userID id.UserID, membership event.Membership)
+	SetMember(roomID id.RoomID, userID id.UserID, member *event.MemberEventContent)
+	// GetRoomJoinedOrInvitedMembers returns the users who are joined to or invited to the given room.
+	GetRoomJoinedOrInvitedMembers(roomID id.RoomID) []id.UserID
+
+	SetPowerLevels(roomID id.RoomID, levels *event.PowerLevelsEventContent)
+	GetPowerLevels(roomID id.RoomID) *event.PowerLevelsEventContent
+
+	SetEncryptionEvent(roomID id.RoomID, content *event.EncryptionEventContent)
+	GetEncryptionEvent(roomID id.RoomID) *event.EncryptionEventContent
+	IsEncrypted(roomID id.RoomID) bool
+	// FindSharedRooms returns the encrypted rooms that the given user is joined to or invited to.
+	FindSharedRooms(userID id.UserID) []id.RoomID
+}
+
+// RoomUpgradeStateStore is an optional extension to StateStore for storing the m.room.create and m.room.tombstone
+// events of rooms, which are used for following room upgrades (see Client.GetRoomPredecessor and Client.GetRoomSuccessor).
+type RoomUpgradeStateStore interface {
+	SetCreateEvent(roomID id.RoomID, content *event.CreateEventContent)
+	GetCreateEvent(roomID id.RoomID) *event.CreateEventContent
+	SetTombstone(roomID id.RoomID, content *event.TombstoneEventContent)
+	GetTombstone(roomID id.RoomID) *event.TombstoneEventContent
+}
+
+// UpdateStateStore stores the given state event in the state store if it's a member, power level or encryption event.
+// Create and tombstone events are also stored if the store implements RoomUpgradeStateStore.
+//
+// The event content is not mutated, so this is safe to call before the event is passed to the Syncer.
+func UpdateStateStore(store StateStore, roomID id.RoomID, evt *event.Event) {
+	if evt.StateKey == nil {
+		return
+	}
+	switch evt.Type.Type {
+	case event.StateMember.Type:
+		member, ok := evt.Content.Parsed.(*event.MemberEventContent)
+		if !ok {
+			member = &event.MemberEventContent{}
+			if json.Unmarshal(evt.Content.VeryRaw, member) != nil {
+				return
+			}
+		}
+		store.SetMember(roomID, id.UserID(*evt.StateKey), member)
+	case event.StatePowerLevels.Type:
+		levels, ok := evt.Content.Parsed.(*event.PowerLevelsEventContent)
+		if !ok {
+			levels = &event.PowerLevelsEventContent{}
+			if json.Unmarshal(evt.Content.VeryRaw, levels) != nil {
+				return
+			}
+		}
+		store.SetPowerLevels(roomID, levels)
+	case event.StateEncryption.Type:
+		encryption, ok := evt.Content.Parsed.(*event.EncryptionEventContent)
+		if !ok {
+			encryption = &event.EncryptionEventContent{}
+			if json.Unmarshal(evt.Content.VeryRaw, encryption) != nil {
+				return
+			}
+		}
+		store.SetEncryptionEvent(roomID, encryption)
+	case event.StateCreate.Type:
+		upgradeStore, ok := store.(RoomUpgradeStateStore)
+		if !ok {
+			return
+		}
+		create, ok := evt.Content.Parsed.(*event.CreateEventContent)
+		if !ok {
+			create = &event.CreateEventContent{}
+			if json.Unmarshal(evt.Content.VeryRaw, create) != nil {
+				return
+			}
+		}
+		upgradeStore.SetCreateEvent(roomID, create)
+	case event.StateTombstone.Type:
+		upgradeStore, ok := store.(RoomUpgradeStateStore)
+		if !ok {
+			return
+		}
+		tombstone, ok := evt.Content.Parsed.(*event.TombstoneEventContent)
+		if !ok {
+			tombstone = &event.TombstoneEventContent{}
+			if json.Unmarshal(evt.Content.VeryRaw, tombstone) != nil {
+				return
+			}
+		}
+		upgradeStore.SetTombstone(roomID, tombstone)
+	}
+}
+
+func updateStateStoreFromList(store StateStore, roomID id.RoomID, events []*event.Event) {
+	for _, evt := range events {
+		UpdateStateStore(store, roomID, evt)
+	}
+}
+
+// UpdateStateStoreFromSync stores all the relevant state events in the given sync response in the state store.
+func UpdateStateStoreFromSync(store StateStore, resp *RespSync) {
+	for roomID, room := range resp.Rooms.Join {
+		updateStateStoreFromList(store, roomID, room.State.Events)
+		updateStateStoreFromList(store, roomID, room.Timeline.Events)
+	}
+	for roomID, room := range resp.Rooms.Leave {
+		updateStateStoreFromList(store, roomID, room.State.Events)
+		updateStateStoreFromList(store, roomID, room.Timeline.Events)
+	}
+}
+
+// GetPowerLevel returns the power level of the given user in the given room using the power levels cached in the store.
+// Missing users get the users_default level. If the power levels aren't cached, 0 is returned.
+func GetPowerLevel(store StateStore, roomID id.RoomID, userID id.UserID) int {
+	levels := store.GetPowerLevels(roomID)
+	if levels == nil {
+		return 0
+	}
+	return levels.GetUserLevel(userID)
+}
+
+// GetEventSendLevel returns the power level required to send the given event type in the given room.
+// Event types that aren't listed use the state_default or events_default level.
+// If the power levels aren't cached, 0 is returned, as specified for rooms without a power level event.
+func GetEventSendLevel(store StateStore, roomID id.RoomID, eventType event.Type) int {
+	levels := store.GetPowerLevels(roomID)
+	if levels == nil {
+		return 0
+	}
+	return levels.GetEventLevel(eventType)
+}
+
+// HasPowerLevel checks whether the given user has at least the given power level in the given room.
+func HasPowerLevel(store StateStore, roomID id.RoomID, userID id.UserID, minLevel int) bool {
+	return GetPowerLevel(store, roomID, userID) >= minLevel
+}
+
+// CanSend checks whether the given user has a high enough power level to send the given event type in the given room.
+func CanSend(store StateStore, roomID id.RoomID, userID id.UserID, eventType event.Type) bool {
+	return HasPowerLevel(store, roomID, userID, GetEventSendLevel(store, roomID, eventType))
+}
+
+// ErrInsufficientPowerLevel is returned (wrapped in an InsufficientPowerLevelError) when sending an event is rejected
+// locally based on the cached power levels. See Client.CheckPowerLevelsBeforeSending.
+// Errors from the server rejecting an event with M_FORBIDDEN (SendForbiddenError) also match it
+// if the error message says that the rejection was caused by power levels.
+var ErrInsufficientPowerLevel = errors.New("insufficient power level")
+
+// ErrSendForbidden is matched by all SendForbiddenErrors, regardless of why the server rejected the event.
+var ErrSendForbidden = errors.New("server rejected event")
+
+// InsufficientPowerLevelError contains the details of a local power level check failure.
+type InsufficientPowerLevelError struct {
+	RoomID    id.RoomID
+	UserID    id.UserID
+	EventType event.Type
+	Required  int
+	Actual    int
+}
+
+func (err InsufficientPowerLevelError) Error() string {
+	return fmt.Sprintf("%v: %s needs power level %d to send %s in %s, but only has %d",
+		ErrInsufficientPowerLevel, err.UserID, err.Required, err.EventType.Type, err.RoomID, err.Actual)
+}
+
+func (err InsufficientPowerLevelError) Unwrap() error {
+	return ErrInsufficientPowerLevel
+}
+
+// SendForbiddenError is returned by the event sending methods when the server rejects the event with M_FORBIDDEN.
+//
+// The error always matches ErrSendForbidden and MForbidden with errors.Is. Servers use the same error code for
+// other reasons too (e.g. the user not being in the room), so it only matches ErrInsufficientPowerLevel if the
+// error message from the server mentions power levels.
+type SendForbiddenError struct {
+	RoomID    id.RoomID
+	EventType event.Type
+	Err       error
+}
+
+func (err SendForbiddenError) Error() string {
+	return fmt.Sprintf("server rejected %s event in %s: %v", err.EventType.Type, err.RoomID, err.Err)
+}
+
+func (err SendForbiddenError) Is(target error) bool {
+	return target == ErrSendForbidden || (target == ErrInsufficientPowerLevel && err.IsPowerLevelError())
+}
+
+// IsPowerLevelError checks whether the error message from the server says that the event was rejected
+// because the user's power level is too low.
+func (err SendForbiddenError) IsPowerLevelError() bool {
+	var respErr RespError
+	if !errors.As(err.Err, &respErr) {
+		return false
+	}
+	msg := strings.ToLower(respErr.Err)
+	return strings.Contains(msg, "power level") || strings.Contains(msg, "power_level") ||
+		strings.Contains(msg, "user_level") || strings.Contains(msg, "send_level")
+}
+
+func (err SendForbiddenError) Unwrap() error {
+	return err.Err
+}
+
+func wrapSendForbiddenError(err error, roomID id.RoomID, eventType event.Type) error {
+	if errors.Is(err, MForbidden) {
+		return SendForbiddenError{RoomID: roomID, EventType: eventType, Err: err}
+	}
+	return err
+}
+
+// checkSendPowerLevel checks if the user is allowed to send the given event type based on the cached power levels.
+// If the check is disabled or the power levels aren't cached, it always passes.
+func (cli *Client) checkSendPowerLevel(roomID id.RoomID, eventType event.Type, force bool) error {
+	if (!cli.CheckPowerLevelsBeforeSending && !force) || cli.StateStore == nil {
+		return nil
+	}
+	levels := cli.StateStore.GetPowerLevels(roomID)
+	if levels == nil {
+		return nil
+	}
+	required := levels.GetEventLevel(eventType)
+	actual := levels.GetUserLevel(cli.UserID)
+	if actual < required {
+		return InsufficientPowerLevelError{
+			RoomID:    roomID,
+			UserID:    cli.UserID,
+			EventType: eventType,
+			Required:  required,
+			Actual:    actual,
+		}
+	}
+	return nil
+}
+
+// MemoryStateStore is a StateStore implementation that keeps everything in memory.
+type MemoryStateStore struct {
+	Members     map[id.RoomID]map[id.UserID]*event.MemberEventContent `json:"memberships"`
+	PowerLevels map[id.RoomID]*event.PowerLevelsEventContent          `json:"power_levels"`
+	Encryption  map[id.RoomID]*event.EncryptionEventContent           `json:"encryption"`
+	Create      map[id.RoomID]*event.CreateEventContent               `json:"create"`
+	Tombstones  map[id.RoomID]*event.TombstoneEventContent            `json:"tombstones"`
+
+	lock sync.RWMutex
+}
+
+var _ StateStore = (*MemoryStateStore)(nil)
+var _ RoomUpgradeStateStore = (*MemoryStateStore)(nil)
+
+// NewMemoryStateStore creates a new empty MemoryStateStore.
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		Members:     make(map[id.RoomID]map[id.UserID]*event.MemberEventContent),
+		PowerLevels: make(map[id.RoomID]*event.PowerLevelsEventContent),
+		Encryption:  make(map[id.RoomID]*event.EncryptionEventContent),
+		Create:      make(map[id.RoomID]*event.CreateEventContent),
+		Tombstones:  make(map[id.RoomID]*event.TombstoneEventContent),
+	}
+}
+
+func (store *MemoryStateStore) IsInRoom(roomID id.RoomID, userID id.UserID) bool {
+	return store.IsMembership(roomID, userID, event.MembershipJoin)
+}
+
+func (store *MemoryStateStore) IsInvited(roomID id.RoomID, userID id.UserID) bool {
+	return store.IsMembership(roomID, userID, event.MembershipJoin, event.MembershipInvite)
+}
+
+func (store *MemoryStateStore) IsMembership(roomID id.RoomID, userID id.UserID, allowedMemberships ...event.Membership) bool {
+	membership := store.GetMember(roomID, userID).Membership
+	for _, allowedMembership := range allowedMemberships {
+		if allowedMembership == membership {
+			return true
+		}
+	}
+	return false
+}
+
+func (store *MemoryStateStore) GetMember(roomID id.RoomID, userID id.UserID) *event.MemberEventContent {
+	member, ok := store.TryGetMember(roomID, userID)
+	if !ok {
+		member = &event.MemberEventContent{Membership: event.MembershipLeave}
+	}
+	return member
+}
+
+func (store *MemoryStateStore) TryGetMember(roomID id.RoomID, userID id.UserID) (member *event.MemberEventContent, ok bool) {
+	store.lock.RLock()
+	member, ok = store.Members[roomID][userID]
+	store.lock.RUnlock()
+	return
+}
+
+func (store *MemoryStateStore) SetMembership(roomID id.RoomID, userID id.UserID, membership event.Membership) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	members, ok := store.Members[roomID]
+	if !ok {
+		members = make(map[id.UserID]*event.MemberEventContent)
+		store.Members[roomID] = members
+	}
+	if member, ok := members[userID]; ok {
+		updatedMember := *member
+		updatedMember.Membership = membership
+		members[userID] = &updatedMember
+	} else {
+		members[userID] = &event.MemberEventContent{Membership: membership}
+	}
+}
+
+func (store *MemoryStateStore) SetMember(roomID id.RoomID, userID id.UserID, member *event.MemberEventContent) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	members, ok := store.Members[roomID]
+	if !ok {
+		members = make(map[id.UserID]*event.MemberEventContent)
+		store.Members[roomID] = members
+	}
+	members[userID] = member
+}
+
+func (store *MemoryStateStore) GetRoomJoinedOrInvitedMembers(roomID id.RoomID) []id.UserID {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	var userIDs []id.UserID
+	for userID, member := range store.Members[roomID] {
+		if member.Membership.IsInviteOrJoin() {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
+func (store *MemoryStateStore) SetPowerLevels(roomID id.RoomID, levels *event.PowerLevelsEventContent) {
+	store.lock.Lock()
+	store.PowerLevels[roomID] = levels
+	store.lock.Unlock()
+}
+
+func (store *MemoryStateStore) GetPowerLevels(roomID id.RoomID) (levels *event.PowerLevelsEventContent) {
+	store.lock.RLock()
+	levels = store.PowerLevels[roomID]
+	store.lock.RUnlock()
+	return
+}
+
+func (store *MemoryStateStore) SetEncryptionEvent(roomID id.RoomID, content *event.EncryptionEventContent) {
+	store.lock.Lock()
+	store.Encryption[roomID] = content
+	store.lock.Unlock()
+}
+
+func (store *MemoryStateStore) GetEncryptionEvent(roomID id.RoomID) *event.EncryptionEventContent {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.Encryption[roomID]
+}
+
+func (store *MemoryStateStore) IsEncrypted(roomID id.RoomID) bool {
+	return store.GetEncryptionEvent(roomID) != nil
+}
+
+func (store *MemoryStateStore) FindSharedRooms(userID id.UserID) []id.RoomID {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	var rooms []id.RoomID
+	for roomID := range store.Encryption {
+		if member, ok := store.Members[roomID][userID]; ok && member.Membership.IsInviteOrJoin() {
+			rooms = append(rooms, roomID)
+		}
+	}
+	return rooms
+}
+
+func (store *MemoryStateStore) SetCreateEvent(roomID id.RoomID, content *event.CreateEventContent) {
+	store.lock.Lock()
+	store.Create[roomID] = content
+	store.lock.Unlock()
+}
+
+func (store *MemoryStateStore) GetCreateEvent(roomID id.RoomID) *event.CreateEventContent {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.Create[roomID]
+}
+
+func (store *MemoryStateStore) SetTombstone(roomID id.RoomID, content *event.TombstoneEventContent) {
+	store.lock.Lock()
+	store.Tombstones[roomID] = content
+	store.lock.Unlock()
+}
+
+func (store *MemoryStateStore) GetTombstone(roomID id.RoomID) *event.TombstoneEventContent {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.Tombstones[roomID]
+}
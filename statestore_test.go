@@ -0,0 +1,115 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/mautrixtest"
+)
+
+const stateSyncData = `{
+  "next_batch": "s1",
+  "rooms": {
+    "join": {
+      "!room:example.com": {
+        "state": {"events": [
+          {"type": "m.room.encryption", "state_key": "", "sender": "@alice:example.com", "event_id": "$1", "content": {"algorithm": "m.megolm.v1.aes-sha2"}},
+          {"type": "m.room.power_levels", "state_key": "", "sender": "@alice:example.com", "event_id": "$2", "content": {"users": {"@alice:example.com": 100}}}
+        ]},
+        "timeline": {"events": [
+          {"type": "m.room.member", "state_key": "@alice:example.com", "sender": "@alice:example.com", "event_id": "$3", "content": {"membership": "join", "displayname": "Alice"}},
+          {"type": "m.room.member", "state_key": "@bob:example.com", "sender": "@alice:example.com", "event_id": "$4", "content": {"membership": "invite"}}
+        ]}
+      }
+    }
+  }
+}`
+
+func TestUpdateStateStoreFromSync(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(stateSyncData), &resp))
+	store := mautrix.NewMemoryStateStore()
+	mautrix.UpdateStateStoreFromSync(store, &resp)
+
+	roomID := id.RoomID("!room:example.com")
+	assert.True(t, store.IsEncrypted(roomID))
+	assert.True(t, store.IsInRoom(roomID, "@alice:example.com"))
+	assert.Equal(t, "Alice", store.GetMember(roomID, "@alice:example.com").Displayname)
+	assert.True(t, store.IsInvited(roomID, "@bob:example.com"))
+	assert.ElementsMatch(t, []id.UserID{"@alice:example.com", "@bob:example.com"}, store.GetRoomJoinedOrInvitedMembers(roomID))
+	assert.Equal(t, []id.RoomID{roomID}, store.FindSharedRooms("@bob:example.com"))
+	assert.Equal(t, 100, mautrix.GetPowerLevel(store, roomID, "@alice:example.com"))
+	assert.Equal(t, 0, mautrix.GetPowerLevel(store, roomID, "@bob:example.com"))
+	assert.True(t, mautrix.CanSend(store, roomID, "@alice:example.com", event.StateTopic))
+	assert.False(t, mautrix.CanSend(store, roomID, "@bob:example.com", event.StateTopic))
+	assert.True(t, mautrix.CanSend(store, roomID, "@bob:example.com", event.EventMessage))
+	assert.True(t, mautrix.HasPowerLevel(store, "!unknown:example.com", "@bob:example.com", 0))
+
+	// The events must still be parseable by the syncer afterwards
+	evt := resp.Rooms.Join[roomID].Timeline.Events[0]
+	require.NoError(t, evt.Content.ParseRaw(evt.Type))
+	assert.Equal(t, event.MembershipJoin, evt.Content.AsMember().Membership)
+}
+
+func TestClient_CheckPowerLevelsBeforeSending(t *testing.T) {
+	cli, err := mautrix.NewClient("https://example.com", "@bot:example.com", "")
+	require.NoError(t, err)
+	cli.StateStore = mautrix.NewMemoryStateStore()
+	cli.CheckPowerLevelsBeforeSending = true
+	roomID := id.RoomID("!room:example.com")
+	cli.StateStore.SetPowerLevels(roomID, &event.PowerLevelsEventContent{})
+
+	_, err = cli.SendStateEvent(roomID, event.StateTopic, "", &event.TopicEventContent{Topic: "hi"})
+	assert.ErrorIs(t, err, mautrix.ErrInsufficientPowerLevel)
+	var plErr mautrix.InsufficientPowerLevelError
+	require.ErrorAs(t, err, &plErr)
+	assert.Equal(t, 50, plErr.Required)
+	assert.Equal(t, 0, plErr.Actual)
+}
+
+func TestClient_GetRoomPredecessorAndSuccessor(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.SetState("!new:example.com", event.StateCreate, "", &event.CreateEventContent{
+		RoomVersion: "9",
+		Predecessor: &event.Predecessor{RoomID: "!old:example.com", EventID: "$tombstone"},
+	})
+
+	cli := hs.NewClient()
+	store := mautrix.NewMemoryStateStore()
+	cli.StateStore = store
+
+	predecessor, err := cli.GetRoomPredecessor("!new:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, predecessor)
+	assert.Equal(t, id.RoomID("!old:example.com"), predecessor.RoomID)
+	_, err = cli.GetRoomPredecessor("!new:example.com")
+	require.NoError(t, err)
+	assert.Len(t, hs.Requests(), 1, "create event should be cached in the state store")
+
+	successor, err := cli.GetRoomSuccessor("!new:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, successor)
+
+	stateKey := ""
+	mautrix.UpdateStateStore(store, "!old:example.com", &event.Event{
+		Type:     event.StateTombstone,
+		StateKey: &stateKey,
+		Content:  event.Content{VeryRaw: json.RawMessage(`{"body":"upgraded","replacement_room":"!new:example.com"}`)},
+	})
+	successor, err = cli.GetRoomSuccessor("!old:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!new:example.com"), successor)
+}
@@ -19,15 +19,23 @@ type Storer interface {
 	LoadRoom(roomID id.RoomID) *Room
 }
 
-// InMemoryStore implements the Storer interface.
+// FilterHashStorer is an optional extension of Storer that allows Client.GetOrCreateFilter
+// to reuse previously uploaded filters with the same content.
+type FilterHashStorer interface {
+	SaveFilterIDForHash(userID id.UserID, filterHash, filterID string)
+	LoadFilterIDForHash(userID id.UserID, filterHash string) string
+}
+
+// InMemoryStore implements the Storer and FilterHashStorer interfaces.
 //
 // Everything is persisted in-memory as maps. It is not safe to load/save filter IDs
 // or next batch tokens on any goroutine other than the syncing goroutine: the one
 // which called Client.Sync().
 type InMemoryStore struct {
-	Filters   map[id.UserID]string
-	NextBatch map[id.UserID]string
-	Rooms     map[id.RoomID]*Room
+	Filters      map[id.UserID]string
+	FilterHashes map[id.UserID]map[string]string
+	NextBatch    map[id.UserID]string
+	Rooms        map[id.RoomID]*Room
 }
 
 // SaveFilterID to memory.
@@ -40,6 +48,24 @@ func (s *InMemoryStore) LoadFilterID(userID id.UserID) string {
 	return s.Filters[userID]
 }
 
+// SaveFilterIDForHash to memory.
+func (s *InMemoryStore) SaveFilterIDForHash(userID id.UserID, filterHash, filterID string) {
+	if s.FilterHashes == nil {
+		s.FilterHashes = make(map[id.UserID]map[string]string)
+	}
+	userHashes, ok := s.FilterHashes[userID]
+	if !ok {
+		userHashes = make(map[string]string)
+		s.FilterHashes[userID] = userHashes
+	}
+	userHashes[filterHash] = filterID
+}
+
+// LoadFilterIDForHash from memory.
+func (s *InMemoryStore) LoadFilterIDForHash(userID id.UserID, filterHash string) string {
+	return s.FilterHashes[userID][filterHash]
+}
+
 // SaveNextBatch to memory.
 func (s *InMemoryStore) SaveNextBatch(userID id.UserID, nextBatchToken string) {
 	s.NextBatch[userID] = nextBatchToken
@@ -76,9 +102,10 @@ func (s *InMemoryStore) UpdateState(_ EventSource, evt *event.Event) {
 // NewInMemoryStore constructs a new InMemoryStore.
 func NewInMemoryStore() *InMemoryStore {
 	return &InMemoryStore{
-		Filters:   make(map[id.UserID]string),
-		NextBatch: make(map[id.UserID]string),
-		Rooms:     make(map[id.RoomID]*Room),
+		Filters:      make(map[id.UserID]string),
+		FilterHashes: make(map[id.UserID]map[string]string),
+		NextBatch:    make(map[id.UserID]string),
+		Rooms:        make(map[id.RoomID]*Room),
 	}
 }
 
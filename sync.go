@@ -7,8 +7,12 @@
 package mautrix
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"runtime/debug"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"maunium.net/go/mautrix/event"
@@ -28,6 +32,7 @@ const (
 	EventSourceState
 	EventSourceEphemeral
 	EventSourceToDevice
+	EventSourceKnock
 )
 
 func (es EventSource) String() string {
@@ -56,6 +61,12 @@ func (es EventSource) String() string {
 		case EventSourceState:
 			return "invited state"
 		}
+	case es&EventSourceKnock != 0:
+		es -= EventSourceKnock
+		switch es {
+		case EventSourceState:
+			return "knocked state"
+		}
 	case es&EventSourceLeave != 0:
 		es -= EventSourceLeave
 		switch es {
@@ -63,11 +74,73 @@ func (es EventSource) String() string {
 			return "left state"
 		case EventSourceTimeline:
 			return "left timeline"
+		case EventSourceAccountData:
+			return "room account data (left)"
 		}
 	}
 	return fmt.Sprintf("unknown (%d)", es)
 }
 
+func sortRoomIDs(roomIDs []id.RoomID) []id.RoomID {
+	sort.Slice(roomIDs, func(i, j int) bool {
+		return roomIDs[i] < roomIDs[j]
+	})
+	return roomIDs
+}
+
+func forEachEventIn(roomID id.RoomID, events []*event.Event, source EventSource, callback func(id.RoomID, EventSource, *event.Event)) {
+	for _, evt := range events {
+		callback(roomID, source, evt)
+	}
+}
+
+// ForEachEvent calls the given function for every event in the sync response.
+//
+// The order is deterministic: to-device events, presence and global account data come first, followed by
+// joined, invited, knocked and left rooms sorted by room ID. Within a room, state events come before timeline events,
+// which come before ephemeral events and room account data. The room ID is empty for events that aren't in a room.
+func (rs *RespSync) ForEachEvent(callback func(roomID id.RoomID, source EventSource, evt *event.Event)) {
+	forEachEventIn("", rs.ToDevice.Events, EventSourceToDevice, callback)
+	forEachEventIn("", rs.Presence.Events, EventSourcePresence, callback)
+	forEachEventIn("", rs.AccountData.Events, EventSourceAccountData, callback)
+
+	roomIDs := make([]id.RoomID, 0, len(rs.Rooms.Join))
+	for roomID := range rs.Rooms.Join {
+		roomIDs = append(roomIDs, roomID)
+	}
+	for _, roomID := range sortRoomIDs(roomIDs) {
+		roomData := rs.Rooms.Join[roomID]
+		forEachEventIn(roomID, roomData.State.Events, EventSourceJoin|EventSourceState, callback)
+		forEachEventIn(roomID, roomData.Timeline.Events, EventSourceJoin|EventSourceTimeline, callback)
+		forEachEventIn(roomID, roomData.Ephemeral.Events, EventSourceJoin|EventSourceEphemeral, callback)
+		forEachEventIn(roomID, roomData.AccountData.Events, EventSourceJoin|EventSourceAccountData, callback)
+	}
+	roomIDs = roomIDs[:0]
+	for roomID := range rs.Rooms.Invite {
+		roomIDs = append(roomIDs, roomID)
+	}
+	for _, roomID := range sortRoomIDs(roomIDs) {
+		forEachEventIn(roomID, rs.Rooms.Invite[roomID].State.Events, EventSourceInvite|EventSourceState, callback)
+	}
+	roomIDs = roomIDs[:0]
+	for roomID := range rs.Rooms.Knock {
+		roomIDs = append(roomIDs, roomID)
+	}
+	for _, roomID := range sortRoomIDs(roomIDs) {
+		forEachEventIn(roomID, rs.Rooms.Knock[roomID].State.Events, EventSourceKnock|EventSourceState, callback)
+	}
+	roomIDs = roomIDs[:0]
+	for roomID := range rs.Rooms.Leave {
+		roomIDs = append(roomIDs, roomID)
+	}
+	for _, roomID := range sortRoomIDs(roomIDs) {
+		roomData := rs.Rooms.Leave[roomID]
+		forEachEventIn(roomID, roomData.State.Events, EventSourceLeave|EventSourceState, callback)
+		forEachEventIn(roomID, roomData.Timeline.Events, EventSourceLeave|EventSourceTimeline, callback)
+		forEachEventIn(roomID, roomData.AccountData.Events, EventSourceLeave|EventSourceAccountData, callback)
+	}
+}
+
 // EventHandler handles a single event from a sync response.
 type EventHandler func(source EventSource, evt *event.Event)
 
@@ -96,6 +169,10 @@ type ExtensibleSyncer interface {
 // replace parts of this default syncer (e.g. the ProcessResponse method). The default syncer uses the observer
 // pattern to notify callers about incoming events. See DefaultSyncer.OnEventType for more information.
 type DefaultSyncer struct {
+	// currentBackoff is accessed atomically, as it may be read from other goroutines via CurrentSyncBackoff.
+	// It's the first field to guarantee 64-bit alignment on 32-bit platforms.
+	currentBackoff int64
+
 	// syncListeners want the whole sync response, e.g. the crypto machine
 	syncListeners []SyncHandler
 	// globalListeners want all events
@@ -107,8 +184,32 @@ type DefaultSyncer struct {
 	// ParseErrorHandler is called when event.Content.ParseRaw returns an error.
 	// If it returns false, the event will not be forwarded to listeners.
 	ParseErrorHandler func(evt *event.Event, err error) bool
+	// FilterIgnoredUsers determines whether timeline events from users in the m.ignored_user_list account data
+	// should be dropped before they're forwarded to listeners. Servers should already filter such events,
+	// but this also catches ones that still come through. State events are never dropped.
+	FilterIgnoredUsers bool
+	// DecryptEvent is called for m.room.encrypted timeline events before they're forwarded to listeners.
+	// The decrypted event is forwarded instead of the encrypted one. If decryption fails, the encrypted event is
+	// forwarded as-is with evt.Mautrix.DecryptionError set. See crypto.OlmMachine.RegisterSyncer.
+	DecryptEvent func(evt *event.Event) (*event.Event, error)
+
+	// MinSyncBackoff and MaxSyncBackoff control how long OnFailedSync waits before retrying a failed /sync.
+	// The delay starts at MinSyncBackoff, doubles after each consecutive failure until it reaches MaxSyncBackoff,
+	// and is reset after a successful sync.
+	MinSyncBackoff time.Duration
+	MaxSyncBackoff time.Duration
+	// IsFatalSyncError determines whether a /sync error should stop syncing instead of being retried.
+	// By default, M_UNKNOWN_TOKEN (i.e. the access token is no longer valid) is fatal.
+	IsFatalSyncError func(err error) bool
+
+	ignoredUsers map[id.UserID]event.IgnoredUser
 }
 
+const (
+	DefaultMinSyncBackoff = 2 * time.Second
+	DefaultMaxSyncBackoff = 2 * time.Minute
+)
+
 var _ Syncer = (*DefaultSyncer)(nil)
 var _ ExtensibleSyncer = (*DefaultSyncer)(nil)
 
@@ -122,9 +223,17 @@ func NewDefaultSyncer() *DefaultSyncer {
 		ParseErrorHandler: func(evt *event.Event, err error) bool {
 			return false
 		},
+		MinSyncBackoff:   DefaultMinSyncBackoff,
+		MaxSyncBackoff:   DefaultMaxSyncBackoff,
+		IsFatalSyncError: IsFatalSyncError,
 	}
 }
 
+// IsFatalSyncError returns true for /sync errors that shouldn't be retried, which is currently only M_UNKNOWN_TOKEN.
+func IsFatalSyncError(err error) bool {
+	return errors.Is(err, MUnknownToken)
+}
+
 // ProcessResponse processes the /sync response in a way suitable for bots. "Suitable for bots" means a stream of
 // unrepeating events. Returns a fatal error if a listener panics.
 func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error) {
@@ -134,39 +243,19 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 		}
 	}()
 
+	atomic.StoreInt64(&s.currentBackoff, 0)
+
 	for _, listener := range s.syncListeners {
 		if !listener(res, since) {
 			return
 		}
 	}
 
-	s.processSyncEvents("", res.ToDevice.Events, EventSourceToDevice)
-	s.processSyncEvents("", res.Presence.Events, EventSourcePresence)
-	s.processSyncEvents("", res.AccountData.Events, EventSourceAccountData)
-
-	for roomID, roomData := range res.Rooms.Join {
-		s.processSyncEvents(roomID, roomData.State.Events, EventSourceJoin|EventSourceState)
-		s.processSyncEvents(roomID, roomData.Timeline.Events, EventSourceJoin|EventSourceTimeline)
-		s.processSyncEvents(roomID, roomData.Ephemeral.Events, EventSourceJoin|EventSourceEphemeral)
-		s.processSyncEvents(roomID, roomData.AccountData.Events, EventSourceJoin|EventSourceAccountData)
-	}
-	for roomID, roomData := range res.Rooms.Invite {
-		s.processSyncEvents(roomID, roomData.State.Events, EventSourceInvite|EventSourceState)
-	}
-	for roomID, roomData := range res.Rooms.Leave {
-		s.processSyncEvents(roomID, roomData.State.Events, EventSourceLeave|EventSourceState)
-		s.processSyncEvents(roomID, roomData.Timeline.Events, EventSourceLeave|EventSourceTimeline)
-	}
+	res.ForEachEvent(s.processSyncEvent)
 	return
 }
 
-func (s *DefaultSyncer) processSyncEvents(roomID id.RoomID, events []*event.Event, source EventSource) {
-	for _, evt := range events {
-		s.processSyncEvent(roomID, evt, source)
-	}
-}
-
-func (s *DefaultSyncer) processSyncEvent(roomID id.RoomID, evt *event.Event, source EventSource) {
+func (s *DefaultSyncer) processSyncEvent(roomID id.RoomID, source EventSource, evt *event.Event) {
 	evt.RoomID = roomID
 
 	// Ensure the type class is correct. It's safe to mutate the class since the event type is not a pointer.
@@ -191,9 +280,47 @@ func (s *DefaultSyncer) processSyncEvent(roomID id.RoomID, evt *event.Event, sou
 		}
 	}
 
+	if source == EventSourceAccountData && evt.Type == event.AccountDataIgnoredUserList {
+		s.updateIgnoredUsers(evt)
+	} else if s.FilterIgnoredUsers && source&EventSourceTimeline != 0 && evt.StateKey == nil {
+		if _, ignored := s.ignoredUsers[evt.Sender]; ignored {
+			return
+		}
+	}
+
+	if s.DecryptEvent != nil && source&EventSourceTimeline != 0 && evt.Type == event.EventEncrypted {
+		evt = s.decryptEvent(evt)
+	}
+
 	s.notifyListeners(source, evt)
 }
 
+func (s *DefaultSyncer) decryptEvent(evt *event.Event) *event.Event {
+	if evt.Content.Parsed == nil {
+		if err := evt.Content.ParseRaw(evt.Type); err != nil {
+			evt.Mautrix.DecryptionError = err
+			return evt
+		}
+	}
+	decrypted, err := s.DecryptEvent(evt)
+	if err != nil {
+		evt.Mautrix.DecryptionError = err
+		return evt
+	}
+	return decrypted
+}
+
+func (s *DefaultSyncer) updateIgnoredUsers(evt *event.Event) {
+	content, ok := evt.Content.Parsed.(*event.IgnoredUserListEventContent)
+	if !ok {
+		content = &event.IgnoredUserListEventContent{}
+		if json.Unmarshal(evt.Content.VeryRaw, content) != nil {
+			return
+		}
+	}
+	s.ignoredUsers = content.IgnoredUsers
+}
+
 func (s *DefaultSyncer) notifyListeners(source EventSource, evt *event.Event) {
 	for _, fn := range s.globalListeners {
 		fn(source, evt)
@@ -208,6 +335,11 @@ func (s *DefaultSyncer) notifyListeners(source EventSource, evt *event.Event) {
 
 // OnEventType allows callers to be notified when there are new events for the given event type.
 // There are no duplicate checks.
+//
+// This works for all parts of the sync response, including global and per-room account data (e.g. event.AccountDataDirectChats)
+// and ephemeral events (e.g. event.EphemeralEventTyping). The event type class must match the part of the response,
+// which is the case for the predefined types in the event package. The source parameter of the handler tells
+// where exactly the event came from, e.g. EventSourceJoin|EventSourceAccountData for the account data of a joined room.
 func (s *DefaultSyncer) OnEventType(eventType event.Type, callback EventHandler) {
 	_, exists := s.listeners[eventType]
 	if !exists {
@@ -224,9 +356,32 @@ func (s *DefaultSyncer) OnEvent(callback EventHandler) {
 	s.globalListeners = append(s.globalListeners, callback)
 }
 
-// OnFailedSync always returns a 10 second wait period between failed /syncs, never a fatal error.
+// OnFailedSync returns an exponentially increasing wait period between failed /syncs (see MinSyncBackoff and
+// MaxSyncBackoff). If IsFatalSyncError returns true for the error, the error is returned to stop syncing.
 func (s *DefaultSyncer) OnFailedSync(res *RespSync, err error) (time.Duration, error) {
-	return 10 * time.Second, nil
+	if s.IsFatalSyncError != nil && s.IsFatalSyncError(err) {
+		return 0, err
+	}
+	minBackoff, maxBackoff := s.MinSyncBackoff, s.MaxSyncBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultMinSyncBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	backoff := time.Duration(atomic.LoadInt64(&s.currentBackoff)) * 2
+	if backoff < minBackoff {
+		backoff = minBackoff
+	} else if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	atomic.StoreInt64(&s.currentBackoff, int64(backoff))
+	return backoff, nil
+}
+
+// CurrentSyncBackoff returns the current delay between retries of failed /syncs, or 0 if the last sync was successful.
+func (s *DefaultSyncer) CurrentSyncBackoff() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.currentBackoff))
 }
 
 // GetFilterJSON returns a filter with a timeline limit of 50.
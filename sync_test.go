@@ -0,0 +1,224 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const syncWithAccountDataAndEphemeral = `{
+	"next_batch": "s2",
+	"account_data": {"events": [{"type": "m.direct", "content": {"@user:example.com": ["!dm:example.com"]}}]},
+	"rooms": {
+		"join": {
+			"!room:example.com": {
+				"account_data": {"events": [{"type": "m.tag", "content": {"tags": {"u.work": {}}}}]},
+				"ephemeral": {"events": [{"type": "m.typing", "content": {"user_ids": ["@user:example.com"]}}]}
+			}
+		},
+		"leave": {
+			"!left:example.com": {
+				"account_data": {"events": [{"type": "m.tag", "content": {"tags": {}}}]}
+			}
+		}
+	}
+}`
+
+func TestDefaultSyncer_AccountDataAndEphemeral(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(syncWithAccountDataAndEphemeral), &resp))
+
+	syncer := mautrix.NewDefaultSyncer()
+	var directSource mautrix.EventSource
+	var tagSources, typingSources []mautrix.EventSource
+	syncer.OnEventType(event.AccountDataDirectChats, func(source mautrix.EventSource, evt *event.Event) {
+		directSource = source
+	})
+	syncer.OnEventType(event.AccountDataRoomTags, func(source mautrix.EventSource, evt *event.Event) {
+		tagSources = append(tagSources, source)
+	})
+	syncer.OnEventType(event.EphemeralEventTyping, func(source mautrix.EventSource, evt *event.Event) {
+		typingSources = append(typingSources, source)
+		assert.Equal(t, "!room:example.com", evt.RoomID.String())
+	})
+	require.NoError(t, syncer.ProcessResponse(&resp, "s1"))
+
+	assert.Equal(t, mautrix.EventSourceAccountData, directSource)
+	assert.ElementsMatch(t, []mautrix.EventSource{
+		mautrix.EventSourceJoin | mautrix.EventSourceAccountData,
+		mautrix.EventSourceLeave | mautrix.EventSourceAccountData,
+	}, tagSources)
+	assert.Equal(t, []mautrix.EventSource{mautrix.EventSourceJoin | mautrix.EventSourceEphemeral}, typingSources)
+}
+
+const syncWithIgnoredUser = `{
+	"next_batch": "s2",
+	"account_data": {"events": [{"type": "m.ignored_user_list", "content": {"ignored_users": {"@spam:example.com": {}}}}]},
+	"rooms": {"join": {"!room:example.com": {"timeline": {"events": [
+		{"type": "m.room.message", "sender": "@spam:example.com", "event_id": "$1", "content": {"msgtype": "m.text", "body": "spam"}},
+		{"type": "m.room.member", "sender": "@spam:example.com", "state_key": "@spam:example.com", "event_id": "$2", "content": {"membership": "join"}},
+		{"type": "m.room.message", "sender": "@user:example.com", "event_id": "$3", "content": {"msgtype": "m.text", "body": "hi"}}
+	]}}}}
+}`
+
+func TestDefaultSyncer_FilterIgnoredUsers(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(syncWithIgnoredUser), &resp))
+
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.FilterIgnoredUsers = true
+	var eventIDs []string
+	syncer.OnEvent(func(source mautrix.EventSource, evt *event.Event) {
+		if source&mautrix.EventSourceTimeline != 0 {
+			eventIDs = append(eventIDs, evt.ID.String())
+		}
+	})
+	require.NoError(t, syncer.ProcessResponse(&resp, "s1"))
+	assert.Equal(t, []string{"$2", "$3"}, eventIDs)
+}
+
+const syncWithEncryptedEvents = `{
+	"next_batch": "s2",
+	"rooms": {
+		"join": {
+			"!room:example.com": {
+				"timeline": {"events": [
+					{"type": "m.room.encrypted", "event_id": "$ok", "sender": "@user:example.com", "content": {"algorithm": "m.megolm.v1.aes-sha2", "ciphertext": "ok", "session_id": "session"}},
+					{"type": "m.room.encrypted", "event_id": "$fail", "sender": "@user:example.com", "content": {"algorithm": "m.megolm.v1.aes-sha2", "ciphertext": "fail", "session_id": "session"}}
+				]}
+			}
+		}
+	}
+}`
+
+func TestDefaultSyncer_DecryptEvent(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(syncWithEncryptedEvents), &resp))
+
+	errNoSession := errors.New("no session")
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.DecryptEvent = func(evt *event.Event) (*event.Event, error) {
+		if string(evt.Content.AsEncrypted().MegolmCiphertext) == "fail" {
+			return nil, errNoSession
+		}
+		return &event.Event{
+			ID:      evt.ID,
+			RoomID:  evt.RoomID,
+			Sender:  evt.Sender,
+			Type:    event.EventMessage,
+			Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}},
+			Mautrix: event.MautrixInfo{WasEncrypted: true},
+		}, nil
+	}
+	var messages, encrypted []*event.Event
+	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
+		messages = append(messages, evt)
+	})
+	syncer.OnEventType(event.EventEncrypted, func(source mautrix.EventSource, evt *event.Event) {
+		encrypted = append(encrypted, evt)
+	})
+	require.NoError(t, syncer.ProcessResponse(&resp, "s1"))
+
+	require.Len(t, messages, 1)
+	assert.Equal(t, "$ok", messages[0].ID.String())
+	assert.True(t, messages[0].Mautrix.WasEncrypted)
+	require.Len(t, encrypted, 1)
+	assert.Equal(t, "$fail", encrypted[0].ID.String())
+	assert.ErrorIs(t, encrypted[0].Mautrix.DecryptionError, errNoSession)
+}
+
+const syncWithMultipleRooms = `{
+	"next_batch": "s2",
+	"to_device": {"events": [{"type": "m.dummy", "sender": "@user:example.com", "content": {}}]},
+	"rooms": {
+		"join": {
+			"!b:example.com": {
+				"timeline": {"events": [{"type": "m.room.message", "event_id": "$b2", "content": {}}]},
+				"state": {"events": [{"type": "m.room.name", "state_key": "", "event_id": "$b1", "content": {}}]}
+			},
+			"!a:example.com": {
+				"timeline": {"events": [{"type": "m.room.message", "event_id": "$a1", "content": {}}]}
+			}
+		},
+		"invite": {
+			"!c:example.com": {"invite_state": {"events": [{"type": "m.room.member", "state_key": "@user:example.com", "content": {}}]}}
+		}
+	}
+}`
+
+func TestRespSync_ForEachEvent(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(syncWithMultipleRooms), &resp))
+
+	var rooms []id.RoomID
+	var sources []mautrix.EventSource
+	resp.ForEachEvent(func(roomID id.RoomID, source mautrix.EventSource, evt *event.Event) {
+		rooms = append(rooms, roomID)
+		sources = append(sources, source)
+	})
+	assert.Equal(t, []id.RoomID{"", "!a:example.com", "!b:example.com", "!b:example.com", "!c:example.com"}, rooms)
+	assert.Equal(t, []mautrix.EventSource{
+		mautrix.EventSourceToDevice,
+		mautrix.EventSourceJoin | mautrix.EventSourceTimeline,
+		mautrix.EventSourceJoin | mautrix.EventSourceState,
+		mautrix.EventSourceJoin | mautrix.EventSourceTimeline,
+		mautrix.EventSourceInvite | mautrix.EventSourceState,
+	}, sources)
+}
+
+func TestDefaultSyncer_OnFailedSync(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.MinSyncBackoff = 1 * time.Second
+	syncer.MaxSyncBackoff = 3 * time.Second
+	var backoffs []time.Duration
+	for i := 0; i < 4; i++ {
+		backoff, err := syncer.OnFailedSync(nil, errors.New("connection refused"))
+		require.NoError(t, err)
+		backoffs = append(backoffs, backoff)
+	}
+	assert.Equal(t, []time.Duration{1 * time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}, backoffs)
+	assert.Equal(t, 3*time.Second, syncer.CurrentSyncBackoff())
+
+	require.NoError(t, syncer.ProcessResponse(&mautrix.RespSync{}, "s1"))
+	assert.Zero(t, syncer.CurrentSyncBackoff())
+
+	_, err := syncer.OnFailedSync(nil, mautrix.HTTPError{RespError: &mautrix.RespError{ErrCode: "M_UNKNOWN_TOKEN"}})
+	assert.ErrorIs(t, err, mautrix.MUnknownToken)
+}
+
+func TestDefaultSyncer_Knock(t *testing.T) {
+	var resp mautrix.RespSync
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"next_batch": "s2",
+		"rooms": {"knock": {"!room:example.com": {"knock_state": {"events": [
+			{"type": "m.room.member", "state_key": "@user:example.com", "sender": "@user:example.com", "content": {"membership": "knock"}}
+		]}}}}
+	}`), &resp))
+
+	syncer := mautrix.NewDefaultSyncer()
+	var source mautrix.EventSource
+	var membership event.Membership
+	syncer.OnEventType(event.StateMember, func(src mautrix.EventSource, evt *event.Event) {
+		source = src
+		membership = evt.Content.AsMember().Membership
+		assert.Equal(t, id.RoomID("!room:example.com"), evt.RoomID)
+	})
+	require.NoError(t, syncer.ProcessResponse(&resp, "s1"))
+	assert.Equal(t, mautrix.EventSourceKnock|mautrix.EventSourceState, source)
+	assert.Equal(t, "knocked state", source.String())
+	assert.Equal(t, event.MembershipKnock, membership)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultTypingTimeout is the typing timeout used by TypingManager if one isn't specified.
+const DefaultTypingTimeout = 30 * time.Second
+
+// TypingManager keeps the user's typing notifications alive in rooms.
+//
+// After Start is called for a room, the typing notification is re-sent periodically before the timeout expires,
+// until Stop is called. Each room is handled by a single background goroutine, so rapid Start and Stop calls
+// are coalesced and requests for a room are never sent out of order. All methods are safe to call from multiple goroutines.
+type TypingManager struct {
+	Client *Client
+	// The typing timeout to send to the server. The notification is re-sent after 3/4 of the timeout has passed.
+	Timeout time.Duration
+
+	rooms map[id.RoomID]*roomTypingState
+	lock  sync.Mutex
+}
+
+type roomTypingState struct {
+	typing bool
+	wake   chan struct{}
+}
+
+// NewTypingManager creates a new TypingManager for the given client.
+func NewTypingManager(cli *Client) *TypingManager {
+	return &TypingManager{
+		Client:  cli,
+		Timeout: DefaultTypingTimeout,
+		rooms:   make(map[id.RoomID]*roomTypingState),
+	}
+}
+
+// Start marks the user as typing in the given room. Calling Start again while already typing does nothing.
+func (tm *TypingManager) Start(roomID id.RoomID) {
+	tm.set(roomID, true)
+}
+
+// Stop marks the user as no longer typing in the given room. The typing:false notification is sent immediately.
+func (tm *TypingManager) Stop(roomID id.RoomID) {
+	tm.set(roomID, false)
+}
+
+// StopAll stops typing in all rooms.
+func (tm *TypingManager) StopAll() {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	for _, state := range tm.rooms {
+		state.typing = false
+		state.notify()
+	}
+}
+
+func (state *roomTypingState) notify() {
+	select {
+	case state.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (tm *TypingManager) set(roomID id.RoomID, typing bool) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	state, ok := tm.rooms[roomID]
+	if !ok {
+		if !typing {
+			return
+		}
+		if tm.rooms == nil {
+			tm.rooms = make(map[id.RoomID]*roomTypingState)
+		}
+		state = &roomTypingState{wake: make(chan struct{}, 1)}
+		tm.rooms[roomID] = state
+		go tm.loop(roomID, state)
+	}
+	state.typing = typing
+	state.notify()
+}
+
+func (tm *TypingManager) loop(roomID id.RoomID, state *roomTypingState) {
+	var sentTyping bool
+	var nextRefresh time.Time
+	for {
+		tm.lock.Lock()
+		typing := state.typing
+		if !typing && !sentTyping {
+			delete(tm.rooms, roomID)
+			tm.lock.Unlock()
+			return
+		}
+		tm.lock.Unlock()
+
+		if !typing {
+			if _, err := tm.Client.UserTyping(roomID, false, 0); err != nil {
+				tm.Client.logWarning("Failed to stop typing in %s: %v", roomID, err)
+			}
+			sentTyping = false
+			continue
+		} else if !sentTyping || !time.Now().Before(nextRefresh) {
+			timeout := tm.Timeout
+			if timeout <= 0 {
+				timeout = DefaultTypingTimeout
+			}
+			if _, err := tm.Client.UserTyping(roomID, true, timeout); err != nil {
+				tm.Client.logWarning("Failed to send typing notification to %s: %v", roomID, err)
+			}
+			sentTyping = true
+			nextRefresh = time.Now().Add(timeout * 3 / 4)
+		}
+		select {
+		case <-state.wake:
+		case <-time.After(time.Until(nextRefresh)):
+		}
+	}
+}
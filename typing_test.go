@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/mautrixtest"
+)
+
+func TestTypingManager(t *testing.T) {
+	hs := mautrixtest.NewHomeserver("@user:example.com")
+	defer hs.Close()
+	hs.Handle(http.MethodPut, "/_matrix/client/v3/rooms/!room:example.com/typing/@user:example.com", func(w http.ResponseWriter, r *http.Request) {
+		mautrixtest.WriteJSON(w, http.StatusOK, struct{}{})
+	})
+	getRequests := func() []mautrix.ReqTyping {
+		var requests []mautrix.ReqTyping
+		for _, httpReq := range hs.Requests() {
+			assert.Equal(t, http.MethodPut, httpReq.Method)
+			assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/typing/@user:example.com", httpReq.Path)
+			var req mautrix.ReqTyping
+			assert.NoError(t, json.Unmarshal(httpReq.Body, &req))
+			requests = append(requests, req)
+		}
+		return requests
+	}
+
+	cli := hs.NewClient()
+	// The zero value must be usable too
+	tm := &mautrix.TypingManager{Client: cli, Timeout: 40 * time.Millisecond}
+	tm.Start("!room:example.com")
+	tm.Start("!room:example.com")
+	assert.Eventually(t, func() bool {
+		return len(getRequests()) >= 3
+	}, time.Second, 5*time.Millisecond, "typing notification wasn't refreshed")
+	for _, req := range getRequests() {
+		assert.True(t, req.Typing)
+		assert.Equal(t, int64(40), req.Timeout)
+	}
+
+	tm.Stop("!room:example.com")
+	assert.Eventually(t, func() bool {
+		reqs := getRequests()
+		return !reqs[len(reqs)-1].Typing
+	}, time.Second, 5*time.Millisecond, "typing:false wasn't sent")
+	count := len(getRequests())
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, getRequests(), count, "typing notifications were sent after stopping")
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// UIACallback is called when an endpoint requires user-interactive authentication. It receives the available flows
+// and completed stages, and should return the auth data for the next stage (e.g. a ReqUIAuthLogin), or nil to stop.
+//
+// If authenticating with the previous stage failed, ErrCode and Error are set in the UIA response.
+type UIACallback = func(*RespUserInteractive) interface{}
+
+// UIARequest is a request to an endpoint that requires user-interactive authentication. See Client.DoUIA.
+type UIARequest struct {
+	Method string
+	URL    string
+	// The request body. It must marshal into a JSON object, as the auth data is added to it in the auth field.
+	Body interface{}
+	// Whether the body contains sensitive data even without the auth data (e.g. a new password).
+	SensitiveContent bool
+	// Callback provides the auth data for each stage. See UIAStageHandlers for a simple implementation.
+	Callback UIACallback
+}
+
+// parseUIAResponse parses the user-interactive auth response from a failed request.
+// It returns nil if the error is not a 401 or the response body doesn't contain any flows.
+func parseUIAResponse(content []byte, err error) *RespUserInteractive {
+	var httpErr HTTPError
+	if !errors.As(err, &httpErr) || !httpErr.IsStatus(http.StatusUnauthorized) {
+		return nil
+	}
+	var uiaResp RespUserInteractive
+	if json.Unmarshal(content, &uiaResp) != nil || len(uiaResp.Flows) == 0 {
+		return nil
+	}
+	return &uiaResp
+}
+
+func toJSONObject(data interface{}) (map[string]interface{}, error) {
+	obj := make(map[string]interface{})
+	if data == nil {
+		return obj, nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(raw, &obj)
+	return obj, err
+}
+
+// DoUIA makes a request to an endpoint that requires user-interactive authentication.
+//
+// Each time the server responds with a UIA response (HTTP 401 with a list of flows), the callback is called and the
+// request is retried with the auth data it returns. The session ID from the server is added to the auth data
+// automatically if the callback didn't set it. When the callback returns nil, the error of the last request is
+// returned. On success, the response is parsed into respJSON (if it's not nil).
+func (cli *Client) DoUIA(req *UIARequest, respJSON interface{}) error {
+	body, err := toJSONObject(req.Body)
+	if err != nil {
+		return fmt.Errorf("failed to convert request body to JSON object: %w", err)
+	}
+	for {
+		var content []byte
+		content, err = cli.MakeFullRequest(FullRequest{
+			Method:           req.Method,
+			URL:              req.URL,
+			RequestJSON:      body,
+			ResponseJSON:     respJSON,
+			SensitiveContent: req.SensitiveContent || body["auth"] != nil,
+		})
+		if err == nil || req.Callback == nil {
+			return err
+		}
+		uiaResp := parseUIAResponse(content, err)
+		if uiaResp == nil {
+			return err
+		}
+		auth := req.Callback(uiaResp)
+		if auth == nil {
+			return err
+		}
+		authObj, convErr := toJSONObject(auth)
+		if convErr != nil {
+			return fmt.Errorf("failed to convert auth data to JSON object: %w", convErr)
+		}
+		if session, _ := authObj["session"].(string); session == "" && uiaResp.Session != "" {
+			authObj["session"] = uiaResp.Session
+		}
+		body["auth"] = authObj
+	}
+}
+
+// UIAStageHandlers is a simple UIACallback implementation that completes stages using handler functions.
+//
+// The first flow where all remaining stages have a handler is chosen. The handler should return the auth data for
+// the stage, e.g. a ReqUIAuthLogin for m.login.password or a BaseAuthData for m.login.dummy. If authenticating with
+// a stage fails (i.e. the server returns an error code with the UIA response), the flow is stopped.
+//
+//	err := cli.DoUIA(&mautrix.UIARequest{
+//		Method:   http.MethodPost,
+//		URL:      url,
+//		Body:     req,
+//		Callback: mautrix.UIAStageHandlers{mautrix.AuthTypePassword: passwordHandler}.Callback,
+//	}, nil)
+type UIAStageHandlers map[AuthType]func(uia *RespUserInteractive) interface{}
+
+// Callback implements UIACallback.
+func (handlers UIAStageHandlers) Callback(uia *RespUserInteractive) interface{} {
+	if uia.ErrCode != "" {
+		return nil
+	}
+	for _, flow := range uia.Flows {
+		if !handlers.canComplete(uia, flow) {
+			continue
+		}
+		stage, ok := uia.NextStage(flow)
+		if ok {
+			return handlers[stage](uia)
+		}
+	}
+	return nil
+}
+
+func (handlers UIAStageHandlers) canComplete(uia *RespUserInteractive, flow UIAFlow) bool {
+	for _, stage := range flow.Stages {
+		if _, ok := handlers[stage]; !ok && !uia.IsCompleted(stage) {
+			return false
+		}
+	}
+	return true
+}
@@ -88,6 +88,21 @@ func (mup MediaURLPath) FullPath() []interface{} {
 	return append([]interface{}{"_matrix", "media"}, []interface{}(mup)...)
 }
 
+// BuildURLWithFullQuery builds a URL with the Client's homeserver and appservice user ID set already.
+// The given function is called with the query parameters, which allows setting parameters with multiple values.
+func (cli *Client) BuildURLWithFullQuery(urlPath PrefixableURLPath, fn func(q url.Values)) string {
+	hsURL := *BuildURL(cli.HomeserverURL, urlPath.FullPath()...)
+	query := hsURL.Query()
+	if cli.AppServiceUserID != "" {
+		query.Set("user_id", string(cli.AppServiceUserID))
+	}
+	if fn != nil {
+		fn(query)
+	}
+	hsURL.RawQuery = query.Encode()
+	return hsURL.String()
+}
+
 // BuildURLWithQuery builds a URL with query parameters in addition to the Client's homeserver
 // and appservice user ID set already.
 func (cli *Client) BuildURLWithQuery(urlPath PrefixableURLPath, urlQuery map[string]string) string {
@@ -7,11 +7,13 @@
 package mautrix_test
 
 import (
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
 )
 
 func TestClient_BuildURL(t *testing.T) {
@@ -63,3 +65,44 @@ func TestClient_BuildURL_MissingSchemeWithPath(t *testing.T) {
 	built := cli.BuildClientURL("v3", "foo/bar%2F🐈 1", "hello", "world")
 	assert.Equal(t, "https://example.com/base/_matrix/client/v3/foo%2Fbar%252F%F0%9F%90%88%201/hello/world", built)
 }
+
+func TestClient_BuildSSORedirectURL(t *testing.T) {
+	cli, err := mautrix.NewClient("https://example.com", "", "")
+	assert.NoError(t, err)
+	built := cli.BuildSSORedirectURL("oidc-github", "https://client.example.com/callback?a=b")
+	assert.Equal(t, "https://example.com/_matrix/client/v3/login/sso/redirect/oidc-github?redirectUrl=https%3A%2F%2Fclient.example.com%2Fcallback%3Fa%3Db", built)
+	built = cli.BuildSSORedirectURL("", "https://client.example.com/callback")
+	assert.Equal(t, "https://example.com/_matrix/client/v3/login/sso/redirect?redirectUrl=https%3A%2F%2Fclient.example.com%2Fcallback", built)
+}
+
+func TestReqSync_BuildQuery_InlineFilter(t *testing.T) {
+	req := mautrix.ReqSync{Filter: &mautrix.Filter{Room: mautrix.RoomFilter{Timeline: mautrix.FilterPart{Limit: 10}}}}
+	assert.Equal(t, `{"account_data":{},"presence":{},"room":{"account_data":{},"ephemeral":{},"state":{},"timeline":{"limit":10}}}`, req.BuildQuery()["filter"])
+
+	cli, err := mautrix.NewClient("https://example.com", "", "")
+	assert.NoError(t, err)
+	req = mautrix.ReqSync{Filter: &mautrix.Filter{EventFields: []string{"type"}}}
+	built := cli.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "sync"}, req.BuildQuery())
+	assert.Contains(t, built, "filter=%7B%22account_data%22%3A%7B%7D%2C%22event_fields%22%3A%5B%22type%22%5D")
+
+	req = mautrix.ReqSync{Filter: &mautrix.Filter{}}
+	assert.NotContains(t, req.BuildQuery(), "filter")
+	req = mautrix.ReqSync{FilterID: "1", Filter: &mautrix.Filter{EventFields: []string{"type"}}}
+	assert.Equal(t, "1", req.BuildQuery()["filter"])
+}
+
+func TestClient_BuildURL_RoomAlias(t *testing.T) {
+	cli, err := mautrix.NewClient("https://example.com", "", "")
+	assert.NoError(t, err)
+	built := cli.BuildClientURL("v3", "directory", "room", id.RoomAlias("#foo/bar:example.com"))
+	assert.Equal(t, "https://example.com/_matrix/client/v3/directory/room/%23foo%2Fbar:example.com", built)
+}
+
+func TestClient_BuildURLWithFullQuery(t *testing.T) {
+	cli, err := mautrix.NewClient("https://example.com", "", "")
+	assert.NoError(t, err)
+	built := cli.BuildURLWithFullQuery(mautrix.ClientURLPath{"v3", "join", id.RoomID("!foo:example.com")}, func(q url.Values) {
+		q["server_name"] = []string{"example.com", "example.org"}
+	})
+	assert.Equal(t, "https://example.com/_matrix/client/v3/join/%21foo:example.com?server_name=example.com&server_name=example.org", built)
+}
@@ -39,6 +39,48 @@ func (versions *RespVersions) ContainsGreaterOrEqual(version SpecVersion) bool {
 	})
 }
 
+// UnstableFeature describes a feature that can be enabled either by an unstable feature flag
+// or by the server supporting a spec version where the feature is stable.
+type UnstableFeature struct {
+	UnstableFlag string
+	// The spec version where the feature became stable. Zero if the feature hasn't been stabilized yet.
+	SpecVersion SpecVersion
+}
+
+var (
+	// FeatureThreads is MSC3440 (threading), which was stabilized in v1.4.
+	FeatureThreads = UnstableFeature{UnstableFlag: "org.matrix.msc3440.stable", SpecVersion: SpecV14}
+	// FeatureAsyncUploads is MSC2246 (asynchronous media uploads).
+	FeatureAsyncUploads = UnstableFeature{UnstableFlag: "fi.mau.msc2246.stable"}
+	// FeatureAuthenticatedMedia is MSC3916 (media endpoints that require authentication), which was stabilized in v1.11.
+	FeatureAuthenticatedMedia = UnstableFeature{UnstableFlag: "org.matrix.msc3916.stable", SpecVersion: SpecV111}
+)
+
+// Supports checks whether the server supports the given feature, either through the unstable feature flag
+// or by supporting a spec version that includes the feature.
+func (versions *RespVersions) Supports(feature UnstableFeature) bool {
+	if versions == nil {
+		return false
+	}
+	return versions.UnstableFeatures[feature.UnstableFlag] ||
+		(feature.SpecVersion.Format != SpecVersionFormatUnknown && versions.ContainsGreaterOrEqual(feature.SpecVersion))
+}
+
+// SupportsThreads checks whether the server supports threads (FeatureThreads).
+func (versions *RespVersions) SupportsThreads() bool {
+	return versions.Supports(FeatureThreads)
+}
+
+// SupportsAsyncUpload checks whether the server supports asynchronous media uploads (FeatureAsyncUploads).
+func (versions *RespVersions) SupportsAsyncUpload() bool {
+	return versions.Supports(FeatureAsyncUploads)
+}
+
+// SupportsAuthenticatedMedia checks whether the server supports authenticated media downloads (FeatureAuthenticatedMedia).
+func (versions *RespVersions) SupportsAuthenticatedMedia() bool {
+	return versions.Supports(FeatureAuthenticatedMedia)
+}
+
 func (versions *RespVersions) GetLatest() (latest SpecVersion) {
 	for _, ver := range versions.Versions {
 		if ver.GreaterThan(latest) {
@@ -67,6 +109,8 @@ var (
 	SpecV11  = MustParseSpecVersion("v1.1")
 	SpecV12  = MustParseSpecVersion("v1.2")
 	SpecV13  = MustParseSpecVersion("v1.3")
+	SpecV14  = MustParseSpecVersion("v1.4")
+	SpecV111 = MustParseSpecVersion("v1.11")
 )
 
 func (svf SpecVersionFormat) String() string {
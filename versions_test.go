@@ -54,6 +54,8 @@ func TestRespVersions_UnmarshalJSON(t *testing.T) {
 	assert.True(t, resp.Contains(mautrix.SpecR061))
 	assert.True(t, resp.ContainsGreaterOrEqual(mautrix.MustParseSpecVersion("r0.0.0")))
 	assert.True(t, !resp.ContainsGreaterOrEqual(mautrix.MustParseSpecVersion("v123.456")))
+	assert.True(t, resp.SupportsThreads())
+	assert.False(t, resp.SupportsAsyncUpload())
 }
 
 func TestParseSpecVersion(t *testing.T) {